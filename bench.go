@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/mpool"
+	"hybridAllocator/rpc"
+	"hybridAllocator/workload"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// benchTransports are the transports bench can run over, direct calls the
+// memory pool without RPC
+var benchTransports = []string{"direct", "inproc", "unix", "tcp"}
+
+// benchEndpoint returns the transport and address the benchmark server
+// listens on for a transport name
+func benchEndpoint(name string) (rpc.Transport, string) {
+	switch name {
+	case "inproc":
+		return rpc.InProcess, "hybridAllocator"
+	case "unix":
+		return rpc.Unix, filepath.Join(os.TempDir(), fmt.Sprintf("hybridAllocator-%d.sock", os.Getpid()))
+	}
+	return rpc.TCP, ServerAddress
+}
+
+// runBench runs the workload over every transport asked for, one after
+// the other, each against a fresh allocator
+func runBench(args []string) error {
+	fs := newFlagSet("bench", "")
+	specs := addSpecFlags(fs)
+	transports := fs.String("transport", "direct", "Comma separated transports to run over: "+strings.Join(benchTransports, ", "))
+	interval := fs.Duration("interval", time.Second, "Period of the utilization timeline, 0 disables it")
+	recordFile := fs.String("record", "", "Log the allocator operations of the direct run to this file")
+	output := addOutputFlags(fs)
+	profiles := addProfileFlags(fs)
+	fs.Parse(args)
+	if err := output.validate(); err != nil {
+		return err
+	}
+
+	spec, err := specs.load()
+	if err != nil {
+		return err
+	}
+	names := strings.Split(*transports, ",")
+	for _, name := range names {
+		if !slices.Contains(benchTransports, name) {
+			return fmt.Errorf("unknown transport %q, expected one of %s", name, strings.Join(benchTransports, ", "))
+		}
+	}
+	recording, err := startRecording(*recordFile)
+	if err != nil {
+		return err
+	}
+	defer recording.stop()
+	stopProfiles, err := profiles.start()
+	if err != nil {
+		return err
+	}
+	defer stopProfiles()
+
+	results := newResults("bench")
+	log.Printf("Workload %s, seed %d", spec.Name, spec.Seed)
+	for _, name := range names {
+		log.Printf("Running over %s...", name)
+		var recorder workload.Recorder
+		if name == "direct" {
+			recorder = recording.recorder()
+		}
+		run, err := benchTransport(name, spec, workload.RunOptions{Interval: *interval}, recorder)
+		if err != nil {
+			return err
+		}
+		results.Runs = append(results.Runs, run)
+	}
+	return output.write(results)
+}
+
+// remoteTarget generates workloads through an RPC client, reporting usage
+// for the spec's stop rule and the timeline
+type remoteTarget struct {
+	*rpc.Client
+	total uint64
+}
+
+func (t remoteTarget) GetUsedSize() uint64 {
+	used, err := t.Client.GetUsedSize()
+	if err != nil {
+		log.Printf("Failed to get used size: %v", err)
+	}
+	return used
+}
+
+func (t remoteTarget) GetTotalSize() uint64 {
+	return t.total
+}
+
+// benchTransport runs spec directly against the memory pool, or through an
+// RPC server reached over transport
+func benchTransport(transport string, spec workload.Spec, opts workload.RunOptions, recorder workload.Recorder) (RunResult, error) {
+	var target workload.Target
+	var allocator *hybrid.Allocator
+	var memoryUsage func() (uint64, error)
+
+	if transport == "direct" {
+		allocator = hybrid.NewAllocator()
+		// Recording starts before the pool preallocates so a replay
+		// against a fresh allocator reproduces its layout
+		allocator.SetRecorder(recorder)
+		memoryPool, err := mpool.NewMemoryPool(allocator)
+		if err != nil {
+			return RunResult{}, fmt.Errorf("failed to create memory pool: %w", err)
+		}
+		defer allocator.Close()
+		defer memoryPool.Close()
+		// The pool serves the operations, the allocator knows the usage
+		target = struct {
+			*mpool.MemoryPool
+			workload.Usage
+		}{memoryPool, allocator}
+		memoryUsage = func() (uint64, error) { return allocator.GetMemoryUsage(), nil }
+	} else {
+		server, err := rpc.NewServer()
+		if err != nil {
+			return RunResult{}, fmt.Errorf("failed to create server: %w", err)
+		}
+		defer server.Close()
+
+		network, address := benchEndpoint(transport)
+		errc := make(chan error, 1)
+		go func() { errc <- server.StartTransport(network, address) }()
+		select {
+		case <-server.Ready():
+		case err := <-errc:
+			return RunResult{}, fmt.Errorf("server error: %w", err)
+		}
+
+		client, err := rpc.NewClientWithConfig(1, server.Addr().String(), rpc.ClientConfig{Transport: network})
+		if err != nil {
+			return RunResult{}, fmt.Errorf("failed to create client: %w", err)
+		}
+		defer client.Close()
+
+		total, err := client.GetTotalSize()
+		if err != nil {
+			return RunResult{}, fmt.Errorf("failed to get total size: %w", err)
+		}
+		target = remoteTarget{Client: client, total: total}
+		memoryUsage = client.GetMemoryUsage
+	}
+
+	report, err := workload.Run(target, spec, opts)
+	if err != nil {
+		return RunResult{}, err
+	}
+	result := newRunResult(spec.Name, transport, spec.Seed, report)
+	if result.MemoryOverheadBytes, err = memoryUsage(); err != nil {
+		return RunResult{}, fmt.Errorf("failed to get memory usage: %w", err)
+	}
+	if allocator != nil {
+		result.setFragmentation(allocator.Fragmentation())
+	}
+	for message, n := range report.Free.Errors {
+		log.Printf("%d frees failed: %s", n, message)
+	}
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// comparedMetrics are the numbers compare checks. Ratios such as
+// utilization are compared by their difference, everything else by the
+// relative change.
+var comparedMetrics = []struct {
+	name           string
+	higherIsBetter bool
+	ratio          bool
+	value          func(r RunResult) float64
+}{
+	{"ops_per_second", true, false, func(r RunResult) float64 { return r.OpsPerSecond }},
+	{"write_bytes_per_second", true, false, func(r RunResult) float64 { return r.WriteBytesPerSec }},
+	{"allocate_p50_us", false, false, func(r RunResult) float64 { return r.AllocateLatency.P50 }},
+	{"allocate_p99_us", false, false, func(r RunResult) float64 { return r.AllocateLatency.P99 }},
+	{"allocate_p999_us", false, false, func(r RunResult) float64 { return r.AllocateLatency.P999 }},
+	{"free_p50_us", false, false, func(r RunResult) float64 { return r.FreeLatency.P50 }},
+	{"free_p99_us", false, false, func(r RunResult) float64 { return r.FreeLatency.P99 }},
+	{"free_p999_us", false, false, func(r RunResult) float64 { return r.FreeLatency.P999 }},
+	{"memory_overhead_bytes", false, false, func(r RunResult) float64 { return float64(r.MemoryOverheadBytes) }},
+	{"peak_utilization", true, true, func(r RunResult) float64 { return r.PeakUtilization }},
+	{"external_fragmentation", false, true, func(r RunResult) float64 { return r.ExternalFragmentation }},
+	{"internal_fragmentation", false, true, func(r RunResult) float64 { return r.InternalFragmentation }},
+}
+
+// runCompare diffs the runs of two JSON result files by name, flagging
+// metrics that got worse by more than the thresholds
+func runCompare(args []string) error {
+	fs := newFlagSet("compare", "old.json new.json")
+	threshold := fs.Float64("threshold", 0.1, "Relative change of a metric counted as a regression")
+	points := fs.Float64("points", 0.01, "Change of a ratio, such as utilization, counted as a regression")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	old, err := readResults(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	current, err := readResults(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	runs := make(map[string]RunResult, len(current.Runs))
+	for _, run := range current.Runs {
+		runs[run.Name] = run
+	}
+	seen := make(map[string]bool, len(old.Runs))
+	regressions := 0
+	for _, before := range old.Runs {
+		seen[before.Name] = true
+		after, ok := runs[before.Name]
+		if !ok {
+			fmt.Printf("%s: missing from %s\n\n", before.Name, fs.Arg(1))
+			continue
+		}
+		fmt.Printf("%s\n", before.Name)
+		fmt.Printf("  %-24s %16s %16s %10s\n", "Metric", "Old", "New", "Change")
+		for _, m := range comparedMetrics {
+			a, b := m.value(before), m.value(after)
+			if a == 0 && b == 0 {
+				continue
+			}
+			// Ratios compare in percentage points, the rest relatively
+			change := relativeChange(a, b)
+			shown := fmt.Sprintf("%+.1f%%", change*100)
+			limit := *threshold
+			if m.ratio {
+				change = b - a
+				shown = fmt.Sprintf("%+.2fpt", change*100)
+				limit = *points
+			}
+			worse := change
+			if m.higherIsBetter {
+				worse = -change
+			}
+			flag := ""
+			if worse > limit {
+				flag = "  REGRESSION"
+				regressions++
+			}
+			fmt.Printf("  %-24s %16.6g %16.6g %10s%s\n", m.name, a, b, shown, flag)
+		}
+		fmt.Println()
+	}
+	for _, run := range current.Runs {
+		if !seen[run.Name] {
+			fmt.Printf("%s: missing from %s\n", run.Name, fs.Arg(0))
+		}
+	}
+
+	if regressions > 0 {
+		fmt.Printf("%d regressions\n", regressions)
+		return errFailed
+	}
+	fmt.Println("No regressions")
+	return nil
+}
+
+// relativeChange returns (b-a)/a, infinite when a metric appears from zero
+func relativeChange(a, b float64) float64 {
+	if a == 0 {
+		return math.Copysign(math.Inf(1), b)
+	}
+	return (b - a) / math.Abs(a)
+}
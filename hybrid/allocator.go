@@ -1,7 +1,13 @@
 // Package hybrid provides disk space allocation management
 package hybrid
 
-import "unsafe"
+import (
+	"context"
+	"hybridAllocator/trace"
+	"hybridAllocator/workload"
+	"time"
+	"unsafe"
+)
 
 // NewAllocator creates a new memory hybrid instance
 func NewAllocator() *Allocator {
@@ -16,59 +22,194 @@ func NewAllocator() *Allocator {
 	return allocator
 }
 
+// NewAllocatorRange creates an allocator managing only [start, start+size),
+// for example to sub-allocate a block handed out by another allocator.
+// The range must satisfy the rules of NewBuddyAllocatorRange.
+func NewAllocatorRange(start, size uint64) (*Allocator, error) {
+	buddy, err := NewBuddyAllocatorRange(start, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Allocator{
+		buddy: buddy,
+		slab:  NewSlabAllocator(buddy),
+	}, nil
+}
+
 // Allocate allocates memory of specified size
 func (a *Allocator) Allocate(size uint64) (uint64, error) {
+	return a.allocateWith(context.Background(), size, AllocOptions{})
+}
+
+// AllocateContext allocates memory of specified size, tracing the allocation
+// as a child of the span carried by ctx
+func (a *Allocator) AllocateContext(ctx context.Context, size uint64) (uint64, error) {
+	return a.allocateWith(ctx, size, AllocOptions{})
+}
+
+// AllocateWith allocates memory of specified size, honouring the reserve
+// pools configured for the priority class in opts
+func (a *Allocator) AllocateWith(size uint64, opts AllocOptions) (uint64, error) {
+	return a.allocateWith(context.Background(), size, opts)
+}
+
+func (a *Allocator) allocateWith(ctx context.Context, size uint64, opts AllocOptions) (start uint64, err error) {
+	_, span := trace.Start(ctx, a.tracer.Get(), "hybrid.Allocate", trace.Uint("size", size))
+	began := time.Now()
+	layer := LayerCount
+	defer func() {
+		span.End(trace.Uint("start", start), trace.String("layer", layer.String()), trace.Error(err))
+		a.record(workload.Allocate, began, size, start, err)
+	}()
+
+	rec := a.newRecord(size, opts.Tag)
+	if a.reserved.Load() == 0 {
+		start, layer, err = a.allocate(span, size, rec)
+		if err != nil {
+			return 0, err
+		}
+		a.checkWatermarks()
+		return start, nil
+	}
+
+	// Reserve check and allocation must not interleave with other
+	// allocations, otherwise they could jointly eat into a reserve
+	a.mutex.Lock()
+	if err := a.checkReserveLocked(size, opts.Priority); err != nil {
+		a.mutex.Unlock()
+		return 0, err
+	}
+	start, layer, err = a.allocate(span, size, rec)
+	a.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	a.checkWatermarks()
+	return start, nil
+}
+
+// allocate picks the slab or buddy layer for the request and returns the
+// layer that served it
+func (a *Allocator) allocate(span trace.Span, size uint64, rec *allocRecord) (uint64, Layer, error) {
 	Debug("Allocating %d bytes", size)
 	if size > MaxBlockSize {
 		Error("Requested size %d exceeds MaxBlockSize %d", size, MaxBlockSize)
-		return 0, ErrSizeTooLarge
+		return 0, LayerCount, ErrSizeTooLarge
 	}
 
+	began := time.Now()
 	if size <= SlabMaxSize {
-		start, err := a.slab.Allocate(size)
+		start, err := a.slab.allocate(span, size, rec)
 		if err == ErrSlabFull {
 			Debug("Slab is full, trying buddy hybrid")
-			return a.buddy.Allocate(size)
+			start, err = a.buddy.allocate(span, size, rec)
+			a.ops.allocate[LayerBuddy].record(began, err)
+			return start, LayerBuddy, err
 		}
+		a.ops.allocate[LayerSlab].record(began, err)
 		if err != nil {
-			return 0, err
+			return 0, LayerSlab, err
 		}
 		Debug("Allocated %d bytes from slab at address %d", size, start)
-		return start, nil
+		return start, LayerSlab, nil
 	}
 
-	start, err := a.buddy.Allocate(size)
+	start, err := a.buddy.allocate(span, size, rec)
+	a.ops.allocate[LayerBuddy].record(began, err)
 	if err != nil {
-		return 0, err
+		return 0, LayerBuddy, err
 	}
 	Debug("Allocated %d bytes from buddy at address %d", size, start)
-	return start, nil
+	return start, LayerBuddy, nil
 }
 
 // Free releases allocated memory at specified address
 func (a *Allocator) Free(start uint64, size uint64) error {
+	return a.FreeContext(context.Background(), start, size)
+}
+
+// FreeContext releases allocated memory at specified address, tracing the
+// free as a child of the span carried by ctx
+func (a *Allocator) FreeContext(ctx context.Context, start uint64, size uint64) (err error) {
+	_, span := trace.Start(ctx, a.tracer.Get(), "hybrid.Free", trace.Uint("start", start), trace.Uint("size", size))
+	began := time.Now()
+	layer := LayerCount
+	defer func() {
+		span.End(trace.String("layer", layer.String()), trace.Error(err))
+		a.record(workload.Free, began, size, start, err)
+	}()
+
+	// References are added under the write lock, so the extent cannot gain
+	// one while it is released
+	a.mutex.RLock()
+	if _, shared := a.refs[start]; shared {
+		a.mutex.RUnlock()
+		return ErrExtentShared
+	}
+	layer, err = a.free(span, start, size)
+	a.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	a.checkWatermarks()
+	return nil
+}
+
+// free returns the extent to the slab or buddy layer and returns the layer
+// that took it
+func (a *Allocator) free(span trace.Span, start uint64, size uint64) (Layer, error) {
 	Debug("Freeing %d bytes at address %d", size, start)
+	began := time.Now()
 	if size <= SlabMaxSize {
-		err := a.slab.Free(start, size)
+		err := a.slab.release(span, start, size)
 		if err == ErrSlabNotFound {
 			Debug("Address not found in slab, trying buddy hybrid")
-			return a.buddy.Free(start, size)
+			err = a.buddy.free(span, start, size)
+			a.ops.free[LayerBuddy].record(began, err)
+			return LayerBuddy, err
 		}
+		a.ops.free[LayerSlab].record(began, err)
 		if err != nil {
 			Error("Slab free failed: %v", err)
-			return err
+			return LayerSlab, err
 		}
 		Debug("Freed %d bytes from slab at address %d", size, start)
-		return nil
+		return LayerSlab, nil
 	}
 
-	err := a.buddy.Free(start, size)
+	a.slab.mutex.RLock()
+	inSlab := a.slab.holdsLocked(start)
+	a.slab.mutex.RUnlock()
+	if inSlab {
+		return LayerBuddy, ErrAddressNotAllocated
+	}
+	err := a.buddy.free(span, start, size)
+	a.ops.free[LayerBuddy].record(began, err)
 	if err != nil {
 		Error("Buddy free failed: %v", err)
-		return err
+		return LayerBuddy, err
 	}
 	Debug("Freed %d bytes from buddy at address %d", size, start)
-	return nil
+	return LayerBuddy, nil
+}
+
+// SetTracer installs a tracer receiving the spans of allocations and frees
+// along with slab creation, buddy splits and merges. nil turns tracing off.
+func (a *Allocator) SetTracer(t trace.Tracer) {
+	a.tracer.Set(t)
+}
+
+// SetRecorder installs a recorder receiving every allocation and free, for
+// example a workload.Writer logging them for replay. nil stops recording.
+func (a *Allocator) SetRecorder(r workload.Recorder) {
+	a.recorder.Set(r)
+}
+
+// record reports a completed operation to the recorder, if any
+func (a *Allocator) record(op workload.Op, began time.Time, size, start uint64, err error) {
+	if r := a.recorder.Get(); r != nil {
+		r.Record(workload.Record{Op: op, Time: began, Size: size, Addr: start, Failed: err != nil})
+	}
 }
 
 // GetUsedSize returns the total size of allocated memory
@@ -78,11 +219,9 @@ func (a *Allocator) GetUsedSize() uint64 {
 	return used
 }
 
+// GetTotalSize returns the size of the managed address range
 func (a *Allocator) GetTotalSize() uint64 {
-	base := 20
-	offset := MaxOrder - base
-
-	return 1 << (40 + uint(offset))
+	return a.buddy.endAddr - a.buddy.startAddr
 }
 
 // GetMemoryUsage returns the memory overhead of the hybrid
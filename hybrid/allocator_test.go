@@ -1,9 +1,20 @@
 package hybrid
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"hybridAllocator/trace"
+	"hybridAllocator/workload"
+	"math/rand"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -177,3 +188,713 @@ func BenchmarkAlloc(b *testing.B) {
 		})
 	}
 }
+
+func TestReserve(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	// Leave only 4MB for normal writes
+	allocator.SetReserve(PriorityMetadata, allocator.GetTotalSize()-4*MB)
+
+	var addresses []uint64
+	for {
+		start, err := allocator.Allocate(1 * MB)
+		if err == ErrNoSpaceAvailable {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to allocate 1MB: %v", err)
+		}
+		addresses = append(addresses, start)
+	}
+	if len(addresses) != 4 {
+		t.Fatalf("Expected 4 normal allocations, got %d", len(addresses))
+	}
+
+	// Metadata writes may use the reserve
+	start, err := allocator.AllocateWith(1*MB, AllocOptions{Priority: PriorityMetadata})
+	if err != nil {
+		t.Fatalf("Failed to allocate from reserve: %v", err)
+	}
+	addresses = append(addresses, start)
+
+	allocator.SetReserve(PriorityMetadata, 0)
+	if _, err := allocator.Allocate(1 * MB); err != nil {
+		t.Fatalf("Failed to allocate after removing reserve: %v", err)
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	total := allocator.GetTotalSize()
+	var lows, highs int
+	err := allocator.SetWatermarks(&Watermarks{
+		Low:    total - 2*MB,
+		High:   total - 1*MB,
+		OnLow:  func(free uint64) { lows++ },
+		OnHigh: func(free uint64) { highs++ },
+	})
+	if err != nil {
+		t.Fatalf("Failed to set watermarks: %v", err)
+	}
+
+	start1, _ := allocator.Allocate(2 * MB)
+	start2, _ := allocator.Allocate(2 * MB)
+	if lows != 1 || highs != 0 {
+		t.Fatalf("Expected one low event, got %d low and %d high", lows, highs)
+	}
+
+	allocator.Free(start1, 2*MB)
+	if highs != 0 {
+		t.Fatalf("High watermark fired too early")
+	}
+	allocator.Free(start2, 2*MB)
+	if lows != 1 || highs != 1 {
+		t.Fatalf("Expected one high event, got %d low and %d high", lows, highs)
+	}
+
+	if err := allocator.SetWatermarks(&Watermarks{Low: 2, High: 1}); err != ErrInvalidWatermarks {
+		t.Errorf("Expected ErrInvalidWatermarks, got %v", err)
+	}
+}
+
+func TestTagging(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+	allocator.EnableTagging(true)
+
+	const (
+		tagData Tag = iota + 1
+		tagIndex
+	)
+	small, err := allocator.AllocateTagged(16*KB, tagData)
+	if err != nil {
+		t.Fatalf("Failed to allocate 16KB: %v", err)
+	}
+	large, err := allocator.AllocateTagged(4*MB, tagIndex)
+	if err != nil {
+		t.Fatalf("Failed to allocate 4MB: %v", err)
+	}
+	if _, err := allocator.AllocateTagged(16*KB, tagData); err != nil {
+		t.Fatalf("Failed to allocate 16KB: %v", err)
+	}
+
+	live := allocator.GetLiveBytesByTag()
+	if live[tagData] != 32*KB || live[tagIndex] != 4*MB {
+		t.Fatalf("Unexpected live bytes per tag: %v", live)
+	}
+
+	if err := allocator.Free(small, 16*KB); err != nil {
+		t.Fatalf("Failed to free: %v", err)
+	}
+	if err := allocator.Free(large, 4*MB); err != nil {
+		t.Fatalf("Failed to free: %v", err)
+	}
+
+	report := allocator.LeakReport(0)
+	if len(report) != 1 || report[0].Tag != tagData || report[0].Count != 1 || report[0].Bytes != 16*KB {
+		t.Fatalf("Unexpected leak report: %+v", report)
+	}
+	if !strings.Contains(report[0].Stack, "TestTagging") {
+		t.Errorf("Leak stack does not point at the test:\n%s", report[0].Stack)
+	}
+	if report := allocator.LeakReport(time.Hour); len(report) != 0 {
+		t.Errorf("Expected no allocations older than an hour, got %+v", report)
+	}
+}
+
+func TestTaggingCaller(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+	allocator.EnableTagging(true)
+
+	// Every allocation entry point records the stack from its caller on
+	allocate := map[string]func() (uint64, error){
+		"Allocate":        func() (uint64, error) { return allocator.Allocate(16 * KB) },
+		"AllocateContext": func() (uint64, error) { return allocator.AllocateContext(context.Background(), 16*KB) },
+		"AllocateWith":    func() (uint64, error) { return allocator.AllocateWith(16*KB, AllocOptions{}) },
+		"AllocateTagged":  func() (uint64, error) { return allocator.AllocateTagged(16*KB, NoTag) },
+	}
+	for name, fn := range allocate {
+		start, err := fn()
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		report := allocator.LeakReport(0)
+		if len(report) != 1 {
+			t.Fatalf("Expected one leak group, got %+v", report)
+		}
+		caller, _, _ := strings.Cut(report[0].Stack, "\n")
+		if !strings.HasPrefix(caller, "hybridAllocator/hybrid.TestTaggingCaller.") {
+			t.Errorf("%s recorded %s as the caller instead of the test", name, caller)
+		}
+		if err := allocator.Free(start, 16*KB); err != nil {
+			t.Fatalf("Failed to free: %v", err)
+		}
+	}
+}
+
+func TestRefCount(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	for _, size := range []uint64{8 * KB, 2 * MB} {
+		start, err := allocator.Allocate(size)
+		if err != nil {
+			t.Fatalf("Failed to allocate %d bytes: %v", size, err)
+		}
+		if err := allocator.IncRef(start, size); err != nil {
+			t.Fatalf("Failed to add reference: %v", err)
+		}
+		if refs, _ := allocator.GetRefCount(start, size); refs != 2 {
+			t.Fatalf("Expected 2 references, got %d", refs)
+		}
+		if err := allocator.Free(start, size); err != ErrExtentShared {
+			t.Fatalf("Expected ErrExtentShared, got %v", err)
+		}
+
+		if refs, err := allocator.DecRef(start, size); err != nil || refs != 1 {
+			t.Fatalf("Expected 1 reference left, got %d: %v", refs, err)
+		}
+		if !allocator.IsAllocated(start, size) {
+			t.Fatalf("Extent released while still referenced")
+		}
+		if refs, err := allocator.DecRef(start, size); err != nil || refs != 0 {
+			t.Fatalf("Expected no reference left, got %d: %v", refs, err)
+		}
+		if allocator.IsAllocated(start, size) {
+			t.Fatalf("Extent not released after last reference")
+		}
+		if err := allocator.IncRef(start, size); err != ErrAddressNotAllocated {
+			t.Fatalf("Expected ErrAddressNotAllocated, got %v", err)
+		}
+	}
+}
+
+func TestRefCountSplitBlock(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	// Two buddies split from one parent block, one of them freed again
+	size := uint64(8 * MB)
+	first, err := allocator.Allocate(size)
+	if err != nil {
+		t.Fatalf("Failed to allocate %d bytes: %v", size, err)
+	}
+	second, err := allocator.Allocate(size)
+	if err != nil {
+		t.Fatalf("Failed to allocate %d bytes: %v", size, err)
+	}
+	parent := min(first, second)
+	if max(first, second) != parent+size || parent%(2*size) != 0 {
+		t.Fatalf("Expected buddies, got %d and %d", first, second)
+	}
+	if err := allocator.Free(second, size); err != nil {
+		t.Fatalf("Failed to free: %v", err)
+	}
+
+	if allocator.IsAllocated(parent, 2*size) {
+		t.Fatalf("Parent block reported allocated while half of it is free")
+	}
+	if err := allocator.IncRef(parent, 2*size); err != ErrAddressNotAllocated {
+		t.Fatalf("Expected ErrAddressNotAllocated, got %v", err)
+	}
+	if !allocator.IsAllocated(first, size) {
+		t.Fatalf("Remaining half not reported allocated")
+	}
+}
+
+func TestRefCountAdjacent(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	// Two neighbouring extents are not one extent of twice the size
+	size := uint64(2 * MB)
+	first, _ := allocator.Allocate(size)
+	second, _ := allocator.Allocate(size)
+	parent := min(first, second)
+	if max(first, second) != parent+size || parent%(2*size) != 0 {
+		t.Fatalf("Expected buddies, got %d and %d", first, second)
+	}
+	if allocator.IsAllocated(parent, 2*size) {
+		t.Fatalf("Adjacent extents reported as one allocation")
+	}
+	if err := allocator.IncRef(parent, 2*size); err != ErrAddressNotAllocated {
+		t.Fatalf("Expected ErrAddressNotAllocated from IncRef, got %v", err)
+	}
+	if _, err := allocator.DecRef(parent, 2*size); err != ErrAddressNotAllocated {
+		t.Fatalf("Expected ErrAddressNotAllocated from DecRef, got %v", err)
+	}
+	for _, start := range []uint64{first, second} {
+		if err := allocator.Free(start, size); err != nil {
+			t.Fatalf("Failed to free %d: %v", start, err)
+		}
+	}
+	if err := allocator.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+}
+
+func TestRefCountRace(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	// Either the reference or the free wins, never both
+	for i := 0; i < 1000; i++ {
+		start, err := allocator.Allocate(16 * KB)
+		if err != nil {
+			t.Fatalf("Allocation failed: %v", err)
+		}
+		var incErr, freeErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			incErr = allocator.IncRef(start, 16*KB)
+		}()
+		go func() {
+			defer wg.Done()
+			freeErr = allocator.Free(start, 16*KB)
+		}()
+		wg.Wait()
+
+		switch {
+		case incErr == nil && freeErr == ErrExtentShared:
+			allocator.DecRef(start, 16*KB)
+			allocator.Free(start, 16*KB)
+		case incErr == ErrAddressNotAllocated && freeErr == nil:
+		default:
+			t.Fatalf("IncRef returned %v, Free %v", incErr, freeErr)
+		}
+	}
+	if err := allocator.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if used := allocator.GetUsedSize(); used != 0 {
+		t.Fatalf("Expected nothing in use, got %d bytes", used)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	sizes := []uint64{4 * KB, 4 * KB, 64 * KB, 1 * MB, 3 * MB, 4 * KB}
+	addresses := make([]uint64, len(sizes))
+	for i, size := range sizes {
+		start, err := allocator.Allocate(size)
+		if err != nil {
+			t.Fatalf("Failed to allocate %d bytes: %v", size, err)
+		}
+		addresses[i] = start
+	}
+	allocator.Free(addresses[1], sizes[1])
+	allocator.IncRef(addresses[4], sizes[4])
+
+	var buf bytes.Buffer
+	if err := allocator.SaveMetadata(&buf); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	data := buf.Bytes()
+
+	loaded, err := LoadMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	if loaded.GetUsedSize() != allocator.GetUsedSize() {
+		t.Fatalf("Used size mismatch: %d != %d", loaded.GetUsedSize(), allocator.GetUsedSize())
+	}
+	if refs, _ := loaded.GetRefCount(addresses[4], sizes[4]); refs != 2 {
+		t.Fatalf("Expected 2 references after reload, got %d", refs)
+	}
+
+	// Both allocators must keep handing out the same addresses
+	for _, size := range []uint64{4 * KB, 64 * KB, 2 * MB} {
+		want, _ := allocator.Allocate(size)
+		got, err := loaded.Allocate(size)
+		if err != nil || got != want {
+			t.Fatalf("Reloaded allocator returned %d for %d bytes, want %d (%v)", got, size, want, err)
+		}
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := LoadMetadata(bytes.NewReader(corrupt)); err != ErrCorruptMetadata {
+		t.Errorf("Expected ErrCorruptMetadata, got %v", err)
+	}
+
+	// A reference count larger than the extents is rejected before it is
+	// used, even with a matching checksum
+	empty := NewAllocator()
+	defer empty.Close()
+	buf.Reset()
+	if err := empty.SaveMetadata(&buf); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	data = buf.Bytes()
+	corrupt = binary.AppendUvarint(append([]byte(nil), data[:len(data)-5]...), 1<<36)
+	corrupt = binary.LittleEndian.AppendUint32(corrupt, crc32.ChecksumIEEE(corrupt))
+	if _, err := LoadMetadata(bytes.NewReader(corrupt)); err != ErrCorruptMetadata {
+		t.Errorf("Expected ErrCorruptMetadata for a corrupt reference count, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+	rng := rand.New(rand.NewSource(1))
+	var extents [][2]uint64
+	for i := 0; i < 1000; i++ {
+		size := uint64(rng.Intn(16)+1) * 4 * KB
+		if i%20 == 0 {
+			size = uint64(rng.Intn(4)+2) * MB
+		}
+		start, err := allocator.Allocate(size)
+		if err != nil {
+			t.Fatalf("Allocation failed: %v", err)
+		}
+		extents = append(extents, [2]uint64{start, size})
+	}
+	for i := 0; i < len(extents); i += 3 {
+		allocator.Free(extents[i][0], extents[i][1])
+	}
+	allocator.IncRef(extents[1][0], extents[1][1])
+	if err := allocator.Check(); err != nil {
+		t.Fatalf("Check failed on a healthy allocator: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := allocator.SaveMetadata(&buf); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	loaded, err := LoadMetadata(&buf)
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	if err := loaded.Check(); err != nil {
+		t.Fatalf("Check failed on loaded metadata: %v", err)
+	}
+
+	// Break the bookkeeping of clones in ways a bug could
+	slabStart := extents[1][0] &^ uint64(SlabMaxSize-1)
+	for _, tc := range []struct {
+		name    string
+		corrupt func(a *Allocator)
+		want    string
+	}{
+		{"used counter", func(a *Allocator) { a.buddy.used += 4 * KB }, "bytes used"},
+		{"allocated block", func(a *Allocator) {
+			delete(a.buddy.allocated, extents[20][0])
+		}, "its allocated blocks"},
+		{"slab allocation", func(a *Allocator) {
+			slab := a.slab.slabs[slabStart]
+			for start, size := range slab.allocated {
+				slab.allocated[start+1] = size
+				slab.used += size
+				a.slab.free -= size
+				break
+			}
+		}, "overlaps the previous one"},
+		{"free block in a slab", func(a *Allocator) {
+			a.buddy.appendFreeBlockLocked(0, slabStart, nil)
+		}, "overlaps slab"},
+		{"shared free extent", func(a *Allocator) {
+			a.refs[extents[3][0]] = 1
+		}, "is not allocated in slab"},
+	} {
+		clone := allocator.Clone()
+		tc.corrupt(clone)
+		err := clone.Check()
+		if !errors.Is(err, ErrInconsistent) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected a problem mentioning %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	small, _ := allocator.Allocate(16 * KB)
+	large, _ := allocator.Allocate(2 * MB)
+
+	clone := allocator.Clone()
+	if diffs := Diff(allocator, clone); len(diffs) != 0 {
+		t.Fatalf("Fresh clone differs from origin: %+v", diffs)
+	}
+
+	// Changes to the clone must not leak into the origin
+	if err := clone.Free(large, 2*MB); err != nil {
+		t.Fatalf("Failed to free in clone: %v", err)
+	}
+	extra, err := clone.Allocate(16 * KB)
+	if err != nil {
+		t.Fatalf("Failed to allocate in clone: %v", err)
+	}
+	if !allocator.IsAllocated(large, 2*MB) || allocator.IsAllocated(extra, 16*KB) {
+		t.Fatalf("Clone shares state with origin")
+	}
+
+	diffs := Diff(allocator, clone)
+	want := []ExtentDiff{
+		{Start: extra, Size: 16 * KB, A: ExtentSlabFree, B: ExtentSlabAllocated},
+		{Start: large, Size: 2 * MB, A: ExtentAllocated, B: ExtentFree},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("Expected %d diffs, got %+v", len(want), diffs)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Errorf("Diff %d: expected %+v, got %+v", i, want[i], diffs[i])
+		}
+	}
+
+	if err := allocator.Free(small, 16*KB); err != nil {
+		t.Fatalf("Failed to free in origin: %v", err)
+	}
+	if !clone.IsAllocated(small, 16*KB) {
+		t.Fatalf("Free in origin leaked into clone")
+	}
+}
+
+func TestAllocatorRange(t *testing.T) {
+	if _, err := NewAllocatorRange(3*MB, 4*MB); err != ErrInvalidRange {
+		t.Fatalf("Expected ErrInvalidRange for misaligned range, got %v", err)
+	}
+
+	base := uint64(64 * MB)
+	allocator, err := NewAllocatorRange(base, 8*MB)
+	if err != nil {
+		t.Fatalf("Failed to create range allocator: %v", err)
+	}
+	defer allocator.Close()
+
+	var addresses []uint64
+	for {
+		start, err := allocator.Allocate(256 * KB)
+		if err == ErrNoSpaceAvailable {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to allocate 256KB: %v", err)
+		}
+		if start < base || start+256*KB > base+8*MB {
+			t.Fatalf("Allocation at %d is outside the range", start)
+		}
+		addresses = append(addresses, start)
+	}
+	if len(addresses) != 32 {
+		t.Fatalf("Expected 32 allocations in 8MB, got %d", len(addresses))
+	}
+
+	for _, start := range addresses {
+		if err := allocator.Free(start, 256*KB); err != nil {
+			t.Fatalf("Failed to free: %v", err)
+		}
+	}
+	if allocator.GetUsedSize() != 0 {
+		t.Fatalf("Expected empty range allocator, %d bytes used", allocator.GetUsedSize())
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	frag := allocator.Fragmentation()
+	if frag.FreeBytes != MaxBlockSize || frag.LargestFreeBlock != MaxBlockSize || frag.External != 0 {
+		t.Fatalf("Unexpected fragmentation of an empty allocator: %+v", frag)
+	}
+
+	// A 2MB block splits the space into one free block of each order from 1 up
+	if _, err := allocator.Allocate(2 * MB); err != nil {
+		t.Fatalf("Failed to allocate 2MB: %v", err)
+	}
+	if _, err := allocator.Allocate(4 * KB); err != nil {
+		t.Fatalf("Failed to allocate 4KB: %v", err)
+	}
+	frag = allocator.Fragmentation()
+	if frag.FreeBytes != MaxBlockSize-3*MB || frag.LargestFreeBlock != MaxBlockSize/2 {
+		t.Fatalf("Unexpected free space: %+v", frag)
+	}
+	if frag.FreeBlocks[0] != 1 || frag.FreeBlocks[1] != 0 || frag.FreeBlocks[MaxOrder] != 0 {
+		t.Fatalf("Unexpected free blocks: %v", frag.FreeBlocks)
+	}
+	if frag.External <= 0 || frag.External >= 1 {
+		t.Fatalf("Unexpected external fragmentation %f", frag.External)
+	}
+	if frag.Slabs != 1 || frag.SlabBytes != SlabMaxSize || frag.SlabFreeBytes != SlabMaxSize-4*KB {
+		t.Fatalf("Unexpected slab space: %+v", frag)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+	var events []trace.Event
+	tracer := trace.TracerFunc(func(e trace.Event) {
+		events = append(events, e)
+	})
+	allocator.SetTracer(tracer)
+	find := func(name string) *trace.Event {
+		for i := range events {
+			if events[i].Name == name {
+				return &events[i]
+			}
+		}
+		t.Fatalf("No %s event in %+v", name, events)
+		return nil
+	}
+	arg := func(e *trace.Event, key string) any {
+		a, _ := e.Arg(key)
+		return a.Value()
+	}
+
+	// A buddy block splits the whole range and merges back up when freed
+	large, err := allocator.Allocate(16 * MB)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	if end := events[len(events)-1]; arg(&end, "layer") != "buddy" || find("hybrid.Allocate").Parent != 0 {
+		t.Fatalf("Unexpected allocation %+v", events)
+	}
+	events = nil
+	if err := allocator.Free(large, 16*MB); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if merge := find("buddy.merge"); arg(merge, "depth") != int64(MaxOrder-4) {
+		t.Fatalf("Unexpected merge %+v", merge)
+	}
+
+	// The first small allocation creates a slab, splitting the whole range again
+	events = nil
+	ctx, request := trace.Start(context.Background(), tracer, "request")
+	small, err := allocator.AllocateContext(ctx, 4*KB)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	begin := find("hybrid.Allocate")
+	if begin.Parent != request.ID() || begin.Trace != request.TraceID() || arg(begin, "size") != uint64(4*KB) {
+		t.Fatalf("Allocation not traced under the request: %+v", begin)
+	}
+	if create := find("slab.create"); create.Span != begin.Span || arg(create, "size_class") != uint64(4*KB) {
+		t.Fatalf("Unexpected slab creation %+v", create)
+	}
+	if split := find("buddy.split"); arg(split, "depth") != int64(MaxOrder) {
+		t.Fatalf("Unexpected split %+v", split)
+	}
+	end := events[len(events)-1]
+	if end.Phase != trace.End || arg(&end, "layer") != "slab" || arg(&end, "start") != small {
+		t.Fatalf("Unexpected end %+v", end)
+	}
+
+	events = nil
+	if err := allocator.Free(small+1, 4*KB); err == nil {
+		t.Fatalf("Expected freeing an unaligned address to fail")
+	}
+	if end := events[len(events)-1]; end.Name != "hybrid.Free" || arg(&end, "error") == "" {
+		t.Fatalf("Failure not traced: %+v", end)
+	}
+
+	allocator.SetTracer(nil)
+	events = nil
+	if _, err := allocator.Allocate(4 * KB); err != nil || len(events) != 0 {
+		t.Fatalf("Expected no events once tracing is off, got %v, %+v", err, events)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+	var buf bytes.Buffer
+	log := workload.NewWriter(&buf)
+	allocator.SetRecorder(log)
+
+	// A mix of slab and buddy extents, half of them freed again
+	rng := rand.New(rand.NewSource(1))
+	var extents [][2]uint64
+	for i := 0; i < 2000; i++ {
+		size := uint64(rng.Intn(64)+1) * 4 * KB
+		if i%50 == 0 {
+			size = uint64(rng.Intn(8)+2) * MB
+		}
+		start, err := allocator.Allocate(size)
+		if err != nil {
+			t.Fatalf("Allocation failed: %v", err)
+		}
+		extents = append(extents, [2]uint64{start, size})
+	}
+	for i := 0; i < len(extents); i += 2 {
+		if err := allocator.Free(extents[i][0], extents[i][1]); err != nil {
+			t.Fatalf("Free failed: %v", err)
+		}
+	}
+	if err := allocator.Free(1, 4*KB); err == nil {
+		t.Fatalf("Expected freeing an unaligned address to fail")
+	}
+	used, frag := allocator.GetUsedSize(), allocator.Fragmentation()
+	allocator.SetRecorder(nil)
+	allocator.Allocate(4 * KB)
+	if err := log.Close(); err != nil {
+		t.Fatalf("Failed to close log: %v", err)
+	}
+	if log.Count() != 2000+1000+1 {
+		t.Fatalf("Expected 3001 records, got %d", log.Count())
+	}
+
+	reader, err := workload.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	replayed := NewAllocator()
+	defer replayed.Close()
+	report, err := workload.Replay(reader, replayed, workload.ReplayOptions{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if report.Allocate.Count != 2000 || report.Free.Count != 1000 || report.Allocate.Failures+report.Free.Failures != 0 || report.RecordedFailures != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	// The allocator is deterministic, so the replay ends up in the same state
+	if report.UsedBytes != used || !reflect.DeepEqual(replayed.Fragmentation(), frag) {
+		t.Fatalf("Replay ended with %d bytes used and %+v, recording with %d and %+v",
+			report.UsedBytes, replayed.Fragmentation(), used, frag)
+	}
+}
+
+func TestStaleFree(t *testing.T) {
+	allocator := NewAllocator()
+	defer allocator.Close()
+
+	start, err := allocator.Allocate(2 * MB)
+	if err != nil {
+		t.Fatalf("Failed to allocate 2MB: %v", err)
+	}
+	if err := allocator.Free(start, 2*MB); err != nil {
+		t.Fatalf("Failed to free 2MB: %v", err)
+	}
+	if err := allocator.Free(start, 2*MB); err == nil {
+		t.Fatalf("Freeing 2MB at %#x twice succeeded", start)
+	}
+
+	// A slab taking the freed space must not be freed by a stale free
+	small, err := allocator.Allocate(4 * KB)
+	if err != nil {
+		t.Fatalf("Failed to allocate 4KB: %v", err)
+	}
+	if small < start || small >= start+2*MB {
+		t.Skipf("4KB at %#x outside the freed block at %#x", small, start)
+	}
+	if err := allocator.Free(start, 2*MB); err != ErrAddressNotAllocated {
+		t.Fatalf("Expected ErrAddressNotAllocated, got %v", err)
+	}
+	if !allocator.IsAllocated(small, 4*KB) {
+		t.Fatalf("4KB at %#x freed by a stale free", small)
+	}
+	if err := allocator.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+}
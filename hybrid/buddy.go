@@ -2,17 +2,53 @@ package hybrid
 
 import (
 	"fmt"
+	"hybridAllocator/trace"
 	"sync"
 	"unsafe"
 )
 
 // NewBuddyAllocator creates a new buddy allocator
 func NewBuddyAllocator() *BuddyAllocator {
+	b, _ := NewBuddyAllocatorRange(0, MaxBlockSize)
+	return b
+}
+
+// NewBuddyAllocatorRange creates a buddy allocator managing [start, start+size).
+// size must be a power of two multiple of BuddyStartSize and start must be
+// aligned to size, as it is for any block handed out by another buddy allocator.
+func NewBuddyAllocatorRange(start, size uint64) (*BuddyAllocator, error) {
+	if size < BuddyStartSize || size > MaxBlockSize || size&(size-1) != 0 || start&(size-1) != 0 {
+		return nil, ErrInvalidRange
+	}
+	b := newBuddyAllocator()
+	b.startAddr = start
+	b.endAddr = start + size
+	b.maxOrder = getOrder(size)
+
+	// Initialize the largest block
+	maxBlock := b.getBlock()
+	maxBlock.start = start
+	maxBlock.size = size
+	maxBlock.isFree = true
+	maxBlock.next = nil
+	maxBlock.prev = nil
+	maxBlock.slab = nil
+
+	b.blocks[b.maxOrder] = maxBlock
+	b.blockMap[b.maxOrder][maxBlock.start] = maxBlock
+
+	return b, nil
+}
+
+// newBuddyAllocator creates a buddy allocator without any free blocks
+func newBuddyAllocator() *BuddyAllocator {
 	b := &BuddyAllocator{
 		blockMap:  [MaxOrder + 1]map[uint64]*Block{},
 		allocated: make(map[uint64]*Block),
+		owners:    make(map[uint64]*allocRecord),
 		startAddr: 0,
 		endAddr:   MaxBlockSize,
+		maxOrder:  MaxOrder,
 	}
 
 	// Initialize blockMap for each order
@@ -27,22 +63,28 @@ func NewBuddyAllocator() *BuddyAllocator {
 		},
 	}
 
-	// Initialize the largest block
-	maxBlock := b.getBlock()
-	maxBlock.start = 0
-	maxBlock.size = MaxBlockSize
-	maxBlock.isFree = true
-	maxBlock.next = nil
-	maxBlock.prev = nil
-	maxBlock.slab = nil
-
-	order := getOrder(maxBlock.size)
-	b.blocks[order] = maxBlock
-	b.blockMap[order][maxBlock.start] = maxBlock
-
 	return b
 }
 
+// appendFreeBlockLocked adds a free block after tail in the order's free list
+// and returns it as the new tail, used when rebuilding free lists in order
+func (b *BuddyAllocator) appendFreeBlockLocked(order int, start uint64, tail *Block) *Block {
+	block := b.getBlock()
+	block.start = start
+	block.size = getBlockSize(order)
+	block.isFree = true
+	block.next = nil
+	block.prev = tail
+	block.slab = nil
+	if tail == nil {
+		b.blocks[order] = block
+	} else {
+		tail.next = block
+	}
+	b.blockMap[order][start] = block
+	return block
+}
+
 // getBlock gets a Block from the pool
 func (b *BuddyAllocator) getBlock() *Block {
 	return b.blockPool.Get().(*Block)
@@ -81,16 +123,21 @@ func getBlockSize(order int) uint64 {
 
 // Allocate allocates memory of specified size
 func (b *BuddyAllocator) Allocate(size uint64) (uint64, error) {
+	return b.allocate(trace.Span{}, size, nil)
+}
+
+// allocate allocates a block and attaches the owner record, if any
+func (b *BuddyAllocator) allocate(span trace.Span, size uint64, rec *allocRecord) (uint64, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
 	order := getOrder(size)
-	if order > MaxOrder {
+	if order > b.maxOrder {
 		return 0, ErrSizeTooLarge
 	}
 
 	// Find available block from current order up
-	for i := order; i <= MaxOrder; i++ {
+	for i := order; i <= b.maxOrder; i++ {
 		if b.blocks[i] != nil {
 			block := b.blocks[i]
 			// Remove from linked list
@@ -130,13 +177,15 @@ func (b *BuddyAllocator) Allocate(size uint64) (uint64, error) {
 					b.blocks[j] = newBlock
 					b.blockMap[j][newBlock.start] = newBlock
 				}
+				span.Event("buddy.split", trace.Int("order", order), trace.Int("depth", i-order))
 			}
 
 			block.isFree = false
-			if EnableTrackBlock() {
-				b.allocated[block.start] = block
-			}
+			b.allocated[block.start] = block
 			b.used += block.size
+			if rec != nil {
+				b.owners[block.start] = rec
+			}
 			if size > block.size {
 				panic(fmt.Sprintf("An invalid address was assigned %d - %d - %d",
 					block.start, block.size, size))
@@ -148,16 +197,19 @@ func (b *BuddyAllocator) Allocate(size uint64) (uint64, error) {
 }
 
 // mergeBlockLocked performs the actual merge operation
-func (b *BuddyAllocator) mergeBlockLocked(start, size uint64) error {
+func (b *BuddyAllocator) mergeBlockLocked(span trace.Span, start, size uint64) error {
 	order := getOrder(size)
 	currentStart := start
 
 	// Try to merge blocks starting from current order
-	for order <= MaxOrder {
+	for order <= b.maxOrder {
 		buddyStart := currentStart ^ getBlockSize(order)
 		buddyBlock, exists := b.blockMap[order][buddyStart]
 
 		if !exists {
+			if depth := order - getOrder(size); depth > 0 {
+				span.Event("buddy.merge", trace.Int("order", order), trace.Int("depth", depth))
+			}
 			// No buddy found, add current block to free list
 			newBlock := b.getBlock()
 			newBlock.start = currentStart
@@ -201,27 +253,29 @@ func (b *BuddyAllocator) mergeBlockLocked(start, size uint64) error {
 
 // Free releases allocated memory at specified address
 func (b *BuddyAllocator) Free(start, size uint64) error {
+	return b.free(trace.Span{}, start, size)
+}
+
+// free releases a block, reporting how far it merged to span
+func (b *BuddyAllocator) free(span trace.Span, start, size uint64) error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	blockSize := size
-	if EnableTrackBlock() {
-		// Find the block in allocated blocks
-		block, exists := b.allocated[start]
-		if !exists {
-			return ErrBlockNotFound
-		}
-
-		// Remove from allocated blocks
-		delete(b.allocated, start)
-		blockSize = block.size
-		if blockSize != getBlockSizeWithSize(size) {
+	block, exists := b.allocated[start]
+	if !exists {
+		return ErrBlockNotFound
+	}
+	blockSize := block.size
+	if blockSize != getBlockSizeWithSize(size) {
+		if EnableTrackBlock() {
 			panic(fmt.Sprintf("Free an invalid block %d, %v", size, block))
 		}
-	} else {
-		blockSize = getBlockSizeWithSize(size)
+		return ErrInvalidAddress
 	}
+	delete(b.allocated, start)
+	b.putBlock(block)
 	b.used -= blockSize
-	if err := b.mergeBlockLocked(start, blockSize); err != nil {
+	delete(b.owners, start)
+	if err := b.mergeBlockLocked(span, start, blockSize); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,213 @@
+package hybrid
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// maxCheckProblems bounds the problems Check lists one by one
+const maxCheckProblems = 100
+
+// checkRange is a part of the address space Check accounts for
+type checkRange struct {
+	start uint64
+	size  uint64
+	what  string
+}
+
+// checker collects the problems Check finds
+type checker struct {
+	problems []error
+	dropped  int
+}
+
+func (c *checker) report(format string, args ...any) {
+	if len(c.problems) == maxCheckProblems {
+		c.dropped++
+		return
+	}
+	c.problems = append(c.problems, fmt.Errorf("%w: %s", ErrInconsistent, fmt.Sprintf(format, args...)))
+}
+
+func (c *checker) err() error {
+	if c.dropped > 0 {
+		c.problems = append(c.problems, fmt.Errorf("%w: %d more problems", ErrInconsistent, c.dropped))
+	}
+	return errors.Join(c.problems...)
+}
+
+// Check verifies the bookkeeping of the allocator the way fsck verifies a
+// file system: free buddy blocks are aligned, linked and disjoint, slabs lie
+// outside the free space and account for their allocations, the used and
+// free counters match, and shared extents are allocated. It returns every
+// problem found joined into one error, each wrapping ErrInconsistent, or
+// nil. Metadata loaded by LoadMetadata passed its checksum but may still
+// have been saved from a broken allocator, which is what Check catches.
+func (a *Allocator) Check() error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	a.slab.mutex.RLock()
+	defer a.slab.mutex.RUnlock()
+	a.buddy.mutex.RLock()
+	defer a.buddy.mutex.RUnlock()
+
+	var c checker
+	ranges := a.buddy.checkLocked(&c)
+	ranges = append(ranges, a.slab.checkLocked(&c)...)
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	for i := 1; i < len(ranges); i++ {
+		prev, r := ranges[i-1], ranges[i]
+		if prev.start+prev.size > r.start {
+			c.report("%s %#x overlaps %s %#x", prev.what, prev.start, r.what, r.start)
+		}
+	}
+
+	for _, start := range sortedKeys(a.refs) {
+		if a.refs[start] == 0 {
+			c.report("shared extent %#x has no extra references", start)
+		}
+		// The last range starting at or before the extent holds it, if any
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i].start > start }) - 1
+		if i < 0 || ranges[i].start+ranges[i].size <= start {
+			continue
+		}
+		switch r := ranges[i]; r.what {
+		case "free block":
+			c.report("shared extent %#x lies in free block %#x", start, r.start)
+		case "slab":
+			if _, allocated := a.slab.slabs[r.start].allocated[start]; !allocated {
+				c.report("shared extent %#x is not allocated in slab %#x", start, r.start)
+			}
+		}
+	}
+	return c.err()
+}
+
+// checkLocked checks the free lists, the allocated blocks and the used
+// counter, returning the free blocks
+func (b *BuddyAllocator) checkLocked(c *checker) []checkRange {
+	var ranges []checkRange
+	var free uint64
+	for order := 0; order <= MaxOrder; order++ {
+		size := getBlockSize(order)
+		blocks := b.blockMap[order]
+
+		listed := 0
+		for block := b.blocks[order]; block != nil; block = block.next {
+			if listed++; listed > len(blocks) {
+				c.report("free list of order %d holds more blocks than its map", order)
+				break
+			}
+			if blocks[block.start] != block {
+				c.report("free block %#x of order %d is listed but not mapped", block.start, order)
+			}
+		}
+		if listed < len(blocks) {
+			c.report("free list of order %d holds %d blocks, its map %d", order, listed, len(blocks))
+		}
+
+		for _, start := range sortedKeys(blocks) {
+			block := blocks[start]
+			switch {
+			case block.start != start || block.size != size || !block.isFree:
+				c.report("free block %#x of order %d describes %#x+%d, free %v", start, order, block.start, block.size, block.isFree)
+			case start < b.startAddr || start+size > b.endAddr:
+				c.report("free block %#x of order %d lies outside [%#x, %#x)", start, order, b.startAddr, b.endAddr)
+			case (start-b.startAddr)%size != 0:
+				c.report("free block %#x of order %d is not aligned to its size", start, order)
+			}
+			ranges = append(ranges, checkRange{start: start, size: size, what: "free block"})
+			free += size
+		}
+	}
+
+	if total := b.endAddr - b.startAddr; free > total || b.used != total-free {
+		c.report("buddy allocator counts %d of %d bytes used, its free blocks %d", b.used, total, free)
+	}
+
+	var allocated uint64
+	for _, start := range sortedKeys(b.allocated) {
+		block := b.allocated[start]
+		if block.start != start || block.isFree {
+			c.report("allocated block %#x describes %#x+%d, free %v", start, block.start, block.size, block.isFree)
+		}
+		allocated += block.size
+	}
+	if allocated != b.used {
+		c.report("buddy allocator counts %d bytes used, its allocated blocks %d", b.used, allocated)
+	}
+	return ranges
+}
+
+// checkLocked checks the slabs against the size caches and the free counter,
+// returning the slabs
+func (s *SlabAllocator) checkLocked(c *checker) []checkRange {
+	classes := make(map[*Slab]uint64, len(s.slabs))
+	for _, class := range sortedKeys(s.cache) {
+		slabs := s.cache[class]
+		if s.counts[class] != len(slabs) {
+			c.report("size %d counts %d slabs, caches %d", class, s.counts[class], len(slabs))
+		}
+		for _, slab := range slabs {
+			if other, cached := classes[slab]; cached {
+				c.report("slab %#x is cached for sizes %d and %d", slab.start, other, class)
+			}
+			classes[slab] = class
+			if s.slabs[slab.start] != slab {
+				c.report("slab %#x is cached for size %d but not registered", slab.start, class)
+			}
+		}
+	}
+	for _, class := range sortedKeys(s.counts) {
+		if _, cached := s.cache[class]; !cached {
+			c.report("size %d counts %d slabs but caches none", class, s.counts[class])
+		}
+	}
+
+	var ranges []checkRange
+	var free uint64
+	for _, start := range sortedKeys(s.slabs) {
+		slab := s.slabs[start]
+		end := slab.start + slab.size
+		if slab.start != start {
+			c.report("slab %#x is registered at %#x", slab.start, start)
+		}
+		class, cached := classes[slab]
+		if !cached {
+			c.report("slab %#x is not cached for any size", start)
+		}
+		ranges = append(ranges, checkRange{start: start, size: slab.size, what: "slab"})
+
+		var used uint64
+		pos := slab.start
+		for _, at := range sortedKeys(slab.allocated) {
+			size := slab.allocated[at]
+			switch {
+			case at < pos:
+				c.report("allocation %#x in slab %#x overlaps the previous one", at, start)
+			case at+size > end:
+				c.report("allocation %#x+%d exceeds slab %#x", at, size, start)
+			case cached && (size != class || (at-slab.start)%class != 0):
+				c.report("allocation %#x+%d does not fit size %d of slab %#x", at, size, class, start)
+			}
+			used += size
+			pos = max(pos, at+size)
+		}
+		if used != slab.used || used > slab.size {
+			c.report("slab %#x counts %d bytes used, its allocations %d", start, slab.used, used)
+		} else {
+			free += slab.size - slab.used
+		}
+		for _, at := range slab.freeList {
+			if at < slab.start || at >= end {
+				c.report("free list of slab %#x holds %#x outside of it", start, at)
+			}
+		}
+	}
+	if free != s.free {
+		c.report("slab allocator counts %d bytes free, its slabs %d", s.free, free)
+	}
+	return ranges
+}
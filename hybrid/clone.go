@@ -0,0 +1,233 @@
+package hybrid
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ExtentState describes how a range of the address space is used
+type ExtentState uint8
+
+const (
+	// ExtentFree is free space owned by the buddy allocator
+	ExtentFree ExtentState = iota
+	// ExtentAllocated is allocated straight from the buddy allocator
+	ExtentAllocated
+	// ExtentSlabFree is unused space inside a slab
+	ExtentSlabFree
+	// ExtentSlabAllocated is allocated from a slab
+	ExtentSlabAllocated
+)
+
+func (s ExtentState) String() string {
+	switch s {
+	case ExtentFree:
+		return "free"
+	case ExtentAllocated:
+		return "allocated"
+	case ExtentSlabFree:
+		return "slab-free"
+	case ExtentSlabAllocated:
+		return "slab-allocated"
+	}
+	return fmt.Sprintf("ExtentState(%d)", uint8(s))
+}
+
+// Extent is a contiguous range of the address space in a single state
+type Extent struct {
+	Start uint64
+	Size  uint64
+	State ExtentState
+}
+
+// ExtentDiff is a range whose state differs between two allocators
+type ExtentDiff struct {
+	Start uint64
+	Size  uint64
+	A     ExtentState
+	B     ExtentState
+}
+
+// Clone returns an independent copy of the allocator, taken consistently
+// under the allocator locks. Reserves, tagging and reference counts are
+// copied; watermarks are not, so simulated workloads never fire production
+// callbacks.
+func (a *Allocator) Clone() *Allocator {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	a.slab.mutex.RLock()
+	defer a.slab.mutex.RUnlock()
+	a.buddy.mutex.RLock()
+	defer a.buddy.mutex.RUnlock()
+
+	buddy := a.buddy.cloneLocked()
+	clone := &Allocator{
+		buddy: buddy,
+		slab:  a.slab.cloneLocked(buddy),
+	}
+	if a.reserves != nil {
+		clone.reserves = make(map[Priority]uint64, len(a.reserves))
+		for p, size := range a.reserves {
+			clone.reserves[p] = size
+		}
+	}
+	clone.reserved.Store(a.reserved.Load())
+	clone.tagging.Store(a.tagging.Load())
+	if a.refs != nil {
+		clone.refs = make(map[uint64]uint32, len(a.refs))
+		for start, extra := range a.refs {
+			clone.refs[start] = extra
+		}
+	}
+	return clone
+}
+
+// cloneLocked deep copies the buddy allocator, keeping free list order
+func (b *BuddyAllocator) cloneLocked() *BuddyAllocator {
+	clone := newBuddyAllocator()
+	clone.used = b.used
+	clone.startAddr = b.startAddr
+	clone.endAddr = b.endAddr
+	clone.maxOrder = b.maxOrder
+	for order := 0; order <= MaxOrder; order++ {
+		var tail *Block
+		for block := b.blocks[order]; block != nil; block = block.next {
+			tail = clone.appendFreeBlockLocked(order, block.start, tail)
+		}
+	}
+	for start, block := range b.allocated {
+		copied := clone.getBlock()
+		*copied = Block{start: block.start, size: block.size}
+		clone.allocated[start] = copied
+	}
+	// Owner records are never modified once created and can be shared
+	for start, rec := range b.owners {
+		clone.owners[start] = rec
+	}
+	return clone
+}
+
+// cloneLocked deep copies the slab allocator on top of a cloned buddy allocator
+func (s *SlabAllocator) cloneLocked(buddy *BuddyAllocator) *SlabAllocator {
+	clone := NewSlabAllocator(buddy)
+	clone.free = s.free
+	copies := make(map[*Slab]*Slab, len(s.slabs))
+	for start, slab := range s.slabs {
+		copied := NewSlab(slab.start, slab.size, clone, slab.fromBuddy)
+		copied.used = slab.used
+		copied.freeList = append([]uint64(nil), slab.freeList...)
+		for addr, size := range slab.allocated {
+			copied.allocated[addr] = size
+		}
+		if slab.owners != nil {
+			copied.owners = make(map[uint64]*allocRecord, len(slab.owners))
+			for addr, rec := range slab.owners {
+				copied.owners[addr] = rec
+			}
+		}
+		clone.slabs[start] = copied
+		copies[slab] = copied
+	}
+	for size, slabs := range s.cache {
+		cached := make([]*Slab, len(slabs))
+		for i, slab := range slabs {
+			cached[i] = copies[slab]
+		}
+		clone.cache[size] = cached
+	}
+	for size, count := range s.counts {
+		clone.counts[size] = count
+	}
+	return clone
+}
+
+// Extents returns the state of the whole address space as sorted,
+// non-overlapping extents. Adjacent buddy allocations are reported as a
+// single extent because the buddy layer does not track them individually.
+func (a *Allocator) Extents() []Extent {
+	a.slab.mutex.RLock()
+	defer a.slab.mutex.RUnlock()
+	a.buddy.mutex.RLock()
+	defer a.buddy.mutex.RUnlock()
+
+	var known []Extent
+	for order := 0; order <= MaxOrder; order++ {
+		for start := range a.buddy.blockMap[order] {
+			known = append(known, Extent{Start: start, Size: getBlockSize(order), State: ExtentFree})
+		}
+	}
+	for _, slab := range a.slab.slabs {
+		pos := slab.start
+		for _, start := range sortedKeys(slab.allocated) {
+			if start > pos {
+				known = append(known, Extent{Start: pos, Size: start - pos, State: ExtentSlabFree})
+			}
+			known = append(known, Extent{Start: start, Size: slab.allocated[start], State: ExtentSlabAllocated})
+			pos = start + slab.allocated[start]
+		}
+		if end := slab.start + slab.size; end > pos {
+			known = append(known, Extent{Start: pos, Size: end - pos, State: ExtentSlabFree})
+		}
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i].Start < known[j].Start })
+
+	// Whatever is neither free nor part of a slab is a buddy allocation
+	extents := make([]Extent, 0, len(known)*2+1)
+	add := func(e Extent) {
+		if n := len(extents); n > 0 && e.State != ExtentSlabAllocated &&
+			extents[n-1].State == e.State && extents[n-1].Start+extents[n-1].Size == e.Start {
+			extents[n-1].Size += e.Size
+			return
+		}
+		extents = append(extents, e)
+	}
+	pos := a.buddy.startAddr
+	for _, e := range known {
+		if e.Start > pos {
+			add(Extent{Start: pos, Size: e.Start - pos, State: ExtentAllocated})
+		}
+		add(e)
+		pos = e.Start + e.Size
+	}
+	if end := a.buddy.endAddr; end > pos {
+		add(Extent{Start: pos, Size: end - pos, State: ExtentAllocated})
+	}
+	return extents
+}
+
+// Diff lists the ranges whose state differs between two allocators, such as a
+// clone and its origin. A range also counts as different when both sides hold
+// a slab allocation there but with different boundaries.
+func Diff(a, b *Allocator) []ExtentDiff {
+	ea, eb := a.Extents(), b.Extents()
+
+	var diffs []ExtentDiff
+	var i, j int
+	var pos uint64
+	if len(ea) > 0 {
+		pos = ea[0].Start
+	}
+	for i < len(ea) && j < len(eb) {
+		x, y := ea[i], eb[j]
+		end := min(x.Start+x.Size, y.Start+y.Size)
+		differs := x.State != y.State ||
+			(x.State == ExtentSlabAllocated && (x.Start != y.Start || x.Size != y.Size))
+		if differs {
+			n := len(diffs)
+			if n > 0 && diffs[n-1].Start+diffs[n-1].Size == pos &&
+				diffs[n-1].A == x.State && diffs[n-1].B == y.State {
+				diffs[n-1].Size += end - pos
+			} else {
+				diffs = append(diffs, ExtentDiff{Start: pos, Size: end - pos, A: x.State, B: y.State})
+			}
+		}
+		pos = end
+		if x.Start+x.Size == end {
+			i++
+		}
+		if y.Start+y.Size == end {
+			j++
+		}
+	}
+	return diffs
+}
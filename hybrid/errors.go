@@ -21,4 +21,14 @@ var (
 	ErrAddressNotAllocated = errors.New("address not allocated")
 
 	ErrBlockNotFound = errors.New("Block not found in allocated blocks")
+	// ErrInvalidWatermarks is returned when the low watermark is above the high watermark
+	ErrInvalidWatermarks = errors.New("low watermark is above high watermark")
+	// ErrExtentShared is returned when freeing an extent that still has other references
+	ErrExtentShared = errors.New("extent is shared")
+	// ErrInvalidRange is returned when an allocator range is not a power of two or not aligned
+	ErrInvalidRange = errors.New("invalid allocator range")
+	// ErrCorruptMetadata is returned when persisted allocator metadata cannot be decoded
+	ErrCorruptMetadata = errors.New("corrupt allocator metadata")
+	// ErrInconsistent is wrapped by the problems Check finds in the allocator state
+	ErrInconsistent = errors.New("inconsistent allocator state")
 )
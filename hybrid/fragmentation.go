@@ -0,0 +1,51 @@
+package hybrid
+
+// Fragmentation describes how the free space of an allocator is split up
+type Fragmentation struct {
+	// FreeBytes is the free space held by the buddy allocator
+	FreeBytes uint64 `json:"free_bytes"`
+	// FreeBlocks counts the free buddy blocks of each order
+	FreeBlocks []int `json:"free_blocks"`
+	// LargestFreeBlock is the largest allocation the buddy allocator can serve
+	LargestFreeBlock uint64 `json:"largest_free_block"`
+	// SlabBytes is the space held by slabs, SlabFreeBytes the unused part of it
+	SlabBytes     uint64 `json:"slab_bytes"`
+	SlabFreeBytes uint64 `json:"slab_free_bytes"`
+	Slabs         int    `json:"slabs"`
+	// External is 1 - LargestFreeBlock/FreeBytes, 0 when free space is contiguous
+	External float64 `json:"external"`
+	// Internal is the unused fraction of the slab space
+	Internal float64 `json:"internal"`
+}
+
+// Fragmentation returns a breakdown of the free space
+func (a *Allocator) Fragmentation() Fragmentation {
+	a.slab.mutex.RLock()
+	defer a.slab.mutex.RUnlock()
+	a.buddy.mutex.RLock()
+	defer a.buddy.mutex.RUnlock()
+
+	frag := Fragmentation{FreeBlocks: make([]int, a.buddy.maxOrder+1)}
+	for order := 0; order <= a.buddy.maxOrder; order++ {
+		count := len(a.buddy.blockMap[order])
+		if count == 0 {
+			continue
+		}
+		frag.FreeBlocks[order] = count
+		frag.FreeBytes += uint64(count) * getBlockSize(order)
+		frag.LargestFreeBlock = getBlockSize(order)
+	}
+	for _, slab := range a.slab.slabs {
+		frag.SlabBytes += slab.size
+		frag.Slabs++
+	}
+	frag.SlabFreeBytes = a.slab.free
+
+	if frag.FreeBytes > 0 {
+		frag.External = 1 - float64(frag.LargestFreeBlock)/float64(frag.FreeBytes)
+	}
+	if frag.SlabBytes > 0 {
+		frag.Internal = float64(frag.SlabFreeBytes) / float64(frag.SlabBytes)
+	}
+	return frag
+}
@@ -26,6 +26,12 @@ const (
 
 var currentLogLevel = LogLevelError
 
+// SetLogLevel sets the level of the messages logged, LogLevelError by
+// default. It is meant to be called once at startup.
+func SetLogLevel(level LogLevel) {
+	currentLogLevel = level
+}
+
 var (
 	debugLogger *log.Logger
 	infoLogger  *log.Logger
@@ -0,0 +1,266 @@
+package hybrid
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Persisted metadata layout. All integers are unsigned varints.
+//
+//	magic "HYBA", version
+//	buddy:  used, then for every order 0..MaxOrder the free block count and
+//	        the block starts in free list order, then the allocated blocks as
+//	        (start, size) pairs
+//	slabs:  size class count, then per class the class size and slab count,
+//	        per slab: start, size, fromBuddy, allocated offsets, free list
+//	refs:   count, then (start, extra references) pairs
+//	crc32 (IEEE) of everything above, little endian
+//
+// Tags, reserves and watermarks are runtime state and are not persisted.
+// Only allocators covering the full address space, as created by
+// NewAllocator, can be persisted.
+const (
+	metadataMagic = "HYBA"
+	// Version 1 only held the allocated blocks when block tracking was
+	// enabled, which frees and reference counts now rely on
+	metadataVersion = 2
+)
+
+type metaWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (m *metaWriter) uvarint(v uint64) {
+	if m.err != nil {
+		return
+	}
+	n := binary.PutUvarint(m.buf[:], v)
+	m.crc.Write(m.buf[:n])
+	_, m.err = m.w.Write(m.buf[:n])
+}
+
+type metaReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+}
+
+func (m *metaReader) ReadByte() (byte, error) {
+	c, err := m.r.ReadByte()
+	if err == nil {
+		m.crc.Write([]byte{c})
+	}
+	return c, err
+}
+
+func (m *metaReader) uvarint() uint64 {
+	if m.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(m)
+	if err != nil {
+		m.err = ErrCorruptMetadata
+	}
+	return v
+}
+
+// count reads a length prefix, rejecting values no valid metadata could hold
+func (m *metaReader) count(limit uint64) int {
+	n := m.uvarint()
+	if n > limit {
+		m.err = ErrCorruptMetadata
+		return 0
+	}
+	return int(n)
+}
+
+// SaveMetadata writes a consistent image of the allocator state to w
+func (a *Allocator) SaveMetadata(w io.Writer) error {
+	if a.buddy.startAddr != 0 || a.buddy.endAddr != MaxBlockSize {
+		return ErrInvalidRange
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	a.slab.mutex.RLock()
+	defer a.slab.mutex.RUnlock()
+	a.buddy.mutex.RLock()
+	defer a.buddy.mutex.RUnlock()
+
+	m := &metaWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	m.crc.Write([]byte(metadataMagic))
+	if _, err := m.w.WriteString(metadataMagic); err != nil {
+		return err
+	}
+	m.uvarint(metadataVersion)
+
+	// Buddy allocator
+	b := a.buddy
+	m.uvarint(b.used)
+	for order := 0; order <= MaxOrder; order++ {
+		m.uvarint(uint64(len(b.blockMap[order])))
+		for block := b.blocks[order]; block != nil; block = block.next {
+			m.uvarint(block.start)
+		}
+	}
+	m.uvarint(uint64(len(b.allocated)))
+	for _, start := range sortedKeys(b.allocated) {
+		m.uvarint(start)
+		m.uvarint(b.allocated[start].size)
+	}
+
+	// Slab allocator
+	classes := sortedKeys(a.slab.cache)
+	m.uvarint(uint64(len(classes)))
+	for _, class := range classes {
+		slabs := a.slab.cache[class]
+		m.uvarint(class)
+		m.uvarint(uint64(len(slabs)))
+		for _, slab := range slabs {
+			m.uvarint(slab.start)
+			m.uvarint(slab.size)
+			if slab.fromBuddy {
+				m.uvarint(1)
+			} else {
+				m.uvarint(0)
+			}
+			m.uvarint(uint64(len(slab.allocated)))
+			for _, start := range sortedKeys(slab.allocated) {
+				m.uvarint(start - slab.start)
+			}
+			m.uvarint(uint64(len(slab.freeList)))
+			for _, start := range slab.freeList {
+				m.uvarint(start - slab.start)
+			}
+		}
+	}
+
+	// Reference counts
+	m.uvarint(uint64(len(a.refs)))
+	for _, start := range sortedKeys(a.refs) {
+		m.uvarint(start)
+		m.uvarint(uint64(a.refs[start]))
+	}
+
+	if m.err != nil {
+		return m.err
+	}
+	if err := binary.Write(m.w, binary.LittleEndian, m.crc.Sum32()); err != nil {
+		return err
+	}
+	return m.w.Flush()
+}
+
+// LoadMetadata rebuilds an allocator from metadata written by SaveMetadata
+func LoadMetadata(r io.Reader) (*Allocator, error) {
+	m := &metaReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	magic := make([]byte, len(metadataMagic))
+	for i := range magic {
+		magic[i], m.err = m.ReadByte()
+		if m.err != nil {
+			return nil, ErrCorruptMetadata
+		}
+	}
+	if string(magic) != metadataMagic || m.uvarint() != metadataVersion {
+		return nil, ErrCorruptMetadata
+	}
+
+	// Buddy allocator, free lists are rebuilt in their saved order
+	buddy := newBuddyAllocator()
+	buddy.used = m.uvarint()
+	maxBlocks := uint64(MaxBlockSize / BuddyStartSize)
+	for order := 0; order <= MaxOrder && m.err == nil; order++ {
+		var tail *Block
+		n := m.count(maxBlocks)
+		for i := 0; i < n && m.err == nil; i++ {
+			tail = buddy.appendFreeBlockLocked(order, m.uvarint(), tail)
+		}
+	}
+	n := m.count(maxBlocks)
+	// Every shared extent is an allocated block or a slab allocation
+	extents := n
+	for i := 0; i < n && m.err == nil; i++ {
+		block := buddy.getBlock()
+		block.start = m.uvarint()
+		block.size = m.uvarint()
+		block.isFree = false
+		buddy.allocated[block.start] = block
+	}
+
+	// Slab allocator
+	slab := NewSlabAllocator(buddy)
+	classes := m.count(SlabMaxSize)
+	for i := 0; i < classes && m.err == nil; i++ {
+		class := m.uvarint()
+		count := m.count(maxBlocks)
+		if class == 0 {
+			m.err = ErrCorruptMetadata
+		}
+		for j := 0; j < count && m.err == nil; j++ {
+			start := m.uvarint()
+			size := m.uvarint()
+			sb := NewSlab(start, size, slab, m.uvarint() == 1)
+			sb.freeList = nil
+			allocated := m.count(size / class)
+			for k := 0; k < allocated && m.err == nil; k++ {
+				sb.allocated[start+m.uvarint()] = class
+			}
+			sb.used = uint64(allocated) * class
+			extents += allocated
+			free := m.count(size)
+			for k := 0; k < free && m.err == nil; k++ {
+				sb.freeList = append(sb.freeList, start+m.uvarint())
+			}
+			if sb.used > sb.size {
+				m.err = ErrCorruptMetadata
+				break
+			}
+			slab.slabs[start] = sb
+			slab.cache[class] = append(slab.cache[class], sb)
+			slab.counts[class]++
+			slab.free += sb.size - sb.used
+		}
+	}
+
+	allocator := &Allocator{
+		buddy: buddy,
+		slab:  slab,
+	}
+
+	// Reference counts. The map grows as entries are read, so a corrupt
+	// count cannot allocate memory before the checksum is verified.
+	n = m.count(uint64(extents))
+	if n > 0 {
+		allocator.refs = make(map[uint64]uint32)
+	}
+	for i := 0; i < n && m.err == nil; i++ {
+		start := m.uvarint()
+		allocator.refs[start] = uint32(m.uvarint())
+	}
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var sum uint32
+	if err := binary.Read(m.r, binary.LittleEndian, &sum); err != nil || sum != m.crc.Sum32() {
+		return nil, ErrCorruptMetadata
+	}
+	return allocator, nil
+}
+
+// sortedKeys returns the keys of an address keyed map in ascending order
+func sortedKeys[V any](m map[uint64]V) []uint64 {
+	keys := make([]uint64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,96 @@
+package hybrid
+
+// Extents start with a single reference. Only extents shared by more than one
+// owner get an entry in Allocator.refs, holding the number of extra references,
+// so the common refcount==1 case costs no memory at all.
+
+// IsAllocated reports whether [start, start+size) is a live allocation
+func (a *Allocator) IsAllocated(start, size uint64) bool {
+	if size == 0 || size > MaxBlockSize {
+		return false
+	}
+
+	if size <= SlabMaxSize {
+		a.slab.mutex.RLock()
+		slab, exists := a.slab.slabs[start&^uint64(SlabMaxSize-1)]
+		if exists {
+			allocatedSize, allocated := slab.allocated[start]
+			a.slab.mutex.RUnlock()
+			return allocated && allocatedSize == size
+		}
+		a.slab.mutex.RUnlock()
+	} else {
+		a.slab.mutex.RLock()
+		_, isSlab := a.slab.slabs[start]
+		a.slab.mutex.RUnlock()
+		if isSlab {
+			return false
+		}
+	}
+
+	return a.buddy.isAllocated(start, size)
+}
+
+// IncRef adds a reference to an allocated extent
+func (a *Allocator) IncRef(start, size uint64) error {
+	// Frees check for references under the read lock, so the extent cannot
+	// be released between the check and the update
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.IsAllocated(start, size) {
+		return ErrAddressNotAllocated
+	}
+
+	if a.refs == nil {
+		a.refs = make(map[uint64]uint32)
+	}
+	a.refs[start]++
+	Debug("Extent %d referenced %d times", start, a.refs[start]+1)
+	return nil
+}
+
+// DecRef drops a reference to an allocated extent and returns how many remain.
+// The extent goes back to the slab or buddy layer when the last one is dropped.
+func (a *Allocator) DecRef(start, size uint64) (uint32, error) {
+	a.mutex.Lock()
+	if !a.IsAllocated(start, size) {
+		a.mutex.Unlock()
+		return 0, ErrAddressNotAllocated
+	}
+	if extra, exists := a.refs[start]; exists {
+		if extra == 1 {
+			delete(a.refs, start)
+		} else {
+			a.refs[start] = extra - 1
+		}
+		a.mutex.Unlock()
+		return extra, nil
+	}
+	a.mutex.Unlock()
+
+	// A reference added meanwhile makes Free fail with ErrExtentShared
+	if err := a.Free(start, size); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// GetRefCount returns the number of references held on an allocated extent
+func (a *Allocator) GetRefCount(start, size uint64) (uint32, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if !a.IsAllocated(start, size) {
+		return 0, ErrAddressNotAllocated
+	}
+	return a.refs[start] + 1, nil
+}
+
+// isAllocated reports whether a block of the size of [start, start+size) was
+// handed out at start
+func (b *BuddyAllocator) isAllocated(start, size uint64) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	block, exists := b.allocated[start]
+	return exists && block.size == getBlockSizeWithSize(size)
+}
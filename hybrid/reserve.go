@@ -0,0 +1,123 @@
+package hybrid
+
+// Priority identifies the class of an allocation request
+type Priority int
+
+const (
+	// PriorityNormal is used for regular data writes
+	PriorityNormal Priority = iota
+	// PriorityMetadata is used for metadata writes
+	PriorityMetadata
+	// PriorityCompaction is used for compaction and other background rewrites
+	PriorityCompaction
+)
+
+// AllocOptions holds optional parameters of an allocation request
+type AllocOptions struct {
+	Priority Priority
+	Tag      Tag // owner recorded when tagging is enabled
+}
+
+// Watermarks configures free space thresholds. OnLow fires once when free
+// space drops below Low, OnHigh fires once when it climbs back to High or more.
+// Callbacks run synchronously on the allocating goroutine without any
+// allocator lock held.
+type Watermarks struct {
+	Low    uint64
+	High   uint64
+	OnLow  func(free uint64)
+	OnHigh func(free uint64)
+}
+
+// SetReserve holds back size bytes of free space for priority class p.
+// Allocations of any other class fail with ErrNoSpaceAvailable rather than
+// dip into it. A size of zero removes the reserve.
+func (a *Allocator) SetReserve(p Priority, size uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.reserves == nil {
+		a.reserves = make(map[Priority]uint64)
+	}
+	total := a.reserved.Load() - a.reserves[p] + size
+	if size == 0 {
+		delete(a.reserves, p)
+	} else {
+		a.reserves[p] = size
+	}
+	a.reserved.Store(total)
+	Debug("Reserve for priority %d set to %d bytes", p, size)
+}
+
+// GetReserve returns the space reserved for priority class p
+func (a *Allocator) GetReserve(p Priority) uint64 {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.reserves[p]
+}
+
+// SetWatermarks installs free space watermarks, nil disables them
+func (a *Allocator) SetWatermarks(w *Watermarks) error {
+	if w != nil && w.Low > w.High {
+		return ErrInvalidWatermarks
+	}
+
+	a.mutex.Lock()
+	a.watermarks.Store(w)
+	a.belowLow = false
+	a.mutex.Unlock()
+
+	a.checkWatermarks()
+	return nil
+}
+
+// GetFreeSize returns the total size of unallocated space
+func (a *Allocator) GetFreeSize() uint64 {
+	return a.GetTotalSize() - a.GetUsedSize()
+}
+
+// checkReserveLocked verifies that size bytes can be handed to class p
+// without touching space reserved for the other classes
+func (a *Allocator) checkReserveLocked(size uint64, p Priority) error {
+	held := a.reserved.Load() - a.reserves[p]
+	if held == 0 {
+		return nil
+	}
+
+	charge := size
+	if size > SlabMaxSize {
+		charge = getBlockSizeWithSize(size)
+	}
+	free := a.GetFreeSize()
+	if free < held || free-held < charge {
+		Debug("Allocation of %d bytes for priority %d denied, free %d, reserved %d", size, p, free, held)
+		return ErrNoSpaceAvailable
+	}
+	return nil
+}
+
+// checkWatermarks fires the watermark callbacks when free space crossed a threshold
+func (a *Allocator) checkWatermarks() {
+	w := a.watermarks.Load()
+	if w == nil {
+		return
+	}
+
+	free := a.GetFreeSize()
+	var fire func(uint64)
+	a.mutex.Lock()
+	if a.watermarks.Load() == w {
+		if !a.belowLow && free < w.Low {
+			a.belowLow = true
+			fire = w.OnLow
+		} else if a.belowLow && free >= w.High {
+			a.belowLow = false
+			fire = w.OnHigh
+		}
+	}
+	a.mutex.Unlock()
+
+	if fire != nil {
+		fire(free)
+	}
+}
@@ -1,6 +1,9 @@
 package hybrid
 
-import "fmt"
+import (
+	"fmt"
+	"hybridAllocator/trace"
+)
 
 // NewSlab creates a new slab
 func NewSlab(start, size uint64, allocator *SlabAllocator, fromBuddy bool) *Slab {
@@ -69,6 +72,11 @@ func (s *Slab) findFreeSpace(size uint64) (uint64, bool) {
 
 // Allocate allocates memory of specified size from slab cache
 func (s *SlabAllocator) Allocate(size uint64) (uint64, error) {
+	return s.allocate(trace.Span{}, size, nil)
+}
+
+// allocate allocates from slab cache and attaches the owner record, if any
+func (s *SlabAllocator) allocate(span trace.Span, size uint64, rec *allocRecord) (uint64, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -78,16 +86,18 @@ func (s *SlabAllocator) Allocate(size uint64) (uint64, error) {
 	if !exists || len(slabs) == 0 {
 		Debug("No existing slab found for size %d, creating new one", size)
 		// Get new slab from buddy hybrid
-		start, err := s.buddy.Allocate(SlabMaxSize)
+		start, err := s.buddy.allocate(span, SlabMaxSize, nil)
 		if err != nil {
 			Error("Failed to allocate new slab: %v", err)
 			return 0, err
 		}
+		span.Event("slab.create", trace.Uint("size_class", size), trace.Uint("start", start))
 
 		slab := NewSlab(start, SlabMaxSize, s, true)
 		s.slabs[slab.start] = slab
 		s.cache[size] = []*Slab{slab}
 		s.counts[size] = 1
+		s.free += SlabMaxSize
 		slabs = s.cache[size]
 		Debug("Created new slab at address %d", start)
 	}
@@ -104,15 +114,17 @@ func (s *SlabAllocator) Allocate(size uint64) (uint64, error) {
 	if targetSlab == nil {
 		Debug("All existing slabs are full, creating new one")
 		// All existing slabs are full, create a new one
-		start, err := s.buddy.Allocate(SlabMaxSize)
+		start, err := s.buddy.allocate(span, SlabMaxSize, nil)
 		if err != nil {
 			return 0, err
 		}
+		span.Event("slab.create", trace.Uint("size_class", size), trace.Uint("start", start))
 
 		targetSlab = NewSlab(start, SlabMaxSize, s, true)
 		s.slabs[targetSlab.start] = targetSlab
 		s.cache[size] = append(s.cache[size], targetSlab)
 		s.counts[size]++
+		s.free += SlabMaxSize
 		Debug("Created new slab at address %d", start)
 	}
 
@@ -130,12 +142,25 @@ func (s *SlabAllocator) Allocate(size uint64) (uint64, error) {
 	// Allocate space
 	targetSlab.allocated[start] = size
 	targetSlab.used += size
+	s.free -= size
+	if rec != nil {
+		if targetSlab.owners == nil {
+			targetSlab.owners = make(map[uint64]*allocRecord)
+		}
+		targetSlab.owners[start] = rec
+	}
 	Debug("Allocated %d bytes from slab at address %d", size, start)
 	return start, nil
 }
 
 // Free releases allocated memory at specified address from slab cache
 func (s *SlabAllocator) Free(start, size uint64) error {
+	return s.release(trace.Span{}, start, size)
+}
+
+// release frees memory from slab cache, reporting slabs handed back to the
+// buddy layer to span
+func (s *SlabAllocator) release(span trace.Span, start, size uint64) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -153,9 +178,13 @@ func (s *SlabAllocator) Free(start, size uint64) error {
 	}
 
 	if targetSlab == nil {
+		// Space of a slab of another size class is not the buddy's to free
+		if s.holdsLocked(start) {
+			return ErrAddressNotAllocated
+		}
 		Debug("Address not found in slab cache, trying buddy hybrid")
 		// Try buddy hybrid if not found in slab cache
-		err := s.buddy.Free(start, size)
+		err := s.buddy.free(span, start, size)
 		if err != nil {
 			Error("Failed to free memory from buddy hybrid: %v", err)
 			return err
@@ -185,7 +214,9 @@ func (s *SlabAllocator) Free(start, size uint64) error {
 
 	// Update used size and clear allocation record
 	targetSlab.used -= targetSize
+	s.free += targetSize
 	delete(targetSlab.allocated, start)
+	delete(targetSlab.owners, start)
 	targetSlab.freeList = append(targetSlab.freeList, start)
 	Debug("Updated slab used size to %d", targetSlab.used)
 
@@ -210,7 +241,7 @@ func (s *SlabAllocator) Free(start, size uint64) error {
 			}
 		}
 		Debug("Performing synchronous merge for slab with free space: %d", freeSpace)
-		if err := s.mergeSlab(targetSlab); err != nil {
+		if err := s.mergeSlab(span, targetSlab); err != nil {
 			Error("Failed to merge slab: %v", err)
 			return err
 		}
@@ -219,16 +250,25 @@ func (s *SlabAllocator) Free(start, size uint64) error {
 	return nil
 }
 
+// holdsLocked reports whether start lies in a slab. Slabs are buddy blocks
+// of SlabMaxSize, so only the one aligned below start can hold it.
+func (s *SlabAllocator) holdsLocked(start uint64) bool {
+	_, exists := s.slabs[start&^uint64(SlabMaxSize-1)]
+	return exists
+}
+
 // mergeSlab performs the actual slab merge operation
-func (s *SlabAllocator) mergeSlab(slab *Slab) error {
+func (s *SlabAllocator) mergeSlab(span trace.Span, slab *Slab) error {
 	// Clear the free list as we're merging the entire slab
 	slab.freeList = nil
 
 	// Remove from slabs list
 	delete(s.slabs, slab.start)
+	s.free -= slab.size - slab.used
 
 	// Free to buddy system
-	return s.buddy.Free(slab.start, slab.size)
+	span.Event("slab.release", trace.Uint("start", slab.start))
+	return s.buddy.free(span, slab.start, slab.size)
 }
 
 // GetUsedSize returns the total size of allocated memory from slab cache
@@ -248,12 +288,8 @@ func (s *SlabAllocator) GetFreeSize() uint64 {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	var free uint64
-	for _, slab := range s.slabs {
-		free += slab.size - slab.used
-	}
-	Debug("Slab hybrid free size: %d bytes", free)
-	return free
+	Debug("Slab hybrid free size: %d bytes", s.free)
+	return s.free
 }
 
 func (s *SlabAllocator) Close() error {
@@ -0,0 +1,93 @@
+package hybrid
+
+import (
+	"hybridAllocator/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Layer identifies the part of the allocator that served an operation
+type Layer int
+
+const (
+	LayerSlab Layer = iota
+	LayerBuddy
+	// LayerCount is the number of layers
+	LayerCount
+)
+
+func (l Layer) String() string {
+	switch l {
+	case LayerSlab:
+		return "slab"
+	case LayerBuddy:
+		return "buddy"
+	}
+	return "unknown"
+}
+
+// OpStats counts the operations a layer served and how long the successful
+// ones took
+type OpStats struct {
+	Count    uint64
+	Failures uint64
+	Latency  metrics.HistogramSnapshot
+}
+
+// LayerStats breaks allocations and frees down by the layer that served them
+type LayerStats struct {
+	Allocate [LayerCount]OpStats
+	Free     [LayerCount]OpStats
+}
+
+// opCounters is the live form of OpStats, updated without locking
+type opCounters struct {
+	failures atomic.Uint64
+	latency  metrics.LatencyHistogram
+}
+
+func (c *opCounters) record(began time.Time, err error) {
+	if err != nil {
+		c.failures.Add(1)
+		return
+	}
+	c.latency.Since(began)
+}
+
+func (c *opCounters) stats() OpStats {
+	latency := c.latency.Snapshot()
+	return OpStats{Count: latency.Count, Failures: c.failures.Load(), Latency: latency}
+}
+
+// layerCounters holds the opCounters of every layer
+type layerCounters struct {
+	allocate [LayerCount]opCounters
+	free     [LayerCount]opCounters
+}
+
+// LayerStats returns the operation counts and latencies of each layer
+func (a *Allocator) LayerStats() LayerStats {
+	var stats LayerStats
+	for layer := range LayerCount {
+		stats.Allocate[layer] = a.ops.allocate[layer].stats()
+		stats.Free[layer] = a.ops.free[layer].stats()
+	}
+	return stats
+}
+
+// SlabCounts returns the number of slabs of each size class
+func (a *Allocator) SlabCounts() map[uint64]int {
+	a.slab.mutex.RLock()
+	defer a.slab.mutex.RUnlock()
+
+	counts := make(map[uint64]int, len(a.slab.counts))
+	for size, count := range a.slab.counts {
+		counts[size] = count
+	}
+	return counts
+}
+
+// BlockSize returns the size of the buddy blocks of order
+func BlockSize(order int) uint64 {
+	return getBlockSize(order)
+}
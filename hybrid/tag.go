@@ -0,0 +1,190 @@
+package hybrid
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tag identifies the owner of an allocation
+type Tag uint32
+
+// NoTag is recorded for allocations made without an explicit tag
+const NoTag Tag = 0
+
+const (
+	tagModeOff uint32 = iota
+	tagModeOn
+	tagModeStacks
+)
+
+const maxStackDepth = 32
+
+// allocRecord is kept next to each allocation while tagging is enabled
+type allocRecord struct {
+	size  uint64
+	tag   Tag
+	at    int64 // allocation time in unix nanoseconds
+	stack []uintptr
+}
+
+// TaggedAllocation describes a live allocation in a leak report
+type TaggedAllocation struct {
+	Start       uint64
+	Size        uint64
+	AllocatedAt time.Time
+}
+
+// LeakGroup aggregates suspected leaks sharing a tag and allocation stack
+type LeakGroup struct {
+	Tag         Tag
+	Stack       string // empty unless stacks are captured
+	Count       int
+	Bytes       uint64
+	Allocations []TaggedAllocation // oldest first
+}
+
+// EnableTagging starts recording an owner tag and allocation time for every
+// new allocation. With captureStacks the allocating call stack is kept too,
+// which is considerably more expensive. Allocations made before tagging was
+// enabled are not tracked.
+func (a *Allocator) EnableTagging(captureStacks bool) {
+	if captureStacks {
+		a.tagging.Store(tagModeStacks)
+	} else {
+		a.tagging.Store(tagModeOn)
+	}
+}
+
+// DisableTagging stops recording owners for new allocations
+func (a *Allocator) DisableTagging() {
+	a.tagging.Store(tagModeOff)
+}
+
+// AllocateTagged allocates memory of specified size on behalf of tag
+func (a *Allocator) AllocateTagged(size uint64, tag Tag) (uint64, error) {
+	return a.allocateWith(context.Background(), size, AllocOptions{Tag: tag})
+}
+
+// newRecord builds the owner record for an allocation, nil while tagging is off
+func (a *Allocator) newRecord(size uint64, tag Tag) *allocRecord {
+	mode := a.tagging.Load()
+	if mode == tagModeOff {
+		return nil
+	}
+
+	rec := &allocRecord{
+		size: size,
+		tag:  tag,
+		at:   time.Now().UnixNano(),
+	}
+	if mode == tagModeStacks {
+		pcs := make([]uintptr, maxStackDepth)
+		// Skip runtime.Callers, newRecord, allocateWith and the exported
+		// method that called it, so the stack starts at the user's frame
+		n := runtime.Callers(4, pcs)
+		rec.stack = pcs[:n]
+	}
+	return rec
+}
+
+// forEachRecord calls fn for every tracked allocation in the slab and buddy layers
+func (a *Allocator) forEachRecord(fn func(start uint64, rec *allocRecord)) {
+	a.slab.mutex.RLock()
+	for _, slab := range a.slab.slabs {
+		for start, rec := range slab.owners {
+			fn(start, rec)
+		}
+	}
+	a.slab.mutex.RUnlock()
+
+	a.buddy.mutex.RLock()
+	for start, rec := range a.buddy.owners {
+		fn(start, rec)
+	}
+	a.buddy.mutex.RUnlock()
+}
+
+// GetLiveBytesByTag returns the number of allocated bytes held by each tag
+func (a *Allocator) GetLiveBytesByTag() map[Tag]uint64 {
+	live := make(map[Tag]uint64)
+	a.forEachRecord(func(start uint64, rec *allocRecord) {
+		live[rec.tag] += rec.size
+	})
+	return live
+}
+
+// LeakReport lists allocations older than olderThan grouped by tag and,
+// when stacks are captured, by allocation stack. Groups holding the most
+// bytes come first.
+func (a *Allocator) LeakReport(olderThan time.Duration) []LeakGroup {
+	cutoff := time.Now().Add(-olderThan).UnixNano()
+
+	type groupKey struct {
+		tag   Tag
+		stack string
+	}
+	groups := make(map[groupKey]*LeakGroup)
+	a.forEachRecord(func(start uint64, rec *allocRecord) {
+		if rec.at > cutoff {
+			return
+		}
+		key := groupKey{tag: rec.tag, stack: stackKey(rec.stack)}
+		group, exists := groups[key]
+		if !exists {
+			group = &LeakGroup{Tag: key.tag, Stack: formatStack(rec.stack)}
+			groups[key] = group
+		}
+		group.Count++
+		group.Bytes += rec.size
+		group.Allocations = append(group.Allocations, TaggedAllocation{
+			Start:       start,
+			Size:        rec.size,
+			AllocatedAt: time.Unix(0, rec.at),
+		})
+	})
+
+	report := make([]LeakGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Slice(group.Allocations, func(i, j int) bool {
+			return group.Allocations[i].AllocatedAt.Before(group.Allocations[j].AllocatedAt)
+		})
+		report = append(report, *group)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Tag < report[j].Tag
+	})
+	return report
+}
+
+// stackKey turns captured program counters into a comparable map key
+func stackKey(pcs []uintptr) string {
+	var sb strings.Builder
+	for _, pc := range pcs {
+		fmt.Fprintf(&sb, "%x,", pc)
+	}
+	return sb.String()
+}
+
+// formatStack renders captured program counters one frame per line
+func formatStack(pcs []uintptr) string {
+	if len(pcs) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&sb, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
@@ -2,7 +2,10 @@
 package hybrid
 
 import (
+	"hybridAllocator/trace"
+	"hybridAllocator/workload"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -11,6 +14,8 @@ const (
 	SlabMaxSize    = 1024 * 1024               // 1MB
 	MaxOrder       = 20                        // Maximum order value, supports up to 1TB
 
+	// EnableTrackAllocatedBlocks panics on allocations and frees that do not
+	// match the allocated blocks instead of failing them
 	EnableTrackAllocatedBlocks = 0
 )
 
@@ -23,6 +28,7 @@ type Slab struct {
 	allocated map[uint64]uint64 // start -> size
 	freeList  []uint64
 	fromBuddy bool
+	owners    map[uint64]*allocRecord // start -> owner, only kept while tagging
 }
 
 // Block represents a memory block
@@ -37,9 +43,18 @@ type Block struct {
 
 // Allocator is the main hybrid combining buddy and slab systems
 type Allocator struct {
-	buddy *BuddyAllocator
-	slab  *SlabAllocator
-	mutex sync.RWMutex
+	buddy      *BuddyAllocator
+	slab       *SlabAllocator
+	mutex      sync.RWMutex
+	reserves   map[Priority]uint64 // space held back for each priority class
+	reserved   atomic.Uint64       // sum of all reserves
+	watermarks atomic.Pointer[Watermarks]
+	belowLow   bool              // free space dropped under the low watermark
+	tagging    atomic.Uint32     // tagMode
+	refs       map[uint64]uint32 // start -> extra references of shared extents
+	ops        layerCounters     // operation counts and latencies per layer
+	tracer     trace.Hook
+	recorder   workload.Hook
 }
 
 // SlabAllocator represents the slab allocator
@@ -49,6 +64,7 @@ type SlabAllocator struct {
 	mutex  sync.RWMutex
 	cache  map[uint64][]*Slab
 	counts map[uint64]int
+	free   uint64 // unused bytes across all slabs
 }
 
 // BuddyAllocator represents the buddy system allocator
@@ -56,10 +72,12 @@ type BuddyAllocator struct {
 	blocks    [MaxOrder + 1]*Block            // MaxOrder + 1 = 21, head of linked list for each order
 	blockMap  [MaxOrder + 1]map[uint64]*Block // Maps block start address to block pointer
 	mutex     sync.RWMutex
-	allocated map[uint64]*Block // track allocated blocks
+	allocated map[uint64]*Block       // start -> allocated block
+	owners    map[uint64]*allocRecord // start -> owner, only kept while tagging
 	used      uint64
 	startAddr uint64
 	endAddr   uint64
+	maxOrder  int        // order of the whole managed range
 	blockPool *sync.Pool // Pool for Block objects
 }
 
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/workload"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runFsck loads an allocator metadata snapshot, as served by the HTTP API
+// under /v1/snapshot, and checks its consistency
+func runFsck(args []string) error {
+	fs := newFlagSet("fsck", "snapshot")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	allocator, err := hybrid.LoadMetadata(file)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return errFailed
+	}
+	defer allocator.Close()
+
+	frag := allocator.Fragmentation()
+	var freeBlocks int
+	for _, n := range frag.FreeBlocks {
+		freeBlocks += n
+	}
+	fmt.Printf("%s: %s of %s used, %d free blocks, %d slabs\n", path,
+		formatBytes(allocator.GetUsedSize()), formatBytes(allocator.GetTotalSize()), freeBlocks, frag.Slabs)
+
+	err = allocator.Check()
+	if err == nil {
+		fmt.Printf("%s: clean\n", path)
+		return nil
+	}
+	problems := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		problems = joined.Unwrap()
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s: %v\n", path, problem)
+	}
+	fmt.Printf("%s: %d problems\n", path, len(problems))
+	return errFailed
+}
+
+// runDump prints the extents of an allocator metadata snapshot or the
+// records of a workload log, whichever the file holds
+func runDump(args []string) error {
+	fs := newFlagSet("dump", "snapshot|workload.log")
+	output := addOutputFlags(fs)
+	fs.Parse(args)
+	if err := output.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	allocator, metadataErr := hybrid.LoadMetadata(file)
+	var reader *workload.Reader
+	if metadataErr != nil {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var logErr error
+		if reader, logErr = workload.NewReader(file); logErr != nil {
+			return fmt.Errorf("%s is neither an allocator snapshot (%v) nor a workload log (%v)", path, metadataErr, logErr)
+		}
+	}
+
+	w, closeOutput, err := output.create()
+	if err != nil {
+		return err
+	}
+	var dumper tableWriter
+	switch *output.format {
+	case "json":
+		dumper = &jsonTable{w: w}
+	case "csv":
+		dumper = &csvTable{w: csv.NewWriter(w)}
+	default:
+		dumper = &textTable{ew: &errWriter{w: w}}
+	}
+	if allocator != nil {
+		defer allocator.Close()
+		err = dumpExtents(dumper, allocator)
+	} else {
+		err = dumpRecords(dumper, reader)
+	}
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func dumpExtents(t tableWriter, allocator *hybrid.Allocator) error {
+	t.header("start", "size", "state")
+	for _, e := range allocator.Extents() {
+		t.row(map[string]any{"start": e.Start, "size": e.Size, "state": e.State.String()},
+			fmt.Sprintf("%#x", e.Start), strconv.FormatUint(e.Size, 10), e.State.String())
+	}
+	return t.close()
+}
+
+func dumpRecords(t tableWriter, reader *workload.Reader) error {
+	t.header("time", "op", "client", "size", "addr", "failed")
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.close()
+			return err
+		}
+		t.row(map[string]any{
+			"time": rec.Time, "op": rec.Op.String(), "client": rec.Client,
+			"size": rec.Size, "addr": rec.Addr, "failed": rec.Failed,
+		},
+			rec.Time.Format(time.RFC3339Nano), rec.Op.String(), strconv.FormatUint(uint64(rec.Client), 10),
+			strconv.FormatUint(rec.Size, 10), fmt.Sprintf("%#x", rec.Addr), strconv.FormatBool(rec.Failed))
+	}
+	return t.close()
+}
+
+// tableWriter writes the rows dump prints, as JSON objects or as columns
+// of text
+type tableWriter interface {
+	header(columns ...string)
+	row(object map[string]any, columns ...string)
+	close() error
+}
+
+// textTable writes tab separated columns
+type textTable struct {
+	ew *errWriter
+}
+
+func (t *textTable) header(columns ...string) { t.row(nil, columns...) }
+
+func (t *textTable) row(object map[string]any, columns ...string) {
+	for i, column := range columns {
+		if i > 0 {
+			t.ew.printf("\t")
+		}
+		t.ew.printf("%s", column)
+	}
+	t.ew.printf("\n")
+}
+
+func (t *textTable) close() error { return t.ew.err }
+
+type csvTable struct {
+	w *csv.Writer
+}
+
+func (t *csvTable) header(columns ...string)                     { t.w.Write(columns) }
+func (t *csvTable) row(object map[string]any, columns ...string) { t.w.Write(columns) }
+
+func (t *csvTable) close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// jsonTable streams a JSON array of objects, so that large logs are not
+// held in memory
+type jsonTable struct {
+	w    io.Writer
+	rows int
+	err  error
+}
+
+func (t *jsonTable) header(columns ...string) {}
+
+func (t *jsonTable) row(object map[string]any, columns ...string) {
+	if t.err != nil {
+		return
+	}
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.err = err
+		return
+	}
+	prefix := ",\n  "
+	if t.rows == 0 {
+		prefix = "[\n  "
+	}
+	t.rows++
+	_, t.err = fmt.Fprintf(t.w, "%s%s", prefix, data)
+}
+
+func (t *jsonTable) close() error {
+	if t.err != nil {
+		return t.err
+	}
+	end := "\n]\n"
+	if t.rows == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(t.w, end)
+	return err
+}
@@ -1,18 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"hybridAllocator/hybrid"
-	"hybridAllocator/mpool"
-	"hybridAllocator/rpc"
+	"hybridAllocator/workload"
+	"io"
 	"log"
-	"math/rand"
 	"os"
 	"runtime"
 	"runtime/pprof"
-	"strings"
-	"sync"
 	"time"
 )
 
@@ -22,377 +19,252 @@ const (
 	MB = 1024 * 1024
 	KB = 1024
 
-	MinBlockSize  = 4 * KB // 4KB
-	MaxBlockSize  = 4 * MB // 4MB
-	TestIteration = 2
-
 	ServerAddress = "localhost:1234"
+	HTTPAddress   = "localhost:8080"
+	GRPCAddress   = "localhost:9090"
 )
 
-// TestResult stores test iteration results
-type TestResult struct {
-	Iteration     int
-	TotalWrites   uint64
-	TotalFrees    uint64
-	MaxUsage      float64
-	FinalUsage    float64
-	MemoryUsage   uint64
-	TotalDuration time.Duration
+// command is a subcommand, parsing its own flags from args
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
 }
 
-type StressTest struct {
-	allocator  *hybrid.Allocator
-	pool       *mpool.MemoryPool
-	blocks     []Block
-	blockCount int
-	mu         sync.Mutex
+var commands = []command{
+	{"bench", "run a generated workload directly or over RPC transports", runBench},
+	{"stress", "fill and drain the allocator until a target amount is written", runStress},
+	{"replay", "replay a recorded workload log against a fresh allocator", runReplay},
+	{"serve", "serve the allocator over net/rpc, HTTP and gRPC", runServe},
+	{"fsck", "check the consistency of an allocator metadata snapshot", runFsck},
+	{"dump", "print an allocator metadata snapshot or a workload log", runDump},
+	{"compare", "compare two result files and flag regressions", runCompare},
+	{"sim", "simulate clients deterministically and shrink failing seeds", runSimulate},
 }
 
-func NewStressTest() *StressTest {
-	allocator := hybrid.NewAllocator()
-	mp, _ := mpool.NewMemoryPool(allocator)
-	return &StressTest{
-		allocator:  allocator,
-		pool:       mp,
-		blocks:     make([]Block, 1000000),
-		blockCount: 0,
+// errFailed makes a command exit with status 1 after reporting on its own,
+// as fsck does for inconsistent snapshots, compare for regressions and sim
+// for broken invariants
+var errFailed = errors.New("failed")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
 }
 
-func (st *StressTest) runStressTest(targetSize uint64) {
-	log.Printf("Starting stress test with target size: %d TB", targetSize/(1024*1024*1024*1024))
-
-	startTime := time.Now()
-	totalWritten := uint64(0)
-	iteration := 0
-
-	for totalWritten < targetSize {
-		now := time.Now()
-		iteration++
-		log.Printf("Iteration %d: Starting allocation phase", iteration)
-		used := uint64(0)
-		for {
-			size := generateRandomSize()
-			start, err := st.allocator.Allocate(size)
-			if err != nil {
-				if strings.Contains(err.Error(), "no space available") {
-					break
-				}
-				panic(fmt.Sprintf("Failed to Allocate. err: %v", err))
-			}
-			st.blocks[st.blockCount] = Block{start: start, size: size}
-			st.blockCount++
-			totalWritten += size
-		}
-		used = st.allocator.GetUsedSize()
-		usage := float64(used) / float64(st.allocator.GetTotalSize()) * 100
-		log.Printf("start delete  usage: %.5f%%\n", usage)
-		printFun := func() {
-			var m runtime.MemStats
-			runtime.ReadMemStats(&m)
-			duration := time.Since(now)
-			log.Printf("Iteration %d completed:", iteration)
-			log.Printf("  Total written: %d TB", totalWritten/(1024*1024*1024*1024))
-			log.Printf("  usage: %.5f%%\n", usage)
-			log.Printf("  Current memory usage: %d MB", m.Alloc/1024/1024)
-			log.Printf("  Duration: %v", duration)
-			log.Printf("  Average write speed: %.2f MB/s", float64(totalWritten)/time.Since(startTime).Seconds()/1024/1024)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
 		}
-		if totalWritten > targetSize {
-			printFun()
-			break
+		err := c.run(os.Args[2:])
+		if errors.Is(err, errFailed) {
+			os.Exit(1)
 		}
-		releaseRatio := 0.3 + rand.Float64()*0.2 // 30%-50%
-
-		releaseCount := int(float64(st.blockCount) * releaseRatio)
-		for j := 0; j < releaseCount; j++ {
-			if st.blockCount == 0 {
-				return
-			}
-			idx := rand.Intn(st.blockCount)
-			block := st.blocks[idx]
-			st.blocks[idx] = st.blocks[st.blockCount-1]
-			st.blockCount--
-			st.allocator.Free(block.start, block.size)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
 		}
-		printFun()
+		return
 	}
-	log.Printf("  Total Duration: %v", time.Since(startTime))
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
 }
 
-func p2roundup(x uint64, align uint64) uint64 {
-	return -(-x & -align)
+// newFlagSet returns the flag set of a command, printing usage that names
+// its positional arguments
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
 }
 
-func generateRandomSize() uint64 {
-	maxBlocks := MaxBlockSize / 512
-	numBlocks := uint64(rand.Intn(maxBlocks)) + 1
-	return p2roundup(numBlocks*512, 4096)
+// profileFlags are the profiling flags of the benchmark commands. Profiles
+// are only written when asked for.
+type profileFlags struct {
+	cpu *string
+	mem *string
 }
 
-// Block represents an allocated memory block
-type Block struct {
-	start uint64
-	size  uint64
+func addProfileFlags(fs *flag.FlagSet) profileFlags {
+	return profileFlags{
+		cpu: fs.String("cpuprofile", "", "Write a CPU profile to this file"),
+		mem: fs.String("memprofile", "", "Write a heap profile to this file when done"),
+	}
 }
 
-func runTest(iteration int) TestResult {
-	var allocator *hybrid.Allocator
-	var memoryPool *mpool.MemoryPool
-	var err error
-
-	var Allocate func(uint64) (uint64, error)
-	var Free func(uint64, uint64) error
-	var GetUsedSize func() uint64
-	var GetMemoryUsage func() uint64
-
-	if iteration == 0 {
-		allocator = hybrid.NewAllocator()
-		memoryPool, err = mpool.NewMemoryPool(allocator)
-		Allocate = memoryPool.Allocate
-		Free = memoryPool.Free
-		GetUsedSize = allocator.GetUsedSize
-		GetMemoryUsage = allocator.GetMemoryUsage
-		defer memoryPool.Close()
-		defer allocator.Close()
-	} else {
-		server, err := rpc.NewServer()
+// start starts the CPU profile and returns a function finishing both
+// profiles
+func (p profileFlags) start() (func(), error) {
+	var cpuFile *os.File
+	if *p.cpu != "" {
+		file, err := os.Create(*p.cpu)
 		if err != nil {
-			log.Fatalf("Failed to create server: %v", err)
+			return nil, fmt.Errorf("could not create CPU profile: %w", err)
 		}
-		defer server.Close()
-
-		go func() {
-			if err := server.Start(ServerAddress); err != nil {
-				log.Printf("Server error: %v", err)
-			}
-		}()
-
-		time.Sleep(time.Second)
-
-		client, err := rpc.NewClient(1, ServerAddress)
-		if err != nil {
-			log.Fatalf("Failed to create client: %v", err)
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not start CPU profile: %w", err)
 		}
-		defer client.Close()
-
-		Allocate = client.Allocate
-		Free = client.Free
-		GetUsedSize = server.GetUsedSize
-		GetMemoryUsage = server.GetMemoryUsage
-	}
-
-	if err != nil {
-		log.Fatalf("Failed to create memory pool: %v", err)
+		cpuFile = file
 	}
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+		if *p.mem == "" {
+			return
+		}
+		file, err := os.Create(*p.mem)
+		if err != nil {
+			log.Printf("Could not create memory profile: %v", err)
+			return
+		}
+		defer file.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(file); err != nil {
+			log.Printf("Could not write memory profile: %v", err)
+		}
+	}, nil
+}
 
-	const maxBlocks = 1000000
-	blocks := make([]Block, maxBlocks)
-	blockCount := 0
-	diskSize := allocator.GetTotalSize()
-
-	var totalWritten, totalAllocated uint64
-	var writeCount, deleteCount int
-	var printThreshold uint64 = 10 * GB
-	var mutex sync.Mutex
-	var wg sync.WaitGroup
-
-	startTime := time.Now()
-	ops := 0
-	maxOps := 2000000
-	startPrint := time.Now()
-	// Start multiple goroutines for concurrent operations
-	for i := 0; i < 32; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				mutex.Lock()
-				if ops >= maxOps {
-					mutex.Unlock()
-					return
-				}
-				ops++
-				mutex.Unlock()
-
-				// Randomly decide whether to allocate or free
-				if rand.Float64() < 0.7 { // 70% chance to allocate
-					size := generateRandomSize()
-					start, err := Allocate(size)
-					if err == nil {
-						mutex.Lock()
-						//found := false
-						//for i := 0; i < blockCount; i++ {
-						//	if blocks[i].start == start {
-						//		found = true
-						//		break
-						//	}
-						//}
-						//if found {
-						//	panic(fmt.Sprintf("invalid address start: %v, size: %d", start, size))
-						//}
-
-						blocks[blockCount] = Block{start: start, size: size}
-						blockCount++
-						totalWritten += size
-						totalAllocated += size
-						writeCount++
-						if totalAllocated >= printThreshold {
-							used := GetUsedSize()
-							use := float64(used) / float64(diskSize) * 100
-							elapsed := time.Since(startPrint)
-							fmt.Printf(
-								"%d MB allocated, cumulative writes: %d, cumulative frees: %d, "+
-									"Duration: %v, Space usage: %.5f%%\n",
-								totalAllocated/MB,
-								writeCount,
-								deleteCount,
-								elapsed.Round(time.Millisecond),
-								use)
-
-							printThreshold += 10 * GB
-							startPrint = time.Now()
-						}
-						mutex.Unlock()
-					} else {
-						mutex.Lock()
-						used := GetUsedSize()
-						use := float64(used) / float64(diskSize) * 100
-						if use > 90 {
-							mutex.Unlock()
-							return
-						}
-						mutex.Unlock()
-					}
-				} else { // 30% chance to free
-					mutex.Lock()
-					if blockCount == 0 {
-						mutex.Unlock()
-						continue
-					}
-					idx := rand.Intn(blockCount)
-					block := blocks[idx]
-					blocks[idx] = blocks[blockCount-1]
-					blockCount--
-					mutex.Unlock()
+// outputFlags select how the benchmark commands write their results
+type outputFlags struct {
+	format *string
+	path   *string
+}
 
-					err := Free(block.start, block.size)
-					if err != nil {
-						panic(fmt.Sprintf("Failed to free memory: %v", err))
-					}
-					deleteCount++
-					totalAllocated -= block.size
-				}
-			}
-		}()
+func addOutputFlags(fs *flag.FlagSet) outputFlags {
+	return outputFlags{
+		format: fs.String("format", "text", "Result format: text, json or csv"),
+		path:   fs.String("o", "", "Write the results to this file instead of stdout"),
 	}
+}
 
-	wg.Wait()
-	duration := time.Since(startTime)
-
-	used := GetUsedSize()
-	use := float64(used) / float64(diskSize) * 100
-	memoryUsage := GetMemoryUsage()
-
-	return TestResult{
-		Iteration:     iteration,
-		TotalWrites:   uint64(writeCount),
-		TotalFrees:    uint64(deleteCount),
-		MaxUsage:      use,
-		FinalUsage:    use,
-		MemoryUsage:   memoryUsage,
-		TotalDuration: duration,
+func (o outputFlags) validate() error {
+	switch *o.format {
+	case "text", "json", "csv":
+		return nil
 	}
+	return fmt.Errorf("unknown format %q, expected text, json or csv", *o.format)
 }
 
-func main() {
-	testMode := flag.String("mode", "basic", "Test mode: basic, stress10t, stress100t")
-	flag.Parse()
-
-	rand.Seed(time.Now().UnixNano())
-
-	cpuProfile, err := os.Create("cpu.prof")
-	if err != nil {
-		log.Fatal("could not create CPU profile: ", err)
+// create opens the output, the returned function closes it
+func (o outputFlags) create() (io.Writer, func() error, error) {
+	if *o.path == "" {
+		return os.Stdout, func() error { return nil }, nil
 	}
-	defer cpuProfile.Close()
-
-	if err := pprof.StartCPUProfile(cpuProfile); err != nil {
-		log.Fatal("could not start CPU profile: ", err)
+	file, err := os.Create(*o.path)
+	if err != nil {
+		return nil, nil, err
 	}
-	defer pprof.StopCPUProfile()
+	return file, file.Close, nil
+}
 
-	memProfile, err := os.Create("mem.prof")
+// write writes results in the selected format
+func (o outputFlags) write(results *Results) error {
+	w, closeOutput, err := o.create()
 	if err != nil {
-		log.Fatal("could not create memory profile: ", err)
+		return err
 	}
-	defer memProfile.Close()
-
-	switch *testMode {
-	case "basic":
-		runBasicTest()
-	case "stress10t":
-		runStressTest10T()
-	case "stress100t":
-		runStressTest100T()
+	switch *o.format {
+	case "json":
+		err = results.WriteJSON(w)
+	case "csv":
+		err = results.WriteCSV(w)
 	default:
-		fmt.Printf("Unknown test mode: %s\n", *testMode)
-		fmt.Println("Available modes: basic, stress10t, stress100t")
-		os.Exit(1)
+		err = results.WriteText(w)
 	}
-
-	if err := pprof.WriteHeapProfile(memProfile); err != nil {
-		log.Fatal("could not write memory profile: ", err)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
 	}
+	return err
 }
 
-func runBasicTest() {
-	fmt.Printf("Starting basic disk allocation test with %d iterations\n", TestIteration)
-	fmt.Println("Min block size:", MinBlockSize/1024, "KB")
-	fmt.Println("Max block size:", MaxBlockSize/1024/1024, "MB")
-	fmt.Println()
-
-	var results []TestResult
-	for i := 0; i < TestIteration; i++ {
-		fmt.Printf("Running iteration %d...\n", i+1)
-		result := runTest(i)
-		results = append(results, result)
+// specFlags select the generated workload of a command
+type specFlags struct {
+	path *string
+	seed *int64
+}
 
-		fmt.Printf("Iteration %d results:\n", i+1)
-		fmt.Printf("  Total writes: %d\n", result.TotalWrites)
-		fmt.Printf("  Total frees: %d\n", result.TotalFrees)
-		fmt.Printf("  Max usage: %.5f%%\n", result.MaxUsage)
-		fmt.Printf("  Final usage: %.5f%%\n", result.FinalUsage)
-		fmt.Printf("  Memory usage: %d bytes\n", result.MemoryUsage)
-		fmt.Printf("  Duration: %v\n", result.TotalDuration)
-		fmt.Println()
+func addSpecFlags(fs *flag.FlagSet) specFlags {
+	return specFlags{
+		path: fs.String("spec", "", "JSON workload spec, the default workload if empty"),
+		seed: fs.Int64("seed", 0, "Seed of the workload, overriding the spec's, 0 picks one from the clock unless the spec sets it"),
 	}
+}
 
-	// Calculate averages
-	var avgUsage, avgMemory, avgDuration float64
-	for _, r := range results {
-		avgUsage += r.FinalUsage
-		avgMemory += float64(r.MemoryUsage)
-		avgDuration += r.TotalDuration.Seconds()
+// load reads the workload spec, or returns the default one, and settles
+// its seed
+func (s specFlags) load() (workload.Spec, error) {
+	spec := workload.DefaultSpec()
+	if *s.path != "" {
+		data, err := os.ReadFile(*s.path)
+		if err != nil {
+			return spec, err
+		}
+		if spec, err = workload.ParseSpec(data); err != nil {
+			return spec, err
+		}
 	}
-	avgUsage /= float64(len(results))
-	avgMemory /= float64(len(results))
-	avgDuration /= float64(len(results))
+	if *s.seed != 0 {
+		spec.Seed = *s.seed
+	}
+	if spec.Seed == 0 {
+		spec.Seed = time.Now().UnixNano()
+	}
+	return spec, nil
+}
 
-	fmt.Println("Average results:")
-	fmt.Printf("  Average usage: %.5f%%\n", avgUsage)
-	fmt.Printf("  Average memory usage: %.2f bytes\n", avgMemory)
-	fmt.Printf("  Average duration: %.2f seconds\n", avgDuration)
+// workloadRecording logs allocator operations to a file, its recorder is
+// nil unless recording was asked for
+type workloadRecording struct {
+	file   *os.File
+	writer *workload.Writer
 }
 
-func runStressTest10T() {
-	log.Println("Starting 10TB stress test...")
-	st := NewStressTest()
-	st.runStressTest(10 * TB)
+func startRecording(path string) (*workloadRecording, error) {
+	if path == "" {
+		return &workloadRecording{}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workload log: %w", err)
+	}
+	return &workloadRecording{file: file, writer: workload.NewWriter(file)}, nil
 }
 
-func runStressTest100T() {
-	log.Println("Starting 100TB stress test...")
-	st := NewStressTest()
-	st.runStressTest(100 * TB)
+// recorder returns the recorder to install, or nil
+func (r *workloadRecording) recorder() workload.Recorder {
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer
+}
+
+func (r *workloadRecording) stop() {
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Close(); err != nil {
+		log.Printf("Failed to write workload log: %v", err)
+	}
+	r.file.Close()
+	log.Printf("Recorded %d operations to %s", r.writer.Count(), r.file.Name())
 }
@@ -0,0 +1,227 @@
+// Package metrics provides lock-free latency histograms and a writer and
+// parser for the Prometheus text exposition format, without depending on
+// the Prometheus client library
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the type of a metric family
+type Type string
+
+const (
+	Counter   Type = "counter"
+	Gauge     Type = "gauge"
+	Histogram Type = "histogram"
+)
+
+const (
+	// firstBound is the upper bound of the first latency bucket
+	firstBound = time.Microsecond
+	// latencyBuckets is the number of finite buckets, each twice as wide as
+	// the previous one, the last one ends around one second
+	latencyBuckets = 21
+)
+
+// LatencyHistogram counts durations in exponential buckets from 1µs to about
+// 1s. The zero value is ready to use and every method is safe for concurrent
+// use without locking.
+type LatencyHistogram struct {
+	buckets [latencyBuckets + 1]atomic.Uint64 // the last one has no upper bound
+	count   atomic.Uint64
+	sum     atomic.Int64 // nanoseconds
+}
+
+// Observe records one duration
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	bucket := 0
+	for bound := firstBound; bucket < latencyBuckets && d > bound; bound *= 2 {
+		bucket++
+	}
+	h.buckets[bucket].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Since records the time elapsed since began
+func (h *LatencyHistogram) Since(began time.Time) {
+	h.Observe(time.Since(began))
+}
+
+// Snapshot returns the current counts. Concurrent observations may be
+// partially included.
+func (h *LatencyHistogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: make([]float64, latencyBuckets),
+		Counts: make([]uint64, latencyBuckets+1),
+		Count:  h.count.Load(),
+		Sum:    time.Duration(h.sum.Load()).Seconds(),
+	}
+	bound := firstBound
+	for i := range s.Bounds {
+		s.Bounds[i] = bound.Seconds()
+		bound *= 2
+	}
+	for i := range s.Counts {
+		s.Counts[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// HistogramSnapshot is a copy of a histogram. Counts has one more element
+// than Bounds, for the observations above the last bound. Bounds and Sum are
+// in seconds.
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// Add merges other into s, both must come from histograms with the same
+// bounds. Adding to an empty snapshot copies other.
+func (s *HistogramSnapshot) Add(other HistogramSnapshot) {
+	if s.Bounds == nil {
+		s.Bounds = append([]float64(nil), other.Bounds...)
+		s.Counts = make([]uint64, len(other.Counts))
+	}
+	for i, count := range other.Counts {
+		s.Counts[i] += count
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+}
+
+// Quantile estimates the q-quantile in seconds, assuming observations are
+// spread evenly within their bucket. It returns 0 without observations.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var seen float64
+	for i, count := range s.Counts {
+		if count == 0 || seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		if i == len(s.Bounds) {
+			return s.Bounds[len(s.Bounds)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.Bounds[i-1]
+		}
+		return lower + (s.Bounds[i]-lower)*(rank-seen)/float64(count)
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+// Label is a name and value pair distinguishing samples of a family
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Writer writes metric families in the Prometheus text exposition format.
+// The first write error is kept and returned by Flush.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter returns a writer to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family starts a metric family, its samples must follow before the next one
+func (w *Writer) Family(name string, typ Type, help string) {
+	w.write("# HELP ", name, " ", escapeHelp(help), "\n")
+	w.write("# TYPE ", name, " ", string(typ), "\n")
+}
+
+// Sample writes one sample of the current family
+func (w *Writer) Sample(name string, value float64, labels ...Label) {
+	w.write(name, formatLabels(labels), " ", formatValue(value), "\n")
+}
+
+// Histogram writes the buckets, sum and count of a histogram sample of the
+// current family
+func (w *Writer) Histogram(name string, s HistogramSnapshot, labels ...Label) {
+	var cumulative uint64
+	for i, count := range s.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(s.Bounds) {
+			le = formatValue(s.Bounds[i])
+		}
+		bucket := append(labels[:len(labels):len(labels)], Label{Name: "le", Value: le})
+		w.Sample(name+"_bucket", float64(cumulative), bucket...)
+	}
+	w.Sample(name+"_sum", s.Sum, labels...)
+	w.Sample(name+"_count", float64(s.Count), labels...)
+}
+
+// Flush writes out buffered data and returns the first error encountered
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) write(parts ...string) {
+	for _, part := range parts {
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(part)
+	}
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label.Name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(label.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
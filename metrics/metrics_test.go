@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 250; j++ {
+				h.Observe(time.Duration(j) * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+	h.Observe(time.Hour)
+
+	s := h.Snapshot()
+	if s.Count != 1001 || len(s.Counts) != len(s.Bounds)+1 {
+		t.Fatalf("Unexpected snapshot %+v", s)
+	}
+	if s.Counts[len(s.Counts)-1] != 1 {
+		t.Fatalf("Expected the hour in the overflow bucket, got %v", s.Counts)
+	}
+	// Durations up to 1µs land in the first bucket
+	if s.Counts[0] != 8 {
+		t.Fatalf("Expected 8 observations up to 1µs, got %d", s.Counts[0])
+	}
+	if median := s.Quantile(0.5); median < 64e-6 || median > 256e-6 {
+		t.Fatalf("Median %v out of range", median)
+	}
+
+	var merged HistogramSnapshot
+	merged.Add(s)
+	merged.Add(s)
+	if merged.Count != 2*s.Count || merged.Counts[0] != 2*s.Counts[0] || merged.Sum != 2*s.Sum {
+		t.Fatalf("Unexpected merge %+v", merged)
+	}
+}
+
+func TestWriteParse(t *testing.T) {
+	var h LatencyHistogram
+	h.Observe(3 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Family("requests_total", Counter, "Requests served\nby method")
+	w.Sample("requests_total", 3, Label{"method", "Allocate"})
+	w.Sample("requests_total", 1, Label{"method", `we"ird\`})
+	w.Family("ratio", Gauge, "A ratio")
+	w.Sample("ratio", math.NaN())
+	w.Sample("ratio", math.Inf(1), Label{"kind", "inf"})
+	w.Family("latency_seconds", Histogram, "Latency")
+	w.Histogram("latency_seconds", h.Snapshot(), Label{"method", "Allocate"})
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	families, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse failed: %v\n%s", err, buf.String())
+	}
+	requests := families["requests_total"]
+	if requests == nil || requests.Type != Counter || requests.Help != "Requests served\nby method" {
+		t.Fatalf("Unexpected family %+v", requests)
+	}
+	if sample, ok := requests.Find("requests_total", "method", `we"ird\`); !ok || sample.Value != 1 {
+		t.Fatalf("Escaped label lost: %+v", requests.Samples)
+	}
+	ratio := families["ratio"]
+	if !math.IsNaN(ratio.Samples[0].Value) || !math.IsInf(ratio.Samples[1].Value, 1) {
+		t.Fatalf("Special values lost: %+v", ratio.Samples)
+	}
+
+	latency := families["latency_seconds"]
+	count, _ := latency.Find("latency_seconds_count", "method", "Allocate")
+	inf, _ := latency.Find("latency_seconds_bucket", "le", "+Inf")
+	first, _ := latency.Find("latency_seconds_bucket", "le", "1e-06")
+	if count.Value != 2 || inf.Value != 2 || first.Value != 0 {
+		t.Fatalf("Unexpected histogram samples %+v", latency.Samples)
+	}
+	var previous float64
+	for _, sample := range latency.Samples {
+		if sample.Name != "latency_seconds_bucket" {
+			continue
+		}
+		if sample.Value < previous {
+			t.Fatalf("Buckets are not cumulative: %+v", latency.Samples)
+		}
+		previous = sample.Value
+	}
+
+	for _, invalid := range []string{
+		"orphan 1\n",
+		"# HELP a A\n# TYPE a counter\nb 1\n",
+		"# HELP a A\n# TYPE a gauge\na{x=\"1} 1\n",
+		"# HELP a A\n# TYPE a gauge\na one\n",
+		"# HELP a A\n# TYPE a summary\n",
+	} {
+		if _, err := Parse(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
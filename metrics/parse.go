@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Sample is a parsed sample
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Family is a parsed metric family with its samples in order
+type Family struct {
+	Name    string
+	Type    Type
+	Help    string
+	Samples []Sample
+}
+
+// Parse reads the Prometheus text exposition format and returns the
+// families by name. Every sample must belong to the family declared last,
+// histogram samples carrying the _bucket, _sum and _count suffixes.
+func Parse(r io.Reader) (map[string]*Family, error) {
+	families := make(map[string]*Family)
+	var current *Family
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		switch {
+		case strings.TrimSpace(text) == "":
+			continue
+		case strings.HasPrefix(text, "# HELP "):
+			name, help, _ := strings.Cut(strings.TrimPrefix(text, "# HELP "), " ")
+			if _, exists := families[name]; exists {
+				return nil, fmt.Errorf("line %d: family %s declared twice", line, name)
+			}
+			current = &Family{Name: name, Help: unescape(help)}
+			families[name] = current
+		case strings.HasPrefix(text, "# TYPE "):
+			name, typ, _ := strings.Cut(strings.TrimPrefix(text, "# TYPE "), " ")
+			if current == nil || current.Name != name {
+				return nil, fmt.Errorf("line %d: type of %s without help", line, name)
+			}
+			switch Type(typ) {
+			case Counter, Gauge, Histogram:
+				current.Type = Type(typ)
+			default:
+				return nil, fmt.Errorf("line %d: unknown type %q", line, typ)
+			}
+		case strings.HasPrefix(text, "#"):
+			continue
+		default:
+			sample, err := parseSample(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			if current == nil || !current.owns(sample.Name) {
+				return nil, fmt.Errorf("line %d: sample %s outside its family", line, sample.Name)
+			}
+			current.Samples = append(current.Samples, sample)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// owns reports whether a sample name belongs to the family
+func (f *Family) owns(name string) bool {
+	if name == f.Name {
+		return f.Type != Histogram
+	}
+	if f.Type != Histogram {
+		return false
+	}
+	suffix, found := strings.CutPrefix(name, f.Name)
+	return found && (suffix == "_bucket" || suffix == "_sum" || suffix == "_count")
+}
+
+// Find returns the first sample of the family named name whose labels
+// include every label given, in name, value pairs
+func (f *Family) Find(name string, labels ...string) (Sample, bool) {
+	for _, sample := range f.Samples {
+		if sample.Name != name {
+			continue
+		}
+		match := true
+		for i := 0; i+1 < len(labels); i += 2 {
+			if sample.Labels[labels[i]] != labels[i+1] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return sample, true
+		}
+	}
+	return Sample{}, false
+}
+
+func parseSample(text string) (Sample, error) {
+	sample := Sample{Labels: make(map[string]string)}
+	rest := text
+	if i := strings.IndexAny(rest, "{ "); i < 0 {
+		return sample, fmt.Errorf("sample without value: %q", text)
+	} else {
+		sample.Name, rest = rest[:i], rest[i:]
+	}
+	if !validName(sample.Name) {
+		return sample, fmt.Errorf("invalid metric name %q", sample.Name)
+	}
+
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			name, value, found := strings.Cut(rest, `="`)
+			if !found || !validName(name) {
+				return sample, fmt.Errorf("invalid label in %q", text)
+			}
+			value, tail, err := cutLabelValue(value)
+			if err != nil {
+				return sample, fmt.Errorf("%v in %q", err, text)
+			}
+			sample.Labels[name] = value
+			rest = strings.TrimPrefix(tail, ",")
+			if rest == "" {
+				return sample, fmt.Errorf("unterminated labels in %q", text)
+			}
+		}
+		rest = rest[1:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return sample, fmt.Errorf("invalid value in %q", text)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("invalid value in %q: %v", text, err)
+	}
+	sample.Value = value
+	return sample, nil
+}
+
+// cutLabelValue splits an escaped label value from the text following its
+// closing quote
+func cutLabelValue(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", "", fmt.Errorf("unterminated escape")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case '\\', '"':
+				b.WriteByte(s[i])
+			default:
+				return "", "", fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated label value")
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(s)
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		letter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,10 +1,16 @@
 package mpool
 
 import (
+	"context"
 	"fmt"
 	"hybridAllocator/hybrid"
+	"hybridAllocator/metrics"
+	"hybridAllocator/trace"
+	"hybridAllocator/workload"
 	"math/rand"
+	"os"
 	"sync"
+	"time"
 )
 
 const (
@@ -18,12 +24,28 @@ const (
 
 // PoolStats represents memory pool statistics
 type PoolStats struct {
-	TotalAllocations uint64
-	PoolHits         uint64
-	PoolMisses       uint64
-	TotalFrees       uint64
-	PoolFreeHits     uint64
-	PoolFreeMisses   uint64
+	TotalAllocations uint64 `json:"total_allocations"`
+	PoolHits         uint64 `json:"pool_hits"`
+	PoolMisses       uint64 `json:"pool_misses"`
+	TotalFrees       uint64 `json:"total_frees"`
+	PoolFreeHits     uint64 `json:"pool_free_hits"`
+	PoolFreeMisses   uint64 `json:"pool_free_misses"`
+}
+
+// HitRate returns the fraction of allocations served from the pool
+func (s PoolStats) HitRate() float64 {
+	if s.TotalAllocations == 0 {
+		return 0
+	}
+	return float64(s.PoolHits) / float64(s.TotalAllocations)
+}
+
+// FreeHitRate returns the fraction of frees returned to the pool
+func (s PoolStats) FreeHitRate() float64 {
+	if s.TotalFrees == 0 {
+		return 0
+	}
+	return float64(s.PoolFreeHits) / float64(s.TotalFrees)
 }
 
 // MemoryPool represents a memory pool structure
@@ -40,10 +62,25 @@ type MemoryPool struct {
 	mu           sync.Mutex
 	allocator    *hybrid.Allocator
 	stats        PoolStats
+	hitLatency   metrics.LatencyHistogram // allocations served from the pool
+	freeLatency  metrics.LatencyHistogram // frees returned to the pool
+	tracer       trace.Hook
+	recorder     workload.Hook
 }
 
 // NewMemoryPool creates a new memory pool
 func NewMemoryPool(allocator *hybrid.Allocator) (*MemoryPool, error) {
+	return NewMemoryPoolWithRand(allocator, nil)
+}
+
+// NewMemoryPoolWithRand creates a memory pool drawing the sizes of its
+// pre-allocated blocks from rng, so that pools created with the same seed
+// hand out the same blocks. A nil rng uses the global source.
+func NewMemoryPoolWithRand(allocator *hybrid.Allocator, rng *rand.Rand) (*MemoryPool, error) {
+	intn := rand.Intn
+	if rng != nil {
+		intn = rng.Intn
+	}
 	pool := &MemoryPool{
 		smallBlocks:  make([]uint64, SmallPoolSize),
 		mediumBlocks: make([]uint64, MediumPoolSize),
@@ -58,7 +95,7 @@ func NewMemoryPool(allocator *hybrid.Allocator) (*MemoryPool, error) {
 	}
 	// Pre-allocate small memory blocks (4KB-64KB)
 	for i := 0; i < SmallPoolSize; i++ {
-		size := uint64(rand.Intn(60*KB) + 4*KB) // 4KB-64KB
+		size := uint64(intn(60*KB) + 4*KB) // 4KB-64KB
 		addr, err := allocator.Allocate(size)
 		if err != nil {
 			return nil, fmt.Errorf("failed to pre-allocate small memory block: %v", err)
@@ -69,7 +106,7 @@ func NewMemoryPool(allocator *hybrid.Allocator) (*MemoryPool, error) {
 
 	// Pre-allocate medium memory blocks (64KB-1MB)
 	for i := 0; i < MediumPoolSize; i++ {
-		size := uint64(rand.Intn(936*KB) + 64*KB) // 64KB-1MB
+		size := uint64(intn(936*KB) + 64*KB) // 64KB-1MB
 		addr, err := allocator.Allocate(size)
 		if err != nil {
 			return nil, fmt.Errorf("failed to pre-allocate medium memory block: %v", err)
@@ -80,7 +117,7 @@ func NewMemoryPool(allocator *hybrid.Allocator) (*MemoryPool, error) {
 
 	// Pre-allocate large memory blocks (1MB-4MB)
 	for i := 0; i < LargePoolSize; i++ {
-		size := uint64(rand.Intn(3*MB) + 1*MB) // 1MB-4MB
+		size := uint64(intn(3*MB) + 1*MB) // 1MB-4MB
 		addr, err := allocator.Allocate(size)
 		if err != nil {
 			return nil, fmt.Errorf("failed to pre-allocate large memory block: %v", err)
@@ -94,6 +131,21 @@ func NewMemoryPool(allocator *hybrid.Allocator) (*MemoryPool, error) {
 
 // Allocate allocates memory from the memory pool
 func (p *MemoryPool) Allocate(size uint64) (uint64, error) {
+	return p.AllocateContext(context.Background(), size)
+}
+
+// AllocateContext allocates memory from the memory pool, tracing the
+// allocation as a child of the span carried by ctx. Misses are traced by
+// the allocator as children of the pool span.
+func (p *MemoryPool) AllocateContext(ctx context.Context, size uint64) (start uint64, err error) {
+	ctx, span := trace.Start(ctx, p.tracer.Get(), "mpool.Allocate", trace.Uint("size", size))
+	began := time.Now()
+	hit := false
+	defer func() {
+		span.End(trace.Bool("hit", hit), trace.Uint("start", start), trace.Error(err))
+		p.record(workload.Allocate, began, size, start, err)
+	}()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -107,6 +159,8 @@ func (p *MemoryPool) Allocate(size uint64) (uint64, error) {
 			if !p.smallUsed[i] && p.smallSizes[i] >= size {
 				p.smallUsed[i] = true
 				p.stats.PoolHits++
+				p.hitLatency.Since(began)
+				hit = true
 				return p.smallBlocks[i], nil
 			}
 		}
@@ -116,6 +170,8 @@ func (p *MemoryPool) Allocate(size uint64) (uint64, error) {
 			if !p.mediumUsed[i] && p.mediumSizes[i] >= size {
 				p.mediumUsed[i] = true
 				p.stats.PoolHits++
+				p.hitLatency.Since(began)
+				hit = true
 				return p.mediumBlocks[i], nil
 			}
 		}
@@ -125,6 +181,8 @@ func (p *MemoryPool) Allocate(size uint64) (uint64, error) {
 			if !p.largeUsed[i] && p.largeSizes[i] >= size {
 				p.largeUsed[i] = true
 				p.stats.PoolHits++
+				p.hitLatency.Since(began)
+				hit = true
 				return p.largeBlocks[i], nil
 			}
 		}
@@ -132,11 +190,26 @@ func (p *MemoryPool) Allocate(size uint64) (uint64, error) {
 
 	p.stats.PoolMisses++
 	// If no suitable free block found, allocate directly from allocator
-	return p.allocator.Allocate(size)
+	return p.allocator.AllocateContext(ctx, size)
 }
 
 // Free releases memory back to the memory pool
 func (p *MemoryPool) Free(addr uint64, size uint64) error {
+	return p.FreeContext(context.Background(), addr, size)
+}
+
+// FreeContext releases memory back to the memory pool, tracing the free as
+// a child of the span carried by ctx. Freeing a pool block that is not
+// handed out fails with hybrid.ErrAddressNotAllocated.
+func (p *MemoryPool) FreeContext(ctx context.Context, addr uint64, size uint64) (err error) {
+	ctx, span := trace.Start(ctx, p.tracer.Get(), "mpool.Free", trace.Uint("start", addr), trace.Uint("size", size))
+	began := time.Now()
+	hit := false
+	defer func() {
+		span.End(trace.Bool("hit", hit), trace.Error(err))
+		p.record(workload.Free, began, size, addr, err)
+	}()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.stats.TotalFrees++
@@ -146,24 +219,39 @@ func (p *MemoryPool) Free(addr uint64, size uint64) error {
 	case size <= 64*KB:
 		for i := range p.smallBlocks {
 			if p.smallBlocks[i] == addr {
+				if !p.smallUsed[i] {
+					return hybrid.ErrAddressNotAllocated
+				}
 				p.smallUsed[i] = false
 				p.stats.PoolFreeHits++
+				p.freeLatency.Since(began)
+				hit = true
 				return nil
 			}
 		}
 	case size <= 1*MB:
 		for i := range p.mediumBlocks {
 			if p.mediumBlocks[i] == addr {
+				if !p.mediumUsed[i] {
+					return hybrid.ErrAddressNotAllocated
+				}
 				p.mediumUsed[i] = false
 				p.stats.PoolFreeHits++
+				p.freeLatency.Since(began)
+				hit = true
 				return nil
 			}
 		}
 	case size <= 4*MB:
 		for i := range p.largeBlocks {
 			if p.largeBlocks[i] == addr {
+				if !p.largeUsed[i] {
+					return hybrid.ErrAddressNotAllocated
+				}
 				p.largeUsed[i] = false
 				p.stats.PoolFreeHits++
+				p.freeLatency.Since(began)
+				hit = true
 				return nil
 			}
 		}
@@ -171,7 +259,70 @@ func (p *MemoryPool) Free(addr uint64, size uint64) error {
 
 	p.stats.PoolFreeMisses++
 	// If block not found in pool, free directly through allocator
-	return p.allocator.Free(addr, size)
+	return p.allocator.FreeContext(ctx, addr, size)
+}
+
+// IsAllocated reports whether addr is handed out with the given size, either
+// as a pool block or by the underlying allocator
+func (p *MemoryPool) IsAllocated(addr uint64, size uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Find corresponding pool the same way Free does
+	switch {
+	case size <= 64*KB:
+		for i := range p.smallBlocks {
+			if p.smallBlocks[i] == addr {
+				return p.smallUsed[i] && size <= p.smallSizes[i]
+			}
+		}
+	case size <= 1*MB:
+		for i := range p.mediumBlocks {
+			if p.mediumBlocks[i] == addr {
+				return p.mediumUsed[i] && size <= p.mediumSizes[i]
+			}
+		}
+	case size <= 4*MB:
+		for i := range p.largeBlocks {
+			if p.largeBlocks[i] == addr {
+				return p.largeUsed[i] && size <= p.largeSizes[i]
+			}
+		}
+	}
+
+	return p.allocator.IsAllocated(addr, size)
+}
+
+// Stats returns a copy of the pool statistics
+func (p *MemoryPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// SetTracer installs a tracer receiving the spans of allocations and frees,
+// telling whether the pool served them. nil turns tracing off.
+func (p *MemoryPool) SetTracer(t trace.Tracer) {
+	p.tracer.Set(t)
+}
+
+// SetRecorder installs a recorder receiving every allocation and free made
+// through the pool, whether it served them or not. nil stops recording.
+func (p *MemoryPool) SetRecorder(r workload.Recorder) {
+	p.recorder.Set(r)
+}
+
+// record reports a completed operation to the recorder, if any
+func (p *MemoryPool) record(op workload.Op, began time.Time, size, start uint64, err error) {
+	if r := p.recorder.Get(); r != nil {
+		r.Record(workload.Record{Op: op, Time: began, Size: size, Addr: start, Failed: err != nil})
+	}
+}
+
+// HitLatency returns how long allocations served from the pool took, and
+// frees returned to it. Misses are timed by the allocator.
+func (p *MemoryPool) HitLatency() (allocate, free metrics.HistogramSnapshot) {
+	return p.hitLatency.Snapshot(), p.freeLatency.Snapshot()
 }
 
 // Close closes the memory pool and releases all pre-allocated memory
@@ -199,14 +350,14 @@ func (p *MemoryPool) Close() error {
 		}
 	}
 
-	// Print statistics
-	fmt.Printf("\nMemory Pool Statistics:\n")
-	fmt.Printf("Total Allocations: %d\n", p.stats.TotalAllocations)
-	fmt.Printf("Pool Hits: %d (%.2f%%)\n", p.stats.PoolHits, float64(p.stats.PoolHits)/float64(p.stats.TotalAllocations)*100)
-	fmt.Printf("Pool Misses: %d (%.2f%%)\n", p.stats.PoolMisses, float64(p.stats.PoolMisses)/float64(p.stats.TotalAllocations)*100)
-	fmt.Printf("Total Frees: %d\n", p.stats.TotalFrees)
-	fmt.Printf("Pool Free Hits: %d (%.2f%%)\n", p.stats.PoolFreeHits, float64(p.stats.PoolFreeHits)/float64(p.stats.TotalFrees)*100)
-	fmt.Printf("Pool Free Misses: %d (%.2f%%)\n", p.stats.PoolFreeMisses, float64(p.stats.PoolFreeMisses)/float64(p.stats.TotalFrees)*100)
+	// Print statistics to stderr, stdout may carry machine-readable results
+	fmt.Fprintf(os.Stderr, "\nMemory Pool Statistics:\n")
+	fmt.Fprintf(os.Stderr, "Total Allocations: %d\n", p.stats.TotalAllocations)
+	fmt.Fprintf(os.Stderr, "Pool Hits: %d (%.2f%%)\n", p.stats.PoolHits, float64(p.stats.PoolHits)/float64(p.stats.TotalAllocations)*100)
+	fmt.Fprintf(os.Stderr, "Pool Misses: %d (%.2f%%)\n", p.stats.PoolMisses, float64(p.stats.PoolMisses)/float64(p.stats.TotalAllocations)*100)
+	fmt.Fprintf(os.Stderr, "Total Frees: %d\n", p.stats.TotalFrees)
+	fmt.Fprintf(os.Stderr, "Pool Free Hits: %d (%.2f%%)\n", p.stats.PoolFreeHits, float64(p.stats.PoolFreeHits)/float64(p.stats.TotalFrees)*100)
+	fmt.Fprintf(os.Stderr, "Pool Free Misses: %d (%.2f%%)\n", p.stats.PoolFreeMisses, float64(p.stats.PoolFreeMisses)/float64(p.stats.TotalFrees)*100)
 
 	return nil
 }
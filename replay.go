@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/workload"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runReplay replays a workload log against a fresh allocator and reports
+// how it went
+func runReplay(args []string) error {
+	fs := newFlagSet("replay", "workload.log")
+	speed := fs.Float64("speed", 0, "Replay speed relative to the recording, 0 replays as fast as possible")
+	output := addOutputFlags(fs)
+	profiles := addProfileFlags(fs)
+	fs.Parse(args)
+	if err := output.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open workload log: %w", err)
+	}
+	defer file.Close()
+	reader, err := workload.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read workload log: %w", err)
+	}
+	stopProfiles, err := profiles.start()
+	if err != nil {
+		return err
+	}
+	defer stopProfiles()
+
+	allocator := hybrid.NewAllocator()
+	defer allocator.Close()
+	log.Printf("Replaying %s, recorded at %v", path, reader.Start().Format(time.RFC3339))
+	// A log that breaks off still gets the report of what was replayed, but
+	// the run fails so comparisons do not take it for a complete one
+	report, replayErr := workload.Replay(reader, allocator, workload.ReplayOptions{Speed: *speed})
+	if replayErr != nil {
+		replayErr = fmt.Errorf("replay stopped early: %w", replayErr)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	result := newRunResult(name, "", 0, report)
+	result.Name = "replay/" + name
+	result.MemoryOverheadBytes = allocator.GetMemoryUsage()
+	frag := allocator.Fragmentation()
+	result.setFragmentation(frag)
+	if *output.format != "text" {
+		results := newResults("replay")
+		results.Runs = append(results.Runs, result)
+		if err := output.write(results); err != nil {
+			return err
+		}
+		return replayErr
+	}
+
+	// The report says more than the table, such as why operations failed
+	w, closeOutput, err := output.create()
+	if err != nil {
+		return err
+	}
+	report.WriteText(w)
+	fmt.Fprintf(w, "\nFragmentation: external %.5f, internal %.5f, largest free block %d MB, %d slabs\n",
+		frag.External, frag.Internal, frag.LargestFreeBlock/MB, frag.Slabs)
+	if err := closeOutput(); err != nil {
+		return err
+	}
+	return replayErr
+}
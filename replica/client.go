@@ -0,0 +1,227 @@
+package replica
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hybridAllocator/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultAttemptTimeout bounds one attempt before the client tries
+	// another node
+	DefaultAttemptTimeout = time.Second
+	// DefaultRequestTimeout bounds calls made without a deadline
+	DefaultRequestTimeout = 10 * time.Second
+)
+
+// ErrInvalidSize is returned for zero-sized allocations
+var ErrInvalidSize = errors.New("size must be positive")
+
+// Client sends operations to the leader of a cluster, following it as
+// leadership moves, and reads statistics from any node
+type Client struct {
+	id       string
+	key      string // keys the deduplication of this instance's operations
+	network  Network
+	nodes    []string
+	requests atomic.Uint64
+
+	mu      sync.Mutex
+	leader  string // empty while unknown
+	suspect string // node that last failed to answer, its followers may still name it
+	next    int    // node tried next while the leader is unknown
+	reads   int    // node read from next
+	attempt time.Duration
+}
+
+// NewClient returns a client of the cluster made of nodes. id names the
+// client on network. Retried operations are deduplicated under a random key
+// of this instance, so a restarted client reusing id never gets the results
+// of its previous run.
+func NewClient(id string, network Network, nodes []string) *Client {
+	return &Client{
+		id:      id,
+		key:     newClientKey(id),
+		network: network,
+		nodes:   append([]string(nil), nodes...),
+		attempt: DefaultAttemptTimeout,
+	}
+}
+
+// newClientKey returns a deduplication key unique to one client instance
+func newClientKey(id string) string {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(fmt.Sprintf("failed to generate client key: %v", err))
+	}
+	return id + "/" + hex.EncodeToString(suffix)
+}
+
+// SetAttemptTimeout changes how long the client waits for a node before
+// trying another one
+func (c *Client) SetAttemptTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempt = timeout
+}
+
+// Leader returns the node the client believes to be the leader
+func (c *Client) Leader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+// Allocate allocates through the leader
+func (c *Client) Allocate(size uint64) (uint64, error) {
+	return c.AllocateContext(context.Background(), size)
+}
+
+// AllocateContext allocates through the leader. Retries after a failover
+// never allocate twice.
+func (c *Client) AllocateContext(ctx context.Context, size uint64) (uint64, error) {
+	if size == 0 {
+		return 0, ErrInvalidSize
+	}
+	resp, err := c.submit(ctx, Op{Kind: OpAllocate, Size: size})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Start, nil
+}
+
+// Free frees through the leader
+func (c *Client) Free(start, size uint64) error {
+	return c.FreeContext(context.Background(), start, size)
+}
+
+// FreeContext frees through the leader. Retries after a failover never free
+// twice.
+func (c *Client) FreeContext(ctx context.Context, start, size uint64) error {
+	if size == 0 {
+		return ErrInvalidSize
+	}
+	_, err := c.submit(ctx, Op{Kind: OpFree, Start: start, Size: size})
+	return err
+}
+
+// submit sends op to the leader until it is applied, moving on to the next
+// node when the current one is unreachable or not the leader
+func (c *Client) submit(ctx context.Context, op Op) (*SubmitResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+	op.ClientID, op.RequestID = c.key, c.requests.Add(1)
+	req := &SubmitRequest{Op: op}
+
+	for {
+		target, timeout := c.target()
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		reply, err := c.network.Call(attemptCtx, c.id, target, req)
+		cancel()
+
+		hint, answered := "", err == nil
+		if answered {
+			resp := reply.(*SubmitResponse)
+			if !resp.NotLeader {
+				c.follow(target)
+				if resp.Code != rpc.CodeOK || resp.Error != "" {
+					return nil, &rpc.ServerError{Code: resp.Code, Message: resp.Error}
+				}
+				return resp, nil
+			}
+			hint = resp.Leader
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !c.redirect(target, hint, answered) {
+			// Nobody knows the leader, give the election time to finish
+			timer := time.NewTimer(timeout / 10)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// target returns the node to send the next operation to
+func (c *Client) target() (string, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader != "" {
+		return c.leader, c.attempt
+	}
+	return c.nodes[c.next], c.attempt
+}
+
+func (c *Client) follow(leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = leader
+	c.suspect = ""
+}
+
+// redirect moves on from a node that could not serve an operation, to the
+// leader it named if any. A leader that just failed to answer is not
+// trusted, followers cut off with it keep naming it. It reports whether the
+// client moved to a named leader.
+func (c *Client) redirect(failed, hint string, answered bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !answered {
+		c.suspect = failed
+	}
+	if hint != "" && hint != failed && hint != c.suspect {
+		c.leader = hint
+		return true
+	}
+	c.leader = ""
+	for i, node := range c.nodes {
+		if node == failed {
+			c.next = (i + 1) % len(c.nodes)
+		}
+	}
+	return false
+}
+
+// Stats reads the statistics of the first reachable node, rotating through
+// the nodes so reads are spread over the followers
+func (c *Client) Stats() (Stats, error) {
+	return c.StatsContext(context.Background())
+}
+
+// StatsContext is Stats with a context
+func (c *Client) StatsContext(ctx context.Context) (Stats, error) {
+	c.mu.Lock()
+	first, timeout := c.reads, c.attempt
+	c.reads = (c.reads + 1) % len(c.nodes)
+	c.mu.Unlock()
+
+	var err error
+	for i := range c.nodes {
+		target := c.nodes[(first+i)%len(c.nodes)]
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		var reply any
+		reply, err = c.network.Call(attemptCtx, c.id, target, &StatsRequest{})
+		cancel()
+		if err == nil {
+			return *reply.(*Stats), nil
+		}
+		if ctx.Err() != nil {
+			return Stats{}, ctx.Err()
+		}
+	}
+	return Stats{}, err
+}
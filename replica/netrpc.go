@@ -0,0 +1,142 @@
+package replica
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hybridAllocator/rpc"
+	"net"
+	netrpc "net/rpc"
+	"sync"
+)
+
+func init() {
+	// Messages travel inside an envelope, gob needs their concrete types
+	gob.Register(&VoteRequest{})
+	gob.Register(&VoteResponse{})
+	gob.Register(&AppendRequest{})
+	gob.Register(&AppendResponse{})
+	gob.Register(&SubmitRequest{})
+	gob.Register(&SubmitResponse{})
+	gob.Register(&StatsRequest{})
+	gob.Register(&Stats{})
+}
+
+// Envelope carries any message of the package over net/rpc
+type Envelope struct {
+	Msg any
+}
+
+// rpcService serves the calls of other nodes and clients to a node
+type rpcService struct {
+	node *Node
+}
+
+func (s *rpcService) Call(req *Envelope, resp *Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	defer cancel()
+	msg, err := s.node.handle(ctx, req.Msg)
+	resp.Msg = msg
+	return err
+}
+
+// ServeRPC serves node over net/rpc on listener until the listener is closed
+func ServeRPC(listener net.Listener, node *Node) error {
+	server := netrpc.NewServer()
+	if err := server.RegisterName("Replica", &rpcService{node: node}); err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// RPCNetwork reaches nodes served by ServeRPC over an rpc.Transport
+type RPCNetwork struct {
+	transport rpc.Transport
+	addresses map[string]string // node id -> address
+	mu        sync.Mutex
+	clients   map[string]*netrpc.Client
+}
+
+// NewRPCNetwork returns a network reaching each node id at its address
+func NewRPCNetwork(transport rpc.Transport, addresses map[string]string) *RPCNetwork {
+	return &RPCNetwork{
+		transport: transport,
+		addresses: addresses,
+		clients:   make(map[string]*netrpc.Client),
+	}
+}
+
+// client returns the connection to a node, dialing it if needed
+func (n *RPCNetwork) client(ctx context.Context, to string) (*netrpc.Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if client, exists := n.clients[to]; exists {
+		return client, nil
+	}
+	address, exists := n.addresses[to]
+	if !exists {
+		return nil, fmt.Errorf("unknown node %q", to)
+	}
+	conn, err := n.transport.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	client := netrpc.NewClient(conn)
+	n.clients[to] = client
+	return client, nil
+}
+
+// drop forgets a broken connection so the next call redials
+func (n *RPCNetwork) drop(to string, client *netrpc.Client) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.clients[to] == client {
+		delete(n.clients, to)
+		client.Close()
+	}
+}
+
+func (n *RPCNetwork) Call(ctx context.Context, from, to string, req any) (any, error) {
+	client, err := n.client(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Envelope{}
+	call := client.Go("Replica.Call", &Envelope{Msg: req}, resp, make(chan *netrpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var serverErr netrpc.ServerError
+	if call.Error != nil && !errors.As(call.Error, &serverErr) {
+		n.drop(to, client)
+	}
+	if call.Error != nil {
+		return nil, call.Error
+	}
+	return resp.Msg, nil
+}
+
+// Close closes every connection
+func (n *RPCNetwork) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for to, client := range n.clients {
+		client.Close()
+		delete(n.clients, to)
+	}
+	return nil
+}
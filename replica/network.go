@@ -0,0 +1,136 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned by SimNetwork for calls it drops
+var ErrUnreachable = errors.New("node unreachable")
+
+// Network delivers calls from a node or client to a node. Requests and
+// responses are pointers to the message types of this package.
+type Network interface {
+	Call(ctx context.Context, from, to string, req any) (any, error)
+}
+
+// SimNetwork connects nodes of the same process. It can partition them,
+// drop a share of the calls and add latency, so failures are reproducible
+// from its seed.
+type SimNetwork struct {
+	mu       sync.Mutex
+	nodes    map[string]*Node
+	group    map[string]int // partition of each node, clients reach every group
+	down     map[string]bool
+	rng      *rand.Rand
+	dropRate float64
+	latency  time.Duration
+}
+
+// NewSimNetwork returns a network without faults
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		nodes: make(map[string]*Node),
+		group: make(map[string]int),
+		down:  make(map[string]bool),
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Add makes node reachable by its id
+func (s *SimNetwork) Add(node *Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[node.ID()] = node
+}
+
+// Partition splits the nodes into groups that cannot reach each other.
+// Nodes not listed stay in the first group.
+func (s *SimNetwork) Partition(groups ...[]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			s.group[id] = i
+		}
+	}
+}
+
+// Disconnect cuts a node off from nodes and clients alike
+func (s *SimNetwork) Disconnect(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down[id] = true
+}
+
+// Connect undoes Disconnect
+func (s *SimNetwork) Connect(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.down, id)
+}
+
+// Heal removes every partition and disconnection
+func (s *SimNetwork) Heal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group = make(map[string]int)
+	s.down = make(map[string]bool)
+}
+
+// SetFaults drops calls with probability dropRate and delays the others by
+// latency
+func (s *SimNetwork) SetFaults(dropRate float64, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropRate = dropRate
+	s.latency = latency
+}
+
+// reachable reports whether a call from one endpoint to another gets through
+func (s *SimNetwork) reachable(from, to string) bool {
+	if s.down[from] || s.down[to] {
+		return false
+	}
+	_, fromNode := s.nodes[from]
+	_, toNode := s.nodes[to]
+	if fromNode && toNode && s.group[from] != s.group[to] {
+		return false
+	}
+	return s.dropRate == 0 || s.rng.Float64() >= s.dropRate
+}
+
+func (s *SimNetwork) Call(ctx context.Context, from, to string, req any) (any, error) {
+	s.mu.Lock()
+	node, exists := s.nodes[to]
+	ok := exists && s.reachable(from, to)
+	latency := s.latency
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnreachable
+	}
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	resp, err := node.handle(ctx, req)
+
+	// The response crosses the network too
+	s.mu.Lock()
+	ok = s.reachable(to, from)
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	return resp, err
+}
@@ -0,0 +1,624 @@
+// Package replica keeps several allocators identical by replicating a log of
+// Allocate and Free operations with Raft-style leader election. The leader
+// applies an operation once a majority stored it; every node applies the
+// same log to its own hybrid.Allocator and so hands out the same addresses.
+// The log and allocator live in memory only and the log is never compacted.
+//
+// Replication is a service of its own next to rpc.Server, not a mode of it:
+// nodes replicate a bare hybrid.Allocator without the pool, sessions,
+// leases, authentication, admission control or HTTP and gRPC front ends of
+// rpc.Server, and only Client follows the leader, rpc.Client does not.
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hybridAllocator/rpc"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultElectionTimeout is the minimum time a follower waits for the
+	// leader before starting an election, randomized up to twice as long
+	DefaultElectionTimeout = 300 * time.Millisecond
+	// DefaultHeartbeatInterval is how often the leader contacts its followers
+	DefaultHeartbeatInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrStopped is returned by calls to a stopped node
+	ErrStopped = errors.New("node stopped")
+	// errNotLeader fails the pending requests of a leader that stepped down
+	errNotLeader = errors.New("not the leader")
+)
+
+// Role is the Raft role of a node
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Config describes a node and the cluster it belongs to
+type Config struct {
+	ID                string
+	Peers             []string // ids of the other nodes
+	Network           Network
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	Seed              int64 // seeds the randomized election timeout
+}
+
+// VoteRequest asks for a vote in an election
+type VoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// VoteResponse answers a VoteRequest
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendRequest replicates log entries, or is a heartbeat when Entries is empty
+type AppendRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendResponse answers an AppendRequest. On a mismatch ConflictIndex is
+// where the leader should retry from.
+type AppendResponse struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+// SubmitRequest asks the leader to replicate and apply an operation
+type SubmitRequest struct {
+	Op Op
+}
+
+// SubmitResponse returns the result of an applied operation, or the leader
+// to retry with when NotLeader is set
+type SubmitResponse struct {
+	Start     uint64
+	NotLeader bool
+	Leader    string
+	Code      rpc.ErrorCode
+	Error     string
+}
+
+// StatsRequest asks a node for its view of the cluster and allocator
+type StatsRequest struct{}
+
+// Stats is the state of one node. Followers serve it from their own
+// allocator, which lags the leader by at most the unapplied entries.
+type Stats struct {
+	ID           string
+	Role         Role
+	Term         uint64
+	Leader       string
+	CommitIndex  uint64
+	AppliedIndex uint64
+	UsedSize     uint64
+	TotalSize    uint64
+}
+
+// waiter is a request waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	done chan result
+}
+
+// Node is one replica of the allocator
+type Node struct {
+	id                string
+	peers             []string
+	network           Network
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	rng               *rand.Rand
+
+	mu          sync.Mutex
+	role        Role
+	term        uint64
+	votedFor    string
+	leader      string
+	log         []Entry // log[0] is a sentinel so indexes start at 1
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool // peers with an AppendRequest outstanding
+	pending     map[string]bool // peers to contact again once it returns
+	deadline    time.Time       // election deadline of followers and candidates
+	heartbeat   time.Time       // next heartbeat of the leader
+	waiters     map[uint64]*waiter
+	state       *stateMachine
+	stopped     bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewNode creates a follower with an empty log and a fresh allocator. It
+// does nothing until Start.
+func NewNode(config Config) *Node {
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	return &Node{
+		id:                config.ID,
+		peers:             append([]string(nil), config.Peers...),
+		network:           config.Network,
+		electionTimeout:   config.ElectionTimeout,
+		heartbeatInterval: config.HeartbeatInterval,
+		rng:               rand.New(rand.NewSource(config.Seed)),
+		log:               make([]Entry, 1),
+		nextIndex:         make(map[string]uint64),
+		matchIndex:        make(map[string]uint64),
+		inflight:          make(map[string]bool),
+		pending:           make(map[string]bool),
+		waiters:           make(map[uint64]*waiter),
+		state:             newStateMachine(),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+}
+
+// ID returns the id of the node
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Start runs the election and heartbeat timers until Stop
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadlineLocked()
+	n.mu.Unlock()
+	go n.run()
+}
+
+// Stop halts the node, failing its pending requests. A stopped node does
+// not answer calls and cannot be restarted.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	n.failWaitersLocked(ErrStopped)
+	n.mu.Unlock()
+
+	close(n.stop)
+	<-n.done
+	n.state.allocator.Close()
+}
+
+func (n *Node) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(max(n.heartbeatInterval/5, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			n.tick(now)
+		}
+	}
+}
+
+// tick starts an election once the deadline passed, or sends heartbeats
+func (n *Node) tick(now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch {
+	case n.stopped:
+	case n.role == Leader && !now.Before(n.heartbeat):
+		n.broadcastLocked()
+	case n.role != Leader && !now.Before(n.deadline):
+		n.startElectionLocked()
+	}
+}
+
+func (n *Node) resetDeadlineLocked() {
+	jitter := time.Duration(n.rng.Int63n(int64(n.electionTimeout)))
+	n.deadline = time.Now().Add(n.electionTimeout + jitter)
+}
+
+func (n *Node) lastIndexLocked() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+// quorum is the number of nodes, including this one, that make a majority
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// becomeFollowerLocked steps down, adopting term if it is newer. The
+// election deadline of a follower is left alone, only a live leader or a
+// granted vote postpones it.
+func (n *Node) becomeFollowerLocked(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	if n.role == Leader {
+		n.failWaitersLocked(errNotLeader)
+		n.resetDeadlineLocked()
+	}
+	n.role = Follower
+	n.leader = leader
+}
+
+func (n *Node) startElectionLocked() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetDeadlineLocked()
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeaderLocked()
+		return
+	}
+	req := &VoteRequest{
+		Term:         n.term,
+		Candidate:    n.id,
+		LastLogIndex: n.lastIndexLocked(),
+		LastLogTerm:  n.log[n.lastIndexLocked()].Term,
+	}
+	for _, peer := range n.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+			defer cancel()
+			reply, err := n.network.Call(ctx, n.id, peer, req)
+			if err != nil {
+				return
+			}
+			resp := reply.(*VoteResponse)
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollowerLocked(resp.Term, "")
+				return
+			}
+			if n.role != Candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}()
+	}
+}
+
+// becomeLeaderLocked takes over the cluster. The no-op entry commits the
+// entries left over from earlier terms.
+func (n *Node) becomeLeaderLocked() {
+	n.role = Leader
+	n.leader = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndexLocked() + 1
+		n.matchIndex[peer] = 0
+	}
+	n.log = append(n.log, Entry{Term: n.term, Op: Op{Kind: OpNoop}})
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+}
+
+// broadcastLocked sends every follower its missing entries, or a heartbeat
+func (n *Node) broadcastLocked() {
+	n.heartbeat = time.Now().Add(n.heartbeatInterval)
+	for _, peer := range n.peers {
+		n.replicateLocked(peer)
+	}
+}
+
+// replicateLocked sends peer the entries from its next index, keeping at
+// most one request in flight per peer
+func (n *Node) replicateLocked(peer string) {
+	if n.inflight[peer] {
+		n.pending[peer] = true
+		return
+	}
+	n.inflight[peer] = true
+	n.pending[peer] = false
+
+	prev := n.nextIndex[peer] - 1
+	req := &AppendRequest{
+		Term:         n.term,
+		Leader:       n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log[prev].Term,
+		Entries:      append([]Entry(nil), n.log[prev+1:]...),
+		LeaderCommit: n.commitIndex,
+	}
+	go n.sendAppend(peer, req)
+}
+
+func (n *Node) sendAppend(peer string, req *AppendRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	reply, err := n.network.Call(ctx, n.id, peer, req)
+	cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[peer] = false
+	if n.stopped || n.role != Leader || n.term != req.Term {
+		return
+	}
+	if err != nil {
+		// Retried by the next heartbeat
+		return
+	}
+
+	resp := reply.(*AppendResponse)
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "")
+		return
+	}
+	if resp.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommitLocked()
+	} else {
+		next := n.nextIndex[peer] - 1
+		if resp.ConflictIndex > 0 {
+			next = min(next, resp.ConflictIndex)
+		}
+		n.nextIndex[peer] = max(next, 1)
+	}
+
+	if n.pending[peer] || n.nextIndex[peer] <= n.lastIndexLocked() {
+		n.replicateLocked(peer)
+	}
+}
+
+// advanceCommitLocked commits the highest entry of the current term stored
+// on a majority, along with everything before it
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if n.log[index].Term != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyLocked()
+			return
+		}
+	}
+}
+
+// applyLocked applies the committed entries and wakes their requests
+func (n *Node) applyLocked() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		entry := n.log[n.lastApplied]
+		r := n.state.apply(entry.Op)
+
+		w, exists := n.waiters[n.lastApplied]
+		if !exists {
+			continue
+		}
+		delete(n.waiters, n.lastApplied)
+		if w.term != entry.Term {
+			// Another leader overwrote the entry
+			r = result{err: errNotLeader}
+		}
+		w.done <- r
+	}
+}
+
+func (n *Node) failWaitersLocked(err error) {
+	for index, w := range n.waiters {
+		w.done <- result{err: err}
+		delete(n.waiters, index)
+	}
+}
+
+// handle serves a call delivered by the network
+func (n *Node) handle(ctx context.Context, msg any) (any, error) {
+	switch req := msg.(type) {
+	case *VoteRequest:
+		return n.requestVote(req)
+	case *AppendRequest:
+		return n.appendEntries(req)
+	case *SubmitRequest:
+		return n.submit(ctx, req)
+	case *StatsRequest:
+		stats, err := n.stats()
+		return &stats, err
+	}
+	return nil, fmt.Errorf("unexpected message %T", msg)
+}
+
+func (n *Node) requestVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil, ErrStopped
+	}
+
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term, "")
+	}
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp, nil
+	}
+
+	// Only vote for candidates whose log holds every committed entry
+	lastTerm := n.log[n.lastIndexLocked()].Term
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.lastIndexLocked()) {
+		return resp, nil
+	}
+	n.votedFor = req.Candidate
+	n.resetDeadlineLocked()
+	resp.Granted = true
+	return resp, nil
+}
+
+func (n *Node) appendEntries(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil, ErrStopped
+	}
+
+	if req.Term < n.term {
+		return &AppendResponse{Term: n.term}, nil
+	}
+	n.becomeFollowerLocked(req.Term, req.Leader)
+	n.resetDeadlineLocked()
+	resp := &AppendResponse{Term: n.term}
+
+	if req.PrevLogIndex > n.lastIndexLocked() {
+		resp.ConflictIndex = n.lastIndexLocked() + 1
+		return resp, nil
+	}
+	if term := n.log[req.PrevLogIndex].Term; term != req.PrevLogTerm {
+		// Skip back over the whole conflicting term
+		index := req.PrevLogIndex
+		for index > n.commitIndex+1 && n.log[index-1].Term == term {
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+
+	for i, entry := range req.Entries {
+		index := req.PrevLogIndex + 1 + uint64(i)
+		if index <= n.lastIndexLocked() {
+			if n.log[index].Term == entry.Term {
+				continue
+			}
+			n.log = n.log[:index]
+		}
+		n.log = append(n.log, req.Entries[i:]...)
+		break
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, req.PrevLogIndex+uint64(len(req.Entries)))
+		n.applyLocked()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// submit appends an operation on the leader and waits until it is applied
+func (n *Node) submit(ctx context.Context, req *SubmitRequest) (*SubmitResponse, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != Leader {
+		resp := &SubmitResponse{NotLeader: true, Leader: n.leader}
+		n.mu.Unlock()
+		return resp, nil
+	}
+	// A retry of an applied operation returns its original result
+	if r, ok := n.state.lookup(req.Op.ClientID, req.Op.RequestID); ok {
+		n.mu.Unlock()
+		return submitResponse(r), nil
+	}
+
+	n.log = append(n.log, Entry{Term: n.term, Op: req.Op})
+	w := &waiter{term: n.term, done: make(chan result, 1)}
+	n.waiters[n.lastIndexLocked()] = w
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	select {
+	case r := <-w.done:
+		if errors.Is(r.err, errNotLeader) {
+			return &SubmitResponse{NotLeader: true}, nil
+		}
+		if errors.Is(r.err, ErrStopped) {
+			return nil, ErrStopped
+		}
+		return submitResponse(r), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func submitResponse(r result) *SubmitResponse {
+	resp := &SubmitResponse{Start: r.start}
+	if r.err != nil {
+		resp.Code, resp.Error = rpc.CodeOf(r.err), r.err.Error()
+	}
+	return resp
+}
+
+func (n *Node) stats() (Stats, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return Stats{}, ErrStopped
+	}
+	return Stats{
+		ID:           n.id,
+		Role:         n.role,
+		Term:         n.term,
+		Leader:       n.leader,
+		CommitIndex:  n.commitIndex,
+		AppliedIndex: n.lastApplied,
+		UsedSize:     n.state.allocator.GetUsedSize(),
+		TotalSize:    n.state.allocator.GetTotalSize(),
+	}, nil
+}
+
+// Stats returns the local state of the node
+func (n *Node) Stats() Stats {
+	stats, _ := n.stats()
+	return stats
+}
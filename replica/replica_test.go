@@ -0,0 +1,371 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/rpc"
+	"testing"
+	"time"
+)
+
+const (
+	testElectionTimeout   = 50 * time.Millisecond
+	testHeartbeatInterval = 10 * time.Millisecond
+)
+
+// newCluster starts size nodes named n0, n1, ... on network
+func newCluster(t *testing.T, size int, network Network, add func(*Node)) []*Node {
+	t.Helper()
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("n%d", i)
+	}
+
+	nodes := make([]*Node, size)
+	for i, id := range ids {
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		nodes[i] = NewNode(Config{
+			ID:                id,
+			Peers:             peers,
+			Network:           network,
+			ElectionTimeout:   testElectionTimeout,
+			HeartbeatInterval: testHeartbeatInterval,
+			Seed:              int64(i + 1),
+		})
+		add(nodes[i])
+	}
+	for _, node := range nodes {
+		node.Start()
+		t.Cleanup(node.Stop)
+	}
+	return nodes
+}
+
+func nodeIDs(nodes []*Node) []string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID()
+	}
+	return ids
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// leader returns the leader among nodes, nil unless exactly one node of the
+// highest term leads
+func leader(nodes []*Node) *Node {
+	var found *Node
+	var term uint64
+	for _, node := range nodes {
+		stats := node.Stats()
+		if stats.Role != Leader {
+			continue
+		}
+		switch {
+		case found == nil || stats.Term > term:
+			found, term = node, stats.Term
+		case stats.Term == term:
+			return nil
+		}
+	}
+	return found
+}
+
+// waitConverged waits until every node applied the same entries and checks
+// that their allocators are identical
+func waitConverged(t *testing.T, nodes []*Node) {
+	t.Helper()
+	waitFor(t, "replicas to converge", func() bool {
+		first := nodes[0].Stats()
+		if first.AppliedIndex == 0 || first.AppliedIndex != first.CommitIndex {
+			return false
+		}
+		for _, node := range nodes[1:] {
+			if node.Stats().AppliedIndex != first.AppliedIndex {
+				return false
+			}
+		}
+		return true
+	})
+	for _, node := range nodes[1:] {
+		if diffs := hybrid.Diff(nodes[0].state.allocator, node.state.allocator); len(diffs) != 0 {
+			t.Fatalf("%s diverged from %s: %v", node.ID(), nodes[0].ID(), diffs[0])
+		}
+	}
+}
+
+func TestElection(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newCluster(t, 3, network, network.Add)
+
+	waitFor(t, "a leader", func() bool { return leader(nodes) != nil })
+	first := leader(nodes)
+
+	// Followers learn the leader from its heartbeats
+	waitFor(t, "followers to follow", func() bool {
+		for _, node := range nodes {
+			if node.Stats().Leader != first.ID() {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Isolating the leader makes the others elect a new one in a later term
+	network.Disconnect(first.ID())
+	var others []*Node
+	for _, node := range nodes {
+		if node != first {
+			others = append(others, node)
+		}
+	}
+	waitFor(t, "a new leader", func() bool { return leader(others) != nil })
+	second := leader(others)
+	if second.Stats().Term <= first.Stats().Term {
+		t.Fatalf("New leader has term %d, old one %d", second.Stats().Term, first.Stats().Term)
+	}
+
+	// The old leader steps down once it hears of the new term
+	network.Heal()
+	waitFor(t, "the old leader to step down", func() bool { return first.Stats().Role == Follower })
+}
+
+func TestReplication(t *testing.T) {
+	network := NewSimNetwork(2)
+	nodes := newCluster(t, 3, network, network.Add)
+	client := NewClient("client", network, nodeIDs(nodes))
+
+	sizes := []uint64{4096, 64 * 1024, hybrid.SlabMaxSize, 8 * 1024 * 1024, 256 * 1024 * 1024}
+	starts := make([]uint64, len(sizes))
+	for i, size := range sizes {
+		start, err := client.Allocate(size)
+		if err != nil {
+			t.Fatalf("Allocation of %d bytes failed: %v", size, err)
+		}
+		starts[i] = start
+	}
+	if err := client.Free(starts[1], sizes[1]); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if err := client.Free(starts[1], sizes[1]); !errors.Is(err, hybrid.ErrAddressNotAllocated) && !errors.Is(err, hybrid.ErrInvalidAddress) {
+		t.Fatalf("Expected a typed error freeing twice, got %v", err)
+	}
+	if _, err := client.Allocate(2 * hybrid.MaxBlockSize); !errors.Is(err, hybrid.ErrSizeTooLarge) {
+		t.Fatalf("Expected ErrSizeTooLarge, got %v", err)
+	}
+	waitConverged(t, nodes)
+
+	// Followers serve reads from their own replica
+	var used uint64
+	for i, size := range sizes {
+		if i != 1 {
+			used += size
+		}
+	}
+	for _, node := range nodes {
+		if stats := node.Stats(); stats.UsedSize != nodes[0].Stats().UsedSize {
+			t.Fatalf("%s reports %d bytes used, %s %d", node.ID(), stats.UsedSize, nodes[0].ID(), nodes[0].Stats().UsedSize)
+		}
+	}
+	for range nodes {
+		stats, err := client.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		if stats.UsedSize < used {
+			t.Fatalf("%s reports %d bytes used, expected at least %d", stats.ID, stats.UsedSize, used)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	network := NewSimNetwork(3)
+	nodes := newCluster(t, 5, network, network.Add)
+	client := NewClient("client", network, nodeIDs(nodes))
+	client.SetAttemptTimeout(200 * time.Millisecond)
+
+	live := make(map[uint64]uint64)
+	allocate := func(size uint64) {
+		t.Helper()
+		start, err := client.Allocate(size)
+		if err != nil {
+			t.Fatalf("Allocation failed: %v", err)
+		}
+		if _, exists := live[start]; exists {
+			t.Fatalf("Address %d handed out twice", start)
+		}
+		live[start] = size
+	}
+	for i := 0; i < 20; i++ {
+		allocate(uint64(i+1) * 4096)
+	}
+
+	// Cut the leader and one follower off in a minority, the client follows
+	// the majority's new leader
+	waitFor(t, "a leader", func() bool { return leader(nodes) != nil })
+	old := leader(nodes).ID()
+	minority := []string{old}
+	var majority []string
+	for _, id := range nodeIDs(nodes) {
+		if id != old && len(minority) < 2 {
+			minority = append(minority, id)
+		} else if id != old {
+			majority = append(majority, id)
+		}
+	}
+	network.Partition(majority, minority)
+	for i := 0; i < 20; i++ {
+		allocate(8 * 1024 * 1024)
+	}
+	if client.Leader() == old {
+		t.Fatalf("Client still talks to the deposed leader %s", old)
+	}
+
+	// Lossy links only slow things down, retries are applied once
+	network.Heal()
+	network.SetFaults(0.2, 0)
+	for start, size := range live {
+		if err := client.Free(start, size); err != nil {
+			t.Fatalf("Free over a lossy network failed: %v", err)
+		}
+		delete(live, start)
+		if len(live) == 10 {
+			break
+		}
+	}
+	network.SetFaults(0, 0)
+
+	// The minority catches up and every replica holds exactly the live extents
+	waitConverged(t, nodes)
+	var used uint64
+	for _, size := range live {
+		used += size
+	}
+	for _, node := range nodes {
+		if got := node.Stats().UsedSize; got < used {
+			t.Fatalf("%s reports %d bytes used, live extents hold %d", node.ID(), got, used)
+		}
+		for start, size := range live {
+			if !node.state.allocator.IsAllocated(start, size) {
+				t.Fatalf("%s lost the extent at %d", node.ID(), start)
+			}
+		}
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	network := NewSimNetwork(4)
+	nodes := newCluster(t, 3, network, network.Add)
+	waitFor(t, "a leader", func() bool { return leader(nodes) != nil })
+	lead := leader(nodes)
+
+	// A retried submission returns the original extent
+	req := &SubmitRequest{Op: Op{Kind: OpAllocate, Size: 8 * 1024 * 1024, ClientID: "c", RequestID: 1}}
+	first, err := lead.submit(context.Background(), req)
+	if err != nil || first.NotLeader {
+		t.Fatalf("Submit failed: %+v %v", first, err)
+	}
+	used := lead.Stats().UsedSize
+	retried, err := lead.submit(context.Background(), req)
+	if err != nil || retried.Start != first.Start {
+		t.Fatalf("Retry returned %+v instead of %+v: %v", retried, first, err)
+	}
+	if lead.Stats().UsedSize != used {
+		t.Fatalf("Retry was applied twice")
+	}
+
+	// Followers redirect to the leader
+	for _, node := range nodes {
+		if node == lead {
+			continue
+		}
+		waitFor(t, "followers to follow", func() bool { return node.Stats().Leader == lead.ID() })
+		resp, err := node.submit(context.Background(), req)
+		if err != nil || !resp.NotLeader || resp.Leader != lead.ID() {
+			t.Fatalf("Expected a redirect to %s, got %+v %v", lead.ID(), resp, err)
+		}
+	}
+}
+
+func TestClientExpiry(t *testing.T) {
+	// A restarted client reusing its id does not share the results of the
+	// previous instance
+	network := NewSimNetwork(5)
+	if a, b := NewClient("c", network, nil), NewClient("c", network, nil); a.key == b.key {
+		t.Fatalf("Expected distinct keys, both are %s", a.key)
+	}
+
+	state := newStateMachine()
+	defer state.allocator.Close()
+	op := Op{Kind: OpAllocate, Size: 4096, ClientID: "idle", RequestID: 1}
+	first := state.apply(op)
+	if first.err != nil {
+		t.Fatalf("Allocate failed: %v", first.err)
+	}
+	for i := uint64(0); i < clientIdleEntries; i++ {
+		state.apply(Op{Kind: OpNoop})
+	}
+	if _, ok := state.lookup("idle", 1); !ok {
+		t.Fatalf("Expected the results of a recent client to be kept")
+	}
+	for i := uint64(0); i < clientIdleEntries; i++ {
+		state.apply(Op{Kind: OpNoop})
+	}
+	if _, ok := state.lookup("idle", 1); ok {
+		t.Fatalf("Expected the results of an idle client to be dropped")
+	}
+	if len(state.clients) != 0 {
+		t.Fatalf("Expected no clients, got %d", len(state.clients))
+	}
+}
+
+func TestRPCNetwork(t *testing.T) {
+	addresses := map[string]string{
+		"n0": "TestRPCNetwork/n0",
+		"n1": "TestRPCNetwork/n1",
+		"n2": "TestRPCNetwork/n2",
+	}
+	network := NewRPCNetwork(rpc.InProcess, addresses)
+	defer network.Close()
+	nodes := newCluster(t, 3, network, func(node *Node) {
+		listener, err := rpc.InProcess.Listen(addresses[node.ID()])
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go ServeRPC(listener, node)
+	})
+
+	client := NewClient("client", network, nodeIDs(nodes))
+	start, err := client.Allocate(8 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	if err := client.Free(start, 8*1024*1024); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if _, err := client.Allocate(2 * hybrid.MaxBlockSize); !errors.Is(err, hybrid.ErrSizeTooLarge) {
+		t.Fatalf("Expected ErrSizeTooLarge over RPC, got %v", err)
+	}
+	waitConverged(t, nodes)
+	if _, err := client.Stats(); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package replica
+
+import "hybridAllocator/hybrid"
+
+const (
+	// requestWindow is how many results are kept per client for deduplication
+	requestWindow = 1024
+	// clientIdleEntries is how many log entries a client may go without
+	// submitting before its results are dropped. It is counted in entries
+	// rather than time so that every node drops the same clients.
+	clientIdleEntries = 1 << 16
+)
+
+// OpKind identifies a replicated operation
+type OpKind uint8
+
+const (
+	// OpNoop is appended by a new leader to commit the entries of earlier terms
+	OpNoop OpKind = iota
+	OpAllocate
+	OpFree
+)
+
+// Op is an allocator operation in the replicated log. ClientID and
+// RequestID identify retries so they are applied once.
+type Op struct {
+	Kind      OpKind
+	Size      uint64
+	Start     uint64
+	ClientID  string
+	RequestID uint64
+}
+
+// Entry is a log entry and the term it was created in
+type Entry struct {
+	Term uint64
+	Op   Op
+}
+
+// result is the outcome of applying an operation
+type result struct {
+	start uint64
+	err   error
+}
+
+// clientResults holds the recent results of one client, oldest first
+type clientResults struct {
+	results map[uint64]result
+	order   []uint64
+	last    uint64 // entry the client last submitted
+}
+
+// stateMachine applies committed operations to an allocator. The hybrid
+// allocator is deterministic, so every node applying the same log ends up
+// with the same allocations at the same addresses.
+type stateMachine struct {
+	allocator *hybrid.Allocator
+	clients   map[string]*clientResults
+	applied   uint64 // entries applied so far
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		allocator: hybrid.NewAllocator(),
+		clients:   make(map[string]*clientResults),
+	}
+}
+
+// lookup returns the result of a request applied before
+func (s *stateMachine) lookup(client string, id uint64) (result, bool) {
+	log, exists := s.clients[client]
+	if !exists {
+		return result{}, false
+	}
+	r, exists := log.results[id]
+	return r, exists
+}
+
+func (s *stateMachine) remember(client string, id uint64, r result) {
+	log, exists := s.clients[client]
+	if !exists {
+		log = &clientResults{results: make(map[uint64]result)}
+		s.clients[client] = log
+	}
+	log.last = s.applied
+	log.results[id] = r
+	log.order = append(log.order, id)
+	if len(log.order) > requestWindow {
+		delete(log.results, log.order[0])
+		log.order = log.order[1:]
+	}
+}
+
+// expireIdle drops the results of clients that submitted nothing in the
+// last clientIdleEntries entries
+func (s *stateMachine) expireIdle() {
+	for client, log := range s.clients {
+		if s.applied-log.last > clientIdleEntries {
+			delete(s.clients, client)
+		}
+	}
+}
+
+// apply performs op unless it is a retry of an operation applied before
+func (s *stateMachine) apply(op Op) result {
+	s.applied++
+	if s.applied%clientIdleEntries == 0 {
+		s.expireIdle()
+	}
+	if op.Kind == OpNoop {
+		return result{}
+	}
+	if r, ok := s.lookup(op.ClientID, op.RequestID); ok {
+		return r
+	}
+
+	var r result
+	switch op.Kind {
+	case OpAllocate:
+		r.start, r.err = s.allocator.Allocate(op.Size)
+	case OpFree:
+		r.start, r.err = op.Start, s.allocator.Free(op.Start, op.Size)
+	}
+	s.remember(op.ClientID, op.RequestID, r)
+	return r
+}
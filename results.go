@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/metrics"
+	"hybridAllocator/workload"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Results are what bench, stress and replay write, and what compare reads
+// back from JSON
+type Results struct {
+	Command   string      `json:"command"`
+	Started   time.Time   `json:"started"`
+	GoVersion string      `json:"go_version"`
+	Platform  string      `json:"platform"`
+	CPUs      int         `json:"cpus"`
+	Runs      []RunResult `json:"runs"`
+}
+
+// RunResult is the outcome of one run. Name identifies the run across
+// result files, such as "default/tcp" for the default workload over TCP.
+type RunResult struct {
+	Name      string `json:"name"`
+	Workload  string `json:"workload"`
+	Transport string `json:"transport,omitempty"`
+	Seed      int64  `json:"seed,omitempty"`
+
+	Allocations        int     `json:"allocations"`
+	AllocationFailures int     `json:"allocation_failures"`
+	Frees              int     `json:"frees"`
+	FreeFailures       int     `json:"free_failures"`
+	DurationSeconds    float64 `json:"duration_seconds"`
+	OpsPerSecond       float64 `json:"ops_per_second"`
+	WrittenBytes       uint64  `json:"written_bytes,omitempty"`
+	WriteBytesPerSec   float64 `json:"write_bytes_per_second,omitempty"`
+
+	AllocateLatency Latency `json:"allocate_latency"`
+	FreeLatency     Latency `json:"free_latency"`
+
+	Utilization     float64 `json:"utilization"`
+	PeakUtilization float64 `json:"peak_utilization"`
+	LiveBytes       uint64  `json:"live_bytes"`
+	PeakLiveBytes   uint64  `json:"peak_live_bytes"`
+	TotalBytes      uint64  `json:"total_bytes"`
+
+	// MemoryOverheadBytes is the memory the allocator uses for its own
+	// bookkeeping
+	MemoryOverheadBytes   uint64  `json:"memory_overhead_bytes"`
+	ExternalFragmentation float64 `json:"external_fragmentation"`
+	InternalFragmentation float64 `json:"internal_fragmentation"`
+	Timeline              []Point `json:"timeline,omitempty"`
+}
+
+// Latency holds the percentiles of an operation's latency in microseconds
+type Latency struct {
+	P50  float64 `json:"p50_us"`
+	P90  float64 `json:"p90_us"`
+	P99  float64 `json:"p99_us"`
+	P999 float64 `json:"p999_us"`
+}
+
+// Point is the state of a run at one point in time
+type Point struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Ops            int64   `json:"ops"`
+	Utilization    float64 `json:"utilization"`
+	LiveBytes      uint64  `json:"live_bytes"`
+}
+
+func newResults(command string) *Results {
+	return &Results{
+		Command:   command,
+		Started:   time.Now().UTC().Truncate(time.Second),
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		CPUs:      runtime.NumCPU(),
+	}
+}
+
+func newLatency(h metrics.HistogramSnapshot) Latency {
+	us := func(q float64) float64 { return h.Quantile(q) * 1e6 }
+	return Latency{P50: us(0.5), P90: us(0.9), P99: us(0.99), P999: us(0.999)}
+}
+
+// newRunResult summarizes the report of a generated or replayed workload
+func newRunResult(workloadName, transport string, seed int64, report workload.Report) RunResult {
+	name := workloadName
+	if transport != "" {
+		name += "/" + transport
+	}
+	r := RunResult{
+		Name:               name,
+		Workload:           workloadName,
+		Transport:          transport,
+		Seed:               seed,
+		Allocations:        report.Allocate.Count,
+		AllocationFailures: report.Allocate.Failures,
+		Frees:              report.Free.Count,
+		FreeFailures:       report.Free.Failures,
+		DurationSeconds:    report.Duration.Seconds(),
+		AllocateLatency:    newLatency(report.Allocate.Latency),
+		FreeLatency:        newLatency(report.Free.Latency),
+		Utilization:        report.Utilization(),
+		PeakUtilization:    report.PeakUtilization(),
+		LiveBytes:          report.LiveBytes,
+		PeakLiveBytes:      report.PeakLiveBytes,
+		TotalBytes:         report.TotalBytes,
+	}
+	if report.Duration > 0 {
+		r.OpsPerSecond = float64(r.Allocations+r.Frees) / report.Duration.Seconds()
+	}
+	for _, s := range report.Timeline {
+		p := Point{ElapsedSeconds: s.Elapsed.Seconds(), Ops: s.Ops, LiveBytes: s.LiveBytes}
+		if report.TotalBytes > 0 {
+			p.Utilization = float64(s.UsedBytes) / float64(report.TotalBytes)
+		}
+		r.Timeline = append(r.Timeline, p)
+	}
+	return r
+}
+
+// setFragmentation records the fragmentation of the allocator a run ended
+// with
+func (r *RunResult) setFragmentation(frag hybrid.Fragmentation) {
+	r.ExternalFragmentation = frag.External
+	r.InternalFragmentation = frag.Internal
+}
+
+// WriteJSON writes the results as indented JSON
+func (r *Results) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// csvColumns are the columns WriteCSV writes, the timeline is left out
+var csvColumns = []struct {
+	name  string
+	value func(r RunResult) string
+}{
+	{"name", func(r RunResult) string { return r.Name }},
+	{"workload", func(r RunResult) string { return r.Workload }},
+	{"transport", func(r RunResult) string { return r.Transport }},
+	{"seed", func(r RunResult) string { return strconv.FormatInt(r.Seed, 10) }},
+	{"allocations", func(r RunResult) string { return strconv.Itoa(r.Allocations) }},
+	{"allocation_failures", func(r RunResult) string { return strconv.Itoa(r.AllocationFailures) }},
+	{"frees", func(r RunResult) string { return strconv.Itoa(r.Frees) }},
+	{"free_failures", func(r RunResult) string { return strconv.Itoa(r.FreeFailures) }},
+	{"duration_seconds", func(r RunResult) string { return formatFloat(r.DurationSeconds) }},
+	{"ops_per_second", func(r RunResult) string { return formatFloat(r.OpsPerSecond) }},
+	{"written_bytes", func(r RunResult) string { return strconv.FormatUint(r.WrittenBytes, 10) }},
+	{"write_bytes_per_second", func(r RunResult) string { return formatFloat(r.WriteBytesPerSec) }},
+	{"allocate_p50_us", func(r RunResult) string { return formatFloat(r.AllocateLatency.P50) }},
+	{"allocate_p90_us", func(r RunResult) string { return formatFloat(r.AllocateLatency.P90) }},
+	{"allocate_p99_us", func(r RunResult) string { return formatFloat(r.AllocateLatency.P99) }},
+	{"allocate_p999_us", func(r RunResult) string { return formatFloat(r.AllocateLatency.P999) }},
+	{"free_p50_us", func(r RunResult) string { return formatFloat(r.FreeLatency.P50) }},
+	{"free_p90_us", func(r RunResult) string { return formatFloat(r.FreeLatency.P90) }},
+	{"free_p99_us", func(r RunResult) string { return formatFloat(r.FreeLatency.P99) }},
+	{"free_p999_us", func(r RunResult) string { return formatFloat(r.FreeLatency.P999) }},
+	{"utilization", func(r RunResult) string { return formatFloat(r.Utilization) }},
+	{"peak_utilization", func(r RunResult) string { return formatFloat(r.PeakUtilization) }},
+	{"live_bytes", func(r RunResult) string { return strconv.FormatUint(r.LiveBytes, 10) }},
+	{"peak_live_bytes", func(r RunResult) string { return strconv.FormatUint(r.PeakLiveBytes, 10) }},
+	{"total_bytes", func(r RunResult) string { return strconv.FormatUint(r.TotalBytes, 10) }},
+	{"memory_overhead_bytes", func(r RunResult) string { return strconv.FormatUint(r.MemoryOverheadBytes, 10) }},
+	{"external_fragmentation", func(r RunResult) string { return formatFloat(r.ExternalFragmentation) }},
+	{"internal_fragmentation", func(r RunResult) string { return formatFloat(r.InternalFragmentation) }},
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteCSV writes one row per run. The timeline only goes into JSON.
+func (r *Results) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	row := make([]string, len(csvColumns))
+	for i, c := range csvColumns {
+		row[i] = c.name
+	}
+	cw.Write(row)
+	for _, run := range r.Runs {
+		for i, c := range csvColumns {
+			row[i] = c.value(run)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteText writes a table of the main numbers of every run
+func (r *Results) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("%-24s %12s %10s %10s %10s %10s %9s %9s %12s\n",
+		"Run", "Ops/s", "Alloc p50", "Alloc p99", "Free p50", "Free p99", "Util", "Peak", "Overhead")
+	for _, run := range r.Runs {
+		ew.printf("%-24s %12.0f %10s %10s %10s %10s %8.3f%% %8.3f%% %12s\n",
+			run.Name, run.OpsPerSecond,
+			formatMicros(run.AllocateLatency.P50), formatMicros(run.AllocateLatency.P99),
+			formatMicros(run.FreeLatency.P50), formatMicros(run.FreeLatency.P99),
+			run.Utilization*100, run.PeakUtilization*100, formatBytes(run.MemoryOverheadBytes))
+	}
+	for _, run := range r.Runs {
+		if run.AllocationFailures+run.FreeFailures > 0 {
+			ew.printf("%s: %d of %d allocations and %d of %d frees failed\n",
+				run.Name, run.AllocationFailures, run.Allocations, run.FreeFailures, run.Frees)
+		}
+		if run.WrittenBytes > 0 {
+			ew.printf("%s: wrote %s at %s/s\n", run.Name, formatBytes(run.WrittenBytes), formatBytes(uint64(run.WriteBytesPerSec)))
+		}
+	}
+	return ew.err
+}
+
+func formatMicros(us float64) string {
+	return time.Duration(us * float64(time.Microsecond)).String()
+}
+
+func formatBytes(b uint64) string {
+	switch {
+	case b >= TB:
+		return fmt.Sprintf("%.2fTB", float64(b)/TB)
+	case b >= GB:
+		return fmt.Sprintf("%.2fGB", float64(b)/GB)
+	case b >= MB:
+		return fmt.Sprintf("%.2fMB", float64(b)/MB)
+	case b >= KB:
+		return fmt.Sprintf("%.2fKB", float64(b)/KB)
+	}
+	return fmt.Sprintf("%dB", b)
+}
+
+// readResults reads a JSON result file
+func readResults(path string) (*Results, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results Results
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &results, nil
+}
+
+// errWriter keeps the first write error
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...any) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
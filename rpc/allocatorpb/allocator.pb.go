@@ -0,0 +1,1504 @@
+// Protobuf service definition of the hybrid allocator server.
+//
+// Regenerate the Go code with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative allocator.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: allocator.proto
+
+package allocatorpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Extent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Start         uint64                 `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	Size          uint64                 `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Extent) Reset() {
+	*x = Extent{}
+	mi := &file_allocator_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Extent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Extent) ProtoMessage() {}
+
+func (x *Extent) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Extent.ProtoReflect.Descriptor instead.
+func (*Extent) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Extent) GetStart() uint64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *Extent) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type AllocateRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Size  uint64                 `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	// If set, the extent is reclaimed unless committed in time.
+	LeaseTtl      *durationpb.Duration `protobuf:"bytes,2,opt,name=lease_ttl,json=leaseTtl,proto3" json:"lease_ttl,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateRequest) Reset() {
+	*x = AllocateRequest{}
+	mi := &file_allocator_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateRequest) ProtoMessage() {}
+
+func (x *AllocateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateRequest.ProtoReflect.Descriptor instead.
+func (*AllocateRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AllocateRequest) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *AllocateRequest) GetLeaseTtl() *durationpb.Duration {
+	if x != nil {
+		return x.LeaseTtl
+	}
+	return nil
+}
+
+type AllocateResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Start         uint64                 `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	LeaseId       uint64                 `protobuf:"varint,2,opt,name=lease_id,json=leaseId,proto3" json:"lease_id,omitempty"`
+	LeaseExpires  *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=lease_expires,json=leaseExpires,proto3" json:"lease_expires,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateResponse) Reset() {
+	*x = AllocateResponse{}
+	mi := &file_allocator_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateResponse) ProtoMessage() {}
+
+func (x *AllocateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateResponse.ProtoReflect.Descriptor instead.
+func (*AllocateResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *AllocateResponse) GetStart() uint64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *AllocateResponse) GetLeaseId() uint64 {
+	if x != nil {
+		return x.LeaseId
+	}
+	return 0
+}
+
+func (x *AllocateResponse) GetLeaseExpires() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LeaseExpires
+	}
+	return nil
+}
+
+type FreeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Start         uint64                 `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	Size          uint64                 `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FreeRequest) Reset() {
+	*x = FreeRequest{}
+	mi := &file_allocator_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FreeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FreeRequest) ProtoMessage() {}
+
+func (x *FreeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FreeRequest.ProtoReflect.Descriptor instead.
+func (*FreeRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *FreeRequest) GetStart() uint64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *FreeRequest) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type FreeResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FreeResponse) Reset() {
+	*x = FreeResponse{}
+	mi := &file_allocator_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FreeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FreeResponse) ProtoMessage() {}
+
+func (x *FreeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FreeResponse.ProtoReflect.Descriptor instead.
+func (*FreeResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{4}
+}
+
+// BatchResult is the outcome of one batch element. code is a gRPC status
+// code, 0 on success.
+type BatchResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Start         uint64                 `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	Code          int32                  `protobuf:"varint,2,opt,name=code,proto3" json:"code,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchResult) Reset() {
+	*x = BatchResult{}
+	mi := &file_allocator_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchResult) ProtoMessage() {}
+
+func (x *BatchResult) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchResult.ProtoReflect.Descriptor instead.
+func (*BatchResult) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *BatchResult) GetStart() uint64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *BatchResult) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *BatchResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type AllocateBatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sizes         []uint64               `protobuf:"varint,1,rep,packed,name=sizes,proto3" json:"sizes,omitempty"`
+	Atomic        bool                   `protobuf:"varint,2,opt,name=atomic,proto3" json:"atomic,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateBatchRequest) Reset() {
+	*x = AllocateBatchRequest{}
+	mi := &file_allocator_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateBatchRequest) ProtoMessage() {}
+
+func (x *AllocateBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateBatchRequest.ProtoReflect.Descriptor instead.
+func (*AllocateBatchRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AllocateBatchRequest) GetSizes() []uint64 {
+	if x != nil {
+		return x.Sizes
+	}
+	return nil
+}
+
+func (x *AllocateBatchRequest) GetAtomic() bool {
+	if x != nil {
+		return x.Atomic
+	}
+	return false
+}
+
+type AllocateBatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*BatchResult         `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateBatchResponse) Reset() {
+	*x = AllocateBatchResponse{}
+	mi := &file_allocator_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateBatchResponse) ProtoMessage() {}
+
+func (x *AllocateBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateBatchResponse.ProtoReflect.Descriptor instead.
+func (*AllocateBatchResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *AllocateBatchResponse) GetResults() []*BatchResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+type FreeBatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Extents       []*Extent              `protobuf:"bytes,1,rep,name=extents,proto3" json:"extents,omitempty"`
+	Atomic        bool                   `protobuf:"varint,2,opt,name=atomic,proto3" json:"atomic,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FreeBatchRequest) Reset() {
+	*x = FreeBatchRequest{}
+	mi := &file_allocator_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FreeBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FreeBatchRequest) ProtoMessage() {}
+
+func (x *FreeBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FreeBatchRequest.ProtoReflect.Descriptor instead.
+func (*FreeBatchRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *FreeBatchRequest) GetExtents() []*Extent {
+	if x != nil {
+		return x.Extents
+	}
+	return nil
+}
+
+func (x *FreeBatchRequest) GetAtomic() bool {
+	if x != nil {
+		return x.Atomic
+	}
+	return false
+}
+
+type FreeBatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*BatchResult         `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FreeBatchResponse) Reset() {
+	*x = FreeBatchResponse{}
+	mi := &file_allocator_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FreeBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FreeBatchResponse) ProtoMessage() {}
+
+func (x *FreeBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FreeBatchResponse.ProtoReflect.Descriptor instead.
+func (*FreeBatchResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *FreeBatchResponse) GetResults() []*BatchResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+type CommitRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	LeaseId       uint64                 `protobuf:"varint,1,opt,name=lease_id,json=leaseId,proto3" json:"lease_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommitRequest) Reset() {
+	*x = CommitRequest{}
+	mi := &file_allocator_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommitRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommitRequest) ProtoMessage() {}
+
+func (x *CommitRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommitRequest.ProtoReflect.Descriptor instead.
+func (*CommitRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CommitRequest) GetLeaseId() uint64 {
+	if x != nil {
+		return x.LeaseId
+	}
+	return 0
+}
+
+type CommitResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommitResponse) Reset() {
+	*x = CommitResponse{}
+	mi := &file_allocator_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommitResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommitResponse) ProtoMessage() {}
+
+func (x *CommitResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommitResponse.ProtoReflect.Descriptor instead.
+func (*CommitResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{11}
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_allocator_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{12}
+}
+
+type WatchStatsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Defaults to one second.
+	Interval      *durationpb.Duration `protobuf:"bytes,1,opt,name=interval,proto3" json:"interval,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchStatsRequest) Reset() {
+	*x = WatchStatsRequest{}
+	mi := &file_allocator_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchStatsRequest) ProtoMessage() {}
+
+func (x *WatchStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchStatsRequest.ProtoReflect.Descriptor instead.
+func (*WatchStatsRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *WatchStatsRequest) GetInterval() *durationpb.Duration {
+	if x != nil {
+		return x.Interval
+	}
+	return nil
+}
+
+type PoolStats struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	TotalAllocations uint64                 `protobuf:"varint,1,opt,name=total_allocations,json=totalAllocations,proto3" json:"total_allocations,omitempty"`
+	PoolHits         uint64                 `protobuf:"varint,2,opt,name=pool_hits,json=poolHits,proto3" json:"pool_hits,omitempty"`
+	PoolMisses       uint64                 `protobuf:"varint,3,opt,name=pool_misses,json=poolMisses,proto3" json:"pool_misses,omitempty"`
+	TotalFrees       uint64                 `protobuf:"varint,4,opt,name=total_frees,json=totalFrees,proto3" json:"total_frees,omitempty"`
+	PoolFreeHits     uint64                 `protobuf:"varint,5,opt,name=pool_free_hits,json=poolFreeHits,proto3" json:"pool_free_hits,omitempty"`
+	PoolFreeMisses   uint64                 `protobuf:"varint,6,opt,name=pool_free_misses,json=poolFreeMisses,proto3" json:"pool_free_misses,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *PoolStats) Reset() {
+	*x = PoolStats{}
+	mi := &file_allocator_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PoolStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PoolStats) ProtoMessage() {}
+
+func (x *PoolStats) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PoolStats.ProtoReflect.Descriptor instead.
+func (*PoolStats) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *PoolStats) GetTotalAllocations() uint64 {
+	if x != nil {
+		return x.TotalAllocations
+	}
+	return 0
+}
+
+func (x *PoolStats) GetPoolHits() uint64 {
+	if x != nil {
+		return x.PoolHits
+	}
+	return 0
+}
+
+func (x *PoolStats) GetPoolMisses() uint64 {
+	if x != nil {
+		return x.PoolMisses
+	}
+	return 0
+}
+
+func (x *PoolStats) GetTotalFrees() uint64 {
+	if x != nil {
+		return x.TotalFrees
+	}
+	return 0
+}
+
+func (x *PoolStats) GetPoolFreeHits() uint64 {
+	if x != nil {
+		return x.PoolFreeHits
+	}
+	return 0
+}
+
+func (x *PoolStats) GetPoolFreeMisses() uint64 {
+	if x != nil {
+		return x.PoolFreeMisses
+	}
+	return 0
+}
+
+type Stats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UsedSize      uint64                 `protobuf:"varint,1,opt,name=used_size,json=usedSize,proto3" json:"used_size,omitempty"`
+	TotalSize     uint64                 `protobuf:"varint,2,opt,name=total_size,json=totalSize,proto3" json:"total_size,omitempty"`
+	MemoryUsage   uint64                 `protobuf:"varint,3,opt,name=memory_usage,json=memoryUsage,proto3" json:"memory_usage,omitempty"`
+	Pool          *PoolStats             `protobuf:"bytes,4,opt,name=pool,proto3" json:"pool,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_allocator_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *Stats) GetUsedSize() uint64 {
+	if x != nil {
+		return x.UsedSize
+	}
+	return 0
+}
+
+func (x *Stats) GetTotalSize() uint64 {
+	if x != nil {
+		return x.TotalSize
+	}
+	return 0
+}
+
+func (x *Stats) GetMemoryUsage() uint64 {
+	if x != nil {
+		return x.MemoryUsage
+	}
+	return 0
+}
+
+func (x *Stats) GetPool() *PoolStats {
+	if x != nil {
+		return x.Pool
+	}
+	return nil
+}
+
+type GetFragmentationRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetFragmentationRequest) Reset() {
+	*x = GetFragmentationRequest{}
+	mi := &file_allocator_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetFragmentationRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetFragmentationRequest) ProtoMessage() {}
+
+func (x *GetFragmentationRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetFragmentationRequest.ProtoReflect.Descriptor instead.
+func (*GetFragmentationRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{16}
+}
+
+type Fragmentation struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	FreeBytes uint64                 `protobuf:"varint,1,opt,name=free_bytes,json=freeBytes,proto3" json:"free_bytes,omitempty"`
+	// Free buddy blocks per order.
+	FreeBlocks       []int64 `protobuf:"varint,2,rep,packed,name=free_blocks,json=freeBlocks,proto3" json:"free_blocks,omitempty"`
+	LargestFreeBlock uint64  `protobuf:"varint,3,opt,name=largest_free_block,json=largestFreeBlock,proto3" json:"largest_free_block,omitempty"`
+	SlabBytes        uint64  `protobuf:"varint,4,opt,name=slab_bytes,json=slabBytes,proto3" json:"slab_bytes,omitempty"`
+	SlabFreeBytes    uint64  `protobuf:"varint,5,opt,name=slab_free_bytes,json=slabFreeBytes,proto3" json:"slab_free_bytes,omitempty"`
+	Slabs            int64   `protobuf:"varint,6,opt,name=slabs,proto3" json:"slabs,omitempty"`
+	External         float64 `protobuf:"fixed64,7,opt,name=external,proto3" json:"external,omitempty"`
+	Internal         float64 `protobuf:"fixed64,8,opt,name=internal,proto3" json:"internal,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Fragmentation) Reset() {
+	*x = Fragmentation{}
+	mi := &file_allocator_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Fragmentation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Fragmentation) ProtoMessage() {}
+
+func (x *Fragmentation) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Fragmentation.ProtoReflect.Descriptor instead.
+func (*Fragmentation) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *Fragmentation) GetFreeBytes() uint64 {
+	if x != nil {
+		return x.FreeBytes
+	}
+	return 0
+}
+
+func (x *Fragmentation) GetFreeBlocks() []int64 {
+	if x != nil {
+		return x.FreeBlocks
+	}
+	return nil
+}
+
+func (x *Fragmentation) GetLargestFreeBlock() uint64 {
+	if x != nil {
+		return x.LargestFreeBlock
+	}
+	return 0
+}
+
+func (x *Fragmentation) GetSlabBytes() uint64 {
+	if x != nil {
+		return x.SlabBytes
+	}
+	return 0
+}
+
+func (x *Fragmentation) GetSlabFreeBytes() uint64 {
+	if x != nil {
+		return x.SlabFreeBytes
+	}
+	return 0
+}
+
+func (x *Fragmentation) GetSlabs() int64 {
+	if x != nil {
+		return x.Slabs
+	}
+	return 0
+}
+
+func (x *Fragmentation) GetExternal() float64 {
+	if x != nil {
+		return x.External
+	}
+	return 0
+}
+
+func (x *Fragmentation) GetInternal() float64 {
+	if x != nil {
+		return x.Internal
+	}
+	return 0
+}
+
+type ListSessionsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListSessionsRequest) Reset() {
+	*x = ListSessionsRequest{}
+	mi := &file_allocator_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListSessionsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListSessionsRequest) ProtoMessage() {}
+
+func (x *ListSessionsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListSessionsRequest.ProtoReflect.Descriptor instead.
+func (*ListSessionsRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{18}
+}
+
+type Session struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	ClientId      int64                  `protobuf:"varint,2,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	Attached      bool                   `protobuf:"varint,3,opt,name=attached,proto3" json:"attached,omitempty"`
+	Allocations   int64                  `protobuf:"varint,4,opt,name=allocations,proto3" json:"allocations,omitempty"`
+	Bytes         uint64                 `protobuf:"varint,5,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Session) Reset() {
+	*x = Session{}
+	mi := &file_allocator_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Session) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Session) ProtoMessage() {}
+
+func (x *Session) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Session.ProtoReflect.Descriptor instead.
+func (*Session) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *Session) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Session) GetClientId() int64 {
+	if x != nil {
+		return x.ClientId
+	}
+	return 0
+}
+
+func (x *Session) GetAttached() bool {
+	if x != nil {
+		return x.Attached
+	}
+	return false
+}
+
+func (x *Session) GetAllocations() int64 {
+	if x != nil {
+		return x.Allocations
+	}
+	return 0
+}
+
+func (x *Session) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+type ListSessionsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sessions      []*Session             `protobuf:"bytes,1,rep,name=sessions,proto3" json:"sessions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListSessionsResponse) Reset() {
+	*x = ListSessionsResponse{}
+	mi := &file_allocator_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListSessionsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListSessionsResponse) ProtoMessage() {}
+
+func (x *ListSessionsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListSessionsResponse.ProtoReflect.Descriptor instead.
+func (*ListSessionsResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *ListSessionsResponse) GetSessions() []*Session {
+	if x != nil {
+		return x.Sessions
+	}
+	return nil
+}
+
+type ReclaimExpiredLeasesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReclaimExpiredLeasesRequest) Reset() {
+	*x = ReclaimExpiredLeasesRequest{}
+	mi := &file_allocator_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReclaimExpiredLeasesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReclaimExpiredLeasesRequest) ProtoMessage() {}
+
+func (x *ReclaimExpiredLeasesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReclaimExpiredLeasesRequest.ProtoReflect.Descriptor instead.
+func (*ReclaimExpiredLeasesRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{21}
+}
+
+type ReclaimExpiredLeasesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Reclaimed     int64                  `protobuf:"varint,1,opt,name=reclaimed,proto3" json:"reclaimed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReclaimExpiredLeasesResponse) Reset() {
+	*x = ReclaimExpiredLeasesResponse{}
+	mi := &file_allocator_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReclaimExpiredLeasesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReclaimExpiredLeasesResponse) ProtoMessage() {}
+
+func (x *ReclaimExpiredLeasesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReclaimExpiredLeasesResponse.ProtoReflect.Descriptor instead.
+func (*ReclaimExpiredLeasesResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *ReclaimExpiredLeasesResponse) GetReclaimed() int64 {
+	if x != nil {
+		return x.Reclaimed
+	}
+	return 0
+}
+
+type SnapshotRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	mi := &file_allocator_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{23}
+}
+
+type SnapshotResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Metadata      []byte                 `protobuf:"bytes,1,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotResponse) Reset() {
+	*x = SnapshotResponse{}
+	mi := &file_allocator_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotResponse) ProtoMessage() {}
+
+func (x *SnapshotResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_allocator_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotResponse.ProtoReflect.Descriptor instead.
+func (*SnapshotResponse) Descriptor() ([]byte, []int) {
+	return file_allocator_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *SnapshotResponse) GetMetadata() []byte {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+var File_allocator_proto protoreflect.FileDescriptor
+
+const file_allocator_proto_rawDesc = "" +
+	"\n" +
+	"\x0fallocator.proto\x12\x12hybridallocator.v1\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"2\n" +
+	"\x06Extent\x12\x14\n" +
+	"\x05start\x18\x01 \x01(\x04R\x05start\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x04R\x04size\"]\n" +
+	"\x0fAllocateRequest\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x04R\x04size\x126\n" +
+	"\tlease_ttl\x18\x02 \x01(\v2\x19.google.protobuf.DurationR\bleaseTtl\"\x84\x01\n" +
+	"\x10AllocateResponse\x12\x14\n" +
+	"\x05start\x18\x01 \x01(\x04R\x05start\x12\x19\n" +
+	"\blease_id\x18\x02 \x01(\x04R\aleaseId\x12?\n" +
+	"\rlease_expires\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\fleaseExpires\"7\n" +
+	"\vFreeRequest\x12\x14\n" +
+	"\x05start\x18\x01 \x01(\x04R\x05start\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x04R\x04size\"\x0e\n" +
+	"\fFreeResponse\"M\n" +
+	"\vBatchResult\x12\x14\n" +
+	"\x05start\x18\x01 \x01(\x04R\x05start\x12\x12\n" +
+	"\x04code\x18\x02 \x01(\x05R\x04code\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"D\n" +
+	"\x14AllocateBatchRequest\x12\x14\n" +
+	"\x05sizes\x18\x01 \x03(\x04R\x05sizes\x12\x16\n" +
+	"\x06atomic\x18\x02 \x01(\bR\x06atomic\"R\n" +
+	"\x15AllocateBatchResponse\x129\n" +
+	"\aresults\x18\x01 \x03(\v2\x1f.hybridallocator.v1.BatchResultR\aresults\"`\n" +
+	"\x10FreeBatchRequest\x124\n" +
+	"\aextents\x18\x01 \x03(\v2\x1a.hybridallocator.v1.ExtentR\aextents\x12\x16\n" +
+	"\x06atomic\x18\x02 \x01(\bR\x06atomic\"N\n" +
+	"\x11FreeBatchResponse\x129\n" +
+	"\aresults\x18\x01 \x03(\v2\x1f.hybridallocator.v1.BatchResultR\aresults\"*\n" +
+	"\rCommitRequest\x12\x19\n" +
+	"\blease_id\x18\x01 \x01(\x04R\aleaseId\"\x10\n" +
+	"\x0eCommitResponse\"\x11\n" +
+	"\x0fGetStatsRequest\"J\n" +
+	"\x11WatchStatsRequest\x125\n" +
+	"\binterval\x18\x01 \x01(\v2\x19.google.protobuf.DurationR\binterval\"\xe7\x01\n" +
+	"\tPoolStats\x12+\n" +
+	"\x11total_allocations\x18\x01 \x01(\x04R\x10totalAllocations\x12\x1b\n" +
+	"\tpool_hits\x18\x02 \x01(\x04R\bpoolHits\x12\x1f\n" +
+	"\vpool_misses\x18\x03 \x01(\x04R\n" +
+	"poolMisses\x12\x1f\n" +
+	"\vtotal_frees\x18\x04 \x01(\x04R\n" +
+	"totalFrees\x12$\n" +
+	"\x0epool_free_hits\x18\x05 \x01(\x04R\fpoolFreeHits\x12(\n" +
+	"\x10pool_free_misses\x18\x06 \x01(\x04R\x0epoolFreeMisses\"\x99\x01\n" +
+	"\x05Stats\x12\x1b\n" +
+	"\tused_size\x18\x01 \x01(\x04R\busedSize\x12\x1d\n" +
+	"\n" +
+	"total_size\x18\x02 \x01(\x04R\ttotalSize\x12!\n" +
+	"\fmemory_usage\x18\x03 \x01(\x04R\vmemoryUsage\x121\n" +
+	"\x04pool\x18\x04 \x01(\v2\x1d.hybridallocator.v1.PoolStatsR\x04pool\"\x19\n" +
+	"\x17GetFragmentationRequest\"\x92\x02\n" +
+	"\rFragmentation\x12\x1d\n" +
+	"\n" +
+	"free_bytes\x18\x01 \x01(\x04R\tfreeBytes\x12\x1f\n" +
+	"\vfree_blocks\x18\x02 \x03(\x03R\n" +
+	"freeBlocks\x12,\n" +
+	"\x12largest_free_block\x18\x03 \x01(\x04R\x10largestFreeBlock\x12\x1d\n" +
+	"\n" +
+	"slab_bytes\x18\x04 \x01(\x04R\tslabBytes\x12&\n" +
+	"\x0fslab_free_bytes\x18\x05 \x01(\x04R\rslabFreeBytes\x12\x14\n" +
+	"\x05slabs\x18\x06 \x01(\x03R\x05slabs\x12\x1a\n" +
+	"\bexternal\x18\a \x01(\x01R\bexternal\x12\x1a\n" +
+	"\binternal\x18\b \x01(\x01R\binternal\"\x15\n" +
+	"\x13ListSessionsRequest\"\x8a\x01\n" +
+	"\aSession\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1b\n" +
+	"\tclient_id\x18\x02 \x01(\x03R\bclientId\x12\x1a\n" +
+	"\battached\x18\x03 \x01(\bR\battached\x12 \n" +
+	"\vallocations\x18\x04 \x01(\x03R\vallocations\x12\x14\n" +
+	"\x05bytes\x18\x05 \x01(\x04R\x05bytes\"O\n" +
+	"\x14ListSessionsResponse\x127\n" +
+	"\bsessions\x18\x01 \x03(\v2\x1b.hybridallocator.v1.SessionR\bsessions\"\x1d\n" +
+	"\x1bReclaimExpiredLeasesRequest\"<\n" +
+	"\x1cReclaimExpiredLeasesResponse\x12\x1c\n" +
+	"\treclaimed\x18\x01 \x01(\x03R\treclaimed\"\x11\n" +
+	"\x0fSnapshotRequest\".\n" +
+	"\x10SnapshotResponse\x12\x1a\n" +
+	"\bmetadata\x18\x01 \x01(\fR\bmetadata2\xdc\x04\n" +
+	"\tAllocator\x12U\n" +
+	"\bAllocate\x12#.hybridallocator.v1.AllocateRequest\x1a$.hybridallocator.v1.AllocateResponse\x12I\n" +
+	"\x04Free\x12\x1f.hybridallocator.v1.FreeRequest\x1a .hybridallocator.v1.FreeResponse\x12d\n" +
+	"\rAllocateBatch\x12(.hybridallocator.v1.AllocateBatchRequest\x1a).hybridallocator.v1.AllocateBatchResponse\x12X\n" +
+	"\tFreeBatch\x12$.hybridallocator.v1.FreeBatchRequest\x1a%.hybridallocator.v1.FreeBatchResponse\x12O\n" +
+	"\x06Commit\x12!.hybridallocator.v1.CommitRequest\x1a\".hybridallocator.v1.CommitResponse\x12J\n" +
+	"\bGetStats\x12#.hybridallocator.v1.GetStatsRequest\x1a\x19.hybridallocator.v1.Stats\x12P\n" +
+	"\n" +
+	"WatchStats\x12%.hybridallocator.v1.WatchStatsRequest\x1a\x19.hybridallocator.v1.Stats0\x012\xa0\x03\n" +
+	"\x05Admin\x12b\n" +
+	"\x10GetFragmentation\x12+.hybridallocator.v1.GetFragmentationRequest\x1a!.hybridallocator.v1.Fragmentation\x12a\n" +
+	"\fListSessions\x12'.hybridallocator.v1.ListSessionsRequest\x1a(.hybridallocator.v1.ListSessionsResponse\x12y\n" +
+	"\x14ReclaimExpiredLeases\x12/.hybridallocator.v1.ReclaimExpiredLeasesRequest\x1a0.hybridallocator.v1.ReclaimExpiredLeasesResponse\x12U\n" +
+	"\bSnapshot\x12#.hybridallocator.v1.SnapshotRequest\x1a$.hybridallocator.v1.SnapshotResponseB!Z\x1fhybridAllocator/rpc/allocatorpbb\x06proto3"
+
+var (
+	file_allocator_proto_rawDescOnce sync.Once
+	file_allocator_proto_rawDescData []byte
+)
+
+func file_allocator_proto_rawDescGZIP() []byte {
+	file_allocator_proto_rawDescOnce.Do(func() {
+		file_allocator_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_allocator_proto_rawDesc), len(file_allocator_proto_rawDesc)))
+	})
+	return file_allocator_proto_rawDescData
+}
+
+var file_allocator_proto_msgTypes = make([]protoimpl.MessageInfo, 25)
+var file_allocator_proto_goTypes = []any{
+	(*Extent)(nil),                       // 0: hybridallocator.v1.Extent
+	(*AllocateRequest)(nil),              // 1: hybridallocator.v1.AllocateRequest
+	(*AllocateResponse)(nil),             // 2: hybridallocator.v1.AllocateResponse
+	(*FreeRequest)(nil),                  // 3: hybridallocator.v1.FreeRequest
+	(*FreeResponse)(nil),                 // 4: hybridallocator.v1.FreeResponse
+	(*BatchResult)(nil),                  // 5: hybridallocator.v1.BatchResult
+	(*AllocateBatchRequest)(nil),         // 6: hybridallocator.v1.AllocateBatchRequest
+	(*AllocateBatchResponse)(nil),        // 7: hybridallocator.v1.AllocateBatchResponse
+	(*FreeBatchRequest)(nil),             // 8: hybridallocator.v1.FreeBatchRequest
+	(*FreeBatchResponse)(nil),            // 9: hybridallocator.v1.FreeBatchResponse
+	(*CommitRequest)(nil),                // 10: hybridallocator.v1.CommitRequest
+	(*CommitResponse)(nil),               // 11: hybridallocator.v1.CommitResponse
+	(*GetStatsRequest)(nil),              // 12: hybridallocator.v1.GetStatsRequest
+	(*WatchStatsRequest)(nil),            // 13: hybridallocator.v1.WatchStatsRequest
+	(*PoolStats)(nil),                    // 14: hybridallocator.v1.PoolStats
+	(*Stats)(nil),                        // 15: hybridallocator.v1.Stats
+	(*GetFragmentationRequest)(nil),      // 16: hybridallocator.v1.GetFragmentationRequest
+	(*Fragmentation)(nil),                // 17: hybridallocator.v1.Fragmentation
+	(*ListSessionsRequest)(nil),          // 18: hybridallocator.v1.ListSessionsRequest
+	(*Session)(nil),                      // 19: hybridallocator.v1.Session
+	(*ListSessionsResponse)(nil),         // 20: hybridallocator.v1.ListSessionsResponse
+	(*ReclaimExpiredLeasesRequest)(nil),  // 21: hybridallocator.v1.ReclaimExpiredLeasesRequest
+	(*ReclaimExpiredLeasesResponse)(nil), // 22: hybridallocator.v1.ReclaimExpiredLeasesResponse
+	(*SnapshotRequest)(nil),              // 23: hybridallocator.v1.SnapshotRequest
+	(*SnapshotResponse)(nil),             // 24: hybridallocator.v1.SnapshotResponse
+	(*durationpb.Duration)(nil),          // 25: google.protobuf.Duration
+	(*timestamppb.Timestamp)(nil),        // 26: google.protobuf.Timestamp
+}
+var file_allocator_proto_depIdxs = []int32{
+	25, // 0: hybridallocator.v1.AllocateRequest.lease_ttl:type_name -> google.protobuf.Duration
+	26, // 1: hybridallocator.v1.AllocateResponse.lease_expires:type_name -> google.protobuf.Timestamp
+	5,  // 2: hybridallocator.v1.AllocateBatchResponse.results:type_name -> hybridallocator.v1.BatchResult
+	0,  // 3: hybridallocator.v1.FreeBatchRequest.extents:type_name -> hybridallocator.v1.Extent
+	5,  // 4: hybridallocator.v1.FreeBatchResponse.results:type_name -> hybridallocator.v1.BatchResult
+	25, // 5: hybridallocator.v1.WatchStatsRequest.interval:type_name -> google.protobuf.Duration
+	14, // 6: hybridallocator.v1.Stats.pool:type_name -> hybridallocator.v1.PoolStats
+	19, // 7: hybridallocator.v1.ListSessionsResponse.sessions:type_name -> hybridallocator.v1.Session
+	1,  // 8: hybridallocator.v1.Allocator.Allocate:input_type -> hybridallocator.v1.AllocateRequest
+	3,  // 9: hybridallocator.v1.Allocator.Free:input_type -> hybridallocator.v1.FreeRequest
+	6,  // 10: hybridallocator.v1.Allocator.AllocateBatch:input_type -> hybridallocator.v1.AllocateBatchRequest
+	8,  // 11: hybridallocator.v1.Allocator.FreeBatch:input_type -> hybridallocator.v1.FreeBatchRequest
+	10, // 12: hybridallocator.v1.Allocator.Commit:input_type -> hybridallocator.v1.CommitRequest
+	12, // 13: hybridallocator.v1.Allocator.GetStats:input_type -> hybridallocator.v1.GetStatsRequest
+	13, // 14: hybridallocator.v1.Allocator.WatchStats:input_type -> hybridallocator.v1.WatchStatsRequest
+	16, // 15: hybridallocator.v1.Admin.GetFragmentation:input_type -> hybridallocator.v1.GetFragmentationRequest
+	18, // 16: hybridallocator.v1.Admin.ListSessions:input_type -> hybridallocator.v1.ListSessionsRequest
+	21, // 17: hybridallocator.v1.Admin.ReclaimExpiredLeases:input_type -> hybridallocator.v1.ReclaimExpiredLeasesRequest
+	23, // 18: hybridallocator.v1.Admin.Snapshot:input_type -> hybridallocator.v1.SnapshotRequest
+	2,  // 19: hybridallocator.v1.Allocator.Allocate:output_type -> hybridallocator.v1.AllocateResponse
+	4,  // 20: hybridallocator.v1.Allocator.Free:output_type -> hybridallocator.v1.FreeResponse
+	7,  // 21: hybridallocator.v1.Allocator.AllocateBatch:output_type -> hybridallocator.v1.AllocateBatchResponse
+	9,  // 22: hybridallocator.v1.Allocator.FreeBatch:output_type -> hybridallocator.v1.FreeBatchResponse
+	11, // 23: hybridallocator.v1.Allocator.Commit:output_type -> hybridallocator.v1.CommitResponse
+	15, // 24: hybridallocator.v1.Allocator.GetStats:output_type -> hybridallocator.v1.Stats
+	15, // 25: hybridallocator.v1.Allocator.WatchStats:output_type -> hybridallocator.v1.Stats
+	17, // 26: hybridallocator.v1.Admin.GetFragmentation:output_type -> hybridallocator.v1.Fragmentation
+	20, // 27: hybridallocator.v1.Admin.ListSessions:output_type -> hybridallocator.v1.ListSessionsResponse
+	22, // 28: hybridallocator.v1.Admin.ReclaimExpiredLeases:output_type -> hybridallocator.v1.ReclaimExpiredLeasesResponse
+	24, // 29: hybridallocator.v1.Admin.Snapshot:output_type -> hybridallocator.v1.SnapshotResponse
+	19, // [19:30] is the sub-list for method output_type
+	8,  // [8:19] is the sub-list for method input_type
+	8,  // [8:8] is the sub-list for extension type_name
+	8,  // [8:8] is the sub-list for extension extendee
+	0,  // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_allocator_proto_init() }
+func file_allocator_proto_init() {
+	if File_allocator_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_allocator_proto_rawDesc), len(file_allocator_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   25,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_allocator_proto_goTypes,
+		DependencyIndexes: file_allocator_proto_depIdxs,
+		MessageInfos:      file_allocator_proto_msgTypes,
+	}.Build()
+	File_allocator_proto = out.File
+	file_allocator_proto_goTypes = nil
+	file_allocator_proto_depIdxs = nil
+}
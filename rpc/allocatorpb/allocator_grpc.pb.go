@@ -0,0 +1,601 @@
+// Protobuf service definition of the hybrid allocator server.
+//
+// Regenerate the Go code with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative allocator.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: allocator.proto
+
+package allocatorpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Allocator_Allocate_FullMethodName      = "/hybridallocator.v1.Allocator/Allocate"
+	Allocator_Free_FullMethodName          = "/hybridallocator.v1.Allocator/Free"
+	Allocator_AllocateBatch_FullMethodName = "/hybridallocator.v1.Allocator/AllocateBatch"
+	Allocator_FreeBatch_FullMethodName     = "/hybridallocator.v1.Allocator/FreeBatch"
+	Allocator_Commit_FullMethodName        = "/hybridallocator.v1.Allocator/Commit"
+	Allocator_GetStats_FullMethodName      = "/hybridallocator.v1.Allocator/GetStats"
+	Allocator_WatchStats_FullMethodName    = "/hybridallocator.v1.Allocator/WatchStats"
+)
+
+// AllocatorClient is the client API for Allocator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Allocator hands out extents of the address space. Allocator errors are
+// reported as status codes: RESOURCE_EXHAUSTED when there is no space left,
+// INVALID_ARGUMENT for bad sizes or addresses, NOT_FOUND for extents that are
+// not allocated and FAILED_PRECONDITION for extents that are still shared.
+type AllocatorClient interface {
+	Allocate(ctx context.Context, in *AllocateRequest, opts ...grpc.CallOption) (*AllocateResponse, error)
+	Free(ctx context.Context, in *FreeRequest, opts ...grpc.CallOption) (*FreeResponse, error)
+	// AllocateBatch allocates many extents in one call. An atomic batch either
+	// allocates every size or fails with the status of the first failure.
+	AllocateBatch(ctx context.Context, in *AllocateBatchRequest, opts ...grpc.CallOption) (*AllocateBatchResponse, error)
+	// FreeBatch frees many extents in one call. An atomic batch frees nothing
+	// and fails unless every extent is allocated and listed once.
+	FreeBatch(ctx context.Context, in *FreeBatchRequest, opts ...grpc.CallOption) (*FreeBatchResponse, error)
+	Commit(ctx context.Context, in *CommitRequest, opts ...grpc.CallOption) (*CommitResponse, error)
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	// WatchStats sends the stats every interval until the client cancels.
+	WatchStats(ctx context.Context, in *WatchStatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Stats], error)
+}
+
+type allocatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAllocatorClient(cc grpc.ClientConnInterface) AllocatorClient {
+	return &allocatorClient{cc}
+}
+
+func (c *allocatorClient) Allocate(ctx context.Context, in *AllocateRequest, opts ...grpc.CallOption) (*AllocateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AllocateResponse)
+	err := c.cc.Invoke(ctx, Allocator_Allocate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) Free(ctx context.Context, in *FreeRequest, opts ...grpc.CallOption) (*FreeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FreeResponse)
+	err := c.cc.Invoke(ctx, Allocator_Free_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) AllocateBatch(ctx context.Context, in *AllocateBatchRequest, opts ...grpc.CallOption) (*AllocateBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AllocateBatchResponse)
+	err := c.cc.Invoke(ctx, Allocator_AllocateBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) FreeBatch(ctx context.Context, in *FreeBatchRequest, opts ...grpc.CallOption) (*FreeBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FreeBatchResponse)
+	err := c.cc.Invoke(ctx, Allocator_FreeBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) Commit(ctx context.Context, in *CommitRequest, opts ...grpc.CallOption) (*CommitResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CommitResponse)
+	err := c.cc.Invoke(ctx, Allocator_Commit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, Allocator_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *allocatorClient) WatchStats(ctx context.Context, in *WatchStatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Stats], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Allocator_ServiceDesc.Streams[0], Allocator_WatchStats_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchStatsRequest, Stats]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Allocator_WatchStatsClient = grpc.ServerStreamingClient[Stats]
+
+// AllocatorServer is the server API for Allocator service.
+// All implementations must embed UnimplementedAllocatorServer
+// for forward compatibility.
+//
+// Allocator hands out extents of the address space. Allocator errors are
+// reported as status codes: RESOURCE_EXHAUSTED when there is no space left,
+// INVALID_ARGUMENT for bad sizes or addresses, NOT_FOUND for extents that are
+// not allocated and FAILED_PRECONDITION for extents that are still shared.
+type AllocatorServer interface {
+	Allocate(context.Context, *AllocateRequest) (*AllocateResponse, error)
+	Free(context.Context, *FreeRequest) (*FreeResponse, error)
+	// AllocateBatch allocates many extents in one call. An atomic batch either
+	// allocates every size or fails with the status of the first failure.
+	AllocateBatch(context.Context, *AllocateBatchRequest) (*AllocateBatchResponse, error)
+	// FreeBatch frees many extents in one call. An atomic batch frees nothing
+	// and fails unless every extent is allocated and listed once.
+	FreeBatch(context.Context, *FreeBatchRequest) (*FreeBatchResponse, error)
+	Commit(context.Context, *CommitRequest) (*CommitResponse, error)
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	// WatchStats sends the stats every interval until the client cancels.
+	WatchStats(*WatchStatsRequest, grpc.ServerStreamingServer[Stats]) error
+	mustEmbedUnimplementedAllocatorServer()
+}
+
+// UnimplementedAllocatorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAllocatorServer struct{}
+
+func (UnimplementedAllocatorServer) Allocate(context.Context, *AllocateRequest) (*AllocateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Allocate not implemented")
+}
+func (UnimplementedAllocatorServer) Free(context.Context, *FreeRequest) (*FreeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Free not implemented")
+}
+func (UnimplementedAllocatorServer) AllocateBatch(context.Context, *AllocateBatchRequest) (*AllocateBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AllocateBatch not implemented")
+}
+func (UnimplementedAllocatorServer) FreeBatch(context.Context, *FreeBatchRequest) (*FreeBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FreeBatch not implemented")
+}
+func (UnimplementedAllocatorServer) Commit(context.Context, *CommitRequest) (*CommitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commit not implemented")
+}
+func (UnimplementedAllocatorServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedAllocatorServer) WatchStats(*WatchStatsRequest, grpc.ServerStreamingServer[Stats]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchStats not implemented")
+}
+func (UnimplementedAllocatorServer) mustEmbedUnimplementedAllocatorServer() {}
+func (UnimplementedAllocatorServer) testEmbeddedByValue()                   {}
+
+// UnsafeAllocatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AllocatorServer will
+// result in compilation errors.
+type UnsafeAllocatorServer interface {
+	mustEmbedUnimplementedAllocatorServer()
+}
+
+func RegisterAllocatorServer(s grpc.ServiceRegistrar, srv AllocatorServer) {
+	// If the following call pancis, it indicates UnimplementedAllocatorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Allocator_ServiceDesc, srv)
+}
+
+func _Allocator_Allocate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).Allocate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_Allocate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).Allocate(ctx, req.(*AllocateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_Free_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FreeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).Free(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_Free_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).Free(ctx, req.(*FreeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_AllocateBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).AllocateBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_AllocateBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).AllocateBatch(ctx, req.(*AllocateBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_FreeBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FreeBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).FreeBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_FreeBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).FreeBatch(ctx, req.(*FreeBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_Commit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).Commit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_Commit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).Commit(ctx, req.(*CommitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Allocator_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Allocator_WatchStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchStatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AllocatorServer).WatchStats(m, &grpc.GenericServerStream[WatchStatsRequest, Stats]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Allocator_WatchStatsServer = grpc.ServerStreamingServer[Stats]
+
+// Allocator_ServiceDesc is the grpc.ServiceDesc for Allocator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Allocator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hybridallocator.v1.Allocator",
+	HandlerType: (*AllocatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Allocate",
+			Handler:    _Allocator_Allocate_Handler,
+		},
+		{
+			MethodName: "Free",
+			Handler:    _Allocator_Free_Handler,
+		},
+		{
+			MethodName: "AllocateBatch",
+			Handler:    _Allocator_AllocateBatch_Handler,
+		},
+		{
+			MethodName: "FreeBatch",
+			Handler:    _Allocator_FreeBatch_Handler,
+		},
+		{
+			MethodName: "Commit",
+			Handler:    _Allocator_Commit_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Allocator_GetStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchStats",
+			Handler:       _Allocator_WatchStats_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "allocator.proto",
+}
+
+const (
+	Admin_GetFragmentation_FullMethodName     = "/hybridallocator.v1.Admin/GetFragmentation"
+	Admin_ListSessions_FullMethodName         = "/hybridallocator.v1.Admin/ListSessions"
+	Admin_ReclaimExpiredLeases_FullMethodName = "/hybridallocator.v1.Admin/ReclaimExpiredLeases"
+	Admin_Snapshot_FullMethodName             = "/hybridallocator.v1.Admin/Snapshot"
+)
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Admin exposes operational calls.
+type AdminClient interface {
+	GetFragmentation(ctx context.Context, in *GetFragmentationRequest, opts ...grpc.CallOption) (*Fragmentation, error)
+	ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error)
+	ReclaimExpiredLeases(ctx context.Context, in *ReclaimExpiredLeasesRequest, opts ...grpc.CallOption) (*ReclaimExpiredLeasesResponse, error)
+	// Snapshot returns the allocator metadata readable by hybrid.LoadMetadata.
+	Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) GetFragmentation(ctx context.Context, in *GetFragmentationRequest, opts ...grpc.CallOption) (*Fragmentation, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Fragmentation)
+	err := c.cc.Invoke(ctx, Admin_GetFragmentation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSessionsResponse)
+	err := c.cc.Invoke(ctx, Admin_ListSessions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ReclaimExpiredLeases(ctx context.Context, in *ReclaimExpiredLeasesRequest, opts ...grpc.CallOption) (*ReclaimExpiredLeasesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReclaimExpiredLeasesResponse)
+	err := c.cc.Invoke(ctx, Admin_ReclaimExpiredLeases_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SnapshotResponse)
+	err := c.cc.Invoke(ctx, Admin_Snapshot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility.
+//
+// Admin exposes operational calls.
+type AdminServer interface {
+	GetFragmentation(context.Context, *GetFragmentationRequest) (*Fragmentation, error)
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	ReclaimExpiredLeases(context.Context, *ReclaimExpiredLeasesRequest) (*ReclaimExpiredLeasesResponse, error)
+	// Snapshot returns the allocator metadata readable by hybrid.LoadMetadata.
+	Snapshot(context.Context, *SnapshotRequest) (*SnapshotResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAdminServer struct{}
+
+func (UnimplementedAdminServer) GetFragmentation(context.Context, *GetFragmentationRequest) (*Fragmentation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFragmentation not implemented")
+}
+func (UnimplementedAdminServer) ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSessions not implemented")
+}
+func (UnimplementedAdminServer) ReclaimExpiredLeases(context.Context, *ReclaimExpiredLeasesRequest) (*ReclaimExpiredLeasesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReclaimExpiredLeases not implemented")
+}
+func (UnimplementedAdminServer) Snapshot(context.Context, *SnapshotRequest) (*SnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Snapshot not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+func (UnimplementedAdminServer) testEmbeddedByValue()               {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	// If the following call pancis, it indicates UnimplementedAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_GetFragmentation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFragmentationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetFragmentation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetFragmentation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetFragmentation(ctx, req.(*GetFragmentationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ListSessions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListSessions(ctx, req.(*ListSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ReclaimExpiredLeases_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReclaimExpiredLeasesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ReclaimExpiredLeases(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ReclaimExpiredLeases_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ReclaimExpiredLeases(ctx, req.(*ReclaimExpiredLeasesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Snapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_Snapshot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Snapshot(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hybridallocator.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetFragmentation",
+			Handler:    _Admin_GetFragmentation_Handler,
+		},
+		{
+			MethodName: "ListSessions",
+			Handler:    _Admin_ListSessions_Handler,
+		},
+		{
+			MethodName: "ReclaimExpiredLeases",
+			Handler:    _Admin_ReclaimExpiredLeases_Handler,
+		},
+		{
+			MethodName: "Snapshot",
+			Handler:    _Admin_Snapshot_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "allocator.proto",
+}
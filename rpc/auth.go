@@ -0,0 +1,397 @@
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds the TLS handshake of an accepted connection
+const handshakeTimeout = 10 * time.Second
+
+var (
+	// ErrUnauthenticated is returned for calls made before the connection
+	// authenticated, and for invalid credentials
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrPermissionDenied is returned when the identity of the connection
+	// lacks the role a call requires
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Role is what an identity may do. Each role includes the ones before it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleReader may read statistics
+	RoleReader
+	// RoleWriter may also allocate, and free the extents it allocated
+	RoleWriter
+	// RoleAdmin may also free any extent and manage sessions and leases
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleReader:
+		return "reader"
+	case RoleWriter:
+		return "writer"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// Identity is an authenticated principal and its role
+type Identity struct {
+	Name string
+	Role Role
+}
+
+// hmacKey is a shared secret clients prove they hold by signing a nonce
+type hmacKey struct {
+	secret   []byte
+	identity Identity
+}
+
+// authTable holds the credentials the server accepts. Authentication is
+// required as soon as any credential is registered.
+type authTable struct {
+	mu     sync.RWMutex
+	tokens map[[sha256.Size]byte]Identity // token hash -> identity
+	keys   map[string]hmacKey             // key id -> key
+	certs  map[string]Identity            // certificate common name -> identity
+	// callers act for the identities of HTTP and gRPC requests, which have
+	// no connection of their own
+	callers map[string]*connService // identity name -> caller
+}
+
+func newAuthTable() authTable {
+	return authTable{
+		tokens:  make(map[[sha256.Size]byte]Identity),
+		keys:    make(map[string]hmacKey),
+		certs:   make(map[string]Identity),
+		callers: make(map[string]*connService),
+	}
+}
+
+func (t *authTable) required() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.tokens) != 0 || len(t.keys) != 0 || len(t.certs) != 0
+}
+
+// token returns the identity of a bearer token. Tokens are looked up by
+// hash so the comparison does not leak how much of a token matched.
+func (t *authTable) token(token string) (Identity, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	identity, exists := t.tokens[sha256.Sum256([]byte(token))]
+	return identity, exists
+}
+
+// verify returns the identity of a key whose HMAC of nonce is mac
+func (t *authTable) verify(keyID string, nonce, mac []byte) (Identity, bool) {
+	t.mu.RLock()
+	key, exists := t.keys[keyID]
+	t.mu.RUnlock()
+	if !exists || !hmac.Equal(signNonce(key.secret, nonce), mac) {
+		return Identity{}, false
+	}
+	return key.identity, true
+}
+
+func (t *authTable) certificate(commonName string) (Identity, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	identity, exists := t.certs[commonName]
+	return identity, exists
+}
+
+// signNonce computes the HMAC a client answers a challenge with
+func signNonce(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func newNonce() []byte {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+	return nonce
+}
+
+// SetTLSConfig makes Serve accept TLS connections only. For mutual TLS set
+// ClientAuth to tls.RequireAndVerifyClientCert and register the common names
+// of client certificates with AddCertificate. Must be called before Serve.
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	s.tlsConfig = config
+}
+
+// AddToken accepts a bearer token for identity
+func (s *Server) AddToken(token string, identity Identity) {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	s.auth.tokens[sha256.Sum256([]byte(token))] = identity
+}
+
+// AddKey accepts HMAC-SHA256 signatures made with secret under keyID for identity
+func (s *Server) AddKey(keyID string, secret []byte, identity Identity) {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	s.auth.keys[keyID] = hmacKey{secret: append([]byte(nil), secret...), identity: identity}
+}
+
+// AddCertificate authenticates TLS clients whose verified certificate has
+// commonName as identity
+func (s *Server) AddCertificate(commonName string, identity Identity) {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	s.auth.certs[commonName] = identity
+}
+
+// handshake completes the TLS handshake of conn, if it is a TLS connection,
+// and returns the identity of its client certificate
+func (s *Server) handshake(conn net.Conn) (*Identity, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, nil
+	}
+	if identity, exists := s.auth.certificate(certs[0].Subject.CommonName); exists {
+		return &identity, nil
+	}
+	return nil, nil
+}
+
+// bearerCaller returns the caller an HTTP or gRPC request acts as, given
+// its Authorization header. Without registered credentials requests are
+// trusted like in-process calls and the caller is nil. Otherwise the header
+// must carry a bearer token registered with AddToken, and requests of the
+// same identity share one caller and its session, so that the extents an
+// identity allocated belong to it whichever transport frees them.
+func (s *Server) bearerCaller(header string) (*connService, error) {
+	if !s.auth.required() {
+		return nil, nil
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	identity, ok := s.auth.token(token)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	caller, exists := s.auth.callers[identity.Name]
+	if !exists {
+		caller = &connService{server: s, shard: s.pickShard(nil)}
+		caller.identity.Store(&identity)
+		caller.session.Store(s.sessions.open(caller))
+		s.auth.callers[identity.Name] = caller
+	}
+	// Tokens registered again may have changed the role
+	caller.identity.Store(&identity)
+	return caller, nil
+}
+
+// authorize checks that the connection may make a call requiring role.
+// Without registered credentials every call is allowed, as are in-process
+// calls which have no connection.
+func (c *connService) authorize(role Role) error {
+	if c == nil || !c.server.auth.required() {
+		return nil
+	}
+	identity := c.identity.Load()
+	if identity == nil {
+		return ErrUnauthenticated
+	}
+	if identity.Role < role {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// checkOwnerLocked checks that conn may free the extent at start: admins may
+// free anything, writers only what their identity allocated. In-process
+// calls are always allowed. The stripe of start must be held.
+func (s *Server) checkOwnerLocked(conn *connService, start uint64) error {
+	if conn == nil || !s.auth.required() {
+		return nil
+	}
+	identity := conn.identity.Load()
+	if identity == nil {
+		return ErrUnauthenticated
+	}
+	if identity.Role >= RoleAdmin {
+		return nil
+	}
+	if owner, exists := s.sessions.identityOf(start); !exists || owner != identity.Name {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// ChallengeRequest asks for a nonce to sign with an HMAC key
+type ChallengeRequest struct{}
+
+// ChallengeResponse returns a nonce valid for one Authenticate call
+type ChallengeResponse struct {
+	Nonce []byte
+}
+
+// AuthenticateRequest carries either a bearer token, or a key id with the
+// HMAC-SHA256 of the nonce returned by Challenge
+type AuthenticateRequest struct {
+	Token string
+	KeyID string
+	MAC   []byte
+}
+
+// AuthenticateResponse returns the identity the connection acts as
+type AuthenticateResponse struct {
+	Identity string
+	Role     Role
+	Code     ErrorCode
+	Error    string
+}
+
+// Challenge returns a fresh nonce for HMAC authentication
+func (c *connService) Challenge(req *ChallengeRequest, resp *ChallengeResponse) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	c.nonce = newNonce()
+	resp.Nonce = c.nonce
+	return nil
+}
+
+// Authenticate sets the identity of the connection. A connection
+// authenticates once, either with a client certificate or with this call.
+func (c *connService) Authenticate(req *AuthenticateRequest, resp *AuthenticateResponse) error {
+	identity, err := c.authenticate(req)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	resp.Identity, resp.Role = identity.Name, identity.Role
+	return nil
+}
+
+func (c *connService) authenticate(req *AuthenticateRequest) (Identity, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	// A nonce is only good for one attempt
+	nonce := c.nonce
+	c.nonce = nil
+
+	var identity Identity
+	var ok bool
+	switch {
+	case req.Token != "":
+		identity, ok = c.server.auth.token(req.Token)
+	case req.KeyID != "" && nonce != nil:
+		identity, ok = c.server.auth.verify(req.KeyID, nonce, req.MAC)
+	}
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	if !c.identity.CompareAndSwap(nil, &identity) {
+		return Identity{}, ErrPermissionDenied
+	}
+
+	c.server.sessions.mu.Lock()
+	c.session.Load().identity = identity.Name
+	c.server.sessions.mu.Unlock()
+	return identity, nil
+}
+
+// ClientConfig configures how a client reaches the server and secures and
+// authenticates its connection. The zero value connects over plain TCP
+// without credentials.
+type ClientConfig struct {
+	// Transport carries the connection, TCP if nil
+	Transport Transport
+	// TLS enables TLS, with a client certificate in Certificates for mutual TLS
+	TLS *tls.Config
+	// Token is a bearer token registered with Server.AddToken
+	Token string
+	// KeyID and Key authenticate with a key registered with Server.AddKey
+	KeyID string
+	Key   []byte
+}
+
+// dial opens a connection to the server, completing the TLS handshake when
+// TLS is configured
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	transport := c.config.Transport
+	if transport == nil {
+		transport = TCP
+	}
+	conn, err := transport.Dial(ctx, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	if c.config.TLS == nil {
+		return conn, nil
+	}
+
+	config := c.config.TLS
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(c.address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// authenticate presents the client's token or HMAC key on a new connection
+func (c *Client) authenticate(ctx context.Context, client *rpc.Client) error {
+	req := &AuthenticateRequest{Token: c.config.Token}
+	if req.Token == "" {
+		if c.config.KeyID == "" {
+			return nil
+		}
+		challenge := &ChallengeResponse{}
+		if err := invoke(ctx, client, "Server.Challenge", &ChallengeRequest{}, challenge); err != nil {
+			return fmt.Errorf("RPC call failed: %w", err)
+		}
+		req.KeyID = c.config.KeyID
+		req.MAC = signNonce(c.config.Key, challenge.Nonce)
+	}
+
+	resp := &AuthenticateResponse{}
+	if err := invoke(ctx, client, "Server.Authenticate", req, resp); err != nil {
+		return fmt.Errorf("RPC call failed: %w", err)
+	}
+	return remoteError(resp.Code, resp.Error)
+}
@@ -0,0 +1,331 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/mpool"
+	"hybridAllocator/trace"
+)
+
+// ErrBatchAborted is reported for the elements of an all-or-nothing batch
+// that were rolled back or skipped because another element failed
+var ErrBatchAborted = errors.New("batch aborted")
+
+// Extent is an allocated range of the address space
+type Extent struct {
+	Start uint64
+	Size  uint64
+}
+
+// BatchAllocRequest allocates many extents in one call. With Atomic set
+// either every size is allocated or none is.
+type BatchAllocRequest struct {
+	Sizes  []uint64
+	Atomic bool
+}
+
+// BatchAllocResponse holds one result per requested size
+type BatchAllocResponse struct {
+	Results []AllocResponse
+	Code    ErrorCode
+	Error   string
+}
+
+// BatchFreeRequest frees many extents in one call. With Atomic set the
+// extents are validated up front and nothing is freed if any is invalid.
+type BatchFreeRequest struct {
+	Extents []Extent
+	Atomic  bool
+}
+
+// BatchFreeResponse holds one result per extent
+type BatchFreeResponse struct {
+	Results []FreeResponse
+	Code    ErrorCode
+	Error   string
+}
+
+func (s *Server) AllocateBatch(req *BatchAllocRequest, resp *BatchAllocResponse) error {
+	return s.allocateBatch(nil, req, resp)
+}
+
+// allocateBatch serves a batch allocation made through conn, which is nil
+// for in-process calls
+func (s *Server) allocateBatch(conn *connService, req *BatchAllocRequest, resp *BatchAllocResponse) error {
+	starts, errs, err := s.allocateExtents(context.Background(), conn, req.Sizes, req.Atomic)
+	resp.Results = make([]AllocResponse, len(req.Sizes))
+	for i := range req.Sizes {
+		resp.Results[i].Start = starts[i]
+		if errs[i] != nil {
+			resp.Results[i].Code, resp.Results[i].Error = wireError(errs[i])
+		}
+	}
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+// allocateExtents allocates every size and returns per-element errors. With
+// atomic set the first failure rolls the batch back and is returned as err.
+func (s *Server) allocateExtents(ctx context.Context, conn *connService, sizes []uint64, atomic bool) (starts []uint64, errs []error, err error) {
+	ctx, span := trace.Start(ctx, s.tracer.Get(), "rpc.AllocateBatch", trace.Int("count", len(sizes)), trace.Bool("atomic", atomic))
+	defer func() {
+		span.End(trace.Error(err))
+	}()
+
+	starts = make([]uint64, len(sizes))
+	pools := make([]*mpool.MemoryPool, len(sizes))
+	errs = make([]error, len(sizes))
+	for i, size := range sizes {
+		start, pool, err := s.allocateExtent(ctx, conn, size)
+		if err != nil {
+			errs[i] = err
+			if atomic {
+				s.abortBatch(ctx, sizes, starts, pools, errs, i)
+				return starts, errs, err
+			}
+			continue
+		}
+		starts[i], pools[i] = start, pool
+	}
+
+	// Extents only become visible once the whole batch is allocated
+	for i, size := range sizes {
+		if errs[i] == nil {
+			stripe := s.extents.lock(starts[i])
+			s.publishLocked(conn, starts[i], size, pools[i])
+			stripe.mu.Unlock()
+		}
+	}
+	return starts, errs, nil
+}
+
+// abortBatch rolls back the allocations made before element failed and
+// marks every other element as aborted. Nothing was published yet, so the
+// extents go straight back to their pools.
+func (s *Server) abortBatch(ctx context.Context, sizes, starts []uint64, pools []*mpool.MemoryPool, errs []error, failed int) {
+	for i := range sizes {
+		if i == failed {
+			continue
+		}
+		if i < failed {
+			if err := pools[i].FreeContext(ctx, starts[i], sizes[i]); err != nil {
+				fmt.Printf("Failed to roll back batch allocation at %d: %v\n", starts[i], err)
+			}
+		}
+		starts[i] = 0
+		errs[i] = ErrBatchAborted
+	}
+}
+
+func (s *Server) FreeBatch(req *BatchFreeRequest, resp *BatchFreeResponse) error {
+	return s.freeBatch(nil, req, resp)
+}
+
+// freeBatch serves a batch free made through conn, which is nil for
+// in-process calls
+func (s *Server) freeBatch(conn *connService, req *BatchFreeRequest, resp *BatchFreeResponse) error {
+	errs, err := s.freeExtents(context.Background(), conn, req.Extents, req.Atomic)
+	resp.Results = make([]FreeResponse, len(req.Extents))
+	for i := range req.Extents {
+		if errs[i] != nil {
+			resp.Results[i].Code, resp.Results[i].Error = wireError(errs[i])
+		}
+	}
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+// freeExtents frees every extent and returns per-element errors. With atomic
+// set nothing is freed unless every extent is valid, and the first invalid
+// one is returned as err.
+func (s *Server) freeExtents(ctx context.Context, conn *connService, extents []Extent, atomic bool) (errs []error, err error) {
+	ctx, span := trace.Start(ctx, s.tracer.Get(), "rpc.FreeBatch", trace.Int("count", len(extents)), trace.Bool("atomic", atomic))
+	defer func() {
+		span.End(trace.Error(err))
+	}()
+
+	errs = make([]error, len(extents))
+	if !atomic {
+		for i, extent := range extents {
+			stripe := s.extents.lock(extent.Start)
+			errs[i] = s.freeExtentLocked(ctx, conn, extent.Start, extent.Size)
+			stripe.mu.Unlock()
+		}
+		return errs, nil
+	}
+
+	// Hold every stripe involved so the extents cannot change between
+	// validating and freeing them
+	starts := make([]uint64, len(extents))
+	for i, extent := range extents {
+		starts[i] = extent.Start
+	}
+	unlock := s.extents.lockAll(starts)
+	defer unlock()
+
+	if err := s.validateExtentsLocked(conn, extents, errs); err != nil {
+		return errs, err
+	}
+	for i, extent := range extents {
+		errs[i] = s.freeExtentLocked(ctx, conn, extent.Start, extent.Size)
+	}
+	return errs, nil
+}
+
+// validateExtentsLocked checks that every extent is allocated with its
+// size, listed once and may be freed through conn. On failure the offending elements carry
+// their error and the rest are marked as aborted. The stripes of every
+// extent must be held.
+func (s *Server) validateExtentsLocked(conn *connService, extents []Extent, errs []error) error {
+	var failure error
+	seen := make(map[uint64]bool, len(extents))
+	for i, extent := range extents {
+		ownerErr := s.checkOwnerLocked(conn, extent.Start)
+		e, exists := s.extents.lookup(extent.Start)
+		switch {
+		case seen[extent.Start]:
+			errs[i] = hybrid.ErrAddressNotAllocated
+		case exists && e.size != extent.Size:
+			errs[i] = hybrid.ErrInvalidAddress
+		case !s.allocatedLocked(extent.Start, extent.Size):
+			errs[i] = hybrid.ErrAddressNotAllocated
+		case ownerErr != nil:
+			errs[i] = ownerErr
+		default:
+			seen[extent.Start] = true
+			continue
+		}
+		if failure == nil {
+			failure = fmt.Errorf("extent %d of %d bytes: %w", extent.Start, extent.Size, errs[i])
+		}
+	}
+	if failure == nil {
+		return nil
+	}
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchAborted
+		}
+	}
+	return failure
+}
+
+func (c *connService) AllocateBatch(req *BatchAllocRequest, resp *BatchAllocResponse) error {
+	if err := c.authorize(RoleWriter); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	var bytes uint64
+	for _, size := range req.Sizes {
+		bytes += size
+	}
+	done, err := c.admit(bytes)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	defer done()
+	return c.server.allocateBatch(c, req, resp)
+}
+
+func (c *connService) FreeBatch(req *BatchFreeRequest, resp *BatchFreeResponse) error {
+	if err := c.authorize(RoleWriter); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	done, err := c.admit(0)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	defer done()
+	return c.server.freeBatch(c, req, resp)
+}
+
+// AllocateBatch allocates memory for every size in one round trip. It returns
+// the start addresses and a per-element error; err is only set when the call
+// itself failed. With atomic set either all sizes are allocated or none is.
+func (c *Client) AllocateBatch(sizes []uint64, atomic bool) ([]uint64, []error, error) {
+	return c.AllocateBatchContext(context.Background(), sizes, atomic)
+}
+
+// AllocateBatchContext is AllocateBatch with a context. Batches are not
+// retried once they may have reached the server.
+func (c *Client) AllocateBatchContext(ctx context.Context, sizes []uint64, atomic bool) ([]uint64, []error, error) {
+	req := &BatchAllocRequest{Sizes: sizes, Atomic: atomic}
+	resp := &BatchAllocResponse{}
+
+	if err := c.call(ctx, "Server.AllocateBatch", req, resp, false); err != nil {
+		return nil, nil, err
+	}
+	if err := batchError(resp.Code, resp.Error, len(resp.Results), len(sizes)); err != nil {
+		return nil, nil, err
+	}
+
+	starts := make([]uint64, len(sizes))
+	errs := make([]error, len(sizes))
+	c.mu.Lock()
+	for i, result := range resp.Results {
+		if errs[i] = remoteError(result.Code, result.Error); errs[i] != nil {
+			continue
+		}
+		starts[i] = result.Start
+		c.allocated[result.Start] = sizes[i]
+	}
+	c.mu.Unlock()
+
+	return starts, errs, nil
+}
+
+// FreeBatch frees every extent in one round trip and returns a per-element
+// error; err is only set when the call itself failed. With atomic set nothing
+// is freed unless every extent is valid.
+func (c *Client) FreeBatch(extents []Extent, atomic bool) ([]error, error) {
+	return c.FreeBatchContext(context.Background(), extents, atomic)
+}
+
+// FreeBatchContext is FreeBatch with a context. Batches are not retried once
+// they may have reached the server.
+func (c *Client) FreeBatchContext(ctx context.Context, extents []Extent, atomic bool) ([]error, error) {
+	req := &BatchFreeRequest{Extents: extents, Atomic: atomic}
+	resp := &BatchFreeResponse{}
+
+	if err := c.call(ctx, "Server.FreeBatch", req, resp, false); err != nil {
+		return nil, err
+	}
+	if err := batchError(resp.Code, resp.Error, len(resp.Results), len(extents)); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(extents))
+	c.mu.Lock()
+	for i, result := range resp.Results {
+		if errs[i] = remoteError(result.Code, result.Error); errs[i] != nil {
+			continue
+		}
+		delete(c.allocated, extents[i].Start)
+	}
+	c.mu.Unlock()
+
+	return errs, nil
+}
+
+// batchError returns the error of a batch rejected as a whole, such as one
+// the caller may not make or one over its limits, which comes back without
+// per-element results. Atomic batches that failed carry their error along
+// with the result of every element, which tells callers more.
+func batchError(code ErrorCode, message string, results, elements int) error {
+	if results == elements {
+		return nil
+	}
+	if err := remoteError(code, message); err != nil {
+		return err
+	}
+	return fmt.Errorf("batch of %d elements got %d results", elements, results)
+}
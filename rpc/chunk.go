@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"hybridAllocator/hybrid"
+)
+
+// DefaultChunkSize is a reasonable chunk size for client-side extent caches
+const DefaultChunkSize = 64 * 1024 * 1024
+
+// ErrInvalidChunkSize is returned for chunk sizes the client cannot sub-allocate
+var ErrInvalidChunkSize = errors.New("chunk size must be a power of two larger than the slab size")
+
+// ChunkRequest asks for a large block to be sub-allocated by the client
+type ChunkRequest struct {
+	Size uint64
+}
+
+// ChunkResponse returns a granted chunk, aligned to its size
+type ChunkResponse struct {
+	Start uint64
+	Code  ErrorCode
+	Error string
+}
+
+// chunk is a server-granted block sub-allocated locally by the client
+type chunk struct {
+	start     uint64
+	size      uint64
+	allocator *hybrid.Allocator
+}
+
+func validChunkSize(size uint64) bool {
+	return size > hybrid.SlabMaxSize && size <= hybrid.MaxBlockSize && size&(size-1) == 0
+}
+
+func (s *Server) GrantChunk(req *ChunkRequest, resp *ChunkResponse) error {
+	return s.grantChunk(nil, req, resp)
+}
+
+// grantChunk hands out a buddy block for a client to sub-allocate. It bypasses
+// the memory pool so the block is always aligned to its size.
+func (s *Server) grantChunk(conn *connService, req *ChunkRequest, resp *ChunkResponse) error {
+	if !validChunkSize(req.Size) {
+		resp.Code, resp.Error = wireError(ErrInvalidChunkSize)
+		return nil
+	}
+
+	start, err := s.allocator.Allocate(req.Size)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+
+	stripe := s.extents.lock(start)
+	s.publishLocked(conn, start, req.Size, nil)
+	stripe.mu.Unlock()
+	resp.Start = start
+	return nil
+}
+
+func (c *connService) GrantChunk(req *ChunkRequest, resp *ChunkResponse) error {
+	if err := c.authorize(RoleWriter); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	done, err := c.admit(req.Size)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	defer done()
+	return c.server.grantChunk(c, req, resp)
+}
+
+// EnableChunkCache makes the client serve allocations up to
+// hybrid.SlabMaxSize from chunks of chunkSize bytes granted by the server,
+// sub-allocated locally with a hybrid allocator. Chunks go back to the server
+// once they are fully free, except for the last one which is kept warm until
+// ReturnChunks or Close.
+func (c *Client) EnableChunkCache(chunkSize uint64) error {
+	if !validChunkSize(chunkSize) {
+		return ErrInvalidChunkSize
+	}
+
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+	c.chunkSize = chunkSize
+	return nil
+}
+
+// allocateFromChunk serves a small allocation locally, requesting a new
+// chunk from the server when every cached chunk is full
+func (c *Client) allocateFromChunk(ctx context.Context, size uint64) (uint64, error) {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+
+	for _, ch := range c.chunks {
+		start, err := ch.allocator.Allocate(size)
+		if err == nil {
+			return start, nil
+		}
+		if err != hybrid.ErrNoSpaceAvailable {
+			return 0, err
+		}
+	}
+
+	req := &ChunkRequest{Size: c.chunkSize}
+	resp := &ChunkResponse{}
+	if err := c.call(ctx, "Server.GrantChunk", req, resp, false); err != nil {
+		return 0, err
+	}
+	if err := remoteError(resp.Code, resp.Error); err != nil {
+		return 0, err
+	}
+
+	allocator, err := hybrid.NewAllocatorRange(resp.Start, c.chunkSize)
+	if err != nil {
+		return 0, err
+	}
+	c.chunks = append(c.chunks, &chunk{start: resp.Start, size: c.chunkSize, allocator: allocator})
+	return allocator.Allocate(size)
+}
+
+// freeToChunk frees a locally sub-allocated extent. It reports false if the
+// extent does not belong to any cached chunk.
+func (c *Client) freeToChunk(ctx context.Context, start, size uint64) (bool, error) {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+
+	for i, ch := range c.chunks {
+		if start < ch.start || start >= ch.start+ch.size {
+			continue
+		}
+		if err := ch.allocator.Free(start, size); err != nil {
+			return true, err
+		}
+		if ch.allocator.GetUsedSize() == 0 && len(c.chunks) > 1 {
+			return true, c.returnChunkLocked(ctx, i)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// returnChunkLocked gives a fully free chunk back to the server
+func (c *Client) returnChunkLocked(ctx context.Context, i int) error {
+	ch := c.chunks[i]
+	if err := c.free(ctx, ch.start, ch.size); err != nil {
+		return err
+	}
+
+	c.chunks = append(c.chunks[:i], c.chunks[i+1:]...)
+	ch.allocator.Close()
+	return nil
+}
+
+// ReturnChunks gives every fully free chunk back to the server
+func (c *Client) ReturnChunks() error {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+
+	for i := len(c.chunks) - 1; i >= 0; i-- {
+		if c.chunks[i].allocator.GetUsedSize() != 0 {
+			continue
+		}
+		if err := c.returnChunkLocked(context.Background(), i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,66 +1,326 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/workload"
+	"io"
+	"net"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrClientClosed is returned by calls made after Close
+var ErrClientClosed = errors.New("client closed")
+
+// RetryPolicy controls how a client reconnects after its connection breaks
+type RetryPolicy struct {
+	MaxAttempts    int           // attempts per call, including the first
+	InitialBackoff time.Duration // wait before the first retry, doubled after each one
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy retries a call for a few seconds before giving up
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    8,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
 // Client represents a memory pool client
 type Client struct {
 	id        int
-	client    *rpc.Client
+	address   string
+	config    ClientConfig
+	key       string // identifies the client to the server across reconnects
+	requests  atomic.Uint64
+	retry     RetryPolicy
+	timeout   time.Duration // default deadline of calls without one
+	session   string
+	client    *rpc.Client // nil while disconnected
+	closed    bool
+	connMu    sync.Mutex
 	allocated map[uint64]uint64 // start -> size
 	mu        sync.Mutex
+	chunkSize uint64 // zero unless the chunk cache is enabled
+	chunks    []*chunk
+	chunkMu   sync.Mutex
+	recorder  workload.Hook
 }
 
 // NewClient creates a new memory pool client
 func NewClient(id int, address string) (*Client, error) {
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %v", err)
-	}
+	return NewClientWithConfig(id, address, ClientConfig{})
+}
 
-	return &Client{
+// NewClientWithConfig creates a memory pool client that connects with TLS
+// and credentials as set in config
+func NewClientWithConfig(id int, address string, config ClientConfig) (*Client, error) {
+	c := &Client{
 		id:        id,
-		client:    client,
+		address:   address,
+		config:    config,
+		key:       newSessionID(),
+		retry:     DefaultRetryPolicy,
 		allocated: make(map[uint64]uint64),
-	}, nil
+	}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if err := c.connectLocked(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetRetryPolicy changes how calls are retried when the connection breaks
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.retry = policy
+}
+
+// SetCallTimeout sets the deadline of calls whose context has none, zero
+// disables it
+func (c *Client) SetCallTimeout(timeout time.Duration) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.timeout = timeout
+}
+
+// connectLocked dials the server, authenticates and opens the session,
+// reattaching to the previous one if the client had a session before
+func (c *Client) connectLocked(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
+	if err := c.authenticate(ctx, client); err != nil {
+		client.Close()
+		return err
+	}
+
+	req := &OpenSessionRequest{ClientID: c.id, SessionID: c.session, ClientKey: c.key}
+	resp := &OpenSessionResponse{}
+	if err := invoke(ctx, client, "Server.OpenSession", req, resp); err != nil {
+		client.Close()
+		return fmt.Errorf("RPC call failed: %w", err)
+	}
+	if err := remoteError(resp.Code, resp.Error); err != nil {
+		client.Close()
+		return err
+	}
+
+	c.client = client
+	c.session = resp.SessionID
+	return nil
+}
+
+// conn returns the current connection, reconnecting if it was dropped. If
+// the server released the session in the meantime a new one is opened.
+func (c *Client) conn(ctx context.Context) (*rpc.Client, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if c.client != nil {
+		return c.client, nil
+	}
+	err := c.connectLocked(ctx)
+	if errors.Is(err, ErrSessionNotFound) {
+		c.session = ""
+		err = c.connectLocked(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.client, nil
+}
+
+// dropConn closes a broken connection unless it was replaced already
+func (c *Client) dropConn(client *rpc.Client) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.client == client {
+		client.Close()
+		c.client = nil
+	}
+}
+
+// Reconnect replaces the connection to the server and reattaches to the
+// session, so allocations made before the connection dropped stay owned. If
+// the server released the session in the meantime a new one is opened.
+func (c *Client) Reconnect() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	err := c.connectLocked(context.Background())
+	if errors.Is(err, ErrSessionNotFound) {
+		c.session = ""
+		err = c.connectLocked(context.Background())
+	}
+	return err
+}
+
+// SessionID returns the id of the server-side session owning the client's allocations
+func (c *Client) SessionID() string {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.session
+}
+
+// invoke performs a single call, giving up when ctx is done
+func invoke(ctx context.Context, client *rpc.Client, method string, args, reply any) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connError reports whether err means the connection is broken
+func connError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.As(err, &netErr)
+}
+
+// call performs an RPC, reconnecting with backoff while the connection is
+// broken. A call that may have reached the server is only retried when it is
+// idempotent, so a retry can never apply it twice.
+func (c *Client) call(ctx context.Context, method string, args, reply any, idempotent bool) error {
+	c.connMu.Lock()
+	retry, timeout := c.retry, c.timeout
+	c.connMu.Unlock()
+	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	backoff := retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		client, err := c.conn(ctx)
+		sent := false
+		if err == nil {
+			err = invoke(ctx, client, method, args, reply)
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil || !connError(err) {
+				return fmt.Errorf("RPC call failed: %w", err)
+			}
+			// ErrShutdown means the call was never written to the connection
+			sent = !errors.Is(err, rpc.ErrShutdown)
+			c.dropConn(client)
+			err = fmt.Errorf("RPC call failed: %w", err)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("RPC call failed: %w", ctx.Err())
+		}
+		if !connError(err) || (sent && !idempotent) || attempt >= retry.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("RPC call failed: %w", ctx.Err())
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, retry.MaxBackoff)
+	}
+}
+
+// nextRequestID returns a fresh idempotency key
+func (c *Client) nextRequestID() uint64 {
+	return c.requests.Add(1)
 }
 
 // Allocate allocates memory through the server
 func (c *Client) Allocate(size uint64) (uint64, error) {
-	req := &AllocRequest{Size: size}
+	return c.AllocateContext(context.Background(), size)
+}
+
+// AllocateContext allocates memory through the server. A retry after the
+// connection broke never allocates twice.
+func (c *Client) AllocateContext(ctx context.Context, size uint64) (start uint64, err error) {
+	defer c.record(workload.Allocate, time.Now(), size, &start, &err)
+	if c.chunkCacheEnabled() && size <= hybrid.SlabMaxSize {
+		start, err := c.allocateFromChunk(ctx, size)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.allocated[start] = size
+		c.mu.Unlock()
+		return start, nil
+	}
+
+	start, _, err = c.allocate(ctx, &AllocRequest{Size: size})
+	return start, err
+}
+
+// allocate sends an allocation request with a fresh idempotency key
+func (c *Client) allocate(ctx context.Context, req *AllocRequest) (uint64, uint64, error) {
+	req.RequestID = c.nextRequestID()
 	resp := &AllocResponse{}
 
-	err := c.client.Call("Server.Allocate", req, resp)
-	if err != nil {
-		return 0, fmt.Errorf("RPC call failed: %v", err)
+	if err := c.call(ctx, "Server.Allocate", req, resp, true); err != nil {
+		return 0, 0, err
 	}
 
-	if resp.Error != "" {
-		return 0, fmt.Errorf("server error: %s", resp.Error)
+	if err := remoteError(resp.Code, resp.Error); err != nil {
+		return 0, 0, err
 	}
 
 	c.mu.Lock()
-	c.allocated[resp.Start] = size
+	c.allocated[resp.Start] = req.Size
 	c.mu.Unlock()
 
-	return resp.Start, nil
+	return resp.Start, resp.LeaseID, nil
 }
 
 // Free frees memory through the server
 func (c *Client) Free(start uint64, size uint64) error {
-	req := &FreeRequest{Start: start, Size: size}
-	resp := &FreeResponse{}
+	return c.FreeContext(context.Background(), start, size)
+}
 
-	err := c.client.Call("Server.Free", req, resp)
-	if err != nil {
-		return fmt.Errorf("RPC call failed: %v", err)
+// FreeContext frees memory through the server. A retry after the connection
+// broke never frees twice.
+func (c *Client) FreeContext(ctx context.Context, start uint64, size uint64) (err error) {
+	defer c.record(workload.Free, time.Now(), size, &start, &err)
+	if c.chunkCacheEnabled() && size <= hybrid.SlabMaxSize {
+		if handled, err := c.freeToChunk(ctx, start, size); handled {
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			delete(c.allocated, start)
+			c.mu.Unlock()
+			return nil
+		}
 	}
 
-	if resp.Error != "" {
-		return fmt.Errorf("server error: %s", resp.Error)
+	if err := c.free(ctx, start, size); err != nil {
+		return err
 	}
 
 	c.mu.Lock()
@@ -70,7 +330,81 @@ func (c *Client) Free(start uint64, size uint64) error {
 	return nil
 }
 
-// Close closes the client connection
+// free sends a free request with a fresh idempotency key
+func (c *Client) free(ctx context.Context, start, size uint64) error {
+	req := &FreeRequest{Start: start, Size: size, RequestID: c.nextRequestID()}
+	resp := &FreeResponse{}
+
+	if err := c.call(ctx, "Server.Free", req, resp, true); err != nil {
+		return err
+	}
+	return remoteError(resp.Code, resp.Error)
+}
+
+// SetRecorder installs a recorder receiving every allocation and free made
+// through the client, tagged with the client ID. nil stops recording.
+func (c *Client) SetRecorder(r workload.Recorder) {
+	c.recorder.Set(r)
+}
+
+// record reports a completed operation to the recorder, if any. It is
+// deferred with pointers to the results, which are read once the call ends.
+func (c *Client) record(op workload.Op, began time.Time, size uint64, start *uint64, err *error) {
+	if r := c.recorder.Get(); r != nil {
+		r.Record(workload.Record{Op: op, Time: began, Client: uint32(c.id), Size: size, Addr: *start, Failed: *err != nil})
+	}
+}
+
+// chunkCacheEnabled reports whether small allocations are served from chunks
+func (c *Client) chunkCacheEnabled() bool {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+	return c.chunkSize != 0
+}
+
+// Close returns the free chunks and closes the client connection
 func (c *Client) Close() error {
-	return c.client.Close()
+	if c.chunkCacheEnabled() {
+		if err := c.ReturnChunks(); err != nil {
+			fmt.Printf("Failed to return chunks: %v\n", err)
+		}
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.closed = true
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// AllocateWithLease allocates memory that the server reclaims unless it is
+// committed within ttl
+func (c *Client) AllocateWithLease(size uint64, ttl time.Duration) (uint64, uint64, error) {
+	return c.AllocateWithLeaseContext(context.Background(), size, ttl)
+}
+
+// AllocateWithLeaseContext is AllocateWithLease with a context
+func (c *Client) AllocateWithLeaseContext(ctx context.Context, size uint64, ttl time.Duration) (uint64, uint64, error) {
+	return c.allocate(ctx, &AllocRequest{Size: size, LeaseTTL: ttl})
+}
+
+// Commit confirms a leased allocation
+func (c *Client) Commit(leaseID uint64) error {
+	return c.CommitContext(context.Background(), leaseID)
+}
+
+// CommitContext confirms a leased allocation
+func (c *Client) CommitContext(ctx context.Context, leaseID uint64) error {
+	req := &CommitRequest{LeaseID: leaseID}
+	resp := &CommitResponse{}
+
+	if err := c.call(ctx, "Server.Commit", req, resp, false); err != nil {
+		return err
+	}
+
+	return remoteError(resp.Code, resp.Error)
 }
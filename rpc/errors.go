@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"errors"
+	"hybridAllocator/hybrid"
+)
+
+// ErrorCode identifies a sentinel error on the wire. Codes are part of the
+// protocol: new ones are appended and existing ones never change.
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	// CodeUnknown is an error without a sentinel, only its message is kept
+	CodeUnknown
+	CodeSizeTooLarge
+	CodeNoSpaceAvailable
+	CodeInvalidAddress
+	CodeSlabNotFound
+	CodeSlabFull
+	CodeAddressAlreadyAllocated
+	CodeAddressNotAllocated
+	CodeBlockNotFound
+	CodeInvalidWatermarks
+	CodeExtentShared
+	CodeInvalidRange
+	CodeCorruptMetadata
+	CodeLeaseNotFound
+	CodeSessionNotFound
+	CodeBatchAborted
+	CodeInvalidChunkSize
+	CodeServerClosed
+	CodeUnauthenticated
+	CodePermissionDenied
+	CodeRateLimited
+	CodeOverloaded
+	CodeInconsistent
+
+	// lastCode is the highest code in use
+	lastCode = CodeInconsistent
+)
+
+// codeErrors maps every code to the sentinel it stands for
+var codeErrors = map[ErrorCode]error{
+	CodeSizeTooLarge:            hybrid.ErrSizeTooLarge,
+	CodeNoSpaceAvailable:        hybrid.ErrNoSpaceAvailable,
+	CodeInvalidAddress:          hybrid.ErrInvalidAddress,
+	CodeSlabNotFound:            hybrid.ErrSlabNotFound,
+	CodeSlabFull:                hybrid.ErrSlabFull,
+	CodeAddressAlreadyAllocated: hybrid.ErrAddressAlreadyAllocated,
+	CodeAddressNotAllocated:     hybrid.ErrAddressNotAllocated,
+	CodeBlockNotFound:           hybrid.ErrBlockNotFound,
+	CodeInvalidWatermarks:       hybrid.ErrInvalidWatermarks,
+	CodeExtentShared:            hybrid.ErrExtentShared,
+	CodeInvalidRange:            hybrid.ErrInvalidRange,
+	CodeCorruptMetadata:         hybrid.ErrCorruptMetadata,
+	CodeLeaseNotFound:           ErrLeaseNotFound,
+	CodeSessionNotFound:         ErrSessionNotFound,
+	CodeBatchAborted:            ErrBatchAborted,
+	CodeInvalidChunkSize:        ErrInvalidChunkSize,
+	CodeServerClosed:            ErrServerClosed,
+	CodeUnauthenticated:         ErrUnauthenticated,
+	CodePermissionDenied:        ErrPermissionDenied,
+	CodeRateLimited:             ErrRateLimited,
+	CodeOverloaded:              ErrOverloaded,
+	CodeInconsistent:            hybrid.ErrInconsistent,
+}
+
+// Err returns the sentinel error of the code, nil for CodeOK and CodeUnknown
+func (c ErrorCode) Err() error {
+	return codeErrors[c]
+}
+
+// errorCode returns the code of the sentinel wrapped by err
+func errorCode(err error) ErrorCode {
+	if err == nil {
+		return CodeOK
+	}
+	for code := CodeSizeTooLarge; code <= lastCode; code++ {
+		if errors.Is(err, codeErrors[code]) {
+			return code
+		}
+	}
+	return CodeUnknown
+}
+
+// wireError splits err into the code and message carried by responses
+func wireError(err error) (ErrorCode, string) {
+	return errorCode(err), err.Error()
+}
+
+// ServerError is an error reported by the server. It unwraps to the sentinel
+// named by its code, so callers can use errors.Is(err, hybrid.ErrNoSpaceAvailable).
+type ServerError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Code.Err()
+}
+
+// remoteError rebuilds the error of a response, nil if there is none
+func remoteError(code ErrorCode, message string) error {
+	if code == CodeOK && message == "" {
+		return nil
+	}
+	if code == CodeOK {
+		code = CodeUnknown
+	}
+	return &ServerError{Code: code, Message: message}
+}
+
+// CodeOf returns the code of the sentinel wrapped by err, for services that
+// carry allocator errors in their own messages
+func CodeOf(err error) ErrorCode {
+	return errorCode(err)
+}
@@ -0,0 +1,318 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/rpc/allocatorpb"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NewGRPCServer returns a gRPC server exposing the Allocator and Admin
+// services over the same pool and allocator as the RPC server. Without
+// registered credentials allocations made over gRPC belong to no session.
+// Otherwise calls carry a bearer token registered with AddToken in their
+// authorization metadata, and are held to the roles and ownership of its
+// identity like RPC calls.
+func (s *Server) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	s.RegisterGRPC(server)
+	return server
+}
+
+// RegisterGRPC registers the Allocator and Admin services on registrar
+func (s *Server) RegisterGRPC(registrar grpc.ServiceRegistrar) {
+	allocatorpb.RegisterAllocatorServer(registrar, &grpcAllocator{server: s})
+	allocatorpb.RegisterAdminServer(registrar, &grpcAdmin{server: s})
+}
+
+// grpcCode maps allocator errors to gRPC status codes
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, hybrid.ErrNoSpaceAvailable):
+		return codes.ResourceExhausted
+	case errors.Is(err, hybrid.ErrSizeTooLarge), errors.Is(err, hybrid.ErrInvalidAddress),
+		errors.Is(err, errInvalidSize):
+		return codes.InvalidArgument
+	case errors.Is(err, hybrid.ErrAddressNotAllocated), errors.Is(err, hybrid.ErrBlockNotFound),
+		errors.Is(err, hybrid.ErrSlabNotFound), errors.Is(err, ErrLeaseNotFound):
+		return codes.NotFound
+	case errors.Is(err, hybrid.ErrExtentShared), errors.Is(err, hybrid.ErrAddressAlreadyAllocated):
+		return codes.FailedPrecondition
+	case errors.Is(err, ErrBatchAborted):
+		return codes.Aborted
+	case errors.Is(err, ErrUnauthenticated):
+		return codes.Unauthenticated
+	case errors.Is(err, ErrPermissionDenied):
+		return codes.PermissionDenied
+	case errors.Is(err, ErrRateLimited):
+		return codes.ResourceExhausted
+	case errors.Is(err, ErrOverloaded):
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+func grpcError(err error) error {
+	return status.Error(grpcCode(err), err.Error())
+}
+
+// grpcCaller returns the caller a gRPC call acts as, given the bearer token
+// in its authorization metadata, after checking that it has role
+func (s *Server) grpcCaller(ctx context.Context, role Role) (*connService, error) {
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			header = values[0]
+		}
+	}
+	caller, err := s.bearerCaller(header)
+	if err == nil {
+		err = caller.authorize(role)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return caller, nil
+}
+
+// grpcAllocator implements allocatorpb.AllocatorServer
+type grpcAllocator struct {
+	allocatorpb.UnimplementedAllocatorServer
+	server *Server
+}
+
+func (g *grpcAllocator) Allocate(ctx context.Context, req *allocatorpb.AllocateRequest) (*allocatorpb.AllocateResponse, error) {
+	caller, err := g.server.grpcCaller(ctx, RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetSize() == 0 {
+		return nil, grpcError(errInvalidSize)
+	}
+	done, err := g.server.admitCaller(caller, req.GetSize())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer done()
+
+	resp := &AllocResponse{}
+	err = g.server.allocate(ctx, caller, &AllocRequest{Size: req.GetSize(), LeaseTTL: req.GetLeaseTtl().AsDuration()}, resp)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	out := &allocatorpb.AllocateResponse{Start: resp.Start, LeaseId: resp.LeaseID}
+	if resp.LeaseID != 0 {
+		out.LeaseExpires = timestamppb.New(resp.LeaseExpires)
+	}
+	return out, nil
+}
+
+func (g *grpcAllocator) Free(ctx context.Context, req *allocatorpb.FreeRequest) (*allocatorpb.FreeResponse, error) {
+	caller, err := g.server.grpcCaller(ctx, RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetSize() == 0 {
+		return nil, grpcError(errInvalidSize)
+	}
+	done, err := g.server.admitCaller(caller, 0)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer done()
+	if err := g.server.free(ctx, caller, &FreeRequest{Start: req.GetStart(), Size: req.GetSize()}); err != nil {
+		return nil, grpcError(err)
+	}
+	return &allocatorpb.FreeResponse{}, nil
+}
+
+func (g *grpcAllocator) AllocateBatch(ctx context.Context, req *allocatorpb.AllocateBatchRequest) (*allocatorpb.AllocateBatchResponse, error) {
+	caller, err := g.server.grpcCaller(ctx, RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+	var bytes uint64
+	for _, size := range req.GetSizes() {
+		bytes += size
+	}
+	done, err := g.server.admitCaller(caller, bytes)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer done()
+	starts, errs, err := g.server.allocateExtents(ctx, caller, req.GetSizes(), req.GetAtomic())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &allocatorpb.AllocateBatchResponse{Results: make([]*allocatorpb.BatchResult, len(starts))}
+	for i := range starts {
+		resp.Results[i] = batchResult(starts[i], errs[i])
+	}
+	return resp, nil
+}
+
+func (g *grpcAllocator) FreeBatch(ctx context.Context, req *allocatorpb.FreeBatchRequest) (*allocatorpb.FreeBatchResponse, error) {
+	caller, err := g.server.grpcCaller(ctx, RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+	done, err := g.server.admitCaller(caller, 0)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer done()
+	extents := make([]Extent, len(req.GetExtents()))
+	for i, extent := range req.GetExtents() {
+		extents[i] = Extent{Start: extent.GetStart(), Size: extent.GetSize()}
+	}
+	errs, err := g.server.freeExtents(ctx, caller, extents, req.GetAtomic())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &allocatorpb.FreeBatchResponse{Results: make([]*allocatorpb.BatchResult, len(extents))}
+	for i := range extents {
+		resp.Results[i] = batchResult(extents[i].Start, errs[i])
+	}
+	return resp, nil
+}
+
+func batchResult(start uint64, err error) *allocatorpb.BatchResult {
+	if err != nil {
+		return &allocatorpb.BatchResult{Code: int32(grpcCode(err)), Error: err.Error()}
+	}
+	return &allocatorpb.BatchResult{Start: start}
+}
+
+func (g *grpcAllocator) Commit(ctx context.Context, req *allocatorpb.CommitRequest) (*allocatorpb.CommitResponse, error) {
+	caller, err := g.server.grpcCaller(ctx, RoleWriter)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.server.commit(caller, req.GetLeaseId()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &allocatorpb.CommitResponse{}, nil
+}
+
+func (g *grpcAllocator) GetStats(ctx context.Context, req *allocatorpb.GetStatsRequest) (*allocatorpb.Stats, error) {
+	if _, err := g.server.grpcCaller(ctx, RoleReader); err != nil {
+		return nil, err
+	}
+	return statsProto(g.server.stats()), nil
+}
+
+func (g *grpcAllocator) WatchStats(req *allocatorpb.WatchStatsRequest, stream grpc.ServerStreamingServer[allocatorpb.Stats]) error {
+	if _, err := g.server.grpcCaller(stream.Context(), RoleReader); err != nil {
+		return err
+	}
+	interval := req.GetInterval().AsDuration()
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := stream.Send(statsProto(g.server.stats())); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-g.server.stop:
+			return status.Error(codes.Unavailable, ErrServerClosed.Error())
+		case <-ticker.C:
+		}
+	}
+}
+
+func statsProto(stats Stats) *allocatorpb.Stats {
+	return &allocatorpb.Stats{
+		UsedSize:    stats.UsedSize,
+		TotalSize:   stats.TotalSize,
+		MemoryUsage: stats.MemoryUsage,
+		Pool: &allocatorpb.PoolStats{
+			TotalAllocations: stats.Pool.TotalAllocations,
+			PoolHits:         stats.Pool.PoolHits,
+			PoolMisses:       stats.Pool.PoolMisses,
+			TotalFrees:       stats.Pool.TotalFrees,
+			PoolFreeHits:     stats.Pool.PoolFreeHits,
+			PoolFreeMisses:   stats.Pool.PoolFreeMisses,
+		},
+	}
+}
+
+// grpcAdmin implements allocatorpb.AdminServer
+type grpcAdmin struct {
+	allocatorpb.UnimplementedAdminServer
+	server *Server
+}
+
+// GetFragmentation needs only RoleReader, like /v1/fragmentation and the
+// Fragmentation RPC
+func (g *grpcAdmin) GetFragmentation(ctx context.Context, req *allocatorpb.GetFragmentationRequest) (*allocatorpb.Fragmentation, error) {
+	if _, err := g.server.grpcCaller(ctx, RoleReader); err != nil {
+		return nil, err
+	}
+	frag := g.server.allocator.Fragmentation()
+	out := &allocatorpb.Fragmentation{
+		FreeBytes:        frag.FreeBytes,
+		FreeBlocks:       make([]int64, len(frag.FreeBlocks)),
+		LargestFreeBlock: frag.LargestFreeBlock,
+		SlabBytes:        frag.SlabBytes,
+		SlabFreeBytes:    frag.SlabFreeBytes,
+		Slabs:            int64(frag.Slabs),
+		External:         frag.External,
+		Internal:         frag.Internal,
+	}
+	for order, count := range frag.FreeBlocks {
+		out.FreeBlocks[order] = int64(count)
+	}
+	return out, nil
+}
+
+func (g *grpcAdmin) ListSessions(ctx context.Context, req *allocatorpb.ListSessionsRequest) (*allocatorpb.ListSessionsResponse, error) {
+	if _, err := g.server.grpcCaller(ctx, RoleAdmin); err != nil {
+		return nil, err
+	}
+	sessions := g.server.ListSessions()
+	resp := &allocatorpb.ListSessionsResponse{Sessions: make([]*allocatorpb.Session, len(sessions))}
+	for i, info := range sessions {
+		resp.Sessions[i] = &allocatorpb.Session{
+			Id:          info.ID,
+			ClientId:    int64(info.ClientID),
+			Attached:    info.Attached,
+			Allocations: int64(info.Allocations),
+			Bytes:       info.Bytes,
+		}
+	}
+	return resp, nil
+}
+
+func (g *grpcAdmin) ReclaimExpiredLeases(ctx context.Context, req *allocatorpb.ReclaimExpiredLeasesRequest) (*allocatorpb.ReclaimExpiredLeasesResponse, error) {
+	if _, err := g.server.grpcCaller(ctx, RoleAdmin); err != nil {
+		return nil, err
+	}
+	return &allocatorpb.ReclaimExpiredLeasesResponse{Reclaimed: int64(g.server.ReclaimExpiredLeases())}, nil
+}
+
+func (g *grpcAdmin) Snapshot(ctx context.Context, req *allocatorpb.SnapshotRequest) (*allocatorpb.SnapshotResponse, error) {
+	if _, err := g.server.grpcCaller(ctx, RoleAdmin); err != nil {
+		return nil, err
+	}
+	snapshot, err := g.server.snapshot()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &allocatorpb.SnapshotResponse{Metadata: snapshot}, nil
+}
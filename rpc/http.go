@@ -0,0 +1,374 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hybridAllocator/hybrid"
+	"net/http"
+)
+
+// snapshot returns the allocator metadata. The allocator holds its own
+// locks while saving, so the snapshot is consistent without stopping calls.
+func (s *Server) snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s.allocator.SaveMetadata(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type httpAllocRequest struct {
+	Size uint64 `json:"size"`
+}
+
+type httpAllocResponse struct {
+	Start uint64 `json:"start"`
+	Size  uint64 `json:"size"`
+}
+
+type httpFreeRequest struct {
+	Start uint64 `json:"start"`
+	Size  uint64 `json:"size"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+var errInvalidSize = errors.New("size must be positive")
+
+// HTTPHandler returns a JSON API over the same pool and allocator as the RPC
+// server. The endpoints are described by the document served at
+// /v1/openapi.json. Without registered credentials allocations made over
+// HTTP belong to no session. Otherwise /v1 requests carry a bearer token
+// registered with AddToken in their Authorization header, and are held to
+// the roles and ownership of its identity like RPC calls.
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/allocate", s.authorizeHTTP(RoleWriter, s.handleAllocate))
+	mux.HandleFunc("POST /v1/free", s.authorizeHTTP(RoleWriter, s.handleFree))
+	mux.HandleFunc("GET /v1/stats", s.authorizeHTTP(RoleReader, s.handleStats))
+	mux.HandleFunc("GET /v1/fragmentation", s.authorizeHTTP(RoleReader, s.handleFragmentation))
+	mux.HandleFunc("GET /v1/snapshot", s.authorizeHTTP(RoleAdmin, s.handleSnapshot))
+	mux.HandleFunc("GET /v1/openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.Handle("GET /metrics", s.MetricsHandler())
+	return mux
+}
+
+// httpCallerKey is the context key of the caller of an authorized request
+type httpCallerKey struct{}
+
+// authorizeHTTP wraps handler to run only for requests whose bearer token
+// has role, passing the caller they act as in the request context
+func (s *Server) authorizeHTTP(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := s.bearerCaller(r.Header.Get("Authorization"))
+		if err == nil {
+			err = caller.authorize(role)
+		}
+		if err != nil {
+			if errors.Is(err, ErrUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJSON(w, httpStatus(err), httpError{Error: err.Error()})
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), httpCallerKey{}, caller)))
+	}
+}
+
+// httpCaller returns the caller of a request passed by authorizeHTTP, nil
+// for requests trusted like in-process calls
+func httpCaller(r *http.Request) *connService {
+	caller, _ := r.Context().Value(httpCallerKey{}).(*connService)
+	return caller
+}
+
+func (s *Server) handleAllocate(w http.ResponseWriter, r *http.Request) {
+	var req httpAllocRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+		return
+	}
+	if req.Size == 0 {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: errInvalidSize.Error()})
+		return
+	}
+
+	done, err := s.admitCaller(httpCaller(r), req.Size)
+	if err != nil {
+		writeJSON(w, httpStatus(err), httpError{Error: err.Error()})
+		return
+	}
+	defer done()
+
+	resp := &AllocResponse{}
+	if err := s.allocate(r.Context(), httpCaller(r), &AllocRequest{Size: req.Size}, resp); err != nil {
+		writeJSON(w, httpStatus(err), httpError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, httpAllocResponse{Start: resp.Start, Size: req.Size})
+}
+
+func (s *Server) handleFree(w http.ResponseWriter, r *http.Request) {
+	var req httpFreeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: err.Error()})
+		return
+	}
+	if req.Size == 0 {
+		writeJSON(w, http.StatusBadRequest, httpError{Error: errInvalidSize.Error()})
+		return
+	}
+
+	done, err := s.admitCaller(httpCaller(r), 0)
+	if err != nil {
+		writeJSON(w, httpStatus(err), httpError{Error: err.Error()})
+		return
+	}
+	defer done()
+
+	if err := s.free(r.Context(), httpCaller(r), &FreeRequest{Start: req.Start, Size: req.Size}); err != nil {
+		writeJSON(w, httpStatus(err), httpError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.stats())
+}
+
+func (s *Server) handleFragmentation(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.allocator.Fragmentation())
+}
+
+// handleSnapshot streams the allocator metadata as written by SaveMetadata,
+// which hybrid.LoadMetadata reads back
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := s.snapshot()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, httpError{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="allocator.snapshot"`)
+	w.Write(snapshot)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.lifeMu.Lock()
+	shuttingDown := s.shuttingDown
+	s.lifeMu.Unlock()
+
+	if shuttingDown {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
+
+// httpStatus maps allocator errors to HTTP status codes
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, hybrid.ErrSizeTooLarge), errors.Is(err, hybrid.ErrInvalidAddress):
+		return http.StatusBadRequest
+	case errors.Is(err, hybrid.ErrNoSpaceAvailable):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, hybrid.ErrAddressNotAllocated), errors.Is(err, hybrid.ErrBlockNotFound),
+		errors.Is(err, hybrid.ErrSlabNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, hybrid.ErrExtentShared), errors.Is(err, hybrid.ErrAddressAlreadyAllocated):
+		return http.StatusConflict
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrOverloaded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// openAPISpec describes the HTTP API
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "hybridAllocator",
+    "description": "Disk space allocation backed by a buddy and slab allocator",
+    "version": "1.0.0"
+  },
+  "security": [{"bearer": []}],
+  "paths": {
+    "/v1/allocate": {
+      "post": {
+        "summary": "Allocate an extent",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AllocateRequest"}}}
+        },
+        "responses": {
+          "200": {"description": "Allocated extent", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Extent"}}}},
+          "400": {"description": "Invalid or too large size", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "401": {"$ref": "#/components/responses/Unauthenticated"},
+          "403": {"$ref": "#/components/responses/PermissionDenied"},
+          "429": {"$ref": "#/components/responses/RateLimited"},
+          "503": {"$ref": "#/components/responses/Overloaded"},
+          "507": {"description": "No space available", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/v1/free": {
+      "post": {
+        "summary": "Free an extent",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Extent"}}}
+        },
+        "responses": {
+          "200": {"description": "Extent freed"},
+          "400": {"description": "Invalid address or size", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "401": {"$ref": "#/components/responses/Unauthenticated"},
+          "403": {"$ref": "#/components/responses/PermissionDenied"},
+          "404": {"description": "Extent not allocated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "409": {"description": "Extent is shared", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "429": {"$ref": "#/components/responses/RateLimited"},
+          "503": {"$ref": "#/components/responses/Overloaded"}
+        }
+      }
+    },
+    "/v1/stats": {
+      "get": {
+        "summary": "Space, memory and pool statistics",
+        "responses": {
+          "200": {"description": "Statistics", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stats"}}}}
+        }
+      }
+    },
+    "/v1/fragmentation": {
+      "get": {
+        "summary": "Breakdown of the free space",
+        "responses": {
+          "200": {"description": "Fragmentation", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Fragmentation"}}}}
+        }
+      }
+    },
+    "/v1/snapshot": {
+      "get": {
+        "summary": "Download the allocator metadata",
+        "responses": {
+          "200": {"description": "Metadata readable by hybrid.LoadMetadata", "content": {"application/octet-stream": {}}},
+          "500": {"description": "Snapshot failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Health check",
+        "security": [],
+        "responses": {
+          "200": {"description": "Serving"},
+          "503": {"description": "Shutting down"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Allocator and server metrics",
+        "security": [],
+        "responses": {
+          "200": {"description": "Prometheus text format", "content": {"text/plain": {}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "description": "Token registered with Server.AddToken, required once the server has credentials"}
+    },
+    "responses": {
+      "Unauthenticated": {"description": "Missing or unknown token", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "PermissionDenied": {"description": "The role of the token does not allow the request, or the extent belongs to another identity", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "RateLimited": {"description": "The identity exceeded its request or byte rate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Overloaded": {"description": "Too many requests in flight", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "AllocateRequest": {
+        "type": "object",
+        "required": ["size"],
+        "properties": {"size": {"type": "integer", "format": "uint64", "minimum": 1}}
+      },
+      "Extent": {
+        "type": "object",
+        "required": ["start", "size"],
+        "properties": {
+          "start": {"type": "integer", "format": "uint64"},
+          "size": {"type": "integer", "format": "uint64", "minimum": 1}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      },
+      "Stats": {
+        "type": "object",
+        "properties": {
+          "used_size": {"type": "integer", "format": "uint64"},
+          "total_size": {"type": "integer", "format": "uint64"},
+          "memory_usage": {"type": "integer", "format": "uint64"},
+          "pool": {
+            "type": "object",
+            "properties": {
+              "total_allocations": {"type": "integer", "format": "uint64"},
+              "pool_hits": {"type": "integer", "format": "uint64"},
+              "pool_misses": {"type": "integer", "format": "uint64"},
+              "total_frees": {"type": "integer", "format": "uint64"},
+              "pool_free_hits": {"type": "integer", "format": "uint64"},
+              "pool_free_misses": {"type": "integer", "format": "uint64"}
+            }
+          },
+          "limits": {
+            "type": "object",
+            "properties": {
+              "rate_limited": {"type": "integer", "format": "uint64"},
+              "bytes_limited": {"type": "integer", "format": "uint64"},
+              "overloaded": {"type": "integer", "format": "uint64"},
+              "in_flight": {"type": "integer", "format": "int64"}
+            }
+          }
+        }
+      },
+      "Fragmentation": {
+        "type": "object",
+        "properties": {
+          "free_bytes": {"type": "integer", "format": "uint64"},
+          "free_blocks": {"type": "array", "items": {"type": "integer"}, "description": "Free buddy blocks per order"},
+          "largest_free_block": {"type": "integer", "format": "uint64"},
+          "slab_bytes": {"type": "integer", "format": "uint64"},
+          "slab_free_bytes": {"type": "integer", "format": "uint64"},
+          "slabs": {"type": "integer"},
+          "external": {"type": "number"},
+          "internal": {"type": "number"}
+        }
+      }
+    }
+  }
+}
+`
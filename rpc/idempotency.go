@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRequestWindow is how many recent requests are remembered per client
+	DefaultRequestWindow = 1024
+	// DefaultRequestTTL is how long the requests of an idle client are remembered
+	DefaultRequestTTL = 10 * time.Minute
+)
+
+// requestResult is the outcome of a request, replayed when it is retried
+type requestResult struct {
+	value any
+	err   error
+}
+
+// requestEntry is a request seen before. done is closed once result is set,
+// so a retry racing with the original waits for its outcome.
+type requestEntry struct {
+	done   chan struct{}
+	result requestResult
+}
+
+// requestLog holds the recent results of one client
+type requestLog struct {
+	results  map[uint64]*requestEntry
+	order    []uint64 // request ids, oldest first
+	lastSeen time.Time
+}
+
+// requestTable remembers recent request results per client key so retried
+// requests return the original result instead of being applied twice
+type requestTable struct {
+	mu      sync.Mutex
+	clients map[string]*requestLog
+	window  int
+	ttl     time.Duration
+}
+
+func newRequestTable() requestTable {
+	return requestTable{
+		clients: make(map[string]*requestLog),
+		window:  DefaultRequestWindow,
+		ttl:     DefaultRequestTTL,
+	}
+}
+
+// start returns the entry of a request and whether it is new, in which case
+// the caller must complete it with finish. The oldest request is forgotten
+// once the window is full.
+func (t *requestTable) start(client string, id uint64) (*requestEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	log, exists := t.clients[client]
+	if !exists {
+		log = &requestLog{results: make(map[uint64]*requestEntry)}
+		t.clients[client] = log
+	}
+	log.lastSeen = time.Now()
+	if entry, exists := log.results[id]; exists {
+		return entry, false
+	}
+	entry := &requestEntry{done: make(chan struct{})}
+	log.results[id] = entry
+	log.order = append(log.order, id)
+	if len(log.order) > t.window {
+		delete(log.results, log.order[0])
+		log.order = log.order[1:]
+	}
+	return entry, true
+}
+
+// finish records the result of a request started with start
+func (e *requestEntry) finish(result requestResult) {
+	e.result = result
+	close(e.done)
+}
+
+// expire forgets clients idle for longer than the ttl
+func (t *requestTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for client, log := range t.clients {
+		if now.Sub(log.lastSeen) > t.ttl {
+			delete(t.clients, client)
+		}
+	}
+}
+
+// replay returns the remembered result of a retried request made through
+// conn, waiting for the original if it is still in progress. Otherwise it
+// returns the entry to complete with record, nil for requests without an id
+// or made in-process, which are never replayed.
+func (s *Server) replay(conn *connService, id uint64) (*requestEntry, bool) {
+	key := conn.clientKey()
+	if key == "" || id == 0 {
+		return nil, false
+	}
+	entry, first := s.requests.start(key, id)
+	if first {
+		return entry, false
+	}
+	<-entry.done
+	return entry, true
+}
+
+// record completes the entry returned by replay, if any
+func (s *Server) record(entry *requestEntry, result requestResult) {
+	if entry != nil {
+		entry.finish(result)
+	}
+}
@@ -0,0 +1,226 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultLeaseSweepInterval is how often the server reclaims expired leases
+const DefaultLeaseSweepInterval = time.Second
+
+// ErrLeaseNotFound is returned when committing an unknown or expired lease
+var ErrLeaseNotFound = errors.New("lease not found or expired")
+
+// CommitRequest confirms a leased allocation
+type CommitRequest struct {
+	LeaseID uint64
+}
+
+// CommitResponse represents a lease commit response
+type CommitResponse struct {
+	Code  ErrorCode
+	Error string
+}
+
+// LeaseStatsRequest asks for lease statistics
+type LeaseStatsRequest struct{}
+
+// LeaseStatsResponse reports lease statistics
+type LeaseStatsResponse struct {
+	Active  uint64
+	Expired uint64
+	Code    ErrorCode
+	Error   string
+}
+
+// lease is an allocation that is reclaimed unless committed before expires
+type lease struct {
+	id      uint64
+	start   uint64
+	size    uint64
+	expires time.Time
+}
+
+// leaseTable tracks uncommitted allocations
+type leaseTable struct {
+	mu      sync.Mutex
+	next    uint64
+	byID    map[uint64]*lease
+	byStart map[uint64]*lease
+	expired uint64
+}
+
+func newLeaseTable() leaseTable {
+	return leaseTable{
+		byID:    make(map[uint64]*lease),
+		byStart: make(map[uint64]*lease),
+	}
+}
+
+// grant registers a lease on a freshly allocated extent
+func (t *leaseTable) grant(start, size uint64, ttl time.Duration) (uint64, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	l := &lease{
+		id:      t.next,
+		start:   start,
+		size:    size,
+		expires: time.Now().Add(ttl),
+	}
+	t.byID[l.id] = l
+	t.byStart[start] = l
+	return l.id, l.expires
+}
+
+// commit turns a lease into a regular allocation
+func (t *leaseTable) commit(id uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, exists := t.byID[id]
+	if !exists {
+		return ErrLeaseNotFound
+	}
+	delete(t.byID, id)
+	delete(t.byStart, l.start)
+	return nil
+}
+
+// startOf returns the start of the extent under lease id
+func (t *leaseTable) startOf(id uint64) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, exists := t.byID[id]
+	if !exists {
+		return 0, false
+	}
+	return l.start, true
+}
+
+// release drops the lease on an extent that is being freed, if any
+func (t *leaseTable) release(start uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if l, exists := t.byStart[start]; exists {
+		delete(t.byID, l.id)
+		delete(t.byStart, start)
+	}
+}
+
+// expiredBefore returns the leases that expired before now, they stay
+// active until removed with expire
+func (t *leaseTable) expiredBefore(now time.Time) []*lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var expired []*lease
+	for _, l := range t.byID {
+		if now.After(l.expires) {
+			expired = append(expired, l)
+		}
+	}
+	return expired
+}
+
+// expire removes an expired lease and reports whether it was still active,
+// it may have been committed or released meanwhile
+func (t *leaseTable) expire(l *lease) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.byID[l.id] != l {
+		return false
+	}
+	delete(t.byID, l.id)
+	delete(t.byStart, l.start)
+	t.expired++
+	return true
+}
+
+func (t *leaseTable) stats() (active, expired uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return uint64(len(t.byID)), t.expired
+}
+
+// Commit confirms a leased allocation so it is no longer reclaimed
+func (s *Server) Commit(req *CommitRequest, resp *CommitResponse) error {
+	if err := s.commit(nil, req.LeaseID); err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+// commit confirms a lease through conn, which is nil for in-process calls.
+// Like frees, only the identity that allocated the extent or an admin may
+// commit it.
+func (s *Server) commit(conn *connService, id uint64) error {
+	start, exists := s.leases.startOf(id)
+	if !exists {
+		return ErrLeaseNotFound
+	}
+	stripe := s.extents.lock(start)
+	defer stripe.mu.Unlock()
+	if err := s.checkOwnerLocked(conn, start); err != nil {
+		return err
+	}
+	return s.leases.commit(id)
+}
+
+// LeaseStats reports the number of active and expired leases
+func (s *Server) LeaseStats(req *LeaseStatsRequest, resp *LeaseStatsResponse) error {
+	resp.Active, resp.Expired = s.leases.stats()
+	return nil
+}
+
+// GetExpiredLeases returns how many leases were reclaimed so far
+func (s *Server) GetExpiredLeases() uint64 {
+	_, expired := s.leases.stats()
+	return expired
+}
+
+// ReclaimExpiredLeases frees every extent whose lease has expired and
+// returns how many were reclaimed
+func (s *Server) ReclaimExpiredLeases() int {
+	reclaimed := 0
+	for _, l := range s.leases.expiredBefore(time.Now()) {
+		// Hold the extent's stripe so a concurrent Free cannot release it twice
+		stripe := s.extents.lock(l.start)
+		if s.leases.expire(l) {
+			if e, exists := s.extents.lookup(l.start); exists {
+				if err := s.releaseLocked(context.Background(), e, l.start, l.size); err != nil {
+					fmt.Printf("Failed to reclaim lease %d at %d: %v\n", l.id, l.start, err)
+				}
+			}
+			s.sessions.forget(l.start)
+			reclaimed++
+		}
+		stripe.mu.Unlock()
+	}
+	return reclaimed
+}
+
+// sweepLeases reclaims expired leases and releases idle sessions until the
+// server is closed
+func (s *Server) sweepLeases(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.ReclaimExpiredLeases()
+			s.releaseIdleSessions(now)
+			s.requests.expire(now)
+			s.admission.expire(now)
+		}
+	}
+}
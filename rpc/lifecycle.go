@@ -0,0 +1,211 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Start and Serve after Shutdown or Close
+var ErrServerClosed = errors.New("server closed")
+
+// callTracker counts in-flight calls so shutdown can wait for them. It is
+// lock-free since every call of every connection goes through it.
+type callTracker struct {
+	active  atomic.Int64
+	closing atomic.Bool
+	init    sync.Once
+	drain   sync.Once
+	drained chan struct{}
+}
+
+// begin registers a new call, it fails once the server is shutting down.
+// The call is counted before checking so close cannot miss it.
+func (t *callTracker) begin() bool {
+	t.active.Add(1)
+	if t.closing.Load() {
+		t.end()
+		return false
+	}
+	return true
+}
+
+func (t *callTracker) end() {
+	if t.active.Add(-1) == 0 && t.closing.Load() {
+		t.drain.Do(func() { close(t.drained) })
+	}
+}
+
+// close rejects new calls and returns a channel closed once all in-flight
+// calls have finished
+func (t *callTracker) close() <-chan struct{} {
+	t.init.Do(func() {
+		t.drained = make(chan struct{})
+		t.closing.Store(true)
+	})
+	if t.active.Load() == 0 {
+		t.drain.Do(func() { close(t.drained) })
+	}
+	return t.drained
+}
+
+// serverCodec is the gob codec of net/rpc that also counts every call
+// between reading its header and writing its response, and times it
+type serverCodec struct {
+	rwc     io.ReadWriteCloser
+	dec     *gob.Decoder
+	enc     *gob.Encoder
+	encBuf  *bufio.Writer
+	calls   *callTracker
+	metrics *rpcMetrics
+	closed  bool
+
+	mu    sync.Mutex
+	began map[uint64]time.Time // seq -> time the call was read
+}
+
+func newServerCodec(conn io.ReadWriteCloser, calls *callTracker, metrics *rpcMetrics) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		calls:   calls,
+		metrics: metrics,
+		began:   make(map[uint64]time.Time),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	// Refusing the call makes net/rpc drop the connection
+	if !c.calls.begin() {
+		return ErrServerClosed
+	}
+	c.mu.Lock()
+	c.began[r.Seq] = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body any) error {
+	defer c.calls.end()
+
+	c.mu.Lock()
+	began := c.began[r.Seq]
+	delete(c.began, r.Seq)
+	c.mu.Unlock()
+	c.metrics.record(r.ServiceMethod, began, responseCode(r, body))
+
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header, should not happen
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// Ready returns a channel that is closed once the server accepts connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address the server listens on, nil before it is ready
+func (s *Server) Addr() net.Addr {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// trackConn registers an accepted connection, it fails once shutting down
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connWG.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.lifeMu.Lock()
+	delete(s.conns, conn)
+	s.lifeMu.Unlock()
+	s.connWG.Done()
+}
+
+// Shutdown stops accepting connections, waits for in-flight calls to finish
+// and closes every connection. If ctx expires first the connections are
+// closed anyway and ctx's error is returned. The allocator stays usable
+// in-process until Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifeMu.Lock()
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.lifeMu.Unlock()
+
+	var err error
+	select {
+	case <-s.calls.close():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.lifeMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lifeMu.Unlock()
+
+	// Wait for the connections to apply their disconnect policy
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned when a client exceeds its request or byte rate
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrOverloaded is returned when too many requests are already in flight
+	ErrOverloaded = errors.New("server overloaded")
+)
+
+// Limits configures admission control of the requests that allocate or free
+// through RPC connections, HTTP and gRPC. Zero fields disable the matching
+// limit.
+type Limits struct {
+	// RequestsPerSecond and RequestBurst bound the requests of each client
+	// ID. The burst defaults to one second worth of requests.
+	RequestsPerSecond float64
+	RequestBurst      int
+	// BytesPerSecond and ByteBurst bound the bytes each client ID allocates.
+	// The burst defaults to one second worth of bytes and must cover the
+	// largest allocation, larger ones are always rejected.
+	BytesPerSecond float64
+	ByteBurst      uint64
+	// MaxInFlight bounds the requests served at once across all clients,
+	// requests beyond it are rejected right away instead of queueing
+	MaxInFlight int
+}
+
+// LimitStats counts the requests rejected by admission control
+type LimitStats struct {
+	RateLimited  uint64 `json:"rate_limited"`
+	BytesLimited uint64 `json:"bytes_limited"`
+	Overloaded   uint64 `json:"overloaded"`
+	InFlight     int64  `json:"in_flight"`
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens if the bucket holds them. A new bucket starts full.
+func (b *tokenBucket) take(n, rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if n > b.tokens {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// full reports whether the bucket refilled completely by now
+func (b *tokenBucket) full(rate, burst float64, now time.Time) bool {
+	return b.last.IsZero() || rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+// limitKey identifies a client across its connections. Client IDs are
+// chosen by clients, so they are scoped to the authenticated identity.
+type limitKey struct {
+	identity string
+	clientID int64
+}
+
+// clientLimiter holds the buckets of one client
+type clientLimiter struct {
+	mu       sync.Mutex
+	requests tokenBucket
+	bytes    tokenBucket
+}
+
+// admission applies Limits. Clients are looked up without a global lock
+// and the in-flight count is a single atomic.
+type admission struct {
+	limits       atomic.Pointer[Limits]
+	clients      sync.Map // limitKey -> *clientLimiter
+	inFlight     atomic.Int64
+	rateLimited  atomic.Uint64
+	bytesLimited atomic.Uint64
+	overloaded   atomic.Uint64
+}
+
+// rates returns the refill rates and bursts of the request and byte buckets
+func (l *Limits) rates() (requestRate, requestBurst, byteRate, byteBurst float64) {
+	requestRate, requestBurst = l.RequestsPerSecond, float64(l.RequestBurst)
+	if requestBurst == 0 {
+		requestBurst = max(1, requestRate)
+	}
+	byteRate, byteBurst = l.BytesPerSecond, float64(l.ByteBurst)
+	if byteBurst == 0 {
+		byteBurst = byteRate
+	}
+	return
+}
+
+// admit registers a request of key allocating bytes, or rejects it. The
+// returned function must be called once the request is served.
+func (a *admission) admit(key limitKey, bytes uint64) (func(), error) {
+	inFlight := a.inFlight.Add(1)
+	done := func() { a.inFlight.Add(-1) }
+
+	limits := a.limits.Load()
+	if limits == nil {
+		return done, nil
+	}
+	if limits.MaxInFlight > 0 && inFlight > int64(limits.MaxInFlight) {
+		done()
+		a.overloaded.Add(1)
+		return nil, ErrOverloaded
+	}
+	if limits.RequestsPerSecond <= 0 && limits.BytesPerSecond <= 0 {
+		return done, nil
+	}
+
+	value, _ := a.clients.LoadOrStore(key, &clientLimiter{})
+	limiter := value.(*clientLimiter)
+	requestRate, requestBurst, byteRate, byteBurst := limits.rates()
+	now := time.Now()
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if requestRate > 0 && !limiter.requests.take(1, requestRate, requestBurst, now) {
+		done()
+		a.rateLimited.Add(1)
+		return nil, ErrRateLimited
+	}
+	if byteRate > 0 && bytes > 0 && !limiter.bytes.take(float64(bytes), byteRate, byteBurst, now) {
+		done()
+		a.bytesLimited.Add(1)
+		return nil, ErrRateLimited
+	}
+	return done, nil
+}
+
+// expire forgets clients whose buckets refilled completely, a fresh bucket
+// starts full anyway
+func (a *admission) expire(now time.Time) {
+	limits := a.limits.Load()
+	if limits == nil {
+		return
+	}
+	requestRate, requestBurst, byteRate, byteBurst := limits.rates()
+	a.clients.Range(func(key, value any) bool {
+		limiter := value.(*clientLimiter)
+		limiter.mu.Lock()
+		idle := limiter.requests.full(requestRate, requestBurst, now) && limiter.bytes.full(byteRate, byteBurst, now)
+		limiter.mu.Unlock()
+		if idle {
+			a.clients.Delete(key)
+		}
+		return true
+	})
+}
+
+func (a *admission) stats() LimitStats {
+	return LimitStats{
+		RateLimited:  a.rateLimited.Load(),
+		BytesLimited: a.bytesLimited.Load(),
+		Overloaded:   a.overloaded.Load(),
+		InFlight:     a.inFlight.Load(),
+	}
+}
+
+// SetLimits configures admission control for requests made through RPC
+// connections, HTTP and gRPC. In-process calls are not limited.
+func (s *Server) SetLimits(limits Limits) {
+	s.admission.limits.Store(&limits)
+}
+
+// LimitStats returns how many requests admission control rejected so far
+func (s *Server) LimitStats() LimitStats {
+	return s.admission.stats()
+}
+
+// admit applies admission control to a request on the connection that
+// allocates bytes, zero for frees. The returned function must be called
+// once the request is served.
+func (c *connService) admit(bytes uint64) (func(), error) {
+	key := limitKey{clientID: c.clientID.Load()}
+	if identity := c.identity.Load(); identity != nil {
+		key.identity = identity.Name
+	}
+	return c.server.admission.admit(key, bytes)
+}
+
+// admitCaller applies admission control to an HTTP or gRPC request of caller
+// that allocates bytes. Without registered credentials the caller is nil and
+// such requests share the limits of clients without an identity.
+func (s *Server) admitCaller(caller *connService, bytes uint64) (func(), error) {
+	if caller != nil {
+		return caller.admit(bytes)
+	}
+	return s.admission.admit(limitKey{}, bytes)
+}
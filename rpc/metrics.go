@@ -0,0 +1,247 @@
+package rpc
+
+import (
+	"hybridAllocator/hybrid"
+	"hybridAllocator/metrics"
+	"io"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// methodMetrics counts the calls of one RPC method
+type methodMetrics struct {
+	latency metrics.LatencyHistogram
+	errors  [lastCode + 1]atomic.Uint64
+}
+
+// rpcMetrics records RPC calls by method without a global lock
+type rpcMetrics struct {
+	methods sync.Map // method name -> *methodMetrics
+}
+
+// rpcMethods holds the methods served on connections. Other names come
+// from clients and are recorded as "unknown" so they cannot add labels.
+var rpcMethods = func() map[string]bool {
+	methods := make(map[string]bool)
+	svc := reflect.TypeOf(&connService{})
+	for i := 0; i < svc.NumMethod(); i++ {
+		methods["Server."+svc.Method(i).Name] = true
+	}
+	return methods
+}()
+
+func (m *rpcMetrics) record(method string, began time.Time, code ErrorCode) {
+	if !rpcMethods[method] {
+		method = "unknown"
+	}
+	value, exists := m.methods.Load(method)
+	if !exists {
+		value, _ = m.methods.LoadOrStore(method, &methodMetrics{})
+	}
+	mm := value.(*methodMetrics)
+	mm.latency.Since(began)
+	if code != CodeOK {
+		mm.errors[code].Add(1)
+	}
+}
+
+var errorCodeType = reflect.TypeOf(CodeOK)
+
+// responseCode returns the error code carried by a response body. r.Error
+// reports failures of net/rpc itself, such as unknown methods.
+func responseCode(r *rpc.Response, body any) ErrorCode {
+	if r.Error != "" {
+		return CodeUnknown
+	}
+	v := reflect.ValueOf(body)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return CodeOK
+	}
+	field := v.FieldByName("Code")
+	if !field.IsValid() || field.Type() != errorCodeType {
+		return CodeOK
+	}
+	code := ErrorCode(field.Int())
+	if code < CodeOK || code > lastCode {
+		return CodeUnknown
+	}
+	return code
+}
+
+// MetricsHandler serves the server and allocator metrics in the Prometheus
+// text format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes the server and allocator metrics to w in the
+// Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) error {
+	mw := metrics.NewWriter(w)
+	s.writeAllocatorMetrics(mw)
+	s.writePoolMetrics(mw)
+	s.writeRPCMetrics(mw)
+	return mw.Flush()
+}
+
+func (s *Server) writeAllocatorMetrics(mw *metrics.Writer) {
+	mw.Family("allocator_used_bytes", metrics.Gauge, "Allocated space")
+	mw.Sample("allocator_used_bytes", float64(s.allocator.GetUsedSize()))
+	mw.Family("allocator_total_bytes", metrics.Gauge, "Managed space")
+	mw.Sample("allocator_total_bytes", float64(s.allocator.GetTotalSize()))
+	mw.Family("allocator_memory_overhead_bytes", metrics.Gauge, "Memory used by the allocator metadata")
+	mw.Sample("allocator_memory_overhead_bytes", float64(s.allocator.GetMemoryUsage()))
+
+	// Pool hits are served by the memory pools, misses by the slab or buddy layer
+	var poolAllocate, poolFree metrics.HistogramSnapshot
+	for _, pool := range s.pools {
+		allocate, free := pool.HitLatency()
+		poolAllocate.Add(allocate)
+		poolFree.Add(free)
+	}
+	layers := s.allocator.LayerStats()
+	ops := []struct {
+		name  string
+		pool  metrics.HistogramSnapshot
+		stats [hybrid.LayerCount]hybrid.OpStats
+	}{
+		{"allocate", poolAllocate, layers.Allocate},
+		{"free", poolFree, layers.Free},
+	}
+
+	mw.Family("allocator_operations_total", metrics.Counter, "Successful operations by the layer that served them")
+	for _, op := range ops {
+		mw.Sample("allocator_operations_total", float64(op.pool.Count), opLabels(op.name, "pool")...)
+		for layer := range hybrid.LayerCount {
+			mw.Sample("allocator_operations_total", float64(op.stats[layer].Count), opLabels(op.name, layer.String())...)
+		}
+	}
+	mw.Family("allocator_operation_failures_total", metrics.Counter, "Failed operations by the layer that failed them")
+	for _, op := range ops {
+		for layer := range hybrid.LayerCount {
+			mw.Sample("allocator_operation_failures_total", float64(op.stats[layer].Failures), opLabels(op.name, layer.String())...)
+		}
+	}
+	mw.Family("allocator_operation_duration_seconds", metrics.Histogram, "Latency of successful operations by layer")
+	for _, op := range ops {
+		mw.Histogram("allocator_operation_duration_seconds", op.pool, opLabels(op.name, "pool")...)
+		for layer := range hybrid.LayerCount {
+			mw.Histogram("allocator_operation_duration_seconds", op.stats[layer].Latency, opLabels(op.name, layer.String())...)
+		}
+	}
+
+	frag := s.allocator.Fragmentation()
+	mw.Family("allocator_buddy_free_bytes", metrics.Gauge, "Free space held in buddy blocks of each order")
+	for order, count := range frag.FreeBlocks {
+		mw.Sample("allocator_buddy_free_bytes", float64(uint64(count)*hybrid.BlockSize(order)),
+			metrics.Label{Name: "order", Value: strconv.Itoa(order)})
+	}
+
+	counts := s.allocator.SlabCounts()
+	classes := make([]uint64, 0, len(counts))
+	for size := range counts {
+		classes = append(classes, size)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i] < classes[j] })
+	mw.Family("allocator_slabs", metrics.Gauge, "Slabs of each size class")
+	for _, size := range classes {
+		mw.Sample("allocator_slabs", float64(counts[size]),
+			metrics.Label{Name: "size_class", Value: strconv.FormatUint(size, 10)})
+	}
+}
+
+func opLabels(op, layer string) []metrics.Label {
+	return []metrics.Label{{Name: "op", Value: op}, {Name: "layer", Value: layer}}
+}
+
+func (s *Server) writePoolMetrics(mw *metrics.Writer) {
+	stats := s.poolStats()
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"allocator_pool_allocations_total", "Allocations requested from the memory pools", stats.TotalAllocations},
+		{"allocator_pool_hits_total", "Allocations served from a pooled block", stats.PoolHits},
+		{"allocator_pool_frees_total", "Frees requested from the memory pools", stats.TotalFrees},
+		{"allocator_pool_free_hits_total", "Frees returning a pooled block", stats.PoolFreeHits},
+	}
+	for _, c := range counters {
+		mw.Family(c.name, metrics.Counter, c.help)
+		mw.Sample(c.name, float64(c.value))
+	}
+	mw.Family("allocator_pool_hit_ratio", metrics.Gauge, "Fraction of allocations served from the memory pools")
+	mw.Sample("allocator_pool_hit_ratio", stats.HitRate())
+	mw.Family("allocator_pool_free_hit_ratio", metrics.Gauge, "Fraction of frees returned to the memory pools")
+	mw.Sample("allocator_pool_free_hit_ratio", stats.FreeHitRate())
+}
+
+func (s *Server) writeRPCMetrics(mw *metrics.Writer) {
+	var names []string
+	s.rpcMetrics.methods.Range(func(key, value any) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	mw.Family("allocator_rpc_request_duration_seconds", metrics.Histogram, "Latency of RPC calls by method")
+	for _, name := range names {
+		value, _ := s.rpcMetrics.methods.Load(name)
+		mw.Histogram("allocator_rpc_request_duration_seconds", value.(*methodMetrics).latency.Snapshot(),
+			metrics.Label{Name: "method", Value: name})
+	}
+	mw.Family("allocator_rpc_errors_total", metrics.Counter, "RPC calls that returned an error, by method and wire error code")
+	for _, name := range names {
+		value, _ := s.rpcMetrics.methods.Load(name)
+		mm := value.(*methodMetrics)
+		for code := range mm.errors {
+			if count := mm.errors[code].Load(); count != 0 {
+				mw.Sample("allocator_rpc_errors_total", float64(count),
+					metrics.Label{Name: "method", Value: name}, metrics.Label{Name: "code", Value: strconv.Itoa(code)})
+			}
+		}
+	}
+
+	s.lifeMu.Lock()
+	conns := len(s.conns)
+	s.lifeMu.Unlock()
+	mw.Family("allocator_rpc_connections", metrics.Gauge, "Connected RPC clients")
+	mw.Sample("allocator_rpc_connections", float64(conns))
+
+	var attached, detached int
+	for _, info := range s.ListSessions() {
+		if info.Attached {
+			attached++
+		} else {
+			detached++
+		}
+	}
+	mw.Family("allocator_rpc_sessions", metrics.Gauge, "Sessions by whether a connection is attached")
+	mw.Sample("allocator_rpc_sessions", float64(attached), metrics.Label{Name: "state", Value: "attached"})
+	mw.Sample("allocator_rpc_sessions", float64(detached), metrics.Label{Name: "state", Value: "detached"})
+
+	limits := s.admission.stats()
+	mw.Family("allocator_rpc_rejected_total", metrics.Counter, "Requests rejected by admission control")
+	mw.Sample("allocator_rpc_rejected_total", float64(limits.RateLimited), metrics.Label{Name: "reason", Value: "rate"})
+	mw.Sample("allocator_rpc_rejected_total", float64(limits.BytesLimited), metrics.Label{Name: "reason", Value: "bytes"})
+	mw.Sample("allocator_rpc_rejected_total", float64(limits.Overloaded), metrics.Label{Name: "reason", Value: "overloaded"})
+	mw.Family("allocator_rpc_in_flight_requests", metrics.Gauge, "Requests being served")
+	mw.Sample("allocator_rpc_in_flight_requests", float64(limits.InFlight))
+
+	active, expired := s.leases.stats()
+	mw.Family("allocator_leases_active", metrics.Gauge, "Leased extents not committed yet")
+	mw.Sample("allocator_leases_active", float64(active))
+	mw.Family("allocator_leases_expired_total", metrics.Counter, "Leases reclaimed after expiring")
+	mw.Sample("allocator_leases_expired_total", float64(expired))
+}
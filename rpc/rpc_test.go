@@ -1,31 +1,109 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/metrics"
+	"hybridAllocator/rpc/allocatorpb"
+	"hybridAllocator/trace"
+	"hybridAllocator/workload"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
-)
 
-const (
-	ServerAddress = "localhost:1234"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
-func TestRPCClientServer(t *testing.T) {
-	server, err := NewServer()
-	if err != nil {
-		t.Fatalf("Failed to create server: %v", err)
+// serve starts server on a free port and returns its address once it is ready
+func serve(t testing.TB, server *Server) string {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- server.Start("localhost:0") }()
+	select {
+	case <-server.Ready():
+		return server.Addr().String()
+	case err := <-errc:
+		t.Fatalf("Server error: %v", err)
 	}
+	return ""
+}
 
-	go func() {
-		if err := server.Start(ServerAddress); err != nil {
-			t.Errorf("Server error: %v", err)
+// exercise allocates and frees ops extents of varied sizes through client,
+// checking that no address is handed out twice across clients
+func exercise(tb testing.TB, client *Client, ops int, live *sync.Map) {
+	sizes := []uint64{4096, 48 * 1024, 512 * 1024, 1024 * 1024, 3 * 1024 * 1024, 16 * 1024 * 1024}
+	var held []Extent
+	for i := 0; i < ops; i++ {
+		size := sizes[i%len(sizes)]
+		start, err := client.Allocate(size)
+		if err != nil {
+			tb.Errorf("Client %d allocation failed: %v", client.id, err)
+			return
+		}
+		if other, loaded := live.LoadOrStore(start, client.id); loaded {
+			tb.Errorf("Address %d handed to clients %d and %d", start, other, client.id)
+			return
 		}
-	}()
+		held = append(held, Extent{Start: start, Size: size})
 
-	time.Sleep(time.Second)
+		// Keep a few extents live so frees interleave with other clients
+		if len(held) > 4 {
+			extent := held[0]
+			held = held[1:]
+			live.Delete(extent.Start)
+			if err := client.Free(extent.Start, extent.Size); err != nil {
+				tb.Errorf("Client %d free failed: %v", client.id, err)
+				return
+			}
+		}
+	}
+	for _, extent := range held {
+		live.Delete(extent.Start)
+		if err := client.Free(extent.Start, extent.Size); err != nil {
+			tb.Errorf("Client %d free failed: %v", client.id, err)
+		}
+	}
+}
 
-	numClients := 5
-	clients := make([]*Client, numClients)
+func TestRPCClientServer(t *testing.T) {
+	server, err := NewServerWithShards(4)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	ServerAddress := serve(t, server)
+	used := server.GetUsedSize()
 
+	numClients := 16
+	clients := make([]*Client, numClients)
 	for i := 0; i < numClients; i++ {
 		client, err := NewClient(i, ServerAddress)
 		if err != nil {
@@ -35,29 +113,1829 @@ func TestRPCClientServer(t *testing.T) {
 		defer client.Close()
 	}
 
-	done := make(chan bool)
-	for i, client := range clients {
-		go func(id int, c *Client) {
-			start, err := c.Allocate(1024 * 1024) // 1MB
-			if err != nil {
-				t.Errorf("Client %d allocation failed: %v", id, err)
-				done <- true
-				return
+	var live sync.Map
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			exercise(t, c, 200, &live)
+		}(client)
+	}
+	wg.Wait()
+
+	if got := server.GetUsedSize(); got != used {
+		t.Errorf("Used size is %d after freeing everything, expected %d", got, used)
+	}
+	stats := server.stats().Pool
+	if stats.TotalAllocations != uint64(numClients*200) || stats.TotalFrees != stats.TotalAllocations {
+		t.Errorf("Unexpected pool statistics %+v", stats)
+	}
+	if _, err := NewServerWithShards(0); err == nil {
+		t.Errorf("Expected an error for zero shards")
+	}
+}
+
+// BenchmarkRPCClientServer measures allocate and free round trips with
+// growing numbers of concurrent clients
+func BenchmarkRPCClientServer(b *testing.B) {
+	server, err := NewServer()
+	if err != nil {
+		b.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	ServerAddress := serve(b, server)
+
+	for _, numClients := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("Clients_%d", numClients), func(b *testing.B) {
+			clients := make([]*Client, numClients)
+			for i := range clients {
+				client, err := NewClient(i, ServerAddress)
+				if err != nil {
+					b.Fatalf("Failed to create client %d: %v", i, err)
+				}
+				clients[i] = client
+				defer client.Close()
+			}
+
+			var live sync.Map
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i, client := range clients {
+				// Spread b.N round trips over the clients
+				ops := b.N / numClients
+				if i < b.N%numClients {
+					ops++
+				}
+				wg.Add(1)
+				go func(c *Client) {
+					defer wg.Done()
+					exercise(b, c, ops, &live)
+				}(client)
 			}
+			wg.Wait()
+			b.StopTimer()
+		})
+	}
+}
+
+func TestLeases(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+
+	committed := &AllocResponse{}
+	server.Allocate(&AllocRequest{Size: 8 * 1024 * 1024, LeaseTTL: time.Millisecond}, committed)
+	abandoned := &AllocResponse{}
+	server.Allocate(&AllocRequest{Size: 8 * 1024 * 1024, LeaseTTL: time.Millisecond}, abandoned)
+	if committed.Error != "" || abandoned.Error != "" {
+		t.Fatalf("Leased allocation failed: %s %s", committed.Error, abandoned.Error)
+	}
+
+	commit := &CommitResponse{}
+	server.Commit(&CommitRequest{LeaseID: committed.LeaseID}, commit)
+	if commit.Error != "" {
+		t.Fatalf("Commit failed: %s", commit.Error)
+	}
+	used := server.GetUsedSize()
+
+	time.Sleep(5 * time.Millisecond)
+	if n := server.ReclaimExpiredLeases(); n != 1 {
+		t.Fatalf("Expected 1 reclaimed lease, got %d", n)
+	}
+	if server.GetUsedSize() != used-8*1024*1024 {
+		t.Fatalf("Expired lease was not freed")
+	}
+	if server.GetExpiredLeases() != 1 {
+		t.Fatalf("Expected 1 expired lease, got %d", server.GetExpiredLeases())
+	}
+
+	server.Commit(&CommitRequest{LeaseID: abandoned.LeaseID}, commit)
+	if commit.Error != ErrLeaseNotFound.Error() {
+		t.Fatalf("Expected lease not found, got %q", commit.Error)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	server.SetDisconnectPolicy(ReleaseAfterGrace, 200*time.Millisecond)
+
+	address := serve(t, server)
+
+	client, err := NewClient(7, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	used := server.GetUsedSize()
+	if _, err := client.Allocate(8 * 1024 * 1024); err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+
+	// Drop the connection and reattach within the grace period
+	session := client.SessionID()
+	client.client.Close()
+	if err := client.Reconnect(); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	if client.SessionID() != session {
+		t.Fatalf("Reconnect opened session %s instead of %s", client.SessionID(), session)
+	}
+	time.Sleep(300 * time.Millisecond)
+	sessions := server.ListSessions()
+	if len(sessions) != 1 || sessions[0].ClientID != 7 || !sessions[0].Attached || sessions[0].Bytes != 8*1024*1024 {
+		t.Fatalf("Unexpected sessions after reattach: %+v", sessions)
+	}
+
+	// Without reattaching the allocation is released after the grace period
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.GetUsedSize() != used && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.GetUsedSize() != used {
+		t.Fatalf("Session allocation was not released")
+	}
+	if sessions := server.ListSessions(); len(sessions) != 0 {
+		t.Fatalf("Expected no sessions, got %+v", sessions)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	address := serve(t, server)
+	waitSessions := func(want int) []SessionInfo {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		sessions := server.ListSessions()
+		for len(sessions) != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			sessions = server.ListSessions()
+		}
+		if len(sessions) != want {
+			t.Fatalf("Expected %d sessions, got %+v", want, sessions)
+		}
+		return sessions
+	}
+
+	// Under the default KeepOnDisconnect sessions owning nothing go with
+	// their connection
+	used := server.GetUsedSize()
+	for i := 0; i < 3; i++ {
+		client, err := NewClient(i, address)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		client.Close()
+	}
+	waitSessions(0)
+
+	// Sessions owning extents are kept, until idle for the timeout
+	client, err := NewClient(7, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := client.Allocate(8 * 1024 * 1024); err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.ListSessions()[0].Attached && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sessions := waitSessions(1); sessions[0].Attached || sessions[0].Bytes != 8*1024*1024 {
+		t.Fatalf("Unexpected detached session: %+v", sessions)
+	}
+	server.releaseIdleSessions(time.Now())
+	waitSessions(1)
+	server.SetSessionIdleTimeout(time.Minute)
+	server.releaseIdleSessions(time.Now().Add(time.Minute))
+	waitSessions(0)
+	if server.GetUsedSize() != used {
+		t.Fatalf("Idle session allocation was not released")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+
+	const huge = 1 << 41 // larger than the whole address space
+	used := server.GetUsedSize()
+
+	// Best effort: only the oversized element fails
+	allocResp := &BatchAllocResponse{}
+	server.AllocateBatch(&BatchAllocRequest{Sizes: []uint64{8 << 20, huge, 16 << 20}}, allocResp)
+	if allocResp.Results[0].Error != "" || allocResp.Results[1].Error == "" || allocResp.Results[2].Error != "" {
+		t.Fatalf("Unexpected batch results: %+v", allocResp.Results)
+	}
+	extents := []Extent{
+		{Start: allocResp.Results[0].Start, Size: 8 << 20},
+		{Start: allocResp.Results[2].Start, Size: 16 << 20},
+	}
+
+	// All or nothing: the first allocation is rolled back
+	atomicResp := &BatchAllocResponse{}
+	server.AllocateBatch(&BatchAllocRequest{Sizes: []uint64{8 << 20, huge}, Atomic: true}, atomicResp)
+	if atomicResp.Error == "" || atomicResp.Results[0].Error != ErrBatchAborted.Error() {
+		t.Fatalf("Unexpected atomic batch results: %+v", atomicResp)
+	}
+	if server.GetUsedSize() != used+24<<20 {
+		t.Fatalf("Atomic batch was not rolled back")
+	}
+
+	// An invalid extent makes an atomic free fail without freeing anything
+	freeResp := &BatchFreeResponse{}
+	server.FreeBatch(&BatchFreeRequest{Extents: append(extents, extents[0]), Atomic: true}, freeResp)
+	if freeResp.Error == "" || freeResp.Results[0].Error != ErrBatchAborted.Error() {
+		t.Fatalf("Unexpected atomic free results: %+v", freeResp)
+	}
+	if server.GetUsedSize() != used+24<<20 {
+		t.Fatalf("Failed atomic free released space")
+	}
+
+	freeResp = &BatchFreeResponse{}
+	server.FreeBatch(&BatchFreeRequest{Extents: extents, Atomic: true}, freeResp)
+	if freeResp.Error != "" {
+		t.Fatalf("Atomic free failed: %+v", freeResp)
+	}
+	if server.GetUsedSize() != used {
+		t.Fatalf("Batch free did not release space")
+	}
+}
+
+func TestFreeSize(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+
+	// Neighbouring extents, a larger free of the first would release the
+	// second with it
+	starts := make([]uint64, 8)
+	for i := range starts {
+		resp := &AllocResponse{}
+		server.Allocate(&AllocRequest{Size: 8 << 20}, resp)
+		if resp.Error != "" {
+			t.Fatalf("Allocation failed: %s", resp.Error)
+		}
+		starts[i] = resp.Start
+	}
+	used := server.GetUsedSize()
+
+	resp := &FreeResponse{}
+	server.Free(&FreeRequest{Start: starts[0], Size: 16 << 20}, resp)
+	if resp.Code != CodeInvalidAddress {
+		t.Fatalf("Expected %v freeing with a larger size, got %+v", CodeInvalidAddress, resp)
+	}
+	resp = &FreeResponse{}
+	server.Free(&FreeRequest{Start: starts[0], Size: 4 << 20}, resp)
+	if resp.Code != CodeInvalidAddress {
+		t.Fatalf("Expected %v freeing with a smaller size, got %+v", CodeInvalidAddress, resp)
+	}
+	for _, atomic := range []bool{false, true} {
+		batchResp := &BatchFreeResponse{}
+		server.FreeBatch(&BatchFreeRequest{Extents: []Extent{{Start: starts[1], Size: 16 << 20}}, Atomic: atomic}, batchResp)
+		if batchResp.Results[0].Code != CodeInvalidAddress {
+			t.Fatalf("Expected %v from a batch free with atomic %v, got %+v", CodeInvalidAddress, atomic, batchResp)
+		}
+	}
+	if server.GetUsedSize() != used {
+		t.Fatalf("Frees with the wrong size released space")
+	}
+	if err := server.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	for _, start := range starts {
+		resp := &FreeResponse{}
+		server.Free(&FreeRequest{Start: start, Size: 8 << 20}, resp)
+		if resp.Error != "" {
+			t.Fatalf("Free failed: %s", resp.Error)
+		}
+	}
+}
+
+func TestChunkCache(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+
+	address := serve(t, server)
+
+	client, err := NewClient(1, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.EnableChunkCache(DefaultChunkSize); err != nil {
+		t.Fatalf("Failed to enable chunk cache: %v", err)
+	}
+
+	// 64 slabs of 1MB fill the first chunk, the last allocation needs a second one
+	var addresses []uint64
+	for i := 0; i < 65; i++ {
+		start, err := client.Allocate(1024 * 1024)
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		addresses = append(addresses, start)
+	}
+	sessions := server.ListSessions()
+	if len(sessions) != 1 || sessions[0].Allocations != 2 || sessions[0].Bytes != 2*DefaultChunkSize {
+		t.Fatalf("Expected two chunks on the server, got %+v", sessions)
+	}
+
+	// Fully free chunks go back, except the last one
+	for _, start := range addresses {
+		if err := client.Free(start, 1024*1024); err != nil {
+			t.Fatalf("Free failed: %v", err)
+		}
+	}
+	if sessions := server.ListSessions(); sessions[0].Allocations != 1 {
+		t.Fatalf("Expected one cached chunk, got %+v", sessions)
+	}
+	if err := client.ReturnChunks(); err != nil {
+		t.Fatalf("Failed to return chunks: %v", err)
+	}
+	if sessions := server.ListSessions(); sessions[0].Allocations != 0 {
+		t.Fatalf("Expected no chunks on the server, got %+v", sessions)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	first, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer first.Close()
+	second, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer second.Close()
+	first.SetDisconnectPolicy(ReleaseOnDisconnect, 0)
 
-			time.Sleep(time.Millisecond * 100)
+	errc := make(chan error, 1)
+	go func() { errc <- first.Start("localhost:0") }()
+	<-first.Ready()
+	firstAddress := first.Addr().String()
+	secondAddress := serve(t, second)
 
-			if err := c.Free(start, 1024*1024); err != nil {
-				t.Errorf("Client %d free failed: %v", id, err)
+	client, err := NewClient(1, firstAddress)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Allocate(8 * 1024 * 1024); err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := first.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := <-errc; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Expected ErrServerClosed from Start, got %v", err)
+	}
+	if err := first.Start("localhost:0"); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Expected ErrServerClosed after shutdown, got %v", err)
+	}
+
+	// The connection is gone and its session was released
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	if _, err := client.Allocate(1024 * 1024); err == nil {
+		t.Fatalf("Allocation succeeded after shutdown")
+	}
+	if len(first.ListSessions()) != 0 {
+		t.Fatalf("Session was not released on shutdown: %+v", first.ListSessions())
+	}
+
+	// The other server keeps working
+	other, err := NewClient(2, secondAddress)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer other.Close()
+	start, err := other.Allocate(1024 * 1024)
+	if err != nil {
+		t.Fatalf("Allocation on second server failed: %v", err)
+	}
+	if err := other.Free(start, 1024*1024); err != nil {
+		t.Fatalf("Free on second server failed: %v", err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Second Close failed: %v", err)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		check  func(t *testing.T, body []byte)
+	}{
+		{
+			name: "allocate", method: http.MethodPost, path: "/v1/allocate",
+			body: `{"size": 8388608}`, status: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var resp httpAllocResponse
+				if err := json.Unmarshal(body, &resp); err != nil || resp.Size != 8*1024*1024 {
+					t.Errorf("Unexpected allocation %s: %v", body, err)
+				}
+			},
+		},
+		{name: "allocate zero", method: http.MethodPost, path: "/v1/allocate", body: `{"size": 0}`, status: http.StatusBadRequest},
+		{name: "allocate malformed", method: http.MethodPost, path: "/v1/allocate", body: `{"size":`, status: http.StatusBadRequest},
+		{name: "allocate too large", method: http.MethodPost, path: "/v1/allocate", body: `{"size": 2199023255552}`, status: http.StatusBadRequest},
+		{name: "allocate wrong method", method: http.MethodGet, path: "/v1/allocate", status: http.StatusMethodNotAllowed},
+		{name: "free misaligned", method: http.MethodPost, path: "/v1/free", body: `{"start": 3735928559, "size": 8388608}`, status: http.StatusBadRequest},
+		{name: "free zero", method: http.MethodPost, path: "/v1/free", body: `{"start": 0, "size": 0}`, status: http.StatusBadRequest},
+		{
+			name: "stats", method: http.MethodGet, path: "/v1/stats", status: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var stats Stats
+				if err := json.Unmarshal(body, &stats); err != nil || stats.TotalSize != hybrid.MaxBlockSize ||
+					stats.UsedSize == 0 || stats.Pool.TotalAllocations == 0 {
+					t.Errorf("Unexpected stats %s: %v", body, err)
+				}
+			},
+		},
+		{
+			name: "fragmentation", method: http.MethodGet, path: "/v1/fragmentation", status: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var frag hybrid.Fragmentation
+				if err := json.Unmarshal(body, &frag); err != nil || frag.FreeBytes == 0 || frag.Slabs == 0 {
+					t.Errorf("Unexpected fragmentation %s: %v", body, err)
+				}
+			},
+		},
+		{
+			name: "snapshot", method: http.MethodGet, path: "/v1/snapshot", status: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				loaded, err := hybrid.LoadMetadata(bytes.NewReader(body))
+				if err != nil {
+					t.Errorf("Failed to load snapshot: %v", err)
+					return
+				}
+				if loaded.GetUsedSize() != server.GetUsedSize() {
+					t.Errorf("Snapshot used %d, server used %d", loaded.GetUsedSize(), server.GetUsedSize())
+				}
+			},
+		},
+		{
+			name: "openapi", method: http.MethodGet, path: "/v1/openapi.json", status: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var spec struct {
+					Paths map[string]any `json:"paths"`
+				}
+				if err := json.Unmarshal(body, &spec); err != nil {
+					t.Errorf("Invalid OpenAPI document: %v", err)
+					return
+				}
+				for _, path := range []string{"/v1/allocate", "/v1/free", "/v1/stats", "/v1/fragmentation", "/v1/snapshot", "/healthz"} {
+					if spec.Paths[path] == nil {
+						t.Errorf("OpenAPI document misses %s", path)
+					}
+				}
+			},
+		},
+		{name: "health", method: http.MethodGet, path: "/healthz", status: http.StatusOK},
+		{name: "unknown", method: http.MethodGet, path: "/v1/unknown", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("Failed to build request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, resp.StatusCode, body)
 			}
+			if tt.check != nil {
+				tt.check(t, body)
+			}
+		})
+	}
+
+	// Freeing over HTTP gives the space back
+	used := server.GetUsedSize()
+	resp, err := http.Post(ts.URL+"/v1/allocate", "application/json", strings.NewReader(`{"size": 16777216}`))
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	var extent httpAllocResponse
+	json.NewDecoder(resp.Body).Decode(&extent)
+	resp.Body.Close()
+	body := fmt.Sprintf(`{"start": %d, "size": %d}`, extent.Start, extent.Size)
+	resp, err = http.Post(ts.URL+"/v1/free", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || server.GetUsedSize() != used {
+		t.Fatalf("Free of %s returned %d, used %d instead of %d", body, resp.StatusCode, server.GetUsedSize(), used)
+	}
+}
 
-			done <- true
-		}(i, client)
+func TestGRPC(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
 	}
+	defer server.Close()
 
-	for i := 0; i < numClients; i++ {
-		<-done
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := server.NewGRPCServer()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := allocatorpb.NewAllocatorClient(conn)
+	admin := allocatorpb.NewAdminClient(conn)
+	ctx := context.Background()
+
+	// Allocator errors map to status codes
+	codeTests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"zero size", func() error {
+			_, err := client.Allocate(ctx, &allocatorpb.AllocateRequest{Size: 0})
+			return err
+		}, codes.InvalidArgument},
+		{"too large", func() error {
+			_, err := client.Allocate(ctx, &allocatorpb.AllocateRequest{Size: 2 * hybrid.MaxBlockSize})
+			return err
+		}, codes.InvalidArgument},
+		{"misaligned free", func() error {
+			_, err := client.Free(ctx, &allocatorpb.FreeRequest{Start: 0xdeadbeef, Size: 8 * 1024 * 1024})
+			return err
+		}, codes.InvalidArgument},
+		{"unknown lease", func() error {
+			_, err := client.Commit(ctx, &allocatorpb.CommitRequest{LeaseId: 12345})
+			return err
+		}, codes.NotFound},
+	}
+	for _, tt := range codeTests {
+		if code := status.Code(tt.call()); code != tt.code {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.code, code)
+		}
+	}
+
+	used := server.GetUsedSize()
+	alloc, err := client.Allocate(ctx, &allocatorpb.AllocateRequest{Size: 8 * 1024 * 1024, LeaseTtl: durationpb.New(time.Minute)})
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if alloc.GetLeaseId() == 0 || alloc.GetLeaseExpires() == nil {
+		t.Fatalf("Expected a lease, got %v", alloc)
+	}
+	if _, err := client.Commit(ctx, &allocatorpb.CommitRequest{LeaseId: alloc.GetLeaseId()}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, err := client.Free(ctx, &allocatorpb.FreeRequest{Start: alloc.GetStart(), Size: 8 * 1024 * 1024}); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if server.GetUsedSize() != used {
+		t.Fatalf("Free did not release space")
+	}
+
+	// Reserving all free space makes allocations past the pool fail
+	server.allocator.SetReserve(hybrid.PriorityMetadata, server.allocator.GetFreeSize())
+	_, err = client.Allocate(ctx, &allocatorpb.AllocateRequest{Size: 8 * 1024 * 1024})
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted, got %v", err)
+	}
+	_, err = client.AllocateBatch(ctx, &allocatorpb.AllocateBatchRequest{Sizes: []uint64{4096, 8 * 1024 * 1024}, Atomic: true})
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted for atomic batch, got %v", err)
+	}
+	batch, err := client.AllocateBatch(ctx, &allocatorpb.AllocateBatchRequest{Sizes: []uint64{4096, 8 * 1024 * 1024}})
+	if err != nil {
+		t.Fatalf("AllocateBatch failed: %v", err)
+	}
+	if batch.Results[0].GetCode() != 0 || codes.Code(batch.Results[1].GetCode()) != codes.ResourceExhausted {
+		t.Fatalf("Unexpected batch results: %v", batch.Results)
+	}
+	server.allocator.SetReserve(hybrid.PriorityMetadata, 0)
+
+	freed, err := client.FreeBatch(ctx, &allocatorpb.FreeBatchRequest{
+		Extents: []*allocatorpb.Extent{{Start: batch.Results[0].GetStart(), Size: 4096}},
+		Atomic:  true,
+	})
+	if err != nil || freed.Results[0].GetCode() != 0 {
+		t.Fatalf("FreeBatch failed: %v %v", err, freed)
+	}
+
+	// Streaming stats and admin calls
+	watchCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.WatchStats(watchCtx, &allocatorpb.WatchStatsRequest{Interval: durationpb.New(time.Millisecond)})
+	if err != nil {
+		t.Fatalf("WatchStats failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		stats, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive stats: %v", err)
+		}
+		if stats.GetTotalSize() != hybrid.MaxBlockSize || stats.GetPool().GetTotalAllocations() == 0 {
+			t.Fatalf("Unexpected stats: %v", stats)
+		}
+	}
+	cancel()
+
+	frag, err := admin.GetFragmentation(ctx, &allocatorpb.GetFragmentationRequest{})
+	if err != nil || frag.GetFreeBytes() == 0 || len(frag.GetFreeBlocks()) != hybrid.MaxOrder+1 {
+		t.Fatalf("Unexpected fragmentation: %v %v", frag, err)
+	}
+	snapshot, err := admin.Snapshot(ctx, &allocatorpb.SnapshotRequest{})
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	loaded, err := hybrid.LoadMetadata(bytes.NewReader(snapshot.GetMetadata()))
+	if err != nil || loaded.GetUsedSize() != server.GetUsedSize() {
+		t.Fatalf("Snapshot does not match the server: %v", err)
 	}
+	if _, err := admin.ListSessions(ctx, &allocatorpb.ListSessionsRequest{}); err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	address := serve(t, server)
+
+	client, err := NewClient(1, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	start, err := client.Allocate(4096)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	defer client.Free(start, 4096)
 
-	server.Close()
+	used, err := client.GetUsedSize()
+	if err != nil || used != server.GetUsedSize() {
+		t.Fatalf("GetUsedSize returned %d (%v), server uses %d", used, err, server.GetUsedSize())
+	}
+	total, err := client.GetTotalSize()
+	if err != nil || total != hybrid.MaxBlockSize {
+		t.Fatalf("GetTotalSize returned %d (%v)", total, err)
+	}
+	usage, err := client.GetMemoryUsage()
+	if err != nil || usage != server.GetMemoryUsage() {
+		t.Fatalf("GetMemoryUsage returned %d (%v), server uses %d", usage, err, server.GetMemoryUsage())
+	}
+	pool, err := client.GetPoolStats()
+	if err != nil || pool.TotalAllocations != 1 || pool.PoolHits != 1 || pool.HitRate() != 1 {
+		t.Fatalf("Unexpected pool stats %+v (%v)", pool, err)
+	}
+	frag, err := client.GetFragmentation()
+	if err != nil || frag.FreeBytes != server.allocator.Fragmentation().FreeBytes || frag.Slabs == 0 {
+		t.Fatalf("Unexpected fragmentation %+v (%v)", frag, err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	sentinels := map[string]error{
+		"ErrSizeTooLarge":            hybrid.ErrSizeTooLarge,
+		"ErrNoSpaceAvailable":        hybrid.ErrNoSpaceAvailable,
+		"ErrInvalidAddress":          hybrid.ErrInvalidAddress,
+		"ErrSlabNotFound":            hybrid.ErrSlabNotFound,
+		"ErrSlabFull":                hybrid.ErrSlabFull,
+		"ErrAddressAlreadyAllocated": hybrid.ErrAddressAlreadyAllocated,
+		"ErrAddressNotAllocated":     hybrid.ErrAddressNotAllocated,
+		"ErrBlockNotFound":           hybrid.ErrBlockNotFound,
+		"ErrInvalidWatermarks":       hybrid.ErrInvalidWatermarks,
+		"ErrExtentShared":            hybrid.ErrExtentShared,
+		"ErrInvalidRange":            hybrid.ErrInvalidRange,
+		"ErrCorruptMetadata":         hybrid.ErrCorruptMetadata,
+		"ErrInconsistent":            hybrid.ErrInconsistent,
+	}
+
+	// Every sentinel declared in hybrid/errors.go must have a wire code
+	file, err := parser.ParseFile(token.NewFileSet(), "../hybrid/errors.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse hybrid/errors.go: %v", err)
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			for _, name := range spec.(*ast.ValueSpec).Names {
+				if _, ok := sentinels[name.Name]; !ok {
+					t.Errorf("hybrid.%s is not covered by this test", name.Name)
+				}
+			}
+		}
+	}
+	sentinels["ErrLeaseNotFound"] = ErrLeaseNotFound
+	sentinels["ErrSessionNotFound"] = ErrSessionNotFound
+	sentinels["ErrBatchAborted"] = ErrBatchAborted
+	sentinels["ErrInvalidChunkSize"] = ErrInvalidChunkSize
+	sentinels["ErrServerClosed"] = ErrServerClosed
+	sentinels["ErrUnauthenticated"] = ErrUnauthenticated
+	sentinels["ErrPermissionDenied"] = ErrPermissionDenied
+	sentinels["ErrRateLimited"] = ErrRateLimited
+	sentinels["ErrOverloaded"] = ErrOverloaded
+
+	for name, sentinel := range sentinels {
+		wrapped := fmt.Errorf("extent 42: %w", sentinel)
+		code, message := wireError(wrapped)
+		if code == CodeOK || code == CodeUnknown {
+			t.Errorf("%s has no wire code", name)
+			continue
+		}
+		err := remoteError(code, message)
+		if !errors.Is(err, sentinel) {
+			t.Errorf("%s does not survive the round trip: %v", name, err)
+		}
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.Message != wrapped.Error() {
+			t.Errorf("%s lost its message: %v", name, err)
+		}
+	}
+	if err := remoteError(wireError(errors.New("disk on fire"))); errors.Unwrap(err) != nil || err.Error() != "server error: disk on fire" {
+		t.Errorf("Unexpected unknown error %v", err)
+	}
+	if err := remoteError(CodeOK, ""); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	// Errors keep their identity through a real connection
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	client, err := NewClient(1, serve(t, server))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Allocate(2 * hybrid.MaxBlockSize); !errors.Is(err, hybrid.ErrSizeTooLarge) {
+		t.Errorf("Expected ErrSizeTooLarge, got %v", err)
+	}
+	if err := client.Free(0xdeadbeef, 8*1024*1024); !errors.Is(err, hybrid.ErrInvalidAddress) {
+		t.Errorf("Expected ErrInvalidAddress, got %v", err)
+	}
+	if err := client.Commit(12345); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("Expected ErrLeaseNotFound, got %v", err)
+	}
+	server.allocator.SetReserve(hybrid.PriorityMetadata, server.allocator.GetFreeSize())
+	if _, err := client.Allocate(8 * 1024 * 1024); !errors.Is(err, hybrid.ErrNoSpaceAvailable) {
+		t.Errorf("Expected ErrNoSpaceAvailable, got %v", err)
+	}
+	server.allocator.SetReserve(hybrid.PriorityMetadata, 0)
+	errs, err := client.FreeBatch([]Extent{{Start: 1 << 30, Size: 8 * 1024 * 1024}}, true)
+	if err != nil || !errors.Is(errs[0], hybrid.ErrAddressNotAllocated) {
+		t.Errorf("Expected ErrAddressNotAllocated, got %v %v", errs, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	address := serve(t, server)
+
+	client, err := NewClient(1, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	start, err := client.Allocate(8 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	session := client.SessionID()
+
+	// Break the connection from the server side, the next call reconnects
+	// and reattaches to the session
+	server.lifeMu.Lock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.lifeMu.Unlock()
+	if err := client.Free(start, 8*1024*1024); err != nil {
+		t.Fatalf("Free after the connection broke failed: %v", err)
+	}
+	if client.SessionID() != session {
+		t.Fatalf("Reconnect opened session %s instead of %s", client.SessionID(), session)
+	}
+
+	// Deadlines apply to every call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.AllocateContext(ctx, 4096); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// Calls give up after the retry policy once the server is gone
+	server.Shutdown(context.Background())
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if _, err := client.Stats(); err == nil {
+		t.Fatalf("Stats succeeded without a server")
+	}
+	client.SetRetryPolicy(DefaultRetryPolicy)
+	client.SetCallTimeout(50 * time.Millisecond)
+	if _, err := client.Stats(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	client.Close()
+	if _, err := client.Allocate(4096); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	address := serve(t, server)
+	client, err := NewClient(1, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	conn, err := client.conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+
+	// A retried allocation returns the original extent and allocates once
+	used := server.GetUsedSize()
+	var first, retried AllocResponse
+	req := &AllocRequest{Size: 8 * 1024 * 1024, RequestID: 7}
+	if err := conn.Call("Server.Allocate", req, &first); err != nil || first.Error != "" {
+		t.Fatalf("Allocation failed: %v %s", err, first.Error)
+	}
+	if err := conn.Call("Server.Allocate", req, &retried); err != nil || retried != first {
+		t.Fatalf("Retry returned %+v instead of %+v: %v", retried, first, err)
+	}
+	if server.GetUsedSize() != used+8*1024*1024 {
+		t.Fatalf("Retried allocation was applied twice")
+	}
+
+	// A retried free succeeds like the original instead of double-freeing
+	free := &FreeRequest{Start: first.Start, Size: 8 * 1024 * 1024, RequestID: 8}
+	for i := 0; i < 2; i++ {
+		var resp FreeResponse
+		if err := conn.Call("Server.Free", free, &resp); err != nil || resp.Error != "" {
+			t.Fatalf("Free %d failed: %v %s", i, err, resp.Error)
+		}
+	}
+	if server.GetUsedSize() != used {
+		t.Fatalf("Free was not applied exactly once")
+	}
+
+	// The results are per client
+	other, err := NewClient(2, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer other.Close()
+	otherConn, err := other.conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	var resp AllocResponse
+	if err := otherConn.Call("Server.Allocate", req, &resp); err != nil || server.GetUsedSize() != used+8*1024*1024 {
+		t.Fatalf("Request ids leaked across clients: %+v %v", resp, err)
+	}
+
+	// Only a bounded window of results is kept
+	server.requests.window = 2
+	size := uint64(8 * 1024 * 1024)
+	starts := make(map[uint64]uint64)
+	for id := uint64(100); id < 103; id++ {
+		if err := conn.Call("Server.Allocate", &AllocRequest{Size: size, RequestID: id}, &resp); err != nil || resp.Error != "" {
+			t.Fatalf("Allocation failed: %v %s", err, resp.Error)
+		}
+		starts[id] = resp.Start
+	}
+	allocate := func(id uint64) (replayed bool) {
+		t.Helper()
+		used := server.GetUsedSize()
+		var resp AllocResponse
+		if err := conn.Call("Server.Allocate", &AllocRequest{Size: size, RequestID: id}, &resp); err != nil || resp.Error != "" {
+			t.Fatalf("Allocation failed: %v %s", err, resp.Error)
+		}
+		if server.GetUsedSize() == used {
+			if resp.Start != starts[id] {
+				t.Fatalf("Replay of %d returned %d instead of %d", id, resp.Start, starts[id])
+			}
+			return true
+		}
+		return false
+	}
+	if !allocate(102) {
+		t.Fatalf("Newest request was forgotten")
+	}
+	if allocate(100) {
+		t.Fatalf("Oldest request was not forgotten")
+	}
+	server.requests.expire(time.Now().Add(2 * DefaultRequestTTL))
+	if allocate(102) {
+		t.Fatalf("Idle client was not forgotten")
+	}
+}
+
+// testPKI issues certificates from a self-signed CA generated for the test
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &testPKI{ca: ca, caKey: key, pool: pool, serial: 1}
+}
+
+// issue returns a certificate for commonName signed by the CA
+func (p *testPKI) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAuth(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	server.AddToken("reader-token", Identity{Name: "dashboard", Role: RoleReader})
+	server.AddToken("writer-token", Identity{Name: "alice", Role: RoleWriter})
+	server.AddToken("admin-token", Identity{Name: "root", Role: RoleAdmin})
+	server.AddKey("bob-key", []byte("bob secret"), Identity{Name: "bob", Role: RoleWriter})
+	address := serve(t, server)
+
+	// Credentials are required once any is registered
+	if _, err := NewClient(1, address); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Expected ErrUnauthenticated without credentials, got %v", err)
+	}
+	if _, err := NewClientWithConfig(1, address, ClientConfig{Token: "guess"}); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Expected ErrUnauthenticated for an unknown token, got %v", err)
+	}
+	if _, err := NewClientWithConfig(1, address, ClientConfig{KeyID: "bob-key", Key: []byte("wrong")}); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Expected ErrUnauthenticated for a wrong key, got %v", err)
+	}
+
+	// Readers only see statistics
+	reader, err := NewClientWithConfig(1, address, ClientConfig{Token: "reader-token"})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+	if _, err := reader.Stats(); err != nil {
+		t.Fatalf("Reader failed to read stats: %v", err)
+	}
+	if _, err := reader.Allocate(8 * 1024 * 1024); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied for a reader allocation, got %v", err)
+	}
+	if _, _, err := reader.AllocateBatch([]uint64{8 * 1024 * 1024, 8 * 1024 * 1024}, false); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied for a reader batch allocation, got %v", err)
+	}
+	if _, err := reader.FreeBatch([]Extent{{Start: 1 << 30, Size: 8 * 1024 * 1024}}, false); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied for a reader batch free, got %v", err)
+	}
+
+	// Writers free only their own extents
+	alice, err := NewClientWithConfig(2, address, ClientConfig{Token: "writer-token"})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer alice.Close()
+	bob, err := NewClientWithConfig(3, address, ClientConfig{KeyID: "bob-key", Key: []byte("bob secret")})
+	if err != nil {
+		t.Fatalf("Failed to authenticate with HMAC: %v", err)
+	}
+	defer bob.Close()
+	start, err := alice.Allocate(8 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("Writer allocation failed: %v", err)
+	}
+	if err := bob.Free(start, 8*1024*1024); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied freeing another identity's extent, got %v", err)
+	}
+	errs, err := bob.FreeBatch([]Extent{{Start: start, Size: 8 * 1024 * 1024}}, true)
+	if err != nil || !errors.Is(errs[0], ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied in batch, got %v %v", errs, err)
+	}
+	if _, err := bob.ListSessions(); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied listing sessions as a writer, got %v", err)
+	}
+	leased, lease, err := alice.AllocateWithLease(8*1024*1024, time.Minute)
+	if err != nil {
+		t.Fatalf("Leased allocation failed: %v", err)
+	}
+	if err := bob.Commit(lease); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied committing another identity's lease, got %v", err)
+	}
+	if err := alice.Commit(lease); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := alice.Free(leased, 8*1024*1024); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+
+	// Admins may free anything
+	admin, err := NewClientWithConfig(4, address, ClientConfig{Token: "admin-token"})
+	if err != nil {
+		t.Fatalf("Failed to create admin: %v", err)
+	}
+	defer admin.Close()
+	sessions, err := admin.ListSessions()
+	if err != nil {
+		t.Fatalf("Admin failed to list sessions: %v", err)
+	}
+	owned := false
+	for _, info := range sessions {
+		owned = owned || (info.Identity == "alice" && info.Allocations == 1)
+	}
+	if !owned {
+		t.Fatalf("Session of alice not listed: %+v", sessions)
+	}
+	if err := admin.Free(start, 8*1024*1024); err != nil {
+		t.Fatalf("Admin free failed: %v", err)
+	}
+
+	// A session cannot be taken over by another identity
+	conn, err := bob.conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	var resp OpenSessionResponse
+	if err := conn.Call("Server.OpenSession", &OpenSessionRequest{SessionID: alice.SessionID()}, &resp); err != nil || resp.Code != CodeSessionNotFound {
+		t.Fatalf("Expected CodeSessionNotFound reattaching to another identity, got %+v %v", resp, err)
+	}
+}
+
+// TestAuthHTTPAndGRPC checks that the HTTP and gRPC APIs authenticate with
+// the bearer tokens of the server and share ownership with RPC calls
+func TestAuthHTTPAndGRPC(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	server.AddToken("reader-token", Identity{Name: "dashboard", Role: RoleReader})
+	server.AddToken("alice-token", Identity{Name: "alice", Role: RoleWriter})
+	server.AddToken("bob-token", Identity{Name: "bob", Role: RoleWriter})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	post := func(path, token, body string) (int, []byte) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	if code, _ := post("/v1/allocate", "", `{"size": 8388608}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token, got %d", code)
+	}
+	if code, _ := post("/v1/allocate", "reader-token", `{"size": 8388608}`); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 allocating as a reader, got %d", code)
+	}
+	code, body := post("/v1/allocate", "alice-token", `{"size": 8388608}`)
+	var alloc httpAllocResponse
+	if code != http.StatusOK || json.Unmarshal(body, &alloc) != nil {
+		t.Fatalf("Allocation as alice failed: %d %s", code, body)
+	}
+	extent := fmt.Sprintf(`{"start": %d, "size": 8388608}`, alloc.Start)
+	if code, _ := post("/v1/free", "bob-token", extent); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 freeing alice's extent as bob, got %d", code)
+	}
+
+	// The same identity owns its extents over gRPC
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := server.NewGRPCServer()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := allocatorpb.NewAllocatorClient(conn)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	free := &allocatorpb.FreeRequest{Start: alloc.Start, Size: 8 * 1024 * 1024}
+	if _, err := client.Free(context.Background(), free); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Expected Unauthenticated without a token, got %v", err)
+	}
+	if _, err := client.Free(withToken("bob-token"), free); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied freeing alice's extent as bob, got %v", err)
+	}
+	if _, err := client.GetStats(withToken("reader-token"), &allocatorpb.GetStatsRequest{}); err != nil {
+		t.Fatalf("Reader failed to get stats: %v", err)
+	}
+	if _, err := allocatorpb.NewAdminClient(conn).Snapshot(withToken("alice-token"), &allocatorpb.SnapshotRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied taking a snapshot as a writer, got %v", err)
+	}
+	if _, err := client.Free(withToken("alice-token"), free); err != nil {
+		t.Fatalf("Free as alice failed: %v", err)
+	}
+
+	// Fragmentation takes the same role on every front end
+	get := func(path, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/v1/fragmentation", ""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for fragmentation without a token, got %d", code)
+	}
+	if code := get("/v1/fragmentation", "reader-token"); code != http.StatusOK {
+		t.Fatalf("Reader failed to get fragmentation over HTTP: %d", code)
+	}
+	admin := allocatorpb.NewAdminClient(conn)
+	if _, err := admin.GetFragmentation(context.Background(), &allocatorpb.GetFragmentationRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Expected Unauthenticated for fragmentation without a token, got %v", err)
+	}
+	if _, err := admin.GetFragmentation(withToken("reader-token"), &allocatorpb.GetFragmentationRequest{}); err != nil {
+		t.Fatalf("Reader failed to get fragmentation over gRPC: %v", err)
+	}
+	reader, err := NewClientWithConfig(1, serve(t, server), ClientConfig{Token: "reader-token"})
+	if err != nil {
+		t.Fatalf("Failed to connect as a reader: %v", err)
+	}
+	defer reader.Close()
+	if _, err := reader.GetFragmentation(); err != nil {
+		t.Fatalf("Reader failed to get fragmentation over RPC: %v", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	server.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "localhost", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+	})
+	server.AddCertificate("alice", Identity{Name: "alice", Role: RoleWriter})
+	address := serve(t, server)
+
+	// The client certificate authenticates the connection
+	client, err := NewClientWithConfig(1, address, ClientConfig{TLS: &tls.Config{
+		RootCAs:      pki.pool,
+		Certificates: []tls.Certificate{pki.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to connect with a client certificate: %v", err)
+	}
+	defer client.Close()
+	start, err := client.Allocate(8 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("Allocation over TLS failed: %v", err)
+	}
+	if err := client.Free(start, 8*1024*1024); err != nil {
+		t.Fatalf("Free over TLS failed: %v", err)
+	}
+
+	// A valid certificate of an unknown identity is not enough
+	if _, err := NewClientWithConfig(2, address, ClientConfig{TLS: &tls.Config{
+		RootCAs:      pki.pool,
+		Certificates: []tls.Certificate{pki.issue(t, "mallory", x509.ExtKeyUsageClientAuth)},
+	}}); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Expected ErrUnauthenticated for an unknown certificate, got %v", err)
+	}
+
+	// Connections without a client certificate, or over plain TCP, fail
+	if _, err := NewClientWithConfig(3, address, ClientConfig{TLS: &tls.Config{RootCAs: pki.pool}}); err == nil {
+		t.Fatalf("Connected without a client certificate")
+	}
+	if _, err := NewClient(4, address); err == nil {
+		t.Fatalf("Connected over plain TCP")
+	}
+}
+
+func TestTransports(t *testing.T) {
+	transports := []struct {
+		transport Transport
+		address   string
+	}{
+		{TCP, "localhost:0"},
+		{Unix, filepath.Join(t.TempDir(), "allocator.sock")},
+		{InProcess, "TestTransports"},
+	}
+	for _, tt := range transports {
+		t.Run(tt.transport.Name(), func(t *testing.T) {
+			server, err := NewServer()
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+			defer server.Close()
+			errc := make(chan error, 1)
+			go func() { errc <- server.StartTransport(tt.transport, tt.address) }()
+			select {
+			case <-server.Ready():
+			case err := <-errc:
+				t.Fatalf("Server error: %v", err)
+			}
+
+			client, err := NewClientWithConfig(1, server.Addr().String(), ClientConfig{Transport: tt.transport})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			defer client.Close()
+			used := server.GetUsedSize()
+			start, err := client.Allocate(8 * 1024 * 1024)
+			if err != nil {
+				t.Fatalf("Allocation failed: %v", err)
+			}
+
+			// Broken connections are redialed over the same transport
+			server.lifeMu.Lock()
+			for conn := range server.conns {
+				conn.Close()
+			}
+			server.lifeMu.Unlock()
+			if err := client.Free(start, 8*1024*1024); err != nil {
+				t.Fatalf("Free after reconnecting failed: %v", err)
+			}
+			if after, err := client.GetUsedSize(); err != nil || after != used {
+				t.Fatalf("Expected %d bytes used, got %d %v", used, after, err)
+			}
+
+			server.Shutdown(context.Background())
+			if err := <-errc; !errors.Is(err, ErrServerClosed) {
+				t.Fatalf("Expected ErrServerClosed, got %v", err)
+			}
+		})
+	}
+
+	// Names are released when the listener closes
+	if _, err := InProcess.Dial(context.Background(), "TestTransports"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Expected ECONNREFUSED dialing a closed name, got %v", err)
+	}
+	listener, err := InProcess.Listen("TestTransports")
+	if err != nil {
+		t.Fatalf("Failed to reuse the name: %v", err)
+	}
+	defer listener.Close()
+	if _, err := InProcess.Listen("TestTransports"); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("Expected EADDRINUSE, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	address := serve(t, server)
+
+	// Refills are negligible over the test, only the bursts matter
+	server.SetLimits(Limits{
+		RequestsPerSecond: 0.001,
+		RequestBurst:      4,
+		BytesPerSecond:    0.001,
+		ByteBurst:         20 * 1024 * 1024,
+	})
+	first, err := NewClient(1, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer first.Close()
+
+	start, err := first.Allocate(8 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	if _, err := first.Allocate(16 * 1024 * 1024); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected the byte limit to reject, got %v", err)
+	}
+	// Frees use no bytes
+	if err := first.Free(start, 8*1024*1024); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if _, err := first.Allocate(4096); err != nil {
+		t.Fatalf("Allocation within the limits failed: %v", err)
+	}
+	if _, err := first.Allocate(4096); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected the request limit to reject, got %v", err)
+	}
+
+	// Limits follow the client id across connections, other ids have their own
+	again, err := NewClient(1, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer again.Close()
+	if _, err := again.Allocate(4096); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected a new connection of the same id to be limited, got %v", err)
+	}
+	other, err := NewClient(2, address)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer other.Close()
+	if _, err := other.Allocate(4096); err != nil {
+		t.Fatalf("Another client was limited: %v", err)
+	}
+
+	// Requests beyond the in-flight bound are rejected without waiting
+	server.SetLimits(Limits{MaxInFlight: 1})
+	conn := &connService{server: server}
+	done, err := conn.admit(4096)
+	if err != nil {
+		t.Fatalf("Admission failed: %v", err)
+	}
+	if _, err := other.Allocate(4096); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("Expected ErrOverloaded, got %v", err)
+	}
+	done()
+	if _, err := other.Allocate(4096); err != nil {
+		t.Fatalf("Allocation failed once the server drained: %v", err)
+	}
+
+	stats, err := other.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	want := LimitStats{RateLimited: 2, BytesLimited: 1, Overloaded: 1}
+	if stats.Limits != want {
+		t.Fatalf("Expected limit stats %+v, got %+v", want, stats.Limits)
+	}
+
+	// Idle clients whose buckets refilled are forgotten
+	server.SetLimits(Limits{RequestsPerSecond: 1000})
+	server.admission.expire(time.Now().Add(time.Second))
+	server.admission.clients.Range(func(key, value any) bool {
+		t.Errorf("Client %v was not forgotten", key)
+		return true
+	})
+}
+
+func TestLimitsHTTPAndGRPC(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	server.AddToken("alice-token", Identity{Name: "alice", Role: RoleWriter})
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := server.NewGRPCServer()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := allocatorpb.NewAllocatorClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer alice-token")
+
+	post := func(path, body string) (int, []byte) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer alice-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	// HTTP and gRPC requests of an identity draw from the same bucket
+	server.SetLimits(Limits{RequestsPerSecond: 0.001, RequestBurst: 2})
+	code, body := post("/v1/allocate", `{"size": 8388608}`)
+	var alloc httpAllocResponse
+	if code != http.StatusOK || json.Unmarshal(body, &alloc) != nil {
+		t.Fatalf("Allocation over HTTP failed: %d %s", code, body)
+	}
+	allocated, err := client.Allocate(ctx, &allocatorpb.AllocateRequest{Size: 8 * 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Allocation over gRPC failed: %v", err)
+	}
+	if _, err := client.Allocate(ctx, &allocatorpb.AllocateRequest{Size: 4096}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted over gRPC, got %v", err)
+	}
+	if code, _ := post("/v1/allocate", `{"size": 4096}`); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 over HTTP, got %d", code)
+	}
+
+	// They count toward the requests in flight
+	server.SetLimits(Limits{MaxInFlight: 1})
+	done, err := (&connService{server: server}).admit(0)
+	if err != nil {
+		t.Fatalf("Admission failed: %v", err)
+	}
+	free := &allocatorpb.FreeRequest{Start: allocated.GetStart(), Size: 8 * 1024 * 1024}
+	if _, err := client.Free(ctx, free); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable over gRPC, got %v", err)
+	}
+	extent := fmt.Sprintf(`{"start": %d, "size": 8388608}`, alloc.Start)
+	if code, _ := post("/v1/free", extent); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 over HTTP, got %d", code)
+	}
+	done()
+
+	if _, err := client.Free(ctx, free); err != nil {
+		t.Fatalf("Free over gRPC failed once the server drained: %v", err)
+	}
+	if code, body := post("/v1/free", extent); code != http.StatusOK {
+		t.Fatalf("Free over HTTP failed once the server drained: %d %s", code, body)
+	}
+	want := LimitStats{RateLimited: 2, Overloaded: 2}
+	if stats := server.LimitStats(); stats != want {
+		t.Fatalf("Expected limit stats %+v, got %+v", want, stats)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	client, err := NewClient(1, serve(t, server))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// Pool hits, a buddy allocation and a failed free
+	for _, size := range []uint64{4096, 8192, 32 * 1024 * 1024} {
+		start, err := client.Allocate(size)
+		if err != nil {
+			t.Fatalf("Allocation failed: %v", err)
+		}
+		if err := client.Free(start, size); err != nil {
+			t.Fatalf("Free failed: %v", err)
+		}
+	}
+	if err := client.Free(0xdeadbeef, 4096); !errors.Is(err, hybrid.ErrInvalidAddress) {
+		t.Fatalf("Expected ErrInvalidAddress, got %v", err)
+	}
+
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	families, err := metrics.Parse(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse metrics: %v", err)
+	}
+
+	value := func(family, name string, labels ...string) float64 {
+		t.Helper()
+		f := families[family]
+		if f == nil {
+			t.Fatalf("Missing family %s", family)
+		}
+		sample, ok := f.Find(name, labels...)
+		if !ok {
+			t.Fatalf("Missing sample %s%v", name, labels)
+		}
+		return sample.Value
+	}
+	sum := func(family string) float64 {
+		var total float64
+		for _, sample := range families[family].Samples {
+			total += sample.Value
+		}
+		return total
+	}
+
+	if got := value("allocator_operations_total", "allocator_operations_total", "op", "allocate", "layer", "pool"); got < 2 {
+		t.Errorf("Expected at least 2 pool hits, got %v", got)
+	}
+	if got := value("allocator_operations_total", "allocator_operations_total", "op", "free", "layer", "buddy"); got < 1 {
+		t.Errorf("Expected a buddy free, got %v", got)
+	}
+	if got := value("allocator_operation_duration_seconds", "allocator_operation_duration_seconds_count", "op", "allocate", "layer", "slab"); got == 0 {
+		t.Errorf("Expected timed slab allocations from preallocating the pools")
+	}
+	if got := value("allocator_rpc_request_duration_seconds", "allocator_rpc_request_duration_seconds_count", "method", "Server.Allocate"); got != 3 {
+		t.Errorf("Expected 3 timed allocations, got %v", got)
+	}
+	code := strconv.Itoa(int(CodeInvalidAddress))
+	if got := value("allocator_rpc_errors_total", "allocator_rpc_errors_total", "method", "Server.Free", "code", code); got != 1 {
+		t.Errorf("Expected 1 failed free, got %v", got)
+	}
+	if got := value("allocator_rpc_connections", "allocator_rpc_connections"); got != 1 {
+		t.Errorf("Expected 1 connection, got %v", got)
+	}
+	if got := value("allocator_rpc_sessions", "allocator_rpc_sessions", "state", "attached"); got != 1 {
+		t.Errorf("Expected 1 attached session, got %v", got)
+	}
+
+	frag := server.allocator.Fragmentation()
+	if got := sum("allocator_buddy_free_bytes"); got != float64(frag.FreeBytes) {
+		t.Errorf("Free bytes per order add up to %v, expected %d", got, frag.FreeBytes)
+	}
+	if got := sum("allocator_slabs"); got != float64(frag.Slabs) {
+		t.Errorf("Slabs per size class add up to %v, expected %d", got, frag.Slabs)
+	}
+	if got := value("allocator_pool_hit_ratio", "allocator_pool_hit_ratio"); got != server.poolStats().HitRate() {
+		t.Errorf("Hit ratio %v, expected %v", got, server.poolStats().HitRate())
+	}
+	if got := value("allocator_used_bytes", "allocator_used_bytes"); got != float64(server.GetUsedSize()) {
+		t.Errorf("Used bytes %v, expected %d", got, server.GetUsedSize())
+	}
+}
+
+func TestTracing(t *testing.T) {
+	server, err := NewServerWithShards(1)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	var buf bytes.Buffer
+	recorder := trace.NewRecorder(&buf)
+	var mu sync.Mutex
+	var events []trace.Event
+	server.SetTracer(trace.TracerFunc(func(e trace.Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		recorder.Emit(e)
+	}))
+	client, err := NewClient(1, serve(t, server))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// A pool hit and a miss served by the buddy layer
+	for _, size := range []uint64{4096, 32 * 1024 * 1024} {
+		start, err := client.Allocate(size)
+		if err != nil {
+			t.Fatalf("Allocation failed: %v", err)
+		}
+		if err := client.Free(start, size); err != nil {
+			t.Fatalf("Free failed: %v", err)
+		}
+	}
+	server.SetTracer(nil)
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Failed to close recorder: %v", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Fatalf("Recorder wrote invalid JSON:\n%s", buf.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	spans := make(map[uint64]trace.Event)
+	ends := make(map[uint64]trace.Event)
+	var roots []trace.Event
+	for _, e := range events {
+		switch e.Phase {
+		case trace.Begin:
+			spans[e.Span] = e
+			if e.Parent == 0 {
+				roots = append(roots, e)
+			}
+		case trace.End:
+			ends[e.Span] = e
+		}
+	}
+	if len(roots) != 4 {
+		t.Fatalf("Expected a root span per request, got %+v", roots)
+	}
+	// children returns the spans started directly under parent
+	children := func(parent trace.Event) []trace.Event {
+		var found []trace.Event
+		for _, e := range spans {
+			if e.Parent == parent.Span {
+				if e.Trace != parent.Trace {
+					t.Fatalf("Child %+v left the trace of %+v", e, parent)
+				}
+				found = append(found, e)
+			}
+		}
+		return found
+	}
+	arg := func(e trace.Event, key string) any {
+		a, _ := e.Arg(key)
+		return a.Value()
+	}
+
+	for i, root := range roots {
+		name := []string{"rpc.Allocate", "rpc.Free"}[i%2]
+		if root.Name != name {
+			t.Fatalf("Expected %s, got %+v", name, root)
+		}
+		pool := children(root)
+		if len(pool) != 1 || pool[0].Name != strings.Replace(name, "rpc.", "mpool.", 1) {
+			t.Fatalf("Expected one pool span under %s, got %+v", name, pool)
+		}
+		hit := i < 2
+		if arg(ends[pool[0].Span], "hit") != hit {
+			t.Fatalf("Expected hit=%v for %+v", hit, ends[pool[0].Span])
+		}
+		allocator := children(pool[0])
+		if hit && len(allocator) != 0 || !hit && (len(allocator) != 1 || arg(ends[allocator[0].Span], "layer") != "buddy") {
+			t.Fatalf("Unexpected allocator spans under %+v: %+v", pool[0], allocator)
+		}
+		if _, ended := ends[root.Span]; !ended {
+			t.Fatalf("Span %+v never ended", root)
+		}
+	}
+}
+
+func TestClientRecording(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+	client, err := NewClient(7, serve(t, server))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	log := workload.NewWriter(&buf)
+	client.SetRecorder(log)
+	start, err := client.Allocate(8192)
+	if err != nil {
+		t.Fatalf("Allocation failed: %v", err)
+	}
+	if err := client.Free(start, 8192); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if err := client.Free(start, 8192); err == nil {
+		t.Fatalf("Expected a double free to fail")
+	}
+	client.SetRecorder(nil)
+	if err := log.Close(); err != nil {
+		t.Fatalf("Failed to close log: %v", err)
+	}
+
+	reader, err := workload.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	want := []workload.Record{
+		{Op: workload.Allocate, Client: 7, Size: 8192, Addr: start},
+		{Op: workload.Free, Client: 7, Size: 8192, Addr: start},
+		{Op: workload.Free, Client: 7, Size: 8192, Addr: start, Failed: true},
+	}
+	for i := range want {
+		rec, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Failed to read record %d: %v", i, err)
+		}
+		rec.Time = time.Time{}
+		if rec != want[i] {
+			t.Fatalf("Record %d is %+v, expected %+v", i, rec, want[i])
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("Expected the log to end, got %v", err)
+	}
 }
@@ -1,92 +1,253 @@
 package rpc
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"hybridAllocator/hybrid"
 	"hybridAllocator/mpool"
+	"hybridAllocator/trace"
+	"log"
+	"math/rand"
 	"net"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Server represents the memory pool server
+// Server represents the memory pool server. Calls are never serialized as a
+// whole: allocations are spread over per-shard memory pools and frees only
+// lock the stripe of the extent index holding their extent.
 type Server struct {
-	pool      *mpool.MemoryPool
-	allocator *hybrid.Allocator
-	mu        sync.Mutex
+	pools      []*mpool.MemoryPool // one per shard
+	nextShard  atomic.Uint64
+	extents    *extentIndex
+	allocator  *hybrid.Allocator
+	leases     leaseTable
+	sessions   sessionTable
+	requests   requestTable
+	auth       authTable
+	admission  admission
+	rpcMetrics rpcMetrics
+	tracer     trace.Hook
+	stop       chan struct{}
+
+	// Lifecycle
+	ready        chan struct{}
+	readyOnce    sync.Once
+	lifeMu       sync.Mutex
+	listener     net.Listener
+	tlsConfig    *tls.Config
+	conns        map[net.Conn]struct{}
+	shuttingDown bool
+	connWG       sync.WaitGroup
+	calls        callTracker
+	closeOnce    sync.Once
 }
 
 // AllocRequest represents a memory allocation request
 type AllocRequest struct {
-	Size uint64
+	Size      uint64
+	LeaseTTL  time.Duration // if set, the extent is reclaimed unless committed in time
+	RequestID uint64        // if set, a retry with the same id returns the original result
 }
 
 // AllocResponse represents a memory allocation response
 type AllocResponse struct {
-	Start uint64
-	Error string
+	Start        uint64
+	LeaseID      uint64
+	LeaseExpires time.Time
+	Code         ErrorCode
+	Error        string
 }
 
 // FreeRequest represents a memory free request
 type FreeRequest struct {
-	Start uint64
-	Size  uint64
+	Start     uint64
+	Size      uint64
+	RequestID uint64 // if set, a retry with the same id returns the original result
 }
 
 // FreeResponse represents a memory free response
 type FreeResponse struct {
+	Code  ErrorCode
 	Error string
 }
 
-// NewServer creates a new memory pool server
+// NewServer creates a new memory pool server with DefaultShards shards
 func NewServer() (*Server, error) {
+	return NewServerWithShards(DefaultShards())
+}
+
+// NewServerWithShards creates a memory pool server whose allocations are
+// spread over shards memory pools sharing one allocator. Each connection is
+// served by one shard, so up to shards clients never contend on a pool lock.
+func NewServerWithShards(shards int) (*Server, error) {
+	return newServer(shards, func(int) *rand.Rand { return nil })
+}
+
+// NewSeededServer creates a server like NewServerWithShards whose memory
+// pools pre-allocate blocks drawn from seed, the pool of shard i from
+// seed+i. Servers created with the same seed serve the same calls, made in
+// the same order over connections opened in the same order, identically.
+func NewSeededServer(shards int, seed int64) (*Server, error) {
+	return newServer(shards, func(shard int) *rand.Rand {
+		return rand.New(rand.NewSource(seed + int64(shard)))
+	})
+}
+
+// newServer creates a server whose shard pools draw from the rng returned
+// for them
+func newServer(shards int, rng func(shard int) *rand.Rand) (*Server, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("invalid shard count %d", shards)
+	}
 	allocator := hybrid.NewAllocator()
-	pool, err := mpool.NewMemoryPool(allocator)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create memory pool: %v", err)
+	pools := make([]*mpool.MemoryPool, shards)
+	for i := range pools {
+		pool, err := mpool.NewMemoryPoolWithRand(allocator, rng(i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create memory pool: %v", err)
+		}
+		pools[i] = pool
 	}
 
 	server := &Server{
-		pool:      pool,
+		pools:     pools,
+		extents:   newExtentIndex(),
 		allocator: allocator,
+		leases:    newLeaseTable(),
+		sessions:  newSessionTable(),
+		requests:  newRequestTable(),
+		auth:      newAuthTable(),
+		stop:      make(chan struct{}),
+		ready:     make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
 	}
 
-	// Register RPC methods
-	rpc.Register(server)
+	go server.sweepLeases(DefaultLeaseSweepInterval)
 	return server, nil
 }
 
-// Start starts the server on the specified address
+// Start starts the server on the specified TCP address. It blocks until the
+// server stops and then returns ErrServerClosed.
 func (s *Server) Start(address string) error {
-	listener, err := net.Listen("tcp", address)
+	return s.StartTransport(TCP, address)
+}
+
+// StartTransport starts the server on address of transport, like Start
+func (s *Server) StartTransport(transport Transport, address string) error {
+	listener, err := transport.Listen(address)
 	if err != nil {
 		return fmt.Errorf("failed to start server: %v", err)
 	}
-	defer listener.Close()
+	return s.Serve(listener)
+}
 
-	fmt.Printf("Server listening on %s\n", address)
+// Serve accepts connections on listener until the server stops
+func (s *Server) Serve(listener net.Listener) error {
+	s.lifeMu.Lock()
+	if s.shuttingDown {
+		s.lifeMu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	s.lifeMu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	log.Printf("Server listening on %s", listener.Addr())
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			s.lifeMu.Lock()
+			shuttingDown := s.shuttingDown
+			s.lifeMu.Unlock()
+			if shuttingDown {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			fmt.Printf("Failed to accept connection: %v\n", err)
 			continue
 		}
-		go rpc.ServeConn(conn)
+		if !s.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		go s.serveConn(conn)
 	}
 }
 
+// serveConn serves RPC calls on a connection bound to its own session
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrackConn(conn)
+
+	identity, err := s.handshake(conn)
+	if err != nil {
+		fmt.Printf("TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	svc := &connService{server: s, shard: s.pickShard(nil)}
+	if identity != nil {
+		svc.identity.Store(identity)
+	}
+	svc.session.Store(s.sessions.open(svc))
+
+	// Every connection gets its own rpc.Server so calls know their session
+	server := rpc.NewServer()
+	server.RegisterName("Server", svc)
+	server.ServeCodec(newServerCodec(conn, &s.calls, &s.rpcMetrics))
+
+	s.disconnect(svc)
+}
+
 func (s *Server) Allocate(req *AllocRequest, resp *AllocResponse) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.allocate(context.Background(), nil, req, resp); err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+// allocate serves an allocation made through conn, which is nil for in-process
+// calls, and returns the allocation error for the caller to report
+func (s *Server) allocate(ctx context.Context, conn *connService, req *AllocRequest, resp *AllocResponse) (err error) {
+	ctx, span := trace.Start(ctx, s.tracer.Get(), "rpc.Allocate", trace.Uint("size", req.Size))
+	defer func() {
+		span.End(trace.Uint("start", resp.Start), trace.Error(err))
+	}()
 
-	start, err := s.pool.Allocate(req.Size)
+	entry, replayed := s.replay(conn, req.RequestID)
+	if replayed {
+		span.Event("rpc.replay", trace.Uint("request_id", req.RequestID))
+		*resp = entry.result.value.(AllocResponse)
+		return entry.result.err
+	}
+
+	start, pool, err := s.allocateExtent(ctx, conn, req.Size)
 	if err != nil {
-		resp.Error = err.Error()
-		return nil
+		s.record(entry, requestResult{value: AllocResponse{}, err: err})
+		return err
 	}
 
+	stripe := s.extents.lock(start)
 	resp.Start = start
+	if req.LeaseTTL > 0 {
+		resp.LeaseID, resp.LeaseExpires = s.leases.grant(start, req.Size, req.LeaseTTL)
+	}
+	s.publishLocked(conn, start, req.Size, pool)
+	stripe.mu.Unlock()
+
+	s.record(entry, requestResult{value: *resp})
 	return nil
 }
 
@@ -94,26 +255,70 @@ func (s *Server) GetUsedSize() uint64 {
 	return s.allocator.GetUsedSize()
 }
 
+// GetTotalSize returns the size of the address range the server allocates
+// from
+func (s *Server) GetTotalSize() uint64 {
+	return s.allocator.GetTotalSize()
+}
+
 func (s *Server) GetMemoryUsage() uint64 {
 	return s.allocator.GetMemoryUsage()
 }
 
+// SetTracer installs a tracer on the server, its pools and its allocator.
+// Allocations and frees are traced as one span per request, with the pool
+// and allocator spans nested under it. nil turns tracing off.
+func (s *Server) SetTracer(t trace.Tracer) {
+	s.tracer.Set(t)
+	for _, pool := range s.pools {
+		pool.SetTracer(t)
+	}
+	s.allocator.SetTracer(t)
+}
+
 func (s *Server) Free(req *FreeRequest, resp *FreeResponse) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.free(context.Background(), nil, req); err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
 
-	err := s.pool.Free(req.Start, req.Size)
-	if err != nil {
-		resp.Error = err.Error()
-		return nil
+// free releases an extent along with its lease and session entry. conn is
+// nil for in-process calls.
+func (s *Server) free(ctx context.Context, conn *connService, req *FreeRequest) (err error) {
+	ctx, span := trace.Start(ctx, s.tracer.Get(), "rpc.Free", trace.Uint("start", req.Start), trace.Uint("size", req.Size))
+	defer func() {
+		span.End(trace.Error(err))
+	}()
+
+	entry, replayed := s.replay(conn, req.RequestID)
+	if replayed {
+		span.Event("rpc.replay", trace.Uint("request_id", req.RequestID))
+		return entry.result.err
 	}
 
-	return nil
+	stripe := s.extents.lock(req.Start)
+	err = s.freeExtentLocked(ctx, conn, req.Start, req.Size)
+	stripe.mu.Unlock()
+
+	s.record(entry, requestResult{err: err})
+	return err
 }
 
+// Close shuts the server down and releases the memory pool and allocator
 func (s *Server) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.allocator.Close()
-	return s.pool.Close()
+	var err error
+	s.closeOnce.Do(func() {
+		s.Shutdown(context.Background())
+		close(s.stop)
+		s.sessions.stopTimers()
+
+		for _, pool := range s.pools {
+			if closeErr := pool.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		s.allocator.Close()
+	})
+	return err
 }
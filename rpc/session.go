@@ -0,0 +1,499 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DisconnectPolicy decides what happens to a session's allocations when its
+// connection drops
+type DisconnectPolicy int
+
+const (
+	// KeepOnDisconnect keeps the allocations until the session is reattached
+	// and they are freed explicitly, or until it stays detached for the idle
+	// timeout
+	KeepOnDisconnect DisconnectPolicy = iota
+	// ReleaseOnDisconnect frees the allocations as soon as the connection drops
+	ReleaseOnDisconnect
+	// ReleaseAfterGrace frees the allocations unless the session is reattached
+	// within the grace period
+	ReleaseAfterGrace
+)
+
+// DefaultSessionIdleTimeout is how long a detached session holding extents
+// is kept before they are released
+const DefaultSessionIdleTimeout = 24 * time.Hour
+
+// ErrSessionNotFound is returned when reattaching to an unknown or released session
+var ErrSessionNotFound = errors.New("session not found")
+
+// OpenSessionRequest identifies the client and, to reattach after
+// reconnecting, the session it held before
+type OpenSessionRequest struct {
+	ClientID  int
+	SessionID string
+	ClientKey string // identifies the client across reconnects for request deduplication
+}
+
+// OpenSessionResponse returns the session bound to the connection
+type OpenSessionResponse struct {
+	SessionID string
+	Code      ErrorCode
+	Error     string
+}
+
+// SessionInfo describes a session for administration
+type SessionInfo struct {
+	ID          string
+	ClientID    int
+	Identity    string
+	Attached    bool
+	Allocations int
+	Bytes       uint64
+}
+
+// session owns the extents allocated through one client connection
+type session struct {
+	id       string
+	clientID int
+	identity string            // authenticated identity, empty without authentication
+	allocs   map[uint64]uint64 // start -> size
+	owner    *connService      // nil while detached
+	detached time.Time         // when owner was last cleared
+	timer    *time.Timer
+}
+
+// sessionTable tracks sessions and which session owns each extent
+type sessionTable struct {
+	mu     sync.Mutex
+	byID   map[string]*session
+	owners map[uint64]*session // extent start -> owning session
+	policy DisconnectPolicy
+	grace  time.Duration
+	idle   time.Duration // detached sessions are released after, 0 never
+}
+
+func newSessionTable() sessionTable {
+	return sessionTable{
+		byID:   make(map[string]*session),
+		owners: make(map[uint64]*session),
+		idle:   DefaultSessionIdleTimeout,
+	}
+}
+
+func newSessionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate session id: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// open creates a fresh session attached to owner
+func (t *sessionTable) open(owner *connService) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess := &session{
+		id:     newSessionID(),
+		allocs: make(map[uint64]uint64),
+		owner:  owner,
+	}
+	if identity := owner.identity.Load(); identity != nil {
+		sess.identity = identity.Name
+	}
+	t.byID[sess.id] = sess
+	return sess
+}
+
+// reattach binds an existing session to owner, moving over whatever the
+// connection allocated before reattaching. The previous connection of the
+// session, if still alive, loses it. Sessions of other identities are
+// reported as not found.
+func (t *sessionTable) reattach(owner *connService, id string) (*session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := owner.session.Load()
+	target, exists := t.byID[id]
+	if !exists || target.identity != current.identity {
+		return nil, ErrSessionNotFound
+	}
+	if current != target {
+		for start, size := range current.allocs {
+			target.allocs[start] = size
+			t.owners[start] = target
+		}
+		delete(t.byID, current.id)
+	}
+	if target.timer != nil {
+		target.timer.Stop()
+		target.timer = nil
+	}
+	target.owner = owner
+	target.detached = time.Time{}
+	owner.session.Store(target)
+	return target, nil
+}
+
+// track records an extent allocated through a connection, owner is nil for
+// in-process calls which belong to no session
+func (t *sessionTable) track(owner *connService, start, size uint64) {
+	if owner == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess := owner.session.Load()
+	sess.allocs[start] = size
+	t.owners[start] = sess
+}
+
+// forget drops a freed extent from its owning session
+func (t *sessionTable) forget(start uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if sess, exists := t.owners[start]; exists {
+		delete(sess.allocs, start)
+		delete(t.owners, start)
+	}
+}
+
+// identityOf returns the identity of the session owning the extent at start
+func (t *sessionTable) identityOf(start uint64) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess, exists := t.owners[start]
+	if !exists {
+		return "", false
+	}
+	return sess.identity, true
+}
+
+// forgetOwned drops an extent from sess and reports whether sess still
+// owned it, it may have been freed or moved to another session meanwhile
+func (t *sessionTable) forgetOwned(sess *session, start uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.owners[start] != sess {
+		return false
+	}
+	delete(sess.allocs, start)
+	delete(t.owners, start)
+	return true
+}
+
+// detach unbinds the session of a closed connection. It returns the session
+// if its extents must be freed right away, and calls expire once the grace
+// period is over. Sessions owning nothing are dropped, a client reconnecting
+// opens a new one.
+func (t *sessionTable) detach(owner *connService, expire func(*session)) (*session, []uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess := owner.session.Load()
+	if sess.owner != owner {
+		// Another connection took the session over
+		return nil, nil
+	}
+	sess.owner = nil
+	sess.detached = time.Now()
+	if len(sess.allocs) == 0 {
+		delete(t.byID, sess.id)
+		return nil, nil
+	}
+
+	switch t.policy {
+	case ReleaseOnDisconnect:
+		return t.removeLocked(sess)
+	case ReleaseAfterGrace:
+		sess.timer = time.AfterFunc(t.grace, func() { expire(sess) })
+	}
+	return nil, nil
+}
+
+// expire removes a session still detached after its grace period and
+// returns its extents
+func (t *sessionTable) expire(sess *session) (*session, []uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if sess.owner != nil || t.byID[sess.id] != sess {
+		return nil, nil
+	}
+	return t.removeLocked(sess)
+}
+
+// expireIdle removes the sessions detached for longer than the idle timeout
+// at now and returns them along with their extents
+func (t *sessionTable) expireIdle(now time.Time) map[*session][]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.idle <= 0 {
+		return nil
+	}
+	expired := make(map[*session][]uint64)
+	for _, sess := range t.byID {
+		if sess.owner != nil || now.Sub(sess.detached) < t.idle {
+			continue
+		}
+		if sess.timer != nil {
+			sess.timer.Stop()
+		}
+		_, expired[sess] = t.removeLocked(sess)
+	}
+	return expired
+}
+
+// removeLocked removes a session so it can no longer be reattached and
+// returns the starts of its extents. They stay owned by the session until
+// released with forgetOwned.
+func (t *sessionTable) removeLocked(sess *session) (*session, []uint64) {
+	delete(t.byID, sess.id)
+	starts := make([]uint64, 0, len(sess.allocs))
+	for start := range sess.allocs {
+		starts = append(starts, start)
+	}
+	return sess, starts
+}
+
+func (t *sessionTable) stopTimers() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sess := range t.byID {
+		if sess.timer != nil {
+			sess.timer.Stop()
+		}
+	}
+}
+
+// SetDisconnectPolicy configures what happens to a session's allocations when
+// its connection drops. grace is only used by ReleaseAfterGrace.
+func (s *Server) SetDisconnectPolicy(policy DisconnectPolicy, grace time.Duration) {
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+	s.sessions.policy = policy
+	s.sessions.grace = grace
+}
+
+// SetSessionIdleTimeout sets how long a detached session holding extents is
+// kept before they are released, whatever the disconnect policy.
+// DefaultSessionIdleTimeout by default, 0 keeps them until reattached.
+// Sessions are checked every DefaultLeaseSweepInterval.
+func (s *Server) SetSessionIdleTimeout(timeout time.Duration) {
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+	s.sessions.idle = timeout
+}
+
+// ListSessions returns all sessions ordered by id
+func (s *Server) ListSessions() []SessionInfo {
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(s.sessions.byID))
+	for _, sess := range s.sessions.byID {
+		info := SessionInfo{
+			ID:          sess.id,
+			ClientID:    sess.clientID,
+			Identity:    sess.identity,
+			Attached:    sess.owner != nil,
+			Allocations: len(sess.allocs),
+		}
+		for _, size := range sess.allocs {
+			info.Bytes += size
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// disconnect applies the disconnect policy to the session of a closed connection
+func (s *Server) disconnect(svc *connService) {
+	s.releaseExtents(s.sessions.detach(svc, func(sess *session) {
+		s.releaseExtents(s.sessions.expire(sess))
+	}))
+}
+
+// releaseIdleSessions releases the sessions detached for longer than the
+// idle timeout at now
+func (s *Server) releaseIdleSessions(now time.Time) {
+	for sess, starts := range s.sessions.expireIdle(now) {
+		s.releaseExtents(sess, starts)
+	}
+}
+
+// releaseExtents frees the extents of a released session. Each extent is
+// checked under its stripe lock to still belong to the session, so one freed
+// concurrently and handed out again is left alone.
+func (s *Server) releaseExtents(sess *session, starts []uint64) {
+	for _, start := range starts {
+		stripe := s.extents.lock(start)
+		if e, exists := s.extents.lookup(start); exists && s.sessions.forgetOwned(sess, start) {
+			if err := s.releaseLocked(context.Background(), e, start, e.size); err != nil {
+				fmt.Printf("Failed to release session extent at %d: %v\n", start, err)
+			}
+			s.leases.release(start)
+		}
+		stripe.mu.Unlock()
+	}
+}
+
+// connService exposes the server's RPC methods on a single connection
+type connService struct {
+	server   *Server
+	shard    int          // shard allocations of the connection are served from
+	clientID atomic.Int64 // client id sent with OpenSession, keys rate limits
+	session  atomic.Pointer[session]
+	key      atomic.Pointer[string]
+	identity atomic.Pointer[Identity] // nil until authenticated
+	authMu   sync.Mutex
+	nonce    []byte // pending HMAC challenge
+}
+
+// clientKey returns the key of the client on the connection, empty for
+// in-process calls and clients that did not send one
+func (c *connService) clientKey() string {
+	if c == nil {
+		return ""
+	}
+	if key := c.key.Load(); key != nil {
+		return *key
+	}
+	return ""
+}
+
+// OpenSession names the client of the connection or reattaches it to the
+// session it held before reconnecting
+func (c *connService) OpenSession(req *OpenSessionRequest, resp *OpenSessionResponse) error {
+	if err := c.authorize(RoleReader); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	if req.ClientKey != "" {
+		// Scope the key to the identity so one client cannot replay another's results
+		key := req.ClientKey
+		if identity := c.identity.Load(); identity != nil {
+			key = identity.Name + "/" + key
+		}
+		c.key.Store(&key)
+	}
+	sess := c.session.Load()
+	if req.SessionID != "" && req.SessionID != sess.id {
+		var err error
+		sess, err = c.server.sessions.reattach(c, req.SessionID)
+		if err != nil {
+			resp.Code, resp.Error = wireError(err)
+			return nil
+		}
+	}
+
+	c.clientID.Store(int64(req.ClientID))
+	c.server.sessions.mu.Lock()
+	sess.clientID = req.ClientID
+	c.server.sessions.mu.Unlock()
+	resp.SessionID = sess.id
+	return nil
+}
+
+func (c *connService) Allocate(req *AllocRequest, resp *AllocResponse) error {
+	if err := c.authorize(RoleWriter); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	done, err := c.admit(req.Size)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	defer done()
+	if err := c.server.allocate(context.Background(), c, req, resp); err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+func (c *connService) Free(req *FreeRequest, resp *FreeResponse) error {
+	if err := c.authorize(RoleWriter); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	done, err := c.admit(0)
+	if err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	defer done()
+	if err := c.server.free(context.Background(), c, req); err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+func (c *connService) Commit(req *CommitRequest, resp *CommitResponse) error {
+	if err := c.authorize(RoleWriter); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	if err := c.server.commit(c, req.LeaseID); err != nil {
+		resp.Code, resp.Error = wireError(err)
+	}
+	return nil
+}
+
+func (c *connService) LeaseStats(req *LeaseStatsRequest, resp *LeaseStatsResponse) error {
+	if err := c.authorize(RoleReader); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	return c.server.LeaseStats(req, resp)
+}
+
+// ListSessionsRequest asks for every session
+type ListSessionsRequest struct{}
+
+// ListSessionsResponse returns every session ordered by id
+type ListSessionsResponse struct {
+	Sessions []SessionInfo
+	Code     ErrorCode
+	Error    string
+}
+
+func (c *connService) ListSessions(req *ListSessionsRequest, resp *ListSessionsResponse) error {
+	if err := c.authorize(RoleAdmin); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	resp.Sessions = c.server.ListSessions()
+	return nil
+}
+
+// ListSessions returns every session on the server, it requires RoleAdmin
+// when the server authenticates clients
+func (c *Client) ListSessions() ([]SessionInfo, error) {
+	req := &ListSessionsRequest{}
+	resp := &ListSessionsResponse{}
+
+	if err := c.call(context.Background(), "Server.ListSessions", req, resp, true); err != nil {
+		return nil, err
+	}
+	if err := remoteError(resp.Code, resp.Error); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
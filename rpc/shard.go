@@ -0,0 +1,220 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/mpool"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+const (
+	// maxDefaultShards caps the shard count picked from GOMAXPROCS, every
+	// shard preallocates a full memory pool
+	maxDefaultShards = 8
+	// extentStripes is the number of locks the extent index is split into
+	extentStripes = 64
+)
+
+// DefaultShards returns the number of memory pools NewServer creates
+func DefaultShards() int {
+	return min(runtime.GOMAXPROCS(0), maxDefaultShards)
+}
+
+// extentRecord describes an extent handed out by the server. pool is the
+// shard pool that allocated it, nil for chunks which come straight from the
+// allocator.
+type extentRecord struct {
+	pool *mpool.MemoryPool
+	size uint64
+}
+
+// extentStripe guards the extents whose start hashes to it. Holding it
+// serializes everything that hands out, frees or reclaims those extents, so
+// a free and the bookkeeping around it cannot interleave with another free
+// or with the address being handed out again.
+type extentStripe struct {
+	mu      sync.Mutex
+	extents map[uint64]extentRecord
+}
+
+// extentIndex records every extent handed out by the server and the pool
+// it must go back to, split into stripes so unrelated extents never contend
+type extentIndex [extentStripes]extentStripe
+
+func newExtentIndex() *extentIndex {
+	var index extentIndex
+	for i := range index {
+		index[i].extents = make(map[uint64]extentRecord)
+	}
+	return &index
+}
+
+func stripeOf(start uint64) int {
+	// Fibonacci hashing, extents are aligned to powers of two
+	return int((start * 0x9E3779B97F4A7C15) >> 58)
+}
+
+// lock locks and returns the stripe of start
+func (x *extentIndex) lock(start uint64) *extentStripe {
+	stripe := &x[stripeOf(start)]
+	stripe.mu.Lock()
+	return stripe
+}
+
+// lockAll locks the stripes of every start in a fixed order and returns a
+// function unlocking them
+func (x *extentIndex) lockAll(starts []uint64) func() {
+	seen := make(map[int]bool, len(starts))
+	var stripes []int
+	for _, start := range starts {
+		if i := stripeOf(start); !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+	for _, i := range stripes {
+		x[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			x[i].mu.Unlock()
+		}
+	}
+}
+
+// lookup returns the extent at start, its stripe must be held
+func (x *extentIndex) lookup(start uint64) (extentRecord, bool) {
+	e, exists := x[stripeOf(start)].extents[start]
+	return e, exists
+}
+
+// pickShard returns the shard serving conn. Connections are bound to a
+// shard when they open, in-process calls take turns.
+func (s *Server) pickShard(conn *connService) int {
+	if conn != nil {
+		return conn.shard
+	}
+	return int(s.nextShard.Add(1) % uint64(len(s.pools)))
+}
+
+// allocateExtent allocates from the pool of the shard serving conn, moving
+// on to the other shards when it runs out of space. The extent is not
+// known to the server until published.
+func (s *Server) allocateExtent(ctx context.Context, conn *connService, size uint64) (uint64, *mpool.MemoryPool, error) {
+	first := s.pickShard(conn)
+	var err error
+	for i := range s.pools {
+		pool := s.pools[(first+i)%len(s.pools)]
+		var start uint64
+		start, err = pool.AllocateContext(ctx, size)
+		if err != hybrid.ErrNoSpaceAvailable {
+			return start, pool, err
+		}
+	}
+	return 0, nil, err
+}
+
+// publishLocked records an extent allocated through conn in the index and
+// its session. The stripe of start must be held.
+func (s *Server) publishLocked(conn *connService, start, size uint64, pool *mpool.MemoryPool) {
+	s.extents[stripeOf(start)].extents[start] = extentRecord{pool: pool, size: size}
+	s.sessions.track(conn, start, size)
+}
+
+// freeExtentLocked frees an extent through conn along with its lease and
+// session entry. Extents the server never handed out, or freed with another
+// size than they were handed out with, are reported as invalid like the
+// allocator does: a larger size would free the neighbours of the extent,
+// which may belong to others. The stripe of start must be held.
+func (s *Server) freeExtentLocked(ctx context.Context, conn *connService, start, size uint64) error {
+	e, exists := s.extents.lookup(start)
+	if !exists {
+		return hybrid.ErrInvalidAddress
+	}
+	if err := s.checkOwnerLocked(conn, start); err != nil {
+		return err
+	}
+	if size != e.size {
+		return hybrid.ErrInvalidAddress
+	}
+	if err := s.releaseLocked(ctx, e, start, e.size); err != nil {
+		return err
+	}
+	s.leases.release(start)
+	s.sessions.forget(start)
+	return nil
+}
+
+// allocatedLocked reports whether the extent at start is handed out with the
+// given size. The stripe of start must be held.
+func (s *Server) allocatedLocked(start, size uint64) bool {
+	e, exists := s.extents.lookup(start)
+	switch {
+	case !exists:
+		return false
+	case e.pool == nil:
+		return s.allocator.IsAllocated(start, size)
+	default:
+		return e.pool.IsAllocated(start, size)
+	}
+}
+
+// Check verifies the allocator like hybrid.Allocator.Check and that every
+// extent the server has handed out is still allocated by the pool or
+// allocator it came from. Problems wrap hybrid.ErrInconsistent.
+func (s *Server) Check() error {
+	problems := []error{s.allocator.Check()}
+	for i := range s.extents {
+		stripe := &s.extents[i]
+		stripe.mu.Lock()
+		starts := make([]uint64, 0, len(stripe.extents))
+		for start := range stripe.extents {
+			starts = append(starts, start)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+		for _, start := range starts {
+			if size := stripe.extents[start].size; !s.allocatedLocked(start, size) {
+				problems = append(problems, fmt.Errorf("%w: extent %#x of %d bytes is handed out but not allocated",
+					hybrid.ErrInconsistent, start, size))
+			}
+		}
+		stripe.mu.Unlock()
+	}
+	return errors.Join(problems...)
+}
+
+// releaseLocked frees an extent to the pool or allocator it came from and
+// drops it from the index. The stripe of start must be held.
+func (s *Server) releaseLocked(ctx context.Context, e extentRecord, start, size uint64) error {
+	var err error
+	if e.pool == nil {
+		err = s.allocator.FreeContext(ctx, start, size)
+	} else {
+		err = e.pool.FreeContext(ctx, start, size)
+	}
+	if err != nil {
+		return err
+	}
+	delete(s.extents[stripeOf(start)].extents, start)
+	return nil
+}
+
+// poolStats sums the statistics of every shard pool
+func (s *Server) poolStats() mpool.PoolStats {
+	var total mpool.PoolStats
+	for _, pool := range s.pools {
+		stats := pool.Stats()
+		total.TotalAllocations += stats.TotalAllocations
+		total.PoolHits += stats.PoolHits
+		total.PoolMisses += stats.PoolMisses
+		total.TotalFrees += stats.TotalFrees
+		total.PoolFreeHits += stats.PoolFreeHits
+		total.PoolFreeMisses += stats.PoolFreeMisses
+	}
+	return total
+}
@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"context"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/mpool"
+)
+
+// Stats summarizes the space and memory usage of a server
+type Stats struct {
+	UsedSize    uint64          `json:"used_size"`
+	TotalSize   uint64          `json:"total_size"`
+	MemoryUsage uint64          `json:"memory_usage"`
+	Pool        mpool.PoolStats `json:"pool"`
+	Limits      LimitStats      `json:"limits"`
+}
+
+// StatsRequest asks for the server statistics
+type StatsRequest struct{}
+
+// StatsResponse returns the server statistics
+type StatsResponse struct {
+	Stats Stats
+	Code  ErrorCode
+	Error string
+}
+
+// FragmentationRequest asks for the fragmentation breakdown
+type FragmentationRequest struct{}
+
+// FragmentationResponse returns the fragmentation breakdown
+type FragmentationResponse struct {
+	Fragmentation hybrid.Fragmentation
+	Code          ErrorCode
+	Error         string
+}
+
+func (s *Server) stats() Stats {
+	return Stats{
+		UsedSize:    s.allocator.GetUsedSize(),
+		TotalSize:   s.allocator.GetTotalSize(),
+		MemoryUsage: s.allocator.GetMemoryUsage(),
+		Pool:        s.poolStats(),
+		Limits:      s.admission.stats(),
+	}
+}
+
+// Stats reports space usage, memory overhead and memory pool statistics
+func (s *Server) Stats(req *StatsRequest, resp *StatsResponse) error {
+	resp.Stats = s.stats()
+	return nil
+}
+
+// Fragmentation reports how the free space is split up
+func (s *Server) Fragmentation(req *FragmentationRequest, resp *FragmentationResponse) error {
+	resp.Fragmentation = s.allocator.Fragmentation()
+	return nil
+}
+
+func (c *connService) Stats(req *StatsRequest, resp *StatsResponse) error {
+	if err := c.authorize(RoleReader); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	return c.server.Stats(req, resp)
+}
+
+func (c *connService) Fragmentation(req *FragmentationRequest, resp *FragmentationResponse) error {
+	if err := c.authorize(RoleReader); err != nil {
+		resp.Code, resp.Error = wireError(err)
+		return nil
+	}
+	return c.server.Fragmentation(req, resp)
+}
+
+// Stats returns the server statistics
+func (c *Client) Stats() (Stats, error) {
+	return c.StatsContext(context.Background())
+}
+
+// StatsContext returns the server statistics
+func (c *Client) StatsContext(ctx context.Context) (Stats, error) {
+	req := &StatsRequest{}
+	resp := &StatsResponse{}
+
+	if err := c.call(ctx, "Server.Stats", req, resp, true); err != nil {
+		return Stats{}, err
+	}
+	if err := remoteError(resp.Code, resp.Error); err != nil {
+		return Stats{}, err
+	}
+	return resp.Stats, nil
+}
+
+// GetUsedSize returns the allocated space of the server
+func (c *Client) GetUsedSize() (uint64, error) {
+	stats, err := c.Stats()
+	return stats.UsedSize, err
+}
+
+// GetTotalSize returns the space managed by the server
+func (c *Client) GetTotalSize() (uint64, error) {
+	stats, err := c.Stats()
+	return stats.TotalSize, err
+}
+
+// GetMemoryUsage returns the memory overhead of the server's allocator
+func (c *Client) GetMemoryUsage() (uint64, error) {
+	stats, err := c.Stats()
+	return stats.MemoryUsage, err
+}
+
+// GetPoolStats returns the memory pool statistics of the server
+func (c *Client) GetPoolStats() (mpool.PoolStats, error) {
+	stats, err := c.Stats()
+	return stats.Pool, err
+}
+
+// GetFragmentation returns the fragmentation breakdown of the server
+func (c *Client) GetFragmentation() (hybrid.Fragmentation, error) {
+	return c.GetFragmentationContext(context.Background())
+}
+
+// GetFragmentationContext returns the fragmentation breakdown of the server
+func (c *Client) GetFragmentationContext(ctx context.Context) (hybrid.Fragmentation, error) {
+	req := &FragmentationRequest{}
+	resp := &FragmentationResponse{}
+
+	if err := c.call(ctx, "Server.Fragmentation", req, resp, true); err != nil {
+		return hybrid.Fragmentation{}, err
+	}
+	if err := remoteError(resp.Code, resp.Error); err != nil {
+		return hybrid.Fragmentation{}, err
+	}
+	return resp.Fragmentation, nil
+}
@@ -0,0 +1,139 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Transport carries the connections between clients and a server
+type Transport interface {
+	// Name identifies the transport, e.g. in benchmark output
+	Name() string
+	// Listen accepts connections at address
+	Listen(address string) (net.Listener, error)
+	// Dial connects to a listener at address
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+var (
+	// TCP connects over TCP, address is host:port
+	TCP Transport = netTransport{network: "tcp"}
+	// Unix connects over a Unix domain socket, address is the socket path
+	Unix Transport = netTransport{network: "unix"}
+	// InProcess connects a client and a server of the same process through
+	// in-memory pipes, address is any name the server listens on
+	InProcess Transport = &inProcessTransport{listeners: make(map[string]*pipeListener)}
+)
+
+// netTransport is a transport provided by the net package
+type netTransport struct {
+	network string
+}
+
+func (t netTransport) Name() string {
+	return t.network
+}
+
+func (t netTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(t.network, address)
+}
+
+func (t netTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, t.network, address)
+}
+
+// inProcessTransport hands one end of a net.Pipe to the listener of the
+// dialed name and returns the other
+type inProcessTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+func (t *inProcessTransport) Name() string {
+	return "inproc"
+}
+
+func (t *inProcessTransport) Listen(address string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.listeners[address]; exists {
+		return nil, &net.OpError{Op: "listen", Net: "inproc", Addr: pipeAddr(address), Err: syscall.EADDRINUSE}
+	}
+	listener := &pipeListener{
+		transport: t,
+		address:   pipeAddr(address),
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	t.listeners[address] = listener
+	return listener, nil
+}
+
+func (t *inProcessTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	t.mu.Lock()
+	listener, exists := t.listeners[address]
+	t.mu.Unlock()
+
+	refused := &net.OpError{Op: "dial", Net: "inproc", Addr: pipeAddr(address), Err: syscall.ECONNREFUSED}
+	if !exists {
+		return nil, refused
+	}
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- server:
+		return client, nil
+	case <-listener.done:
+		return nil, refused
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: "inproc", Addr: pipeAddr(address), Err: ctx.Err()}
+	}
+}
+
+// pipeListener accepts the in-process connections dialed to its name
+type pipeListener struct {
+	transport *inProcessTransport
+	address   pipeAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.address))
+		l.transport.mu.Unlock()
+		close(l.done)
+		err = nil
+	})
+	return err
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.address
+}
+
+// pipeAddr is the name an in-process listener is reachable at
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "inproc"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
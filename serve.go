@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hybridAllocator/rpc"
+	"hybridAllocator/trace"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// startTrace records the spans of server to a Chrome trace file, if one is
+// given, and returns a function completing the file
+func startTrace(server *rpc.Server, path string) (func(), error) {
+	if path == "" {
+		return func() {}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	recorder := trace.NewRecorder(file)
+	server.SetTracer(recorder)
+	return func() {
+		server.SetTracer(nil)
+		if err := recorder.Close(); err != nil {
+			log.Printf("Failed to write trace: %v", err)
+		}
+		file.Close()
+	}, nil
+}
+
+// runServe serves one allocator over every API given an address until
+// interrupted
+func runServe(args []string) error {
+	fs := newFlagSet("serve", "")
+	rpcAddress := fs.String("rpc", "", "Listen address of the net/rpc API, disabled if empty")
+	httpAddress := fs.String("http", HTTPAddress, "Listen address of the HTTP/JSON API, disabled if empty")
+	grpcAddress := fs.String("grpc", "", "Listen address of the gRPC API, disabled if empty, such as "+GRPCAddress)
+	traceFile := fs.String("trace", "", "Write a Chrome trace of the served requests to this file")
+	fs.Parse(args)
+	if *rpcAddress == "" && *httpAddress == "" && *grpcAddress == "" {
+		return errors.New("nothing to serve, set -rpc, -http or -grpc")
+	}
+
+	server, err := rpc.NewServer()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	stopTrace, err := startTrace(server, *traceFile)
+	if err != nil {
+		return err
+	}
+	defer stopTrace()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Each API stops on its own error or once interrupted, the first error
+	// interrupts the others
+	var wg sync.WaitGroup
+	errc := make(chan error, 3)
+	serve := func(name string, run func() error, shutdown func()) {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := run(); err != nil {
+				log.Printf("%s server error: %v", name, err)
+				errc <- err
+				stop()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			shutdown()
+		}()
+	}
+
+	if *rpcAddress != "" {
+		listener, err := net.Listen("tcp", *rpcAddress)
+		if err != nil {
+			return err
+		}
+		serve("net/rpc", func() error {
+			if err := server.Serve(listener); err != rpc.ErrServerClosed {
+				return err
+			}
+			return nil
+		}, func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		})
+	}
+	if *httpAddress != "" {
+		httpServer := &http.Server{Addr: *httpAddress, Handler: server.HTTPHandler()}
+		log.Printf("HTTP API listening on %s", *httpAddress)
+		serve("HTTP", func() error {
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		}, func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			httpServer.Shutdown(shutdownCtx)
+		})
+	}
+	if *grpcAddress != "" {
+		listener, err := net.Listen("tcp", *grpcAddress)
+		if err != nil {
+			stop()
+			wg.Wait()
+			return err
+		}
+		grpcServer := server.NewGRPCServer()
+		log.Printf("gRPC API listening on %s", listener.Addr())
+		serve("gRPC", func() error { return grpcServer.Serve(listener) }, grpcServer.GracefulStop)
+	}
+
+	wg.Wait()
+	close(errc)
+	return <-errc
+}
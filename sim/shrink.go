@@ -0,0 +1,120 @@
+package sim
+
+import (
+	"errors"
+	"slices"
+)
+
+// DefaultShrinkBudget is the number of replays Shrink makes by default
+const DefaultShrinkBudget = 2000
+
+// shrinker replays candidate steps, keeping those that still break the
+// same invariant
+type shrinker struct {
+	newSystem  NewSystem
+	failure    *Failure
+	checkEvery int
+	budget     int
+}
+
+// try replays ops and adopts them if they break the invariant of the
+// current failure. Replays stop counting once the budget is spent.
+func (s *shrinker) try(ops []Op) (bool, error) {
+	if s.budget <= 0 {
+		return false, nil
+	}
+	s.budget--
+	err := Replay(s.newSystem, s.failure.Seed, ops, s.checkEvery)
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		return false, err
+	}
+	if failure.Invariant != s.failure.Invariant {
+		return false, nil
+	}
+	s.failure = failure
+	return true, nil
+}
+
+// Shrink looks for fewer and simpler steps breaking the same invariant as
+// failure, replaying candidates against systems created by newSystem with
+// the failure's seed at most budget times. It removes runs of steps, halving
+// their length down to single steps, then moves the steps of each client to
+// client 0 and halves the sizes of allocations. Steps a removal leaves
+// without their allocation are skipped on replay and removed in turn.
+// Candidates are checked as often as the failure was, the reproducer is
+// finally checked on every step to end it at the first broken invariant.
+func Shrink(newSystem NewSystem, failure *Failure, budget int) (*Failure, error) {
+	s := &shrinker{newSystem: newSystem, failure: failure, checkEvery: failure.CheckEvery, budget: budget}
+
+	for chunk := len(s.failure.Ops) / 2; chunk >= 1; chunk /= 2 {
+		for i := 0; i < len(s.failure.Ops) && s.budget > 0; {
+			ops := s.failure.Ops
+			candidate := append(append([]Op(nil), ops[:i]...), ops[min(i+chunk, len(ops)):]...)
+			ok, err := s.try(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				i += chunk
+			}
+		}
+	}
+
+	var clients []int
+	for _, op := range s.failure.Ops {
+		if op.Client != 0 && !slices.Contains(clients, op.Client) {
+			clients = append(clients, op.Client)
+		}
+	}
+	slices.Sort(clients)
+	for _, client := range clients {
+		candidate := append([]Op(nil), s.failure.Ops...)
+		for i := range candidate {
+			if candidate[i].Client == client {
+				candidate[i].Client = 0
+			}
+		}
+		if _, err := s.try(candidate); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < len(s.failure.Ops); i++ {
+		for i < len(s.failure.Ops) && s.failure.Ops[i].Kind == Allocate && s.failure.Ops[i].Size > 1 {
+			candidate := append([]Op(nil), s.failure.Ops...)
+			candidate[i].Size = halve(candidate[i].Size)
+			ok, err := s.try(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+
+	// Skipped steps changed nothing, so they can go even without budget
+	// left, and checking every step may end the steps earlier
+	s.checkEvery = 1
+	s.budget = max(s.budget, 1)
+	var ops []Op
+	for i, op := range s.failure.Ops {
+		if !s.failure.results[i].skipped {
+			ops = append(ops, op)
+		}
+	}
+	if _, err := s.try(ops); err != nil {
+		return nil, err
+	}
+	return s.failure, nil
+}
+
+// halve halves a size, keeping it a multiple of 4KB while it is one
+func halve(size uint64) uint64 {
+	const page = 4 << 10
+	if size%page == 0 && size >= 2*page {
+		return size / 2 &^ (page - 1)
+	}
+	return size / 2
+}
@@ -0,0 +1,494 @@
+// Package sim runs deterministic simulations of allocator clients. A seeded
+// scheduler interleaves the allocations and frees of virtual clients on one
+// goroutine against a hybrid.Allocator, an mpool.MemoryPool or an
+// in-process rpc.Server, checks invariants after every step and shrinks the
+// steps of a failing seed down to a minimal reproducer.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/workload"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// OpKind is what a step of a virtual client does
+type OpKind uint8
+
+const (
+	// Allocate allocates Size bytes
+	Allocate OpKind = iota
+	// Free frees the extent allocated by step Ref, which the client holds
+	Free
+	// StaleFree frees the extent allocated by step Ref again after it was
+	// freed. It must fail, and is only made while no client holds any part
+	// of the extent.
+	StaleFree
+)
+
+var opKindNames = [...]string{"allocate", "free", "stale-free"}
+
+func (k OpKind) String() string {
+	if int(k) < len(opKindNames) {
+		return opKindNames[k]
+	}
+	return fmt.Sprintf("OpKind(%d)", k)
+}
+
+func (k OpKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *OpKind) UnmarshalText(text []byte) error {
+	for i, name := range opKindNames {
+		if string(text) == name {
+			*k = OpKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown op %q", text)
+}
+
+// Op is one step of a virtual client. Ops refer to allocations by the ID
+// of their step, which stays the same while a failure is shrunk.
+type Op struct {
+	ID     int    `json:"id"`
+	Client int    `json:"client"`
+	Kind   OpKind `json:"op"`
+	Size   uint64 `json:"size,omitempty"`
+	Ref    int    `json:"ref"`
+}
+
+// Extent is a range held by a virtual client
+type Extent struct {
+	Client int
+	Start  uint64
+	Size   uint64
+}
+
+// System is the code under test. The harness drives it from a single
+// goroutine, so that the same calls in the same order give the same
+// results.
+type System interface {
+	workload.Usage
+	// Client returns the target virtual client i calls, connecting it on
+	// first use
+	Client(i int) (workload.Target, error)
+	// Check verifies the internal state of the system against the extents
+	// the clients hold, sorted by start
+	Check(live []Extent) error
+	Close() error
+}
+
+// NewSystem creates a fresh system. Systems pre-allocating anything at
+// random draw from seed.
+type NewSystem func(seed int64) (System, error)
+
+// Invariants the harness checks after every step
+const (
+	// InvariantAllocate requires allocations to fail only for lack of
+	// space or an oversized request
+	InvariantAllocate = "allocate"
+	// InvariantBounds requires allocated extents to lie in the address space
+	InvariantBounds = "bounds"
+	// InvariantOverlap requires allocated extents to be disjoint from every
+	// extent held by a client
+	InvariantOverlap = "overlap"
+	// InvariantFree requires frees of held extents to succeed
+	InvariantFree = "free"
+	// InvariantStaleFree requires frees of extents nobody holds to fail
+	InvariantStaleFree = "stale-free"
+	// InvariantUsage requires the used size to cover the held extents and
+	// not exceed the total size
+	InvariantUsage = "usage"
+	// InvariantCheck requires System.Check to pass, which runs every
+	// Config.CheckEvery steps
+	InvariantCheck = "check"
+)
+
+// Config configures a simulation
+type Config struct {
+	// Spec draws the sizes and lifetimes of each client's extents and its
+	// mix of allocations and frees. Concurrency is the number of virtual
+	// clients, Ops the number of steps and Seed seeds the scheduler.
+	Spec workload.Spec
+	// StaleFreeRatio is the share of frees that free an extent again
+	// after it was freed
+	StaleFreeRatio float64
+	// CheckEvery calls System.Check every so many steps and after the
+	// last, the other invariants are checked on every step. Zero checks
+	// every step. Check walks the whole allocator, every step is slow once
+	// a pool has pre-allocated its blocks.
+	CheckEvery int
+}
+
+// DefaultConfig simulates eight clients making a few thousand allocations
+// and frees of 4KB to 4MB, a mix that exercises the slab and buddy layers
+// and the pool alike
+func DefaultConfig() Config {
+	return Config{
+		Spec: workload.Spec{
+			Name:          "sim",
+			Size:          workload.LogNormal{Median: 64 << 10, Sigma: 1.5},
+			MaxSize:       4 << 20,
+			Align:         4 << 10,
+			Lifetime:      workload.RandomOrder{},
+			AllocateRatio: 0.6,
+			Concurrency:   8,
+			Ops:           5000,
+		},
+		StaleFreeRatio: 0.05,
+		CheckEvery:     100,
+	}
+}
+
+// Failure is a broken invariant, along with the steps that broke it
+type Failure struct {
+	// Seed is the seed the system was created with
+	Seed int64 `json:"seed"`
+	// CheckEvery is how often System.Check ran
+	CheckEvery int `json:"check_every"`
+	// Invariant names the broken invariant
+	Invariant string `json:"invariant"`
+	// Err describes how it broke
+	Err error `json:"-"`
+	// Ops are the steps leading to the failure, the last one broke the
+	// invariant
+	Ops []Op `json:"ops"`
+
+	results []result
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("seed %d: %s invariant broken at step %d: %v", f.Seed, f.Invariant, f.Ops[len(f.Ops)-1].ID, f.Err)
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// WriteText writes the failure and its steps, with the addresses they were
+// served at, as a reproducer to read
+func (f *Failure) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%v\n", f); err != nil {
+		return err
+	}
+	for i, op := range f.Ops {
+		var line string
+		switch op.Kind {
+		case Allocate:
+			line = fmt.Sprintf("%6d  client %d allocate %d", op.ID, op.Client, op.Size)
+		default:
+			line = fmt.Sprintf("%6d  client %d %s #%d", op.ID, op.Client, op.Kind, op.Ref)
+		}
+		if i < len(f.results) {
+			switch r := f.results[i]; {
+			case r.skipped:
+				line += " (skipped)"
+			case r.err != nil:
+				line += fmt.Sprintf(": %v", r.err)
+			case op.Kind == Allocate:
+				line += fmt.Sprintf(" -> %#x", r.start)
+			}
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// result is what a step returned
+type result struct {
+	start   uint64
+	err     error
+	skipped bool
+}
+
+// allocation is an extent allocated by a step
+type allocation struct {
+	Extent
+	live bool
+}
+
+// execution applies steps to a system and tracks what the clients hold
+type execution struct {
+	system     System
+	seed       int64
+	checkEvery int
+	targets    map[int]workload.Target
+	allocs     map[int]*allocation // by step ID
+	live       []Extent            // sorted by start
+	ops        []Op
+	results    []result
+}
+
+func newExecution(newSystem NewSystem, seed int64, checkEvery int) (*execution, error) {
+	system, err := newSystem(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &execution{
+		system:     system,
+		seed:       seed,
+		checkEvery: max(checkEvery, 1),
+		targets:    make(map[int]workload.Target),
+		allocs:     make(map[int]*allocation),
+	}, nil
+}
+
+func (e *execution) close() error {
+	return e.system.Close()
+}
+
+func (e *execution) target(client int) (workload.Target, error) {
+	if t, ok := e.targets[client]; ok {
+		return t, nil
+	}
+	t, err := e.system.Client(client)
+	if err != nil {
+		return nil, err
+	}
+	e.targets[client] = t
+	return t, nil
+}
+
+// overlapping returns the index of a held extent overlapping
+// [start, start+size), or -1
+func (e *execution) overlapping(start, size uint64) int {
+	i := sort.Search(len(e.live), func(i int) bool { return e.live[i].Start >= start+size })
+	if i > 0 && e.live[i-1].Start+e.live[i-1].Size > start {
+		return i - 1
+	}
+	return -1
+}
+
+func (e *execution) hold(x Extent) {
+	i := sort.Search(len(e.live), func(i int) bool { return e.live[i].Start > x.Start })
+	e.live = append(e.live, Extent{})
+	copy(e.live[i+1:], e.live[i:])
+	e.live[i] = x
+}
+
+func (e *execution) release(x Extent) {
+	i := sort.Search(len(e.live), func(i int) bool { return e.live[i].Start >= x.Start })
+	e.live = append(e.live[:i], e.live[i+1:]...)
+}
+
+// step applies op and checks the invariants, System.Check only every
+// checkEvery steps or if last is set. Ops referring to allocations that did
+// not happen or no longer fit the state are skipped.
+func (e *execution) step(op Op, last bool) (*Failure, error) {
+	r, failure, err := e.apply(op)
+	if err != nil {
+		return nil, err
+	}
+	e.ops = append(e.ops, op)
+	e.results = append(e.results, r)
+	if failure != nil || r.skipped {
+		return failure, nil
+	}
+
+	var live uint64
+	for _, x := range e.live {
+		live += x.Size
+	}
+	used, total := e.system.GetUsedSize(), e.system.GetTotalSize()
+	if used < live || used > total {
+		return e.fail(InvariantUsage, fmt.Errorf("%d bytes used, clients hold %d of %d", used, live, total)), nil
+	}
+	if last || len(e.ops)%e.checkEvery == 0 {
+		if err := e.system.Check(e.live); err != nil {
+			return e.fail(InvariantCheck, err), nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *execution) apply(op Op) (result, *Failure, error) {
+	t, err := e.target(op.Client)
+	if err != nil {
+		return result{}, nil, err
+	}
+	switch op.Kind {
+	case Allocate:
+		start, err := t.Allocate(op.Size)
+		r := result{start: start, err: err}
+		if err != nil {
+			if errors.Is(err, hybrid.ErrNoSpaceAvailable) || errors.Is(err, hybrid.ErrSizeTooLarge) {
+				return r, nil, nil
+			}
+			return r, e.failAfter(op, r, InvariantAllocate, err), nil
+		}
+		if total := e.system.GetTotalSize(); start >= total || op.Size > total-start {
+			return r, e.failAfter(op, r, InvariantBounds, fmt.Errorf("%d bytes at %#x exceed the %d byte address space", op.Size, start, total)), nil
+		}
+		if i := e.overlapping(start, op.Size); i >= 0 {
+			x := e.live[i]
+			return r, e.failAfter(op, r, InvariantOverlap, fmt.Errorf("%d bytes at %#x overlap %d bytes at %#x held by client %d",
+				op.Size, start, x.Size, x.Start, x.Client)), nil
+		}
+		x := Extent{Client: op.Client, Start: start, Size: op.Size}
+		e.allocs[op.ID] = &allocation{Extent: x, live: true}
+		e.hold(x)
+		return r, nil, nil
+
+	case Free:
+		a, ok := e.allocs[op.Ref]
+		if !ok || !a.live || a.Client != op.Client {
+			return result{skipped: true}, nil, nil
+		}
+		r := result{err: t.Free(a.Start, a.Size)}
+		if r.err != nil {
+			return r, e.failAfter(op, r, InvariantFree, fmt.Errorf("freeing %d bytes at %#x: %w", a.Size, a.Start, r.err)), nil
+		}
+		a.live = false
+		e.release(a.Extent)
+		return r, nil, nil
+
+	case StaleFree:
+		a, ok := e.allocs[op.Ref]
+		if !ok || a.live || a.Client != op.Client || e.overlapping(a.Start, a.Size) >= 0 {
+			return result{skipped: true}, nil, nil
+		}
+		r := result{err: t.Free(a.Start, a.Size)}
+		if r.err == nil {
+			return r, e.failAfter(op, r, InvariantStaleFree, fmt.Errorf("freeing %d bytes at %#x again succeeded", a.Size, a.Start)), nil
+		}
+		return r, nil, nil
+	}
+	return result{}, nil, fmt.Errorf("unknown op %v", op.Kind)
+}
+
+// failAfter records op and returns the failure it caused
+func (e *execution) failAfter(op Op, r result, invariant string, err error) *Failure {
+	e.ops = append(e.ops, op)
+	e.results = append(e.results, r)
+	return e.fail(invariant, err)
+}
+
+func (e *execution) fail(invariant string, err error) *Failure {
+	return &Failure{Seed: e.seed, CheckEvery: e.checkEvery, Invariant: invariant, Err: err, Ops: e.ops, results: e.results}
+}
+
+// client is the generator of a virtual client's steps
+type client struct {
+	rng    *rand.Rand
+	sizes  func() uint64
+	live   workload.LiveSet
+	steps  int
+	starts map[uint64]int // start of each held extent -> allocating step
+	freed  []int          // steps whose extents were freed, for stale frees
+}
+
+// maxStaleCandidates bounds the freed extents a client remembers
+const maxStaleCandidates = 64
+
+// Run simulates config against a system created by newSystem. Each step
+// the scheduler picks a virtual client, which allocates, frees one of its
+// extents as its lifetime policy says, or frees an extent again. The same
+// config always makes the same steps and, as long as the system is
+// deterministic, gets the same results. Run returns a *Failure when an
+// invariant breaks, other errors when the system fails to run.
+func Run(newSystem NewSystem, config Config) error {
+	spec := config.Spec
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	if spec.Concurrency <= 0 || spec.Ops < 0 {
+		return fmt.Errorf("simulation needs clients and steps, got %d and %d", spec.Concurrency, spec.Ops)
+	}
+
+	e, err := newExecution(newSystem, spec.Seed, config.CheckEvery)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+
+	scheduler := rand.New(rand.NewSource(spec.Seed))
+	clients := make([]*client, spec.Concurrency)
+	for i := range clients {
+		rng := rand.New(rand.NewSource(spec.Seed + int64(i) + 1))
+		clients[i] = &client{
+			rng:    rng,
+			sizes:  spec.Sizes(rng),
+			live:   spec.Lifetime.Live(rng),
+			starts: make(map[uint64]int),
+		}
+	}
+	for id := 0; id < spec.Ops; id++ {
+		i := scheduler.Intn(len(clients))
+		c := clients[i]
+		op := c.next(id, i, spec.AllocateRatio, config.StaleFreeRatio)
+		failure, err := e.step(op, id == spec.Ops-1)
+		if err != nil {
+			return err
+		}
+		if failure != nil {
+			return failure
+		}
+		c.update(op, e.allocs[op.ID])
+	}
+	return nil
+}
+
+// next draws the client's next step
+func (c *client) next(id, index int, allocateRatio, staleFreeRatio float64) Op {
+	step := c.steps
+	c.steps++
+	// Like workload.Run, the mix is drawn on every step so that the
+	// client's random sequence does not depend on which extents expired
+	allocating := c.rng.Float64() < allocateRatio
+	stale := c.rng.Float64() < staleFreeRatio
+	if c.live.Due(step) || (!allocating && c.live.Len() > 0) {
+		if stale && len(c.freed) > 0 {
+			return Op{ID: id, Client: index, Kind: StaleFree, Ref: c.freed[c.rng.Intn(len(c.freed))]}
+		}
+		obj, _ := c.live.Remove(step)
+		ref := c.starts[obj.Start]
+		delete(c.starts, obj.Start)
+		return Op{ID: id, Client: index, Kind: Free, Ref: ref}
+	}
+	return Op{ID: id, Client: index, Kind: Allocate, Size: c.sizes()}
+}
+
+// update records what the step did to the client's extents
+func (c *client) update(op Op, a *allocation) {
+	switch op.Kind {
+	case Allocate:
+		if a != nil {
+			c.live.Add(workload.Object{Start: a.Start, Size: a.Size}, c.steps-1)
+			c.starts[a.Start] = op.ID
+		}
+	case Free:
+		if len(c.freed) == maxStaleCandidates {
+			c.freed = c.freed[1:]
+		}
+		c.freed = append(c.freed, op.Ref)
+	}
+}
+
+// Replay applies ops to a system created from seed, calling System.Check
+// every checkEvery steps and after the last like Run. It returns a *Failure
+// with the steps up to the one breaking an invariant, nil if none does, or
+// other errors when the system fails to run.
+func Replay(newSystem NewSystem, seed int64, ops []Op, checkEvery int) error {
+	e, err := newExecution(newSystem, seed, checkEvery)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+	for i, op := range ops {
+		failure, err := e.step(op, i == len(ops)-1)
+		if err != nil {
+			return err
+		}
+		if failure != nil {
+			return failure
+		}
+	}
+	return nil
+}
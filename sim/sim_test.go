@@ -0,0 +1,199 @@
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/workload"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+	hybrid.SetLogLevel(hybrid.LogLevelNone)
+}
+
+// smallConfig keeps simulations of pools and servers, whose checks walk
+// tens of thousands of pre-allocated blocks, to a few seconds
+func smallConfig(seed int64, ops int) Config {
+	config := DefaultConfig()
+	config.Spec.Seed = seed
+	config.Spec.Ops = ops
+	config.Spec.Concurrency = 4
+	config.CheckEvery = 250
+	return config
+}
+
+func TestRun(t *testing.T) {
+	steps := map[string]int{"hybrid": 5000, "mpool": 1000, "rpc": 500}
+	for name, newSystem := range Systems {
+		t.Run(name, func(t *testing.T) {
+			for seed := int64(1); seed <= 2; seed++ {
+				if err := Run(newSystem, smallConfig(seed, steps[name])); err != nil {
+					t.Fatalf("Seed %d failed: %v", seed, err)
+				}
+			}
+		})
+	}
+
+	config := smallConfig(1, 100)
+	config.Spec.Concurrency = 0
+	if err := Run(NewAllocatorSystem, config); err == nil {
+		t.Fatalf("Run without clients succeeded")
+	}
+}
+
+// recordingSystem records the calls its clients make
+type recordingSystem struct {
+	allocatorSystem
+	calls *[]string
+}
+
+type recordingTarget struct {
+	workload.Target
+	client int
+	calls  *[]string
+}
+
+func (s recordingSystem) Client(i int) (workload.Target, error) {
+	return recordingTarget{Target: s.Allocator, client: i, calls: s.calls}, nil
+}
+
+func (t recordingTarget) Allocate(size uint64) (uint64, error) {
+	start, err := t.Target.Allocate(size)
+	*t.calls = append(*t.calls, fmt.Sprint(t.client, " allocate ", size, " -> ", start, err))
+	return start, err
+}
+
+func (t recordingTarget) Free(start, size uint64) error {
+	err := t.Target.Free(start, size)
+	*t.calls = append(*t.calls, fmt.Sprint(t.client, " free ", start, size, " -> ", err))
+	return err
+}
+
+func TestDeterminism(t *testing.T) {
+	record := func(seed int64) []string {
+		var calls []string
+		newSystem := func(int64) (System, error) {
+			return recordingSystem{allocatorSystem{hybrid.NewAllocator()}, &calls}, nil
+		}
+		if err := Run(newSystem, smallConfig(seed, 2000)); err != nil {
+			t.Fatalf("Seed %d failed: %v", seed, err)
+		}
+		return calls
+	}
+
+	// Stale frees of extents held again are skipped without a call
+	first := record(7)
+	if len(first) < 1900 || len(first) > 2000 {
+		t.Fatalf("Expected about 2000 calls, got %d", len(first))
+	}
+	var staleFrees int
+	for _, call := range first {
+		if strings.Contains(call, hybrid.ErrAddressNotAllocated.Error()) || strings.Contains(call, hybrid.ErrBlockNotFound.Error()) {
+			staleFrees++
+		}
+	}
+	if staleFrees == 0 {
+		t.Fatalf("No stale frees in 2000 steps")
+	}
+	if !reflect.DeepEqual(record(7), first) {
+		t.Fatalf("Seed 7 made different calls on a second run")
+	}
+	if reflect.DeepEqual(record(8), first) {
+		t.Fatalf("Seeds 7 and 8 made the same calls")
+	}
+}
+
+// forgetfulSystem frees extents freed before without complaint, like an
+// allocator that lost track of its free blocks
+type forgetfulSystem struct {
+	allocatorSystem
+}
+
+type forgetfulTarget struct {
+	*hybrid.Allocator
+}
+
+func (s forgetfulSystem) Client(i int) (workload.Target, error) {
+	return forgetfulTarget{s.Allocator}, nil
+}
+
+func (t forgetfulTarget) Free(start, size uint64) error {
+	t.Allocator.Free(start, size)
+	return nil
+}
+
+func newForgetfulSystem(seed int64) (System, error) {
+	return forgetfulSystem{allocatorSystem{hybrid.NewAllocator()}}, nil
+}
+
+func TestShrink(t *testing.T) {
+	config := smallConfig(3, 2000)
+	err := Run(newForgetfulSystem, config)
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		t.Fatalf("Expected a failure, got %v", err)
+	}
+	if failure.Invariant != InvariantStaleFree {
+		t.Fatalf("Expected the %s invariant broken, got %v", InvariantStaleFree, failure)
+	}
+
+	shrunk, err := Shrink(newForgetfulSystem, failure, DefaultShrinkBudget)
+	if err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	var text strings.Builder
+	shrunk.WriteText(&text)
+	// Allocating, freeing and freeing again is all it takes
+	if len(shrunk.Ops) != 3 || shrunk.Invariant != InvariantStaleFree {
+		t.Fatalf("Expected 3 steps breaking the %s invariant, got:\n%s", InvariantStaleFree, text.String())
+	}
+	for _, op := range shrunk.Ops {
+		if op.Client != 0 {
+			t.Fatalf("Expected every step moved to client 0, got:\n%s", text.String())
+		}
+	}
+	if size := shrunk.Ops[0].Size; size != 1 {
+		t.Fatalf("Expected the allocation halved to 1 byte, got %d", size)
+	}
+
+	// The reproducer survives a round trip through JSON and still fails
+	data, err := json.Marshal(shrunk)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var loaded Failure
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Ops, shrunk.Ops) {
+		t.Fatalf("Steps are %+v after a round trip, expected %+v", loaded.Ops, shrunk.Ops)
+	}
+	err = Replay(newForgetfulSystem, loaded.Seed, loaded.Ops, 1)
+	if !errors.As(err, &failure) || failure.Invariant != InvariantStaleFree {
+		t.Fatalf("Expected the reproducer to break the %s invariant, got %v", InvariantStaleFree, err)
+	}
+	if err := Replay(NewAllocatorSystem, loaded.Seed, loaded.Ops, 1); err != nil {
+		t.Fatalf("Reproducer failed against the allocator: %v", err)
+	}
+}
+
+func TestOpKind(t *testing.T) {
+	for _, kind := range []OpKind{Allocate, Free, StaleFree} {
+		text, err := kind.MarshalText()
+		if err != nil {
+			t.Fatalf("MarshalText failed: %v", err)
+		}
+		var got OpKind
+		if err := got.UnmarshalText(text); err != nil || got != kind {
+			t.Fatalf("%q read back as %v, %v", text, got, err)
+		}
+	}
+	var kind OpKind
+	if err := kind.UnmarshalText([]byte("realloc")); err == nil {
+		t.Fatalf("Unknown op read back as %v", kind)
+	}
+}
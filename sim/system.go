@@ -0,0 +1,160 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/mpool"
+	"hybridAllocator/rpc"
+	"hybridAllocator/workload"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Systems are the systems the harness knows, by name
+var Systems = map[string]NewSystem{
+	"hybrid": NewAllocatorSystem,
+	"mpool":  NewPoolSystem,
+	"rpc":    NewServerSystem,
+}
+
+// allocatorSystem has every client call the allocator directly
+type allocatorSystem struct {
+	*hybrid.Allocator
+}
+
+// NewAllocatorSystem returns a system of a fresh hybrid.Allocator, which
+// draws nothing at random
+func NewAllocatorSystem(seed int64) (System, error) {
+	return allocatorSystem{hybrid.NewAllocator()}, nil
+}
+
+func (s allocatorSystem) Client(i int) (workload.Target, error) {
+	return s.Allocator, nil
+}
+
+// Check runs hybrid.Allocator.Check and verifies that the allocator holds
+// exactly the extents of the clients: each is allocated and nothing is used
+// once none is held
+func (s allocatorSystem) Check(live []Extent) error {
+	problems := []error{s.Allocator.Check()}
+	for _, x := range live {
+		if !s.IsAllocated(x.Start, x.Size) {
+			problems = append(problems, fmt.Errorf("%d bytes at %#x held by client %d are not allocated", x.Size, x.Start, x.Client))
+		}
+	}
+	if used := s.GetUsedSize(); len(live) == 0 && used != 0 {
+		problems = append(problems, fmt.Errorf("%d bytes used while no client holds any", used))
+	}
+	return errors.Join(problems...)
+}
+
+// poolSystem has every client call a memory pool over a fresh allocator
+type poolSystem struct {
+	*mpool.MemoryPool
+	allocator *hybrid.Allocator
+}
+
+// NewPoolSystem returns a system of a memory pool whose pre-allocated
+// blocks are drawn from seed
+func NewPoolSystem(seed int64) (System, error) {
+	allocator := hybrid.NewAllocator()
+	pool, err := mpool.NewMemoryPoolWithRand(allocator, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		allocator.Close()
+		return nil, err
+	}
+	return &poolSystem{MemoryPool: pool, allocator: allocator}, nil
+}
+
+func (s *poolSystem) Client(i int) (workload.Target, error) {
+	return s.MemoryPool, nil
+}
+
+func (s *poolSystem) GetUsedSize() uint64  { return s.allocator.GetUsedSize() }
+func (s *poolSystem) GetTotalSize() uint64 { return s.allocator.GetTotalSize() }
+
+// Check runs hybrid.Allocator.Check and verifies that the pool has handed
+// out every extent of the clients
+func (s *poolSystem) Check(live []Extent) error {
+	problems := []error{s.allocator.Check()}
+	for _, x := range live {
+		if !s.IsAllocated(x.Start, x.Size) {
+			problems = append(problems, fmt.Errorf("%d bytes at %#x held by client %d are not allocated", x.Size, x.Start, x.Client))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+func (s *poolSystem) Close() error {
+	err := s.MemoryPool.Close()
+	s.allocator.Close()
+	return err
+}
+
+// serverShards is the number of shards of simulated servers, more than one
+// so that allocations move on to other shards when one runs out
+const serverShards = 2
+
+// serverAddresses tells the in-process listeners of simulated servers apart
+var serverAddresses atomic.Uint64
+
+// serverSystem connects every client to an in-process server over its own
+// connection
+type serverSystem struct {
+	*rpc.Server
+	address string
+	clients map[int]*rpc.Client
+	served  chan error
+}
+
+// NewServerSystem returns a system of an rpc.Server with two shards whose
+// pools are seeded from seed, served in-process. Clients connect in the
+// order they first call, so that connections are bound to the same shards
+// on every run.
+func NewServerSystem(seed int64) (System, error) {
+	server, err := rpc.NewSeededServer(serverShards, seed)
+	if err != nil {
+		return nil, err
+	}
+	address := fmt.Sprintf("sim-%d", serverAddresses.Add(1))
+	listener, err := rpc.InProcess.Listen(address)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	s := &serverSystem{Server: server, address: address, clients: make(map[int]*rpc.Client), served: make(chan error, 1)}
+	go func() { s.served <- server.Serve(listener) }()
+	<-server.Ready()
+	return s, nil
+}
+
+func (s *serverSystem) Client(i int) (workload.Target, error) {
+	if c, ok := s.clients[i]; ok {
+		return c, nil
+	}
+	c, err := rpc.NewClientWithConfig(i, s.address, rpc.ClientConfig{Transport: rpc.InProcess})
+	if err != nil {
+		return nil, err
+	}
+	// A broken connection is a failure to report, not to paper over
+	c.SetRetryPolicy(rpc.RetryPolicy{MaxAttempts: 1})
+	s.clients[i] = c
+	return c, nil
+}
+
+// Check runs rpc.Server.Check
+func (s *serverSystem) Check(live []Extent) error {
+	return s.Server.Check()
+}
+
+func (s *serverSystem) Close() error {
+	for _, c := range s.clients {
+		c.Close()
+	}
+	err := s.Server.Close()
+	if served := <-s.served; served != rpc.ErrServerClosed && err == nil {
+		err = served
+	}
+	return err
+}
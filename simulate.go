@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/sim"
+	"hybridAllocator/workload"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// reproducer is a shrunk simulation failure as saved by sim -o
+type reproducer struct {
+	System string `json:"system"`
+	*sim.Failure
+}
+
+// runSimulate runs deterministic simulations of virtual clients against the
+// systems asked for, one per seed, and shrinks the first failure of each
+// system to a reproducer
+func runSimulate(args []string) error {
+	fs := newFlagSet("sim", "")
+	systems := fs.String("system", "hybrid,mpool,rpc", "Comma separated systems to simulate: "+strings.Join(simSystems(), ", "))
+	seed := fs.Int64("seed", 0, "First seed, 0 picks one from the clock")
+	seeds := fs.Int("seeds", 1, "Number of seeds to run, from -seed on")
+	specFile := fs.String("spec", "", "JSON workload spec drawing sizes, lifetimes and the mix of each client, the simulation's own if empty")
+	steps := fs.Int("steps", 0, "Steps of a simulation, overriding the spec's")
+	clients := fs.Int("clients", 0, "Virtual clients, overriding the spec's concurrency")
+	staleFrees := fs.Float64("stale", sim.DefaultConfig().StaleFreeRatio, "Share of frees that free an extent again")
+	checkEvery := fs.Int("check-every", sim.DefaultConfig().CheckEvery, "Check the consistency of the system every so many steps")
+	budget := fs.Int("shrink", sim.DefaultShrinkBudget, "Replays spent shrinking a failure, 0 reports it as found")
+	replayFile := fs.String("replay", "", "Replay a reproducer saved with -o instead of simulating")
+	output := fs.String("o", "", "Save the reproducer of a failure to this file")
+	verbose := fs.Bool("v", false, "Log allocator errors, such as those of stale frees")
+	fs.Parse(args)
+	if !*verbose {
+		hybrid.SetLogLevel(hybrid.LogLevelNone)
+	}
+	if *replayFile != "" {
+		return replayReproducer(*replayFile)
+	}
+
+	config := sim.DefaultConfig()
+	if *specFile != "" {
+		data, err := os.ReadFile(*specFile)
+		if err != nil {
+			return err
+		}
+		if config.Spec, err = workload.ParseSpec(data); err != nil {
+			return err
+		}
+	}
+	if *steps > 0 {
+		config.Spec.Ops = *steps
+	}
+	if *clients > 0 {
+		config.Spec.Concurrency = *clients
+	}
+	config.StaleFreeRatio = *staleFrees
+	config.CheckEvery = *checkEvery
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	names := strings.Split(*systems, ",")
+	for _, name := range names {
+		if sim.Systems[name] == nil {
+			return fmt.Errorf("unknown system %q, expected one of %s", name, strings.Join(simSystems(), ", "))
+		}
+	}
+
+	failed := false
+	for _, name := range names {
+		newSystem := sim.Systems[name]
+		for i := 0; i < *seeds; i++ {
+			config.Spec.Seed = *seed + int64(i)
+			began := time.Now()
+			err := sim.Run(newSystem, config)
+			var failure *sim.Failure
+			if !errors.As(err, &failure) {
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				fmt.Printf("%s seed %d: %d steps passed in %v\n", name, config.Spec.Seed, config.Spec.Ops, time.Since(began).Round(time.Millisecond))
+				continue
+			}
+
+			failed = true
+			fmt.Printf("%s %v\n", name, failure)
+			if *budget > 0 {
+				fmt.Printf("Shrinking %d steps\n", len(failure.Ops))
+				if failure, err = sim.Shrink(newSystem, failure, *budget); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			fmt.Printf("\nReproducer of %s:\n", name)
+			failure.WriteText(os.Stdout)
+			fmt.Println()
+			if *output != "" {
+				if err := saveReproducer(*output, reproducer{System: name, Failure: failure}); err != nil {
+					return err
+				}
+				fmt.Printf("Saved the reproducer to %s, run 'sim -replay %s' to replay it\n\n", *output, *output)
+			}
+			// Later seeds most likely break the same invariant
+			break
+		}
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+// simSystems returns the names of the systems sim knows, sorted
+func simSystems() []string {
+	names := make([]string, 0, len(sim.Systems))
+	for name := range sim.Systems {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func saveReproducer(path string, r reproducer) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// replayReproducer replays the steps of a saved reproducer, failing while
+// they still break an invariant
+func replayReproducer(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r := reproducer{Failure: &sim.Failure{}}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("failed to read reproducer: %w", err)
+	}
+	newSystem := sim.Systems[r.System]
+	if newSystem == nil {
+		return fmt.Errorf("reproducer of unknown system %q", r.System)
+	}
+
+	err = sim.Replay(newSystem, r.Seed, r.Ops, 1)
+	var failure *sim.Failure
+	if !errors.As(err, &failure) {
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d steps passed, the %s invariant holds\n", r.System, len(r.Ops), r.Invariant)
+		return nil
+	}
+	fmt.Printf("%s ", r.System)
+	failure.WriteText(os.Stdout)
+	return errFailed
+}
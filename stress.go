@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hybridAllocator/hybrid"
+	"hybridAllocator/metrics"
+	"hybridAllocator/mpool"
+	"hybridAllocator/workload"
+	"log"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+// Block represents an allocated memory block
+type Block struct {
+	start uint64
+	size  uint64
+}
+
+type StressTest struct {
+	allocator  *hybrid.Allocator
+	pool       *mpool.MemoryPool
+	blocks     []Block
+	blockCount int
+	spec       workload.Spec
+	rng        *rand.Rand
+	sizes      func() uint64
+
+	allocLatency, freeLatency metrics.LatencyHistogram
+	allocations, frees        int
+}
+
+// NewStressTest fills the allocator with sizes drawn from spec, seeded by
+// its seed
+func NewStressTest(spec workload.Spec) *StressTest {
+	allocator := hybrid.NewAllocator()
+	mp, _ := mpool.NewMemoryPool(allocator)
+	rng := rand.New(rand.NewSource(spec.Seed))
+	return &StressTest{
+		allocator:  allocator,
+		pool:       mp,
+		blocks:     make([]Block, 1000000),
+		blockCount: 0,
+		spec:       spec,
+		rng:        rng,
+		sizes:      spec.Sizes(rng),
+	}
+}
+
+// runStressTest fills the allocator until an allocation fails, frees 30-50%
+// of the blocks at random and starts over until targetSize bytes have been
+// written. The timeline holds the utilization of every fill.
+func (st *StressTest) runStressTest(targetSize uint64) (RunResult, error) {
+	log.Printf("Starting stress test with target size: %d TB", targetSize/(1024*1024*1024*1024))
+	log.Printf("Workload %s, seed %d", st.spec.Name, st.spec.Seed)
+
+	startTime := time.Now()
+	totalWritten := uint64(0)
+	iteration := 0
+	var timeline []Point
+	var peak float64
+
+	for totalWritten < targetSize {
+		now := time.Now()
+		iteration++
+		log.Printf("Iteration %d: Starting allocation phase", iteration)
+		used := uint64(0)
+		for {
+			size := st.sizes()
+			began := time.Now()
+			start, err := st.allocator.Allocate(size)
+			if err != nil {
+				if errors.Is(err, hybrid.ErrNoSpaceAvailable) {
+					break
+				}
+				return RunResult{}, fmt.Errorf("failed to allocate %d bytes: %w", size, err)
+			}
+			st.allocLatency.Since(began)
+			st.allocations++
+			// Small sizes can outnumber the preallocated blocks
+			if st.blockCount == len(st.blocks) {
+				st.blocks = append(st.blocks, Block{})
+			}
+			st.blocks[st.blockCount] = Block{start: start, size: size}
+			st.blockCount++
+			totalWritten += size
+		}
+		used = st.allocator.GetUsedSize()
+		usage := float64(used) / float64(st.allocator.GetTotalSize())
+		peak = max(peak, usage)
+		timeline = append(timeline, Point{
+			ElapsedSeconds: time.Since(startTime).Seconds(),
+			Ops:            int64(st.allocations + st.frees),
+			Utilization:    usage,
+			LiveBytes:      used,
+		})
+		log.Printf("start delete  usage: %.5f%%\n", usage*100)
+		printFun := func() {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			duration := time.Since(now)
+			log.Printf("Iteration %d completed:", iteration)
+			log.Printf("  Total written: %d TB", totalWritten/(1024*1024*1024*1024))
+			log.Printf("  usage: %.5f%%\n", usage*100)
+			log.Printf("  Current memory usage: %d MB", m.Alloc/1024/1024)
+			log.Printf("  Duration: %v", duration)
+			log.Printf("  Average write speed: %.2f MB/s", float64(totalWritten)/time.Since(startTime).Seconds()/1024/1024)
+		}
+		if totalWritten > targetSize {
+			printFun()
+			break
+		}
+		releaseRatio := 0.3 + st.rng.Float64()*0.2 // 30%-50%
+
+		releaseCount := int(float64(st.blockCount) * releaseRatio)
+		for j := 0; j < releaseCount && st.blockCount > 0; j++ {
+			idx := st.rng.Intn(st.blockCount)
+			block := st.blocks[idx]
+			st.blocks[idx] = st.blocks[st.blockCount-1]
+			st.blockCount--
+			began := time.Now()
+			if err := st.allocator.Free(block.start, block.size); err != nil {
+				return RunResult{}, fmt.Errorf("failed to free %d bytes at %d: %w", block.size, block.start, err)
+			}
+			st.freeLatency.Since(began)
+			st.frees++
+		}
+		printFun()
+	}
+	duration := time.Since(startTime)
+	log.Printf("  Total Duration: %v", duration)
+
+	used := st.allocator.GetUsedSize()
+	total := st.allocator.GetTotalSize()
+	result := RunResult{
+		Name:                "stress/" + st.spec.Name,
+		Workload:            st.spec.Name,
+		Seed:                st.spec.Seed,
+		Allocations:         st.allocations,
+		Frees:               st.frees,
+		DurationSeconds:     duration.Seconds(),
+		OpsPerSecond:        float64(st.allocations+st.frees) / duration.Seconds(),
+		WrittenBytes:        totalWritten,
+		WriteBytesPerSec:    float64(totalWritten) / duration.Seconds(),
+		AllocateLatency:     newLatency(st.allocLatency.Snapshot()),
+		FreeLatency:         newLatency(st.freeLatency.Snapshot()),
+		Utilization:         float64(used) / float64(total),
+		PeakUtilization:     peak,
+		LiveBytes:           used,
+		PeakLiveBytes:       uint64(peak * float64(total)),
+		TotalBytes:          total,
+		MemoryOverheadBytes: st.allocator.GetMemoryUsage(),
+		Timeline:            timeline,
+	}
+	result.setFragmentation(st.allocator.Fragmentation())
+	return result, nil
+}
+
+// runStress runs the stress test until the target amount is written
+func runStress(args []string) error {
+	fs := newFlagSet("stress", "")
+	target := fs.Uint64("size", 10, "Terabytes to write in total")
+	specs := addSpecFlags(fs)
+	recordFile := fs.String("record", "", "Log the allocator operations to this file")
+	output := addOutputFlags(fs)
+	profiles := addProfileFlags(fs)
+	fs.Parse(args)
+	if err := output.validate(); err != nil {
+		return err
+	}
+
+	spec, err := specs.load()
+	if err != nil {
+		return err
+	}
+	recording, err := startRecording(*recordFile)
+	if err != nil {
+		return err
+	}
+	defer recording.stop()
+	stopProfiles, err := profiles.start()
+	if err != nil {
+		return err
+	}
+	defer stopProfiles()
+
+	st := NewStressTest(spec)
+	defer st.allocator.Close()
+	st.allocator.SetRecorder(recording.recorder())
+	result, err := st.runStressTest(*target * TB)
+	if err != nil {
+		return err
+	}
+	results := newResults("stress")
+	results.Runs = append(results.Runs, result)
+	return output.write(results)
+}
@@ -0,0 +1,97 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Recorder is a Tracer writing events in the Chrome trace-event format,
+// which chrome://tracing and ui.perfetto.dev load. Every trace gets its own
+// thread row, so the spans of concurrent requests nest properly.
+type Recorder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	epoch  time.Time
+	events int
+	closed bool
+	err    error
+}
+
+// chromeEvent is the JSON form of an event, timestamps in microseconds
+// since the recorder was created
+type chromeEvent struct {
+	Name  string         `json:"name"`
+	Phase string         `json:"ph"`
+	Time  float64        `json:"ts"`
+	PID   int            `json:"pid"`
+	TID   uint64         `json:"tid"`
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// NewRecorder returns a recorder writing to w. Close must be called to
+// complete the JSON document.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{w: bufio.NewWriter(w), epoch: time.Now()}
+	_, r.err = r.w.WriteString(`{"displayTimeUnit":"ns","traceEvents":[`)
+	return r
+}
+
+// Emit writes one event, events after Close are dropped
+func (r *Recorder) Emit(e Event) {
+	ce := chromeEvent{
+		Name:  e.Name,
+		Phase: string(e.Phase),
+		Time:  float64(e.Time.Sub(r.epoch).Nanoseconds()) / 1e3,
+		PID:   1,
+		TID:   e.Trace,
+	}
+	if e.Phase == Instant {
+		ce.Scope = "t"
+	}
+	if len(e.Args) > 0 {
+		ce.Args = make(map[string]any, len(e.Args))
+		for _, arg := range e.Args {
+			ce.Args[arg.Key] = arg.Value()
+		}
+	}
+	data, err := json.Marshal(ce)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.err != nil {
+		return
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+	if r.events > 0 {
+		r.w.WriteByte(',')
+	}
+	r.w.WriteByte('\n')
+	_, r.err = r.w.Write(data)
+	r.events++
+}
+
+// Close completes the JSON document and flushes it, returning the first
+// write error. It does not close the underlying writer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return r.err
+	}
+	r.closed = true
+	if r.err != nil {
+		return r.err
+	}
+	if _, r.err = r.w.WriteString("\n]}\n"); r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
@@ -0,0 +1,237 @@
+// Package trace lets the allocator, the memory pools and the RPC server
+// report span events to an optional Tracer, and records them as Chrome
+// trace-event JSON for local inspection
+package trace
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Phase tells whether an event begins or ends a span or happens within one
+type Phase byte
+
+const (
+	Begin   Phase = 'B'
+	End     Phase = 'E'
+	Instant Phase = 'i'
+)
+
+type argKind uint8
+
+const (
+	kindString argKind = iota
+	kindInt
+	kindUint
+	kindBool
+)
+
+// Arg is a named value attached to an event. Args hold their value without
+// boxing it so that spans cost nothing while tracing is off.
+type Arg struct {
+	Key  string
+	kind argKind
+	num  uint64
+	str  string
+}
+
+// String returns a string argument
+func String(key, value string) Arg {
+	return Arg{Key: key, kind: kindString, str: value}
+}
+
+// Int returns an integer argument
+func Int(key string, value int) Arg {
+	return Arg{Key: key, kind: kindInt, num: uint64(value)}
+}
+
+// Uint returns an unsigned integer argument, for sizes and addresses
+func Uint(key string, value uint64) Arg {
+	return Arg{Key: key, kind: kindUint, num: value}
+}
+
+// Bool returns a boolean argument
+func Bool(key string, value bool) Arg {
+	arg := Arg{Key: key, kind: kindBool}
+	if value {
+		arg.num = 1
+	}
+	return arg
+}
+
+// Error returns an "error" argument holding the error text, empty for nil
+func Error(err error) Arg {
+	if err == nil {
+		return String("error", "")
+	}
+	return String("error", err.Error())
+}
+
+// Value returns the value of the argument as a string, int64, uint64 or bool
+func (a Arg) Value() any {
+	switch a.kind {
+	case kindInt:
+		return int64(a.num)
+	case kindUint:
+		return a.num
+	case kindBool:
+		return a.num != 0
+	}
+	return a.str
+}
+
+func (a Arg) String() string {
+	switch a.kind {
+	case kindInt:
+		return a.Key + "=" + strconv.FormatInt(int64(a.num), 10)
+	case kindUint:
+		return a.Key + "=" + strconv.FormatUint(a.num, 10)
+	case kindBool:
+		return a.Key + "=" + strconv.FormatBool(a.num != 0)
+	}
+	return a.Key + "=" + a.str
+}
+
+// Event is one span event. Trace is the ID of the root span, shared by
+// every span started under it through a context.
+type Event struct {
+	Phase  Phase
+	Name   string
+	Trace  uint64
+	Span   uint64
+	Parent uint64 // zero for root spans
+	Time   time.Time
+	Args   []Arg
+}
+
+// Arg returns the argument named key
+func (e Event) Arg(key string) (Arg, bool) {
+	for _, arg := range e.Args {
+		if arg.Key == key {
+			return arg, true
+		}
+	}
+	return Arg{}, false
+}
+
+// Tracer receives span events. Events arrive from many goroutines at once,
+// often while the allocator holds its locks, so Emit must be safe for
+// concurrent use and return quickly.
+type Tracer interface {
+	Emit(e Event)
+}
+
+// TracerFunc adapts a function to the Tracer interface
+type TracerFunc func(e Event)
+
+func (f TracerFunc) Emit(e Event) { f(e) }
+
+// Hook holds an optional Tracer that can be replaced while in use. The zero
+// value holds none.
+type Hook struct {
+	tracer atomic.Pointer[holder]
+}
+
+type holder struct {
+	Tracer
+}
+
+// Set installs t, nil removes the current tracer
+func (h *Hook) Set(t Tracer) {
+	if t == nil {
+		h.tracer.Store(nil)
+		return
+	}
+	h.tracer.Store(&holder{t})
+}
+
+// Get returns the installed tracer or nil
+func (h *Hook) Get() Tracer {
+	if p := h.tracer.Load(); p != nil {
+		return p.Tracer
+	}
+	return nil
+}
+
+var nextID atomic.Uint64
+
+// Span is a started span. The zero Span is disabled and ignores every call,
+// which is what Start returns without a tracer.
+type Span struct {
+	tracer Tracer
+	name   string
+	trace  uint64
+	id     uint64
+	parent uint64
+}
+
+type spanKey struct{}
+
+// Start begins a span named name as a child of the span carried by ctx, if
+// any, and returns a context carrying the new span. Without a tracer it
+// returns ctx unchanged and a disabled span, so a tracer installed further
+// down still sees the parent from ctx.
+func Start(ctx context.Context, tracer Tracer, name string, args ...Arg) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, Span{}
+	}
+	span := Span{tracer: tracer, name: name, id: nextID.Add(1)}
+	if parent, ok := ctx.Value(spanKey{}).(Span); ok {
+		span.trace, span.parent = parent.trace, parent.id
+	} else {
+		span.trace = span.id
+	}
+	span.emit(Begin, name, args)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span carried by ctx, or a disabled span
+func FromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+// ID returns the ID of the span, zero if disabled
+func (s Span) ID() uint64 {
+	return s.id
+}
+
+// TraceID returns the ID of the root span of the trace, zero if disabled
+func (s Span) TraceID() uint64 {
+	return s.trace
+}
+
+// Enabled reports whether the span emits events
+func (s Span) Enabled() bool {
+	return s.tracer != nil
+}
+
+// Event emits an instant event within the span
+func (s Span) Event(name string, args ...Arg) {
+	if s.tracer != nil {
+		s.emit(Instant, name, args)
+	}
+}
+
+// End ends the span
+func (s Span) End(args ...Arg) {
+	if s.tracer != nil {
+		s.emit(End, s.name, args)
+	}
+}
+
+// emit copies args so that callers' argument lists never escape and stay
+// free when tracing is off
+func (s Span) emit(phase Phase, name string, args []Arg) {
+	s.tracer.Emit(Event{
+		Phase:  phase,
+		Name:   name,
+		Trace:  s.trace,
+		Span:   s.id,
+		Parent: s.parent,
+		Time:   time.Now(),
+		Args:   append([]Arg(nil), args...),
+	})
+}
@@ -0,0 +1,139 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSpans(t *testing.T) {
+	var mu sync.Mutex
+	var events []Event
+	tracer := TracerFunc(func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	})
+
+	ctx, root := Start(context.Background(), tracer, "root", Uint("size", 4096))
+	// A component without a tracer passes the parent through untouched
+	inner, skipped := Start(ctx, nil, "skipped")
+	if skipped.Enabled() || inner != ctx {
+		t.Fatalf("Expected a disabled span without a tracer")
+	}
+	_, child := Start(inner, tracer, "child")
+	child.Event("split", Int("depth", 3))
+	child.End(Error(errors.New("no space")))
+	root.End(Bool("hit", true))
+
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events, got %d", len(events))
+	}
+	begin, split, childEnd, rootEnd := events[0], events[2], events[3], events[4]
+	if begin.Phase != Begin || begin.Parent != 0 || begin.Trace != begin.Span {
+		t.Fatalf("Unexpected root %+v", begin)
+	}
+	if events[1].Parent != begin.Span || events[1].Trace != begin.Trace || events[1].Span == begin.Span {
+		t.Fatalf("Child not nested under the root: %+v", events[1])
+	}
+	if split.Phase != Instant || split.Span != events[1].Span {
+		t.Fatalf("Unexpected instant event %+v", split)
+	}
+	if arg, _ := split.Arg("depth"); arg.Value() != int64(3) {
+		t.Fatalf("Unexpected depth %v", arg)
+	}
+	if arg, _ := childEnd.Arg("error"); childEnd.Phase != End || childEnd.Name != "child" || arg.Value() != "no space" {
+		t.Fatalf("Unexpected end %+v", childEnd)
+	}
+	if arg, _ := rootEnd.Arg("hit"); arg.Value() != true || FromContext(ctx).id != begin.Span {
+		t.Fatalf("Unexpected root end %+v", rootEnd)
+	}
+
+	// Disabled spans must not cost allocations on the hot path
+	var hook Hook
+	allocs := testing.AllocsPerRun(100, func() {
+		_, span := Start(context.Background(), hook.Get(), "op", Uint("size", 1<<20))
+		span.Event("split", Int("order", 4), Int("depth", 2))
+		span.End(Uint("start", 1<<30), String("layer", "buddy"), Error(nil))
+	})
+	if allocs != 0 {
+		t.Fatalf("Disabled span allocated %v times", allocs)
+	}
+	hook.Set(tracer)
+	if hook.Get() == nil {
+		t.Fatalf("Hook lost its tracer")
+	}
+	hook.Set(nil)
+	if hook.Get() != nil {
+		t.Fatalf("Hook kept its tracer")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, root := Start(context.Background(), recorder, "rpc.Allocate")
+			_, child := Start(ctx, recorder, "hybrid.Allocate")
+			child.Event("slab.create", Uint("size_class", 4096))
+			child.End(String("layer", "slab"))
+			root.End()
+		}()
+	}
+	wg.Wait()
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	recorder.Emit(Event{Phase: Instant, Name: "late"})
+
+	var doc struct {
+		TraceEvents []struct {
+			Name  string         `json:"name"`
+			Phase string         `json:"ph"`
+			Time  float64        `json:"ts"`
+			TID   uint64         `json:"tid"`
+			Scope string         `json:"s"`
+			Args  map[string]any `json:"args"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, buf.String())
+	}
+	if len(doc.TraceEvents) != 4*5 {
+		t.Fatalf("Expected 20 events, got %d", len(doc.TraceEvents))
+	}
+
+	// Events of one trace share a thread and nest properly
+	depth := make(map[uint64]int)
+	for _, e := range doc.TraceEvents {
+		switch e.Phase {
+		case "B":
+			depth[e.TID]++
+		case "E":
+			depth[e.TID]--
+		case "i":
+			if e.Scope != "t" || e.Args["size_class"] != float64(4096) || depth[e.TID] != 2 {
+				t.Fatalf("Unexpected instant event %+v", e)
+			}
+		}
+		if depth[e.TID] < 0 || e.Time < 0 {
+			t.Fatalf("Unexpected event %+v", e)
+		}
+	}
+	if len(depth) != 4 {
+		t.Fatalf("Expected 4 threads, got %d", len(depth))
+	}
+	for tid, d := range depth {
+		if d != 0 {
+			t.Fatalf("Unbalanced spans on thread %d", tid)
+		}
+	}
+}
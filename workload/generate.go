@@ -0,0 +1,607 @@
+package workload
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hybridAllocator/metrics"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SizeDistribution draws the sizes of generated allocations
+type SizeDistribution interface {
+	Validate() error
+	// Sampler returns a function drawing sizes with rng. Each worker has
+	// its own rng, so the function need not be safe for concurrent use.
+	Sampler(rng *rand.Rand) func() uint64
+}
+
+// Uniform draws sizes uniformly from [Min, Max]
+type Uniform struct {
+	Min, Max uint64
+}
+
+func (u Uniform) Validate() error {
+	if u.Max < u.Min || u.Max-u.Min >= math.MaxInt64 {
+		return fmt.Errorf("uniform sizes need 0 <= max-min < 2^63, got [%d, %d]", u.Min, u.Max)
+	}
+	return nil
+}
+
+func (u Uniform) Sampler(rng *rand.Rand) func() uint64 {
+	return func() uint64 {
+		return u.Min + uint64(rng.Int63n(int64(u.Max-u.Min)+1))
+	}
+}
+
+// LogNormal draws sizes whose logarithm is normally distributed around
+// ln(Median) with standard deviation Sigma, a long tail of large objects
+type LogNormal struct {
+	Median uint64
+	Sigma  float64
+}
+
+func (l LogNormal) Validate() error {
+	if l.Median == 0 || l.Sigma < 0 {
+		return fmt.Errorf("log-normal sizes need a median > 0 and sigma >= 0, got %d and %g", l.Median, l.Sigma)
+	}
+	return nil
+}
+
+func (l LogNormal) Sampler(rng *rand.Rand) func() uint64 {
+	mu := math.Log(float64(l.Median))
+	return func() uint64 {
+		size := math.Exp(mu + l.Sigma*rng.NormFloat64())
+		if size >= math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return uint64(size)
+	}
+}
+
+// Zipf draws sizes Min, Min+Step, ... up to Max, the k-th of them with
+// probability proportional to 1/(k+1)^S, so small sizes dominate
+type Zipf struct {
+	Min, Max, Step uint64
+	S              float64
+}
+
+func (z Zipf) Validate() error {
+	if z.Step == 0 || z.Max < z.Min || z.S <= 1 {
+		return fmt.Errorf("zipf sizes need step > 0, min <= max and s > 1, got step %d, [%d, %d], s %g", z.Step, z.Min, z.Max, z.S)
+	}
+	return nil
+}
+
+func (z Zipf) Sampler(rng *rand.Rand) func() uint64 {
+	zipf := rand.NewZipf(rng, z.S, 1, (z.Max-z.Min)/z.Step)
+	return func() uint64 {
+		return z.Min + zipf.Uint64()*z.Step
+	}
+}
+
+// Bimodal mixes two distributions, drawing from Large with probability
+// LargeFraction and from Small otherwise
+type Bimodal struct {
+	Small, Large  SizeDistribution
+	LargeFraction float64
+}
+
+func (b Bimodal) Validate() error {
+	if b.Small == nil || b.Large == nil {
+		return errors.New("bimodal sizes need both a small and a large distribution")
+	}
+	if b.LargeFraction < 0 || b.LargeFraction > 1 {
+		return fmt.Errorf("bimodal large fraction %g is not within [0, 1]", b.LargeFraction)
+	}
+	if err := b.Small.Validate(); err != nil {
+		return err
+	}
+	return b.Large.Validate()
+}
+
+func (b Bimodal) Sampler(rng *rand.Rand) func() uint64 {
+	small, large := b.Small.Sampler(rng), b.Large.Sampler(rng)
+	return func() uint64 {
+		if rng.Float64() < b.LargeFraction {
+			return large()
+		}
+		return small()
+	}
+}
+
+// Bucket is one bar of an empirical size histogram, counting the sizes
+// above the previous bucket's Max up to its own
+type Bucket struct {
+	Max    uint64  `json:"max"`
+	Weight float64 `json:"weight"`
+}
+
+// Empirical draws sizes following a measured histogram: a bucket is picked
+// by weight and a size uniformly within it. Buckets are sorted by Max.
+type Empirical struct {
+	Buckets []Bucket
+}
+
+func (e Empirical) Validate() error {
+	var total float64
+	for i, b := range e.Buckets {
+		if b.Weight < 0 || math.IsInf(b.Weight, 0) || math.IsNaN(b.Weight) {
+			return fmt.Errorf("empirical bucket %d has weight %g", i, b.Weight)
+		}
+		if b.Max == 0 || i > 0 && b.Max <= e.Buckets[i-1].Max {
+			return fmt.Errorf("empirical buckets are not sorted by a positive max at bucket %d", i)
+		}
+		total += b.Weight
+	}
+	if total <= 0 {
+		return errors.New("empirical sizes need a bucket with positive weight")
+	}
+	return nil
+}
+
+func (e Empirical) Sampler(rng *rand.Rand) func() uint64 {
+	cumulative := make([]float64, len(e.Buckets))
+	var total float64
+	for i, b := range e.Buckets {
+		total += b.Weight
+		cumulative[i] = total
+	}
+	return func() uint64 {
+		x := rng.Float64() * total
+		i := sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > x })
+		i = min(i, len(cumulative)-1)
+		var low uint64
+		if i > 0 {
+			low = e.Buckets[i-1].Max
+		}
+		return low + 1 + uint64(rng.Int63n(int64(min(e.Buckets[i].Max-low, math.MaxInt64))))
+	}
+}
+
+// Object is an extent a worker allocated
+type Object struct {
+	Start uint64
+	Size  uint64
+}
+
+// Lifetime decides when and in which order a worker frees its objects
+type Lifetime interface {
+	Validate() error
+	// Live returns an empty set of live objects following the policy
+	Live(rng *rand.Rand) LiveSet
+}
+
+// LiveSet holds the objects a worker allocated and has not freed yet. Steps
+// count the operations of the worker.
+type LiveSet interface {
+	// Add adds an object allocated at step
+	Add(obj Object, step int)
+	// Due reports whether an object has to be freed at step whatever the
+	// operation mix says
+	Due(step int) bool
+	// Remove removes the next object to free, false if there is none
+	Remove(step int) (Object, bool)
+	Len() int
+}
+
+// FIFO frees the oldest object first
+type FIFO struct{}
+
+func (FIFO) Validate() error             { return nil }
+func (FIFO) Live(rng *rand.Rand) LiveSet { return &fifoSet{} }
+
+type fifoSet struct {
+	objects []Object
+	head    int
+}
+
+func (s *fifoSet) Add(obj Object, step int) { s.objects = append(s.objects, obj) }
+func (s *fifoSet) Due(step int) bool        { return false }
+func (s *fifoSet) Len() int                 { return len(s.objects) - s.head }
+
+func (s *fifoSet) Remove(step int) (Object, bool) {
+	if s.Len() == 0 {
+		return Object{}, false
+	}
+	obj := s.objects[s.head]
+	s.head++
+	// Drop the freed prefix once it makes up half of the slice
+	if s.head > len(s.objects)/2 {
+		s.objects = append(s.objects[:0], s.objects[s.head:]...)
+		s.head = 0
+	}
+	return obj, true
+}
+
+// LIFO frees the newest object first
+type LIFO struct{}
+
+func (LIFO) Validate() error             { return nil }
+func (LIFO) Live(rng *rand.Rand) LiveSet { return &lifoSet{} }
+
+type lifoSet struct {
+	objects []Object
+}
+
+func (s *lifoSet) Add(obj Object, step int) { s.objects = append(s.objects, obj) }
+func (s *lifoSet) Due(step int) bool        { return false }
+func (s *lifoSet) Len() int                 { return len(s.objects) }
+
+func (s *lifoSet) Remove(step int) (Object, bool) {
+	if len(s.objects) == 0 {
+		return Object{}, false
+	}
+	obj := s.objects[len(s.objects)-1]
+	s.objects = s.objects[:len(s.objects)-1]
+	return obj, true
+}
+
+// RandomOrder frees a uniformly chosen live object
+type RandomOrder struct{}
+
+func (RandomOrder) Validate() error             { return nil }
+func (RandomOrder) Live(rng *rand.Rand) LiveSet { return &randomSet{rng: rng} }
+
+type randomSet struct {
+	rng     *rand.Rand
+	objects []Object
+}
+
+func (s *randomSet) Add(obj Object, step int) { s.objects = append(s.objects, obj) }
+func (s *randomSet) Due(step int) bool        { return false }
+func (s *randomSet) Len() int                 { return len(s.objects) }
+
+func (s *randomSet) Remove(step int) (Object, bool) {
+	if len(s.objects) == 0 {
+		return Object{}, false
+	}
+	i := s.rng.Intn(len(s.objects))
+	obj := s.objects[i]
+	s.objects[i] = s.objects[len(s.objects)-1]
+	s.objects = s.objects[:len(s.objects)-1]
+	return obj, true
+}
+
+// ExponentialTTL gives every object an exponentially distributed lifetime
+// of Mean steps on average. Objects are freed as soon as they expire, and
+// frees asked for by the operation mix take the object expiring next.
+type ExponentialTTL struct {
+	Mean float64
+}
+
+func (t ExponentialTTL) Validate() error {
+	if !(t.Mean > 0) {
+		return fmt.Errorf("exponential TTL needs a mean > 0, got %g", t.Mean)
+	}
+	return nil
+}
+
+func (t ExponentialTTL) Live(rng *rand.Rand) LiveSet {
+	return &ttlSet{rng: rng, mean: t.Mean}
+}
+
+type ttlObject struct {
+	Object
+	deadline int
+}
+
+// ttlSet is a min-heap of objects by deadline
+type ttlSet struct {
+	rng     *rand.Rand
+	mean    float64
+	objects []ttlObject
+}
+
+func (s *ttlSet) Add(obj Object, step int) {
+	ttl := math.Ceil(s.rng.ExpFloat64() * s.mean)
+	heap.Push(s, ttlObject{Object: obj, deadline: step + int(min(ttl, math.MaxInt32))})
+}
+
+func (s *ttlSet) Due(step int) bool {
+	return len(s.objects) > 0 && s.objects[0].deadline <= step
+}
+
+func (s *ttlSet) Remove(step int) (Object, bool) {
+	if len(s.objects) == 0 {
+		return Object{}, false
+	}
+	return heap.Pop(s).(ttlObject).Object, true
+}
+
+func (s *ttlSet) Len() int           { return len(s.objects) }
+func (s *ttlSet) Less(i, j int) bool { return s.objects[i].deadline < s.objects[j].deadline }
+func (s *ttlSet) Swap(i, j int)      { s.objects[i], s.objects[j] = s.objects[j], s.objects[i] }
+func (s *ttlSet) Push(x any)         { s.objects = append(s.objects, x.(ttlObject)) }
+
+func (s *ttlSet) Pop() any {
+	obj := s.objects[len(s.objects)-1]
+	s.objects = s.objects[:len(s.objects)-1]
+	return obj
+}
+
+// Spec defines a generated workload
+type Spec struct {
+	Name string
+	Size SizeDistribution
+	// Drawn sizes are clamped to [MinSize, MaxSize] and rounded up to a
+	// multiple of Align. Zero MinSize means 1, zero MaxSize and Align
+	// leave sizes unbounded and unaligned.
+	MinSize  uint64
+	MaxSize  uint64
+	Align    uint64
+	Lifetime Lifetime
+	// AllocateRatio is the probability that an operation allocates rather
+	// than frees. Workers without live objects always allocate.
+	AllocateRatio float64
+	Concurrency   int
+	Ops           int
+	// StopUtilization stops a worker once one of its allocations fails
+	// while the target is at least that full. Zero never stops early.
+	StopUtilization float64
+	Seed            int64
+}
+
+// DefaultSpec returns the workload the benchmark has always run: uniform
+// sizes up to 4MB in 4KB units, 70% allocations freeing random objects,
+// 32 workers and 2 million operations
+func DefaultSpec() Spec {
+	return Spec{
+		Name:            "default",
+		Size:            Uniform{Min: 512, Max: 4 << 20},
+		MaxSize:         4 << 20,
+		Align:           4 << 10,
+		Lifetime:        RandomOrder{},
+		AllocateRatio:   0.7,
+		Concurrency:     32,
+		Ops:             2000000,
+		StopUtilization: 0.9,
+	}
+}
+
+// Validate reports the first problem of the spec
+func (s Spec) Validate() error {
+	if s.Size == nil {
+		return errors.New("workload spec has no size distribution")
+	}
+	if err := s.Size.Validate(); err != nil {
+		return err
+	}
+	if s.Lifetime == nil {
+		return errors.New("workload spec has no lifetime")
+	}
+	if err := s.Lifetime.Validate(); err != nil {
+		return err
+	}
+	if s.MaxSize > 0 && s.MaxSize < s.MinSize {
+		return fmt.Errorf("workload spec max size %d is below min size %d", s.MaxSize, s.MinSize)
+	}
+	if s.Align&(s.Align-1) != 0 {
+		return fmt.Errorf("workload spec align %d is not a power of two", s.Align)
+	}
+	if s.AllocateRatio < 0 || s.AllocateRatio > 1 {
+		return fmt.Errorf("workload spec allocate ratio %g is not within [0, 1]", s.AllocateRatio)
+	}
+	if s.Concurrency <= 0 || s.Ops <= 0 {
+		return fmt.Errorf("workload spec needs positive concurrency and ops, got %d and %d", s.Concurrency, s.Ops)
+	}
+	return nil
+}
+
+// Sizes returns a function drawing clamped and aligned sizes with rng
+func (s Spec) Sizes(rng *rand.Rand) func() uint64 {
+	sample := s.Size.Sampler(rng)
+	return func() uint64 {
+		size := max(sample(), s.MinSize, 1)
+		if s.MaxSize > 0 {
+			size = min(size, s.MaxSize)
+		}
+		if s.Align > 1 {
+			size = (size + s.Align - 1) &^ (s.Align - 1)
+		}
+		return size
+	}
+}
+
+// RunOptions configures Run
+type RunOptions struct {
+	// Interval adds a sample of the progress to the report's timeline at
+	// this period, and once at the end. Zero takes no samples.
+	Interval time.Duration
+}
+
+// Sample is the progress of a run at one point of its timeline
+type Sample struct {
+	Elapsed   time.Duration
+	Ops       int64
+	LiveBytes uint64
+	UsedBytes uint64 // zero unless the target implements Usage
+}
+
+// run holds the state workers share
+type run struct {
+	spec   Spec
+	target Target
+	usage  Usage
+	began  time.Time
+
+	allocLatency, freeLatency metrics.LatencyHistogram
+	live, peakLive            atomic.Uint64
+	ops                       atomic.Int64
+
+	mu     sync.Mutex
+	report Report
+}
+
+// Run generates the workload of spec against target and reports how it
+// went. Ops are split evenly between Concurrency workers, and worker i
+// draws from its own generator seeded with Seed+i, so a run with one
+// worker is fully reproducible and with more each worker's operations are
+// while their interleaving is up to the scheduler. Failed operations are
+// reported, not returned, the error is only set for an invalid spec.
+// Objects still live at the end are left allocated. Used bytes come from
+// targets implementing Usage and are sampled after failed allocations, on
+// the timeline and at the end.
+func Run(target Target, spec Spec, opts RunOptions) (Report, error) {
+	if err := spec.Validate(); err != nil {
+		return Report{}, err
+	}
+	r := &run{spec: spec, target: target}
+	r.report.Allocate.Errors = make(map[string]int)
+	r.report.Free.Errors = make(map[string]int)
+	r.usage, _ = target.(Usage)
+	if r.usage != nil {
+		r.report.TotalBytes = r.usage.GetTotalSize()
+	}
+
+	r.began = time.Now()
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		r.sampleEvery(opts.Interval, done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < spec.Concurrency; i++ {
+		ops := spec.Ops / spec.Concurrency
+		if i < spec.Ops%spec.Concurrency {
+			ops++
+		}
+		wg.Add(1)
+		go func(worker, ops int) {
+			defer wg.Done()
+			r.work(spec.Seed+int64(worker), ops)
+		}(i, ops)
+	}
+	wg.Wait()
+	close(done)
+	<-sampled
+
+	report := r.report
+	report.Duration = time.Since(r.began)
+	report.Allocate.Latency = r.allocLatency.Snapshot()
+	report.Free.Latency = r.freeLatency.Snapshot()
+	report.LiveBytes = r.live.Load()
+	report.PeakLiveBytes = r.peakLive.Load()
+	if r.usage != nil {
+		report.UsedBytes = r.usage.GetUsedSize()
+		report.PeakUsedBytes = max(report.PeakUsedBytes, report.UsedBytes)
+	}
+	return report, nil
+}
+
+// work performs the operations of one worker
+func (r *run) work(seed int64, ops int) {
+	rng := rand.New(rand.NewSource(seed))
+	sizes := r.spec.Sizes(rng)
+	live := r.spec.Lifetime.Live(rng)
+	allocate := OpReport{Errors: make(map[string]int)}
+	free := OpReport{Errors: make(map[string]int)}
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.report.Allocate.merge(allocate)
+		r.report.Free.merge(free)
+	}()
+
+	for step := 0; step < ops; step++ {
+		r.ops.Add(1)
+		// The mix is drawn on every step so the worker's random sequence
+		// does not depend on which objects expired
+		allocating := rng.Float64() < r.spec.AllocateRatio
+		if live.Due(step) || (!allocating && live.Len() > 0) {
+			obj, _ := live.Remove(step)
+			free.Count++
+			began := time.Now()
+			if err := r.target.Free(obj.Start, obj.Size); err != nil {
+				free.fail(err)
+				continue
+			}
+			r.freeLatency.Since(began)
+			r.live.Add(^(obj.Size - 1))
+			continue
+		}
+
+		size := sizes()
+		allocate.Count++
+		began := time.Now()
+		start, err := r.target.Allocate(size)
+		if err != nil {
+			allocate.fail(err)
+			if r.full() {
+				return
+			}
+			continue
+		}
+		r.allocLatency.Since(began)
+		live.Add(Object{Start: start, Size: size}, step)
+		r.raisePeak(r.live.Add(size))
+	}
+}
+
+// raisePeak records live as the peak of live bytes if it is higher
+func (r *run) raisePeak(live uint64) {
+	for {
+		peak := r.peakLive.Load()
+		if live <= peak || r.peakLive.CompareAndSwap(peak, live) {
+			return
+		}
+	}
+}
+
+// sampleEvery adds samples to the timeline until done is closed, then a
+// last one
+func (r *run) sampleEvery(interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sample()
+		case <-done:
+			r.sample()
+			return
+		}
+	}
+}
+
+func (r *run) sample() {
+	s := Sample{Elapsed: time.Since(r.began), Ops: r.ops.Load(), LiveBytes: r.live.Load()}
+	if r.usage != nil {
+		s.UsedBytes = r.usage.GetUsedSize()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Timeline = append(r.report.Timeline, s)
+	r.report.PeakUsedBytes = max(r.report.PeakUsedBytes, s.UsedBytes)
+}
+
+// full samples the used bytes after a failed allocation and reports
+// whether the worker should stop
+func (r *run) full() bool {
+	if r.usage == nil || r.report.TotalBytes == 0 {
+		return false
+	}
+	used := r.usage.GetUsedSize()
+	r.mu.Lock()
+	r.report.PeakUsedBytes = max(r.report.PeakUsedBytes, used)
+	r.mu.Unlock()
+	return r.spec.StopUtilization > 0 && float64(used)/float64(r.report.TotalBytes) >= r.spec.StopUtilization
+}
+
+func (o *OpReport) merge(other OpReport) {
+	o.Count += other.Count
+	o.Failures += other.Failures
+	for message, n := range other.Errors {
+		o.Errors[message] += n
+	}
+}
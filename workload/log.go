@@ -0,0 +1,239 @@
+// Package workload records allocator operations to a compact binary log and
+// replays such logs against a fresh allocator, so that workloads seen in
+// production can be reproduced offline, and generates synthetic workloads
+// from seeded specs for benchmarks
+package workload
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op is the kind of a recorded operation
+type Op uint8
+
+const (
+	Allocate Op = iota + 1
+	Free
+)
+
+func (op Op) String() string {
+	switch op {
+	case Allocate:
+		return "allocate"
+	case Free:
+		return "free"
+	}
+	return fmt.Sprintf("op(%d)", uint8(op))
+}
+
+// Record is one allocator operation. Time is when the operation began and
+// Addr the address it returned or freed, zero for failed allocations.
+type Record struct {
+	Op     Op
+	Time   time.Time
+	Client uint32
+	Size   uint64
+	Addr   uint64
+	Failed bool
+}
+
+// Recorder receives operations as they complete. Operations arrive from
+// many goroutines at once, so Record must be safe for concurrent use.
+type Recorder interface {
+	Record(rec Record)
+}
+
+// Hook holds an optional Recorder that can be replaced while in use. The
+// zero value holds none.
+type Hook struct {
+	recorder atomic.Pointer[holder]
+}
+
+type holder struct {
+	Recorder
+}
+
+// Set installs r, nil removes the current recorder
+func (h *Hook) Set(r Recorder) {
+	if r == nil {
+		h.recorder.Store(nil)
+		return
+	}
+	h.recorder.Store(&holder{r})
+}
+
+// Get returns the installed recorder or nil
+func (h *Hook) Get() Recorder {
+	if p := h.recorder.Load(); p != nil {
+		return p.Recorder
+	}
+	return nil
+}
+
+// ErrInvalidLog is returned when reading data that is not a workload log
+var ErrInvalidLog = errors.New("invalid workload log")
+
+const (
+	// logMagic starts every log, followed by logVersion and the start time
+	logMagic   = "HAWL"
+	logVersion = 1
+
+	// failedBit marks failed operations in the op byte of a record
+	failedBit = 0x80
+)
+
+// A log is the header followed by one record after another:
+//
+//	op      byte, failedBit set for failed operations
+//	time    varint, nanoseconds since the previous record, or the start
+//	client  uvarint
+//	size    uvarint
+//	addr    uvarint
+//
+// Concurrent operations are logged in the order they complete, so times
+// may go backwards and are stored as signed deltas.
+
+// Writer writes a workload log. It is a Recorder, safe for concurrent use.
+// The first write error is kept and returned by Close.
+type Writer struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	last   int64 // time of the previous record, in Unix nanoseconds
+	count  int
+	closed bool
+	err    error
+	buf    [1 + 4*binary.MaxVarintLen64]byte
+}
+
+// NewWriter starts a log on w
+func NewWriter(w io.Writer) *Writer {
+	lw := &Writer{w: bufio.NewWriter(w), last: time.Now().UnixNano()}
+	header := append([]byte(logMagic), logVersion)
+	header = binary.AppendVarint(header, lw.last)
+	_, lw.err = lw.w.Write(header)
+	return lw
+}
+
+// Record appends rec to the log
+func (w *Writer) Record(rec Record) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.err != nil {
+		return
+	}
+
+	op := byte(rec.Op)
+	if rec.Failed {
+		op |= failedBit
+	}
+	b := append(w.buf[:0], op)
+	b = binary.AppendVarint(b, rec.Time.UnixNano()-w.last)
+	b = binary.AppendUvarint(b, uint64(rec.Client))
+	b = binary.AppendUvarint(b, rec.Size)
+	b = binary.AppendUvarint(b, rec.Addr)
+	w.last = rec.Time.UnixNano()
+	_, w.err = w.w.Write(b)
+	w.count++
+}
+
+// Count returns the number of records written so far
+func (w *Writer) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// Close flushes the log and returns the first error encountered. It does
+// not close the underlying writer, later records are dropped.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// Reader reads a workload log
+type Reader struct {
+	r     *bufio.Reader
+	start time.Time
+	last  time.Time
+}
+
+// NewReader reads the header of a log from r
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(logMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLog, err)
+	}
+	if string(header[:len(logMagic)]) != logMagic {
+		return nil, ErrInvalidLog
+	}
+	if header[len(logMagic)] != logVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidLog, header[len(logMagic)])
+	}
+	start, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLog, err)
+	}
+	lr := &Reader{r: br, start: time.Unix(0, start)}
+	lr.last = lr.start
+	return lr, nil
+}
+
+// Start returns when recording started
+func (r *Reader) Start() time.Time {
+	return r.start
+}
+
+// Next returns the next record, or io.EOF after the last one
+func (r *Reader) Next() (Record, error) {
+	op, err := r.r.ReadByte()
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{Op: Op(op &^ failedBit), Failed: op&failedBit != 0}
+	if rec.Op != Allocate && rec.Op != Free {
+		return Record{}, fmt.Errorf("%w: unknown op %d", ErrInvalidLog, op)
+	}
+
+	delta, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return Record{}, truncated(err)
+	}
+	client, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, truncated(err)
+	}
+	if rec.Size, err = binary.ReadUvarint(r.r); err != nil {
+		return Record{}, truncated(err)
+	}
+	if rec.Addr, err = binary.ReadUvarint(r.r); err != nil {
+		return Record{}, truncated(err)
+	}
+	r.last = r.last.Add(time.Duration(delta))
+	rec.Time = r.last
+	rec.Client = uint32(client)
+	return rec, nil
+}
+
+// truncated reports a record cut short, which io.EOF must not hide
+func truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidLog, err)
+}
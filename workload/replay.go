@@ -0,0 +1,242 @@
+package workload
+
+import (
+	"fmt"
+	"hybridAllocator/metrics"
+	"io"
+	"sort"
+	"time"
+)
+
+// Target is what a log is replayed against. hybrid.Allocator,
+// mpool.MemoryPool and rpc.Client all satisfy it.
+type Target interface {
+	Allocate(size uint64) (uint64, error)
+	Free(start, size uint64) error
+}
+
+// Usage is implemented by targets reporting how much of their space is in
+// use, such as hybrid.Allocator
+type Usage interface {
+	GetUsedSize() uint64
+	GetTotalSize() uint64
+}
+
+// ReplayOptions configures Replay
+type ReplayOptions struct {
+	// Speed scales the recorded pauses between operations, 1 replays in
+	// real time and 2 twice as fast. Zero replays as fast as possible.
+	Speed float64
+}
+
+// OpReport summarizes the replayed operations of one kind
+type OpReport struct {
+	Count    int
+	Failures int
+	Errors   map[string]int // failures by error text
+	Latency  metrics.HistogramSnapshot
+}
+
+// Report summarizes a replay. Live bytes count the requested sizes, used
+// and total bytes come from the target and stay zero unless it implements
+// Usage.
+type Report struct {
+	Allocate OpReport
+	Free     OpReport
+	// Skipped counts frees of extents the replay never allocated, because
+	// the allocation failed or happened before recording started
+	Skipped int
+	// RecordedFailures counts operations that had failed when recorded
+	RecordedFailures int
+	LiveBytes        uint64
+	PeakLiveBytes    uint64
+	UsedBytes        uint64
+	PeakUsedBytes    uint64
+	TotalBytes       uint64
+	Recorded         time.Duration // from the first to the last record
+	Duration         time.Duration
+	Timeline         []Sample // taken by Run when asked to
+}
+
+// Utilization returns the fraction of the target in use after the replay
+func (r Report) Utilization() float64 {
+	if r.TotalBytes == 0 {
+		return 0
+	}
+	return float64(r.UsedBytes) / float64(r.TotalBytes)
+}
+
+// PeakUtilization returns the highest fraction of the target in use
+func (r Report) PeakUtilization() float64 {
+	if r.TotalBytes == 0 {
+		return 0
+	}
+	return float64(r.PeakUsedBytes) / float64(r.TotalBytes)
+}
+
+// extent is an allocation made by the replay
+type extent struct {
+	start uint64
+	size  uint64
+}
+
+// Replay performs the operations of a log in order against target. Since
+// the target hands out its own addresses, recorded addresses are mapped to
+// the replayed ones. Operations on the same address that raced when
+// recorded may be logged in either order, and are replayed as logged.
+// Failed operations are reported, not returned, the error is only set when
+// the log cannot be read.
+func Replay(r *Reader, target Target, opts ReplayOptions) (Report, error) {
+	report := Report{
+		Allocate: OpReport{Errors: make(map[string]int)},
+		Free:     OpReport{Errors: make(map[string]int)},
+	}
+	usage, _ := target.(Usage)
+	if usage != nil {
+		report.TotalBytes = usage.GetTotalSize()
+	}
+	var allocLatency, freeLatency metrics.LatencyHistogram
+	live := make(map[uint64]extent) // recorded address -> replayed extent
+
+	began := time.Now()
+	var first, previous time.Time
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		if first.IsZero() {
+			first, previous = rec.Time, rec.Time
+		}
+		if opts.Speed > 0 && rec.Time.After(previous) {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(previous)) / opts.Speed))
+		}
+		if rec.Time.After(previous) {
+			previous = rec.Time
+		}
+		report.Recorded = previous.Sub(first)
+		if rec.Failed {
+			report.RecordedFailures++
+		}
+
+		switch rec.Op {
+		case Allocate:
+			report.Allocate.Count++
+			opBegan := time.Now()
+			start, err := target.Allocate(rec.Size)
+			if err != nil {
+				report.Allocate.fail(err)
+				continue
+			}
+			allocLatency.Since(opBegan)
+			if rec.Failed {
+				// The log never frees an allocation that failed when
+				// recorded, so it is undone right away
+				if err := target.Free(start, rec.Size); err != nil {
+					report.Free.fail(err)
+				}
+				break
+			}
+			live[rec.Addr] = extent{start: start, size: rec.Size}
+			report.LiveBytes += rec.Size
+		case Free:
+			if rec.Failed {
+				continue
+			}
+			e, exists := live[rec.Addr]
+			if !exists {
+				report.Skipped++
+				continue
+			}
+			delete(live, rec.Addr)
+			report.Free.Count++
+			opBegan := time.Now()
+			if err := target.Free(e.start, e.size); err != nil {
+				report.Free.fail(err)
+				continue
+			}
+			freeLatency.Since(opBegan)
+			report.LiveBytes -= e.size
+		}
+
+		report.PeakLiveBytes = max(report.PeakLiveBytes, report.LiveBytes)
+		if usage != nil {
+			report.UsedBytes = usage.GetUsedSize()
+			report.PeakUsedBytes = max(report.PeakUsedBytes, report.UsedBytes)
+		}
+	}
+
+	report.Duration = time.Since(began)
+	report.Allocate.Latency = allocLatency.Snapshot()
+	report.Free.Latency = freeLatency.Snapshot()
+	return report, nil
+}
+
+func (o *OpReport) fail(err error) {
+	o.Failures++
+	o.Errors[err.Error()]++
+}
+
+// quantiles are the latency percentiles WriteText prints
+var quantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// WriteText writes a human readable summary of the report
+func (r Report) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("%d allocations and %d frees in %v", r.Allocate.Count, r.Free.Count, r.Duration.Round(time.Millisecond))
+	if r.Recorded > 0 {
+		ew.printf(" (recorded over %v)", r.Recorded.Round(time.Millisecond))
+	}
+	ew.printf("\n")
+	if r.TotalBytes > 0 {
+		ew.printf("Utilization: %.5f%% final, %.5f%% peak\n", r.Utilization()*100, r.PeakUtilization()*100)
+	}
+	ew.printf("Live bytes: %d final, %d peak\n", r.LiveBytes, r.PeakLiveBytes)
+	if r.Skipped > 0 || r.RecordedFailures > 0 {
+		ew.printf("Skipped frees: %d, failures when recorded: %d\n", r.Skipped, r.RecordedFailures)
+	}
+
+	ops := []struct {
+		name   string
+		report OpReport
+	}{{"allocate", r.Allocate}, {"free", r.Free}}
+	ew.printf("\n%-10s %10s %10s", "Op", "Count", "Failures")
+	for _, q := range quantiles {
+		ew.printf(" %10s", fmt.Sprintf("p%g", q*100))
+	}
+	ew.printf("\n")
+	for _, op := range ops {
+		ew.printf("%-10s %10d %10d", op.name, op.report.Count, op.report.Failures)
+		for _, q := range quantiles {
+			ew.printf(" %10v", time.Duration(op.report.Latency.Quantile(q)*float64(time.Second)))
+		}
+		ew.printf("\n")
+	}
+
+	for _, op := range ops {
+		messages := make([]string, 0, len(op.report.Errors))
+		for message := range op.report.Errors {
+			messages = append(messages, message)
+		}
+		sort.Strings(messages)
+		for _, message := range messages {
+			ew.printf("%s failed %d times: %s\n", op.name, op.report.Errors[message], message)
+		}
+	}
+	return ew.err
+}
+
+// errWriter keeps the first write error
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...any) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
@@ -0,0 +1,149 @@
+package workload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// specConfig is the JSON form of a Spec, fields left out keep the value of
+// DefaultSpec
+type specConfig struct {
+	Name            *string     `json:"name"`
+	Size            *sizeConfig `json:"size"`
+	MinSize         *uint64     `json:"min_size"`
+	MaxSize         *uint64     `json:"max_size"`
+	Align           *uint64     `json:"align"`
+	Lifetime        *lifeConfig `json:"lifetime"`
+	AllocateRatio   *float64    `json:"allocate_ratio"`
+	Concurrency     *int        `json:"concurrency"`
+	Ops             *int        `json:"ops"`
+	StopUtilization *float64    `json:"stop_utilization"`
+	Seed            *int64      `json:"seed"`
+}
+
+// sizeConfig is the JSON form of a SizeDistribution, Dist selects which of
+// the other fields apply
+type sizeConfig struct {
+	Dist          string      `json:"dist"`
+	Min           uint64      `json:"min"`
+	Max           uint64      `json:"max"`
+	Step          uint64      `json:"step"`
+	S             float64     `json:"s"`
+	Median        uint64      `json:"median"`
+	Sigma         float64     `json:"sigma"`
+	Small         *sizeConfig `json:"small"`
+	Large         *sizeConfig `json:"large"`
+	LargeFraction float64     `json:"large_fraction"`
+	Buckets       []Bucket    `json:"buckets"`
+}
+
+// lifeConfig is the JSON form of a Lifetime
+type lifeConfig struct {
+	Policy string  `json:"policy"`
+	Mean   float64 `json:"mean"`
+}
+
+// ParseSpec reads a spec from JSON such as
+//
+//	{
+//		"name": "small-files",
+//		"seed": 42,
+//		"ops": 1000000,
+//		"concurrency": 8,
+//		"allocate_ratio": 0.6,
+//		"size": {"dist": "bimodal", "large_fraction": 0.05,
+//			"small": {"dist": "lognormal", "median": 16384, "sigma": 1},
+//			"large": {"dist": "uniform", "min": 1048576, "max": 4194304}},
+//		"lifetime": {"policy": "ttl", "mean": 5000}
+//	}
+//
+// Size distributions are "uniform" (min, max), "lognormal" (median, sigma),
+// "zipf" (min, max, step, s), "bimodal" (small, large, large_fraction) and
+// "empirical" (buckets of max and weight). Lifetime policies are "fifo",
+// "lifo", "random" and "ttl" (mean). Fields left out keep the value of
+// DefaultSpec.
+func ParseSpec(data []byte) (Spec, error) {
+	var config specConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Spec{}, fmt.Errorf("invalid workload spec: %w", err)
+	}
+
+	spec := DefaultSpec()
+	if config.Name != nil {
+		spec.Name = *config.Name
+	}
+	if config.Size != nil {
+		size, err := config.Size.distribution()
+		if err != nil {
+			return Spec{}, err
+		}
+		spec.Size = size
+	}
+	if config.Lifetime != nil {
+		lifetime, err := config.Lifetime.lifetime()
+		if err != nil {
+			return Spec{}, err
+		}
+		spec.Lifetime = lifetime
+	}
+	set(&spec.MinSize, config.MinSize)
+	set(&spec.MaxSize, config.MaxSize)
+	set(&spec.Align, config.Align)
+	set(&spec.AllocateRatio, config.AllocateRatio)
+	set(&spec.Concurrency, config.Concurrency)
+	set(&spec.Ops, config.Ops)
+	set(&spec.StopUtilization, config.StopUtilization)
+	set(&spec.Seed, config.Seed)
+	return spec, spec.Validate()
+}
+
+func set[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func (c *sizeConfig) distribution() (SizeDistribution, error) {
+	switch c.Dist {
+	case "uniform":
+		return Uniform{Min: c.Min, Max: c.Max}, nil
+	case "lognormal":
+		return LogNormal{Median: c.Median, Sigma: c.Sigma}, nil
+	case "zipf":
+		return Zipf{Min: c.Min, Max: c.Max, Step: c.Step, S: c.S}, nil
+	case "bimodal":
+		if c.Small == nil || c.Large == nil {
+			return nil, errors.New("bimodal sizes need both small and large")
+		}
+		small, err := c.Small.distribution()
+		if err != nil {
+			return nil, err
+		}
+		large, err := c.Large.distribution()
+		if err != nil {
+			return nil, err
+		}
+		return Bimodal{Small: small, Large: large, LargeFraction: c.LargeFraction}, nil
+	case "empirical":
+		return Empirical{Buckets: c.Buckets}, nil
+	}
+	return nil, fmt.Errorf("unknown size distribution %q", c.Dist)
+}
+
+func (c *lifeConfig) lifetime() (Lifetime, error) {
+	switch c.Policy {
+	case "fifo":
+		return FIFO{}, nil
+	case "lifo":
+		return LIFO{}, nil
+	case "random":
+		return RandomOrder{}, nil
+	case "ttl":
+		return ExponentialTTL{Mean: c.Mean}, nil
+	}
+	return nil, fmt.Errorf("unknown lifetime policy %q", c.Policy)
+}
@@ -0,0 +1,445 @@
+package workload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	base := time.Now()
+	records := []Record{
+		{Op: Allocate, Time: base, Client: 3, Size: 4096, Addr: 1 << 40},
+		{Op: Free, Time: base.Add(-time.Microsecond), Client: 3, Size: 4096, Addr: 1 << 40},
+		{Op: Allocate, Time: base.Add(time.Hour), Size: 1 << 30, Failed: true},
+	}
+	for _, rec := range records {
+		w.Record(rec)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	w.Record(records[0])
+	if w.Count() != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), w.Count())
+	}
+	// Varints keep records of small extents to a few bytes
+	if buf.Len() > 64 {
+		t.Fatalf("Log of %d records takes %d bytes", len(records), buf.Len())
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	for i, want := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if !got.Time.Equal(want.Time) {
+			t.Fatalf("Record %d at %v, expected %v", i, got.Time, want.Time)
+		}
+		got.Time = want.Time
+		if got != want {
+			t.Fatalf("Record %d is %+v, expected %+v", i, got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+
+	for _, invalid := range [][]byte{
+		nil,
+		[]byte("HAWX\x01\x00"),
+		[]byte("HAWL\x09\x00"),
+		buf.Bytes()[:buf.Len()-1],
+	} {
+		r, err := NewReader(bytes.NewReader(invalid))
+		for err == nil {
+			_, err = r.Next()
+		}
+		if !errors.Is(err, ErrInvalidLog) {
+			t.Errorf("Expected ErrInvalidLog reading %q, got %v", invalid, err)
+		}
+	}
+}
+
+// bumpTarget hands out addresses from a fixed space, failing once it is
+// used up
+type bumpTarget struct {
+	mu    sync.Mutex
+	next  uint64
+	total uint64
+	used  uint64
+	live  map[uint64]uint64
+}
+
+func (b *bumpTarget) Allocate(size uint64) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+size > b.total {
+		return 0, errors.New("no space")
+	}
+	start := b.next
+	b.next += size
+	b.used += size
+	b.live[start] = size
+	return start, nil
+}
+
+func (b *bumpTarget) Free(start, size uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.live[start] != size {
+		return errors.New("not allocated")
+	}
+	delete(b.live, start)
+	b.used -= size
+	return nil
+}
+
+func (b *bumpTarget) GetUsedSize() uint64  { return b.used }
+func (b *bumpTarget) GetTotalSize() uint64 { return b.total }
+
+func TestReplay(t *testing.T) {
+	// Record a workload against one target
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	recorded := &bumpTarget{total: 10000, live: make(map[uint64]uint64)}
+	do := func(op Op, size, addr uint64) uint64 {
+		rec := Record{Op: op, Time: time.Now(), Size: size}
+		var err error
+		if op == Allocate {
+			addr, err = recorded.Allocate(size)
+		} else {
+			err = recorded.Free(addr, size)
+		}
+		rec.Addr, rec.Failed = addr, err != nil
+		w.Record(rec)
+		return addr
+	}
+	a := do(Allocate, 4000, 0)
+	b := do(Allocate, 3000, 0)
+	do(Allocate, 5000, 0) // fails, no space left
+	do(Free, 4000, a)
+	do(Free, 4000, a) // fails, already freed
+	do(Allocate, 2000, 0)
+	do(Free, 100, 1<<20) // never allocated
+	do(Free, 3000, b)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Replay it against a smaller target
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	target := &bumpTarget{total: 6000, live: make(map[uint64]uint64)}
+	report, err := Replay(r, target, ReplayOptions{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if report.Allocate.Count != 4 || report.Allocate.Failures != 2 || report.Allocate.Errors["no space"] != 2 {
+		t.Fatalf("Unexpected allocations %+v", report.Allocate)
+	}
+	// The 3000 byte allocation failed in the replay, so its free is skipped
+	if report.Free.Count != 1 || report.Free.Failures != 0 || report.Skipped != 1 || report.RecordedFailures != 3 {
+		t.Fatalf("Unexpected frees %+v", report)
+	}
+	if report.LiveBytes != 2000 || report.PeakLiveBytes != 4000 || report.UsedBytes != 2000 || report.TotalBytes != 6000 {
+		t.Fatalf("Unexpected usage %+v", report)
+	}
+	if report.Allocate.Latency.Count != 2 || report.Free.Latency.Count != 1 {
+		t.Fatalf("Unexpected latency counts %+v", report)
+	}
+
+	var text strings.Builder
+	if err := report.WriteText(&text); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	for _, want := range []string{"Utilization: 33.33333% final, 66.66667% peak", "p99.9", "allocate failed 2 times: no space"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("Report lacks %q:\n%s", want, text.String())
+		}
+	}
+}
+
+func TestSizeDistributions(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const samples = 100000
+	for _, tc := range []struct {
+		name     string
+		dist     SizeDistribution
+		min, max uint64
+		check    func(counts map[uint64]int) bool
+	}{
+		{"uniform", Uniform{Min: 10, Max: 19}, 10, 19, func(counts map[uint64]int) bool {
+			return len(counts) == 10
+		}},
+		{"lognormal", LogNormal{Median: 1000, Sigma: 1}, 1, math.MaxInt64, func(counts map[uint64]int) bool {
+			var below int
+			for size, n := range counts {
+				if size < 1000 {
+					below += n
+				}
+			}
+			return below > samples*45/100 && below < samples*55/100
+		}},
+		{"zipf", Zipf{Min: 4096, Max: 40960, Step: 4096, S: 2}, 4096, 40960, func(counts map[uint64]int) bool {
+			return counts[4096] > samples/2 && counts[4096] > counts[8192] && counts[8192] > counts[40960]
+		}},
+		{"bimodal", Bimodal{Small: Uniform{Min: 1, Max: 10}, Large: Uniform{Min: 1000, Max: 2000}, LargeFraction: 0.1}, 1, 2000, func(counts map[uint64]int) bool {
+			var large int
+			for size, n := range counts {
+				if size >= 1000 {
+					large += n
+				}
+			}
+			return large > samples*8/100 && large < samples*12/100
+		}},
+		{"empirical", Empirical{Buckets: []Bucket{{Max: 100, Weight: 3}, {Max: 200, Weight: 0}, {Max: 300, Weight: 1}}}, 1, 300, func(counts map[uint64]int) bool {
+			var first, second int
+			for size, n := range counts {
+				if size <= 100 {
+					first += n
+				} else if size <= 200 {
+					second += n
+				}
+			}
+			return second == 0 && first > samples*70/100 && first < samples*80/100
+		}},
+	} {
+		if err := tc.dist.Validate(); err != nil {
+			t.Fatalf("%s: Validate failed: %v", tc.name, err)
+		}
+		sample := tc.dist.Sampler(rng)
+		counts := make(map[uint64]int)
+		for i := 0; i < samples; i++ {
+			size := sample()
+			if size < tc.min || size > tc.max {
+				t.Fatalf("%s: size %d outside [%d, %d]", tc.name, size, tc.min, tc.max)
+			}
+			counts[size]++
+		}
+		if !tc.check(counts) {
+			t.Errorf("%s: unexpected distribution of %d sizes", tc.name, len(counts))
+		}
+	}
+
+	for _, invalid := range []SizeDistribution{
+		Uniform{Min: 2, Max: 1},
+		LogNormal{Sigma: 1},
+		Zipf{Min: 1, Max: 10, Step: 1, S: 1},
+		Bimodal{Small: Uniform{Max: 1}, LargeFraction: 0.5},
+		Empirical{Buckets: []Bucket{{Max: 10, Weight: 1}, {Max: 10, Weight: 1}}},
+		Empirical{Buckets: []Bucket{{Max: 10}}},
+	} {
+		if invalid.Validate() == nil {
+			t.Errorf("Expected %+v to be invalid", invalid)
+		}
+	}
+}
+
+func TestLifetimes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	order := func(lifetime Lifetime) []uint64 {
+		live := lifetime.Live(rng)
+		for i := uint64(1); i <= 5; i++ {
+			live.Add(Object{Start: i, Size: 1}, int(i))
+		}
+		var starts []uint64
+		for live.Len() > 0 {
+			obj, _ := live.Remove(10)
+			starts = append(starts, obj.Start)
+		}
+		if _, ok := live.Remove(10); ok {
+			t.Fatalf("%T removed from an empty set", lifetime)
+		}
+		return starts
+	}
+	if got := order(FIFO{}); !reflect.DeepEqual(got, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("FIFO freed %v", got)
+	}
+	if got := order(LIFO{}); !reflect.DeepEqual(got, []uint64{5, 4, 3, 2, 1}) {
+		t.Errorf("LIFO freed %v", got)
+	}
+	got := order(RandomOrder{})
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if !reflect.DeepEqual(got, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("RandomOrder freed %v", got)
+	}
+
+	// Lifetimes average the mean and objects come due in deadline order
+	live := ExponentialTTL{Mean: 100}.Live(rng)
+	for i := 0; i < 10000; i++ {
+		live.Add(Object{Start: uint64(i)}, 0)
+	}
+	var total, freed int
+	for step := 0; live.Len() > 0; step++ {
+		for live.Due(step) {
+			live.Remove(step)
+			total += step
+			freed++
+		}
+	}
+	if mean := total / freed; mean < 90 || mean > 110 {
+		t.Errorf("Mean lifetime %d, expected about 100", mean)
+	}
+}
+
+// opTarget logs the operations reaching a target
+type opTarget struct {
+	Target
+	mu  sync.Mutex
+	ops []Record
+}
+
+func (o *opTarget) Allocate(size uint64) (uint64, error) {
+	start, err := o.Target.Allocate(size)
+	o.mu.Lock()
+	o.ops = append(o.ops, Record{Op: Allocate, Size: size, Addr: start, Failed: err != nil})
+	o.mu.Unlock()
+	return start, err
+}
+
+func (o *opTarget) Free(start, size uint64) error {
+	err := o.Target.Free(start, size)
+	o.mu.Lock()
+	o.ops = append(o.ops, Record{Op: Free, Size: size, Addr: start, Failed: err != nil})
+	o.mu.Unlock()
+	return err
+}
+
+func TestRun(t *testing.T) {
+	spec := Spec{
+		Size:          Zipf{Min: 100, Max: 1000, Step: 100, S: 1.5},
+		Align:         64,
+		Lifetime:      ExponentialTTL{Mean: 50},
+		AllocateRatio: 0.8,
+		Concurrency:   1,
+		Ops:           5000,
+		Seed:          42,
+	}
+	run := func(spec Spec) (Report, []Record) {
+		target := &opTarget{Target: &bumpTarget{total: 1 << 40, live: make(map[uint64]uint64)}}
+		report, err := Run(target, spec, RunOptions{})
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return report, target.ops
+	}
+
+	// The same seed reproduces the same operations
+	report, ops := run(spec)
+	_, again := run(spec)
+	if !reflect.DeepEqual(ops, again) {
+		t.Fatalf("Runs with seed %d differ", spec.Seed)
+	}
+	if _, other := run(Spec{Size: spec.Size, Lifetime: spec.Lifetime, Concurrency: 1, Ops: 5000, AllocateRatio: 0.8, Seed: 43}); reflect.DeepEqual(ops, other) {
+		t.Fatalf("Runs with different seeds match")
+	}
+	if len(ops) != spec.Ops || report.Allocate.Count+report.Free.Count != spec.Ops {
+		t.Fatalf("Expected %d operations, got %d: %+v", spec.Ops, len(ops), report)
+	}
+	var live uint64
+	for _, op := range ops {
+		if op.Failed || op.Size%64 != 0 || op.Size < 128 || op.Size > 1024 {
+			t.Fatalf("Unexpected operation %+v", op)
+		}
+		if op.Op == Allocate {
+			live += op.Size
+		} else {
+			live -= op.Size
+		}
+	}
+	if report.LiveBytes != live || report.PeakLiveBytes < live {
+		t.Fatalf("Expected %d live bytes, got %+v", live, report)
+	}
+	// Objects live about 50 steps at 80% allocations
+	if report.LiveBytes > 100*1024 {
+		t.Errorf("TTL left %d bytes live", report.LiveBytes)
+	}
+
+	// Workers stop once the target fills up
+	target := &bumpTarget{total: 1 << 20, live: make(map[uint64]uint64)}
+	spec = DefaultSpec()
+	spec.Ops = 100000
+	spec.Concurrency = 4
+	report, err := Run(target, spec, RunOptions{Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if report.Allocate.Failures < spec.Concurrency || report.Allocate.Count+report.Free.Count >= spec.Ops {
+		t.Fatalf("Expected every worker to stop once full, got %+v", report)
+	}
+	if report.PeakUsedBytes < report.TotalBytes*9/10 {
+		t.Fatalf("Stopped at %d of %d bytes", report.PeakUsedBytes, report.TotalBytes)
+	}
+	// At least the final sample is taken, however fast the run
+	last := report.Timeline[len(report.Timeline)-1]
+	if last.Ops != int64(report.Allocate.Count+report.Free.Count) || last.UsedBytes != report.UsedBytes || last.LiveBytes != report.LiveBytes {
+		t.Fatalf("Last sample %+v does not match %+v", last, report)
+	}
+
+	spec.Concurrency = 0
+	if _, err := Run(target, spec, RunOptions{}); err == nil {
+		t.Fatalf("Expected Run to reject a spec without workers")
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec([]byte(`{
+		"name": "small-files",
+		"seed": 42,
+		"ops": 1000000,
+		"concurrency": 8,
+		"allocate_ratio": 0.6,
+		"size": {"dist": "bimodal", "large_fraction": 0.05,
+			"small": {"dist": "lognormal", "median": 16384, "sigma": 1},
+			"large": {"dist": "empirical", "buckets": [{"max": 1048576, "weight": 1}, {"max": 4194304, "weight": 2}]}},
+		"lifetime": {"policy": "ttl", "mean": 5000}
+	}`))
+	if err != nil {
+		t.Fatalf("ParseSpec failed: %v", err)
+	}
+	want := DefaultSpec()
+	want.Name = "small-files"
+	want.Seed = 42
+	want.Ops = 1000000
+	want.Concurrency = 8
+	want.AllocateRatio = 0.6
+	want.Size = Bimodal{
+		Small:         LogNormal{Median: 16384, Sigma: 1},
+		Large:         Empirical{Buckets: []Bucket{{Max: 1048576, Weight: 1}, {Max: 4194304, Weight: 2}}},
+		LargeFraction: 0.05,
+	}
+	want.Lifetime = ExponentialTTL{Mean: 5000}
+	if !reflect.DeepEqual(spec, want) {
+		t.Fatalf("Parsed %+v, expected %+v", spec, want)
+	}
+
+	for _, invalid := range []string{
+		`{"size": {"dist": "gaussian"}}`,
+		`{"lifetime": {"policy": "ttl"}}`,
+		`{"lifetime": {"policy": "oldest"}}`,
+		`{"size": {"dist": "bimodal", "small": {"dist": "uniform", "max": 1}}}`,
+		`{"allocate_ratio": 2}`,
+		`{"threads": 8}`,
+	} {
+		if _, err := ParseSpec([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be invalid", invalid)
+		}
+	}
+}